@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AdminConfig enables the admin API on its own listener. It is disabled
+// unless both Listen and Token are set.
+type AdminConfig struct {
+	Listen string `json:"listen"`
+	// Token must be sent as "Authorization: Bearer <token>".
+	Token string `json:"token"`
+	// RedactHeaders lists headers whose values are hidden in request
+	// captures. Defaults to defaultRedactHeaders.
+	RedactHeaders []string `json:"redact_headers"`
+}
+
+// Enabled reports whether the admin API should be served.
+func (c AdminConfig) Enabled() bool {
+	return c.Listen != "" && c.Token != ""
+}
+
+var defaultRedactHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// newAdminHandler returns the admin API, gated by the configured token.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/capture", startCaptureHandler)
+	mux.HandleFunc("GET /admin/capture", listCaptureHandler)
+	mux.HandleFunc("GET /admin/concurrency", concurrencyStatsHandler)
+	mux.HandleFunc("GET /admin/error-rates", errorRatesHandler)
+	mux.HandleFunc("GET /admin/fuses", listFusesHandler)
+	mux.HandleFunc("GET /admin/in-flight", inFlightHandler)
+	mux.HandleFunc("GET /admin/mirrors", mirrorStatsHandler)
+	mux.HandleFunc("POST /admin/fuses/reset", resetFuseHandler)
+	mux.HandleFunc("POST /admin/health/probe", probeHandler)
+	mux.HandleFunc("POST /admin/replay", replayHandler)
+	return adminAuth(mux)
+}
+
+// adminAuth rejects requests that do not carry the admin bearer token.
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		want := currentState().config.Admin.Token
+		if !ok || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/crc32"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backend is the runtime state of a backend, shared by every route whose
+// pool contains it.
+type backend struct {
+	url    string
+	weight int
+
+	inFlight atomic.Int64
+	// unhealthy is set while the backend's health check is failing.
+	unhealthy atomic.Bool
+	// fuse, if set, takes the backend out of service once it fails every
+	// request over a window.
+	fuse *fuse
+
+	mu         sync.Mutex
+	ewmaMillis float64
+}
+
+// ewmaDecay weights each new latency sample in a backend's moving average.
+const ewmaDecay = 0.3
+
+// observe folds a response latency into the backend's moving average.
+func (b *backend) observe(latency time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ms := float64(latency) / float64(time.Millisecond)
+	if b.ewmaMillis == 0 {
+		b.ewmaMillis = ms
+	} else {
+		b.ewmaMillis = ewmaDecay*ms + (1-ewmaDecay)*b.ewmaMillis
+	}
+}
+
+func (b *backend) healthy() bool {
+	return !b.unhealthy.Load() && (b.fuse == nil || !b.fuse.isBlown())
+}
+
+func (b *backend) latency() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ewmaMillis
+}
+
+// Balancer is a load-balancing strategy. Pick chooses the backend that
+// serves r from healthy, the pool members currently able to take traffic,
+// which is never empty.
+type Balancer interface {
+	Pick(r *http.Request, healthy []*backend) *backend
+}
+
+// balancerFactories maps the strategy names accepted in RouteConfig to
+// their constructors, which receive every member of the pool.
+var balancerFactories = map[string]func(backends []*backend) Balancer{
+	"round-robin":     func([]*backend) Balancer { return &roundRobin{} },
+	"least-conn":      func([]*backend) Balancer { return leastConn{} },
+	"weighted":        func([]*backend) Balancer { return newWeightedRoundRobin() },
+	"random":          func([]*backend) Balancer { return weightedRandom{} },
+	"ewma":            func([]*backend) Balancer { return ewmaBalancer{} },
+	"consistent-hash": func(b []*backend) Balancer { return newConsistentHash(b) },
+}
+
+const defaultStrategy = "round-robin"
+
+// newBalancer returns the Balancer for strategy over backends.
+func newBalancer(strategy string, backends []*backend) (Balancer, error) {
+	if strategy == "" {
+		strategy = defaultStrategy
+	}
+	factory, ok := balancerFactories[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+	return factory(backends), nil
+}
+
+// pool is the set of backends serving a route and the strategy that
+// balances them.
+type pool struct {
+	backends []*backend
+	balancer Balancer
+	strategy string
+}
+
+func newPool(strategy string, backends []*backend) (*pool, error) {
+	bal, err := newBalancer(strategy, backends)
+	if err != nil {
+		return nil, err
+	}
+	return &pool{backends: backends, balancer: bal, strategy: cmp.Or(strategy, defaultStrategy)}, nil
+}
+
+// Pick returns the backend that serves r, skipping unhealthy backends and
+// any already tried for r, or nil if none is left.
+func (p *pool) Pick(r *http.Request) *backend {
+	healthy := make([]*backend, 0, len(p.backends))
+	var skipped map[string]string
+	for _, b := range p.backends {
+		reason := skipReason(r, b)
+		if reason == "" {
+			healthy = append(healthy, b)
+			continue
+		}
+		if skipped == nil {
+			skipped = make(map[string]string)
+		}
+		skipped[b.url] = reason
+	}
+	recordDecision(r, p.strategy, skipped)
+	if len(healthy) == 0 {
+		return nil
+	}
+	return p.balancer.Pick(r, healthy)
+}
+
+// recordDecision notes how the backend for r was chosen in its access log
+// entry, when Config.Log.BalancerDecisions is on.
+func recordDecision(r *http.Request, strategy string, skipped map[string]string) {
+	if !stateFrom(r.Context()).config.Log.BalancerDecisions {
+		return
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.strategy = strategy
+		info.skipped = skipped
+	}
+}
+
+// roundRobin cycles through the healthy backends in order.
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+func (rr *roundRobin) Pick(r *http.Request, healthy []*backend) *backend {
+	n := rr.next.Add(1) - 1
+	return healthy[n%uint64(len(healthy))]
+}
+
+// leastConn picks the backend with the fewest requests in flight.
+type leastConn struct{}
+
+func (leastConn) Pick(r *http.Request, healthy []*backend) *backend {
+	best := healthy[0]
+	for _, b := range healthy[1:] {
+		if b.inFlight.Load() < best.inFlight.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// weightedRoundRobin spreads requests in proportion to backend weights using
+// the smooth weighted round-robin algorithm, so heavier backends are not
+// picked in bursts.
+type weightedRoundRobin struct {
+	mu      sync.Mutex
+	current map[*backend]int
+}
+
+func newWeightedRoundRobin() *weightedRoundRobin {
+	return &weightedRoundRobin{current: make(map[*backend]int)}
+}
+
+func (w *weightedRoundRobin) Pick(r *http.Request, healthy []*backend) *backend {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var best *backend
+	total := 0
+	for _, b := range healthy {
+		w.current[b] += b.weight
+		total += b.weight
+		if best == nil || w.current[b] > w.current[best] {
+			best = b
+		}
+	}
+	w.current[best] -= total
+	return best
+}
+
+// weightedRandom picks a backend at random in proportion to its weight.
+type weightedRandom struct{}
+
+func (weightedRandom) Pick(r *http.Request, healthy []*backend) *backend {
+	total := 0
+	for _, b := range healthy {
+		total += b.weight
+	}
+	n := rand.IntN(total)
+	for _, b := range healthy {
+		if n < b.weight {
+			return b
+		}
+		n -= b.weight
+	}
+	return healthy[len(healthy)-1]
+}
+
+// ewmaBalancer picks the backend with the lowest moving-average latency.
+// Backends without a sample yet are tried first.
+type ewmaBalancer struct{}
+
+func (ewmaBalancer) Pick(r *http.Request, healthy []*backend) *backend {
+	best, bestLatency := healthy[0], healthy[0].latency()
+	for _, b := range healthy[1:] {
+		if l := b.latency(); l < bestLatency {
+			best, bestLatency = b, l
+		}
+	}
+	return best
+}
+
+// consistentHash maps each client IP to the same backend for as long as the
+// pool is unchanged, moving few clients when it does change.
+type consistentHash struct {
+	ring   []uint32
+	owners map[uint32]*backend
+}
+
+// hashReplicas is the number of points each backend has on the ring.
+const hashReplicas = 64
+
+func newConsistentHash(backends []*backend) *consistentHash {
+	ch := &consistentHash{owners: make(map[uint32]*backend)}
+	for _, b := range backends {
+		for i := 0; i < hashReplicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(b.url + "#" + strconv.Itoa(i)))
+			ch.ring = append(ch.ring, h)
+			ch.owners[h] = b
+		}
+	}
+	sort.Slice(ch.ring, func(i, j int) bool { return ch.ring[i] < ch.ring[j] })
+	return ch
+}
+
+func (ch *consistentHash) Pick(r *http.Request, healthy []*backend) *backend {
+	key, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		key = r.RemoteAddr
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	// Walk clockwise past unhealthy backends, so only their clients move.
+	start := sort.Search(len(ch.ring), func(i int) bool { return ch.ring[i] >= h })
+	for i := range ch.ring {
+		if b := ch.owners[ch.ring[(start+i)%len(ch.ring)]]; slices.Contains(healthy, b) {
+			return b
+		}
+	}
+	return healthy[0]
+}
+
+// inFlightStats describes one pooled backend's load in the admin API.
+type inFlightStats struct {
+	Backend  string `json:"backend"`
+	InFlight int64  `json:"in_flight"`
+}
+
+// inFlightHandler lists the requests in flight to each pooled backend, from
+// dispatch until the response body is closed, as least-conn balancing sees
+// them.
+func inFlightHandler(w http.ResponseWriter, r *http.Request) {
+	backends := currentState().backendStates
+	stats := make([]inFlightStats, 0, len(backends))
+	for _, b := range backends {
+		stats = append(stats, inFlightStats{Backend: b.url, InFlight: b.inFlight.Load()})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Backend < stats[j].Backend })
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// newRoutePools builds the pool of each pooled route in cfg, and the state of
+// their backends keyed by backendKey. Backends in prev, the states under the
+// previous config, keep their state.
+func newRoutePools(cfg *Config, prev map[string]*backend) (map[string]*pool, map[string]*backend, error) {
+	pools := make(map[string]*pool)
+	states := make(map[string]*backend)
+	for _, rt := range cfg.Routes {
+		if len(rt.Backends) == 0 {
+			continue
+		}
+		members := make([]*backend, 0, len(rt.Backends))
+		for _, raw := range rt.Backends {
+			u, err := url.Parse(raw)
+			if err != nil {
+				return nil, nil, err
+			}
+			key := backendKey(u)
+			b := states[key]
+			if b == nil {
+				b = newBackend(raw, cfg.Backends[raw], prev[key])
+				states[key] = b
+			}
+			members = append(members, b)
+		}
+		p, err := newPool(rt.Strategy, members)
+		if err != nil {
+			return nil, nil, fmt.Errorf("route %q: %w", rt.Prefix, err)
+		}
+		pools[rt.Prefix] = p
+	}
+	return pools, states, nil
+}
+
+// newBackend returns the state of the pooled backend at raw, configured by
+// bc. prev is its state under the previous config, if any: it is reused as
+// is when the backend's settings are unchanged, so the requests in flight
+// keep counting against it. Otherwise the new state starts from prev's
+// health, latency and fuse, while its requests in flight finish against
+// prev.
+func newBackend(raw string, bc BackendConfig, prev *backend) *backend {
+	weight := max(bc.Weight, 1)
+	if prev != nil && prev.url == raw && prev.weight == weight && sameFuse(prev.fuse, bc.Fuse) {
+		return prev
+	}
+	b := &backend{url: raw, weight: weight}
+	if bc.Fuse != nil {
+		b.fuse = &fuse{cfg: *bc.Fuse}
+	}
+	if prev != nil {
+		b.unhealthy.Store(prev.unhealthy.Load())
+		b.ewmaMillis = prev.latency()
+		if b.fuse != nil && prev.fuse != nil {
+			b.fuse.carryOver(prev.fuse)
+		}
+	}
+	return b
+}
+
+// sameFuse reports whether f is configured by fc.
+func sameFuse(f *fuse, fc *FuseConfig) bool {
+	if f == nil || fc == nil {
+		return f == nil && fc == nil
+	}
+	return f.cfg == *fc
+}
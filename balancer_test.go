@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testBackends(urls ...string) []*backend {
+	backends := make([]*backend, len(urls))
+	for i, u := range urls {
+		backends[i] = &backend{url: u, weight: 1}
+	}
+	return backends
+}
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		strategy string
+		want     Balancer
+	}{
+		{"", &roundRobin{}},
+		{"round-robin", &roundRobin{}},
+		{"least-conn", leastConn{}},
+		{"weighted", &weightedRoundRobin{}},
+		{"random", weightedRandom{}},
+		{"ewma", ewmaBalancer{}},
+		{"consistent-hash", &consistentHash{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			got, err := newBalancer(tt.strategy, testBackends("http://a"))
+			if err != nil {
+				t.Fatalf("newBalancer(%q) error: %v", tt.strategy, err)
+			}
+			if gotType, wantType := fmt.Sprintf("%T", got), fmt.Sprintf("%T", tt.want); gotType != wantType {
+				t.Errorf("newBalancer(%q) = %s, want %s", tt.strategy, gotType, wantType)
+			}
+		})
+	}
+
+	if _, err := newBalancer("random-ish", nil); err == nil || !strings.Contains(err.Error(), "random-ish") {
+		t.Errorf("newBalancer(unknown) error = %v, want unknown strategy error", err)
+	}
+}
+
+func TestConfigValidate_UnknownStrategy(t *testing.T) {
+	c := &Config{Routes: []RouteConfig{{
+		Prefix:   "/api",
+		Backends: []string{"http://localhost:8081"},
+		Strategy: "fastest",
+	}}}
+	err := c.validate()
+	if err == nil || !strings.Contains(err.Error(), `unknown balancing strategy "fastest"`) {
+		t.Errorf("validate() = %v, want unknown strategy error", err)
+	}
+}
+
+// testPool returns a pool of backends balanced by strategy.
+func testPool(t *testing.T, strategy string, backends []*backend) *pool {
+	t.Helper()
+	p, err := newPool(strategy, backends)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func pickN(p *pool, r *http.Request, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[p.Pick(r).url]++
+	}
+	return counts
+}
+
+func TestBalancerStrategies(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+
+	t.Run("round-robin", func(t *testing.T) {
+		counts := pickN(testPool(t, "round-robin", testBackends("http://a", "http://b", "http://c")), req, 9)
+		for _, u := range []string{"http://a", "http://b", "http://c"} {
+			if counts[u] != 3 {
+				t.Errorf("counts = %v, want 3 each", counts)
+			}
+		}
+	})
+
+	t.Run("least-conn", func(t *testing.T) {
+		backends := testBackends("http://a", "http://b")
+		backends[0].inFlight.Store(5)
+		backends[1].inFlight.Store(2)
+		if got := testPool(t, "least-conn", backends).Pick(req).url; got != "http://b" {
+			t.Errorf("Pick() = %s, want http://b", got)
+		}
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		backends := testBackends("http://a", "http://b")
+		backends[0].weight = 3
+		counts := pickN(testPool(t, "weighted", backends), req, 8)
+		if counts["http://a"] != 6 || counts["http://b"] != 2 {
+			t.Errorf("counts = %v, want a:6 b:2", counts)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		backends := testBackends("http://a", "http://b")
+		backends[0].weight = 9
+		counts := pickN(testPool(t, "random", backends), req, 1000)
+		if counts["http://a"] < 800 || counts["http://b"] < 50 {
+			t.Errorf("counts = %v, want roughly a:900 b:100", counts)
+		}
+	})
+
+	t.Run("ewma", func(t *testing.T) {
+		backends := testBackends("http://a", "http://b")
+		backends[0].observe(80 * time.Millisecond)
+		backends[1].observe(10 * time.Millisecond)
+		if got := testPool(t, "ewma", backends).Pick(req).url; got != "http://b" {
+			t.Errorf("Pick() = %s, want http://b", got)
+		}
+	})
+
+	t.Run("consistent-hash", func(t *testing.T) {
+		ch := testPool(t, "consistent-hash", testBackends("http://a", "http://b", "http://c"))
+		seen := make(map[string]bool)
+		for i := 0; i < 50; i++ {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+			first := ch.Pick(r).url
+			r.RemoteAddr = strings.Replace(r.RemoteAddr, ":1234", ":9999", 1)
+			if again := ch.Pick(r).url; again != first {
+				t.Fatalf("client %s moved from %s to %s", r.RemoteAddr, first, again)
+			}
+			seen[first] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("all clients hashed to %v, want a spread", seen)
+		}
+	})
+}
+
+func TestBalancerStrategies_SkipUnhealthy(t *testing.T) {
+	for strategy := range balancerFactories {
+		t.Run(strategy, func(t *testing.T) {
+			backends := testBackends("http://a", "http://b", "http://c")
+			backends[1].unhealthy.Store(true)
+			backends[2].weight = 5
+			p := testPool(t, strategy, backends)
+			for i := 0; i < 30; i++ {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = fmt.Sprintf("10.0.0.%d:1234", i)
+				if got := p.Pick(r); got == nil || got.url == "http://b" {
+					t.Fatalf("Pick() = %v, want a healthy backend", got)
+				}
+			}
+		})
+	}
+}
+
+func TestReverseProxy_Pool(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	a, b := newBackend("a"), newBackend("b")
+	defer a.Close()
+	defer b.Close()
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backends: []string{a.URL, b.URL}})
+	logs := captureLogs(t)
+
+	var bodies []string
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+		bodies = append(bodies, rr.Body.String())
+	}
+	if got := strings.Join(bodies, ""); got != "abab" {
+		t.Errorf("responses = %q, want round-robin abab", got)
+	}
+
+	var logged []string
+	for _, rec := range logRecords(t, logs) {
+		if rec["msg"] == "proxy request" {
+			logged = append(logged, rec["backend"].(string))
+		}
+	}
+	if len(logged) != 4 || logged[0] != a.URL || logged[1] != b.URL {
+		t.Errorf("logged backends = %v, want the picked backend per request", logged)
+	}
+	for _, state := range currentState().backendStates {
+		if n := state.inFlight.Load(); n != 0 {
+			t.Errorf("backend %s has %d requests in flight after completion", state.url, n)
+		}
+	}
+}
+
+func TestInFlightGauge(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer slow.Close()
+	idle := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer idle.Close()
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/slow", Backends: []string{slow.URL}},
+		RouteConfig{Prefix: "/idle", Backends: []string{idle.URL}},
+	)
+
+	gauge := func() map[string]int64 {
+		var stats []inFlightStats
+		if err := json.NewDecoder(adminRequest(t, "GET", "/admin/in-flight").Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int64)
+		for _, s := range stats {
+			got[s.Backend] = s.InFlight
+		}
+		return got
+	}
+
+	const n = 3
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			newTestProxy().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		}()
+	}
+	// The backend holds each response body open, so every request stays in
+	// flight until it is released.
+	waitFor(t, func() bool { return gauge()[slow.URL] == n })
+	if got := gauge()[idle.URL]; got != 0 {
+		t.Errorf("idle backend in flight = %d, want 0", got)
+	}
+
+	close(release)
+	wg.Wait()
+	if got := gauge()[slow.URL]; got != 0 {
+		t.Errorf("in flight after completion = %d, want 0", got)
+	}
+}
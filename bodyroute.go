@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// BodyRouteConfig routes a route's JSON requests by a value in their body,
+// e.g. orders by their type:
+//
+//	{"pointer": "/type", "backends": {"refund": "http://refunds:8080"}}
+//
+// Requests whose value maps to no backend, that are not JSON, or whose body
+// is too large to inspect go to the route's own backend or pool.
+type BodyRouteConfig struct {
+	// Pointer is an RFC 6901 JSON pointer to the value routed on. Strings,
+	// numbers and booleans are matched by their JSON text, strings without
+	// quotes.
+	Pointer string `json:"pointer"`
+	// Backends maps values to the backend that serves them.
+	Backends map[string]string `json:"backends"`
+	// MaxBytes is the most of a body buffered to inspect it. Defaults to
+	// 64KiB.
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+const defaultBodyRouteMaxBytes = 64 << 10
+
+func (bc BodyRouteConfig) validate() error {
+	if _, err := parseJSONPointer(bc.Pointer); err != nil {
+		return fmt.Errorf("body_route: %w", err)
+	}
+	if len(bc.Backends) == 0 {
+		return errors.New("body_route: backends must not be empty")
+	}
+	for _, backend := range bc.Backends {
+		if err := validateBackendURL(backend); err != nil {
+			return fmt.Errorf("body_route: %w", err)
+		}
+	}
+	if bc.MaxBytes < 0 {
+		return errors.New("body_route: max_bytes must not be negative")
+	}
+	return nil
+}
+
+// parseJSONPointer splits an RFC 6901 pointer into its unescaped reference
+// tokens. The empty pointer refers to the whole document.
+func parseJSONPointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("pointer %q must start with /", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, tok := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// resolveJSONPointer returns the value tokens refer to in doc, decoded with
+// UseNumber, and whether it exists.
+func resolveJSONPointer(doc any, tokens []string) (any, bool) {
+	for _, tok := range tokens {
+		switch v := doc.(type) {
+		case map[string]any:
+			next, ok := v[tok]
+			if !ok {
+				return nil, false
+			}
+			doc = next
+		case []any:
+			i, err := strconv.Atoi(tok)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			doc = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// bodyRouteKey marks a request with the backend its body routed it to.
+type bodyRouteKey struct{}
+
+// bodyRouteBackend returns the backend chosen for r by its body, if any.
+func bodyRouteBackend(r *http.Request) string {
+	backend, _ := r.Context().Value(bodyRouteKey{}).(string)
+	return backend
+}
+
+// bodyRouteMiddleware inspects the JSON body of requests on routes with a
+// BodyRoute and marks them with the backend their value maps to. What was
+// read is replayed, so the backend receives the full body.
+func bodyRouteMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := routeMatchFrom(r.Context())
+		rt := route.Config
+		if rt.BodyRoute == nil || r.Body == nil || r.Body == http.NoBody || !isJSON(r.Header.Get("Content-Type")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := cmp.Or(rt.BodyRoute.MaxBytes, defaultBodyRouteMaxBytes)
+		if r.ContentLength > limit {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := r.Body
+		var read bytes.Buffer
+		_, err := read.ReadFrom(io.LimitReader(body, limit+1))
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(&read, body), body}
+		if err == nil && int64(read.Len()) <= limit {
+			if backend := rt.BodyRoute.backendFor(read.Bytes()); backend != "" {
+				r = r.WithContext(context.WithValue(r.Context(), bodyRouteKey{}, backend))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// backendFor returns the backend that the value in body maps to, or "" if
+// none does.
+func (bc BodyRouteConfig) backendFor(body []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return ""
+	}
+	tokens, _ := parseJSONPointer(bc.Pointer)
+	v, ok := resolveJSONPointer(doc, tokens)
+	if !ok {
+		return ""
+	}
+	var key string
+	switch v := v.(type) {
+	case string:
+		key = v
+	case json.Number:
+		key = v.String()
+	case bool:
+		key = strconv.FormatBool(v)
+	default:
+		return ""
+	}
+	return bc.Backends[key]
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBodyRoute(t *testing.T) {
+	// Each backend echoes its name and the body it received.
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			io.WriteString(w, name+" "+string(body))
+		}))
+	}
+	orders, refunds, priority := named("orders"), named("refunds"), named("priority")
+	defer orders.Close()
+	defer refunds.Close()
+	defer priority.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/orders", Backend: orders.URL, BodyRoute: &BodyRouteConfig{
+			Pointer:  "/type",
+			Backends: map[string]string{"refund": refunds.URL},
+		}},
+		RouteConfig{Prefix: "/tiers", Backends: []string{orders.URL}, BodyRoute: &BodyRouteConfig{
+			Pointer:  "/meta/tier",
+			Backends: map[string]string{"1": priority.URL, "true": refunds.URL},
+			MaxBytes: 64,
+		}},
+	)
+	handler := routeMiddleware(bodyRouteMiddleware(newProxy()))
+
+	large := `{"meta":{"tier":1},"pad":"` + strings.Repeat("x", 64) + `"}`
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"mapped value", "/orders", "application/json", `{"type":"refund","id":7}`, "refunds"},
+		{"unmapped value", "/orders", "application/json", `{"type":"purchase","id":7}`, "orders"},
+		{"missing value", "/orders", "application/json", `{"id":7}`, "orders"},
+		{"not JSON", "/orders", "text/plain", `{"type":"refund"}`, "orders"},
+		{"invalid JSON", "/orders", "application/json", `{"type":"refund"`, "orders"},
+		{"nested number", "/tiers", "application/json", `{"meta":{"tier":1}}`, "priority"},
+		{"nested boolean", "/tiers", "application/json", `{"meta":{"tier":true}}`, "refunds"},
+		{"too large to inspect", "/tiers", "application/json", large, "orders"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if want := tt.want + " " + tt.body; rr.Body.String() != want {
+				t.Errorf("response = %q, want %q", rr.Body.String(), want)
+			}
+		})
+	}
+
+	t.Run("chunked body too large to inspect", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/tiers", io.MultiReader(strings.NewReader(large)))
+		req.ContentLength = -1
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if want := "orders " + large; rr.Body.String() != want {
+			t.Errorf("response = %q, want %q", rr.Body.String(), want)
+		}
+	})
+}
+
+func TestParseJSONPointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"/type", []string{"type"}, false},
+		{"/a~1b/~0c/0", []string{"a/b", "~c", "0"}, false},
+		{"type", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseJSONPointer(tt.pointer)
+		if (err != nil) != tt.wantErr || strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("parseJSONPointer(%q) = %q, %v, want %q", tt.pointer, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CircuitBreakerConfig stops sending a route's requests to its backends
+// after repeated failures, giving them time to recover.
+type CircuitBreakerConfig struct {
+	// Failures is the number of consecutive failed requests (5xx responses,
+	// including proxy errors) that opens the breaker.
+	Failures int `json:"failures"`
+	// Cooldown is how long the breaker stays open before one trial request
+	// is let through. Defaults to 30s.
+	Cooldown Duration `json:"cooldown"`
+	// Fallback is served while the breaker is open, instead of a 503.
+	Fallback *FallbackConfig `json:"fallback"`
+}
+
+// FallbackConfig is the response served by an open circuit breaker.
+type FallbackConfig struct {
+	// LastGood serves the route's most recent successful GET response for
+	// the same path, query and Accept-Encoding, when one smaller than
+	// maxLastGoodSize was seen and the request matches the headers it
+	// Varies on. Up to maxLastGoodEntries are kept, evicting the least
+	// recently used.
+	LastGood bool `json:"last_good"`
+	// Store is how LastGood keeps responses the backend compressed:
+	// compressed (default) keeps them as received, one per Accept-Encoding;
+	// normalized decodes gzipped ones, so a single response serves every
+	// client and Config.Compression gzips it again for those that accept
+	// it. Responses in other encodings are then not kept.
+	Store string `json:"store"`
+	// CacheAuthenticated lets LastGood store and serve responses to
+	// requests carrying Authorization or a cookie, and responses setting a
+	// cookie or marked Cache-Control private or no-store. They bypass the
+	// cache by default, as they may be private to the user.
+	CacheAuthenticated bool `json:"cache_authenticated"`
+	// Status, Body and ContentType form a static response, served when
+	// there is no last-good response. Status defaults to 200.
+	Status      int    `json:"status"`
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+}
+
+// Policies for FallbackConfig.Store.
+const (
+	lastGoodStoreCompressed = "compressed"
+	lastGoodStoreNormalized = "normalized"
+)
+
+var lastGoodStorePolicies = []string{"", lastGoodStoreCompressed, lastGoodStoreNormalized}
+
+const (
+	defaultBreakerCooldown = 30 * time.Second
+	// maxLastGoodSize bounds the responses kept for FallbackConfig.LastGood.
+	maxLastGoodSize = 1 << 20
+	// maxLastGoodEntries bounds the number of responses each breaker keeps
+	// for FallbackConfig.LastGood.
+	maxLastGoodEntries = 256
+)
+
+// cacheable reports whether the response to r may be stored as, or served
+// from, the last-good response.
+func (fb *FallbackConfig) cacheable(r *http.Request) bool {
+	return fb != nil && fb.LastGood && r.Method == http.MethodGet &&
+		(fb.CacheAuthenticated || !authenticated(r))
+}
+
+// storable reports whether a response with header h may be stored as the
+// last-good response.
+func (fb *FallbackConfig) storable(h http.Header) bool {
+	if fb.CacheAuthenticated {
+		return true
+	}
+	if len(h.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	if slices.Contains(headerTokens(h, "Vary"), "*") {
+		return false
+	}
+	for _, v := range h.Values("Cache-Control") {
+		for directive := range strings.SplitSeq(v, ",") {
+			name, _, _ := strings.Cut(directive, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "private" || name == "no-store" {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// authenticated reports whether r carries credentials: an Authorization
+// header or a cookie, any of which may be a session cookie.
+func authenticated(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
+
+// breaker is the circuit breaker of one route.
+type breaker struct {
+	cfg CircuitBreakerConfig
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool
+	// lastGood indexes the elements of lastGoodLRU, whose values are
+	// *cachedResponse, by lastGoodKey. The most recently used is in front.
+	lastGood    map[string]*list.Element
+	lastGoodLRU *list.List
+}
+
+type cachedResponse struct {
+	key    string
+	header http.Header
+	body   []byte
+	// vary holds the request's values of each header the response Varies
+	// on, other than Accept-Encoding, which is part of the key.
+	vary map[string]string
+}
+
+func newBreaker(cfg CircuitBreakerConfig) *breaker {
+	return &breaker{cfg: cfg, lastGood: make(map[string]*list.Element), lastGoodLRU: list.New()}
+}
+
+// lastGoodKey identifies the last-good response for r: its path, query and
+// Accept-Encoding, as the backend may encode the response differently for
+// each. Normalized responses are decoded, so they serve any Accept-Encoding.
+func (fb *FallbackConfig) lastGoodKey(r *http.Request) string {
+	if fb.Store == lastGoodStoreNormalized {
+		return r.URL.RequestURI()
+	}
+	return r.URL.RequestURI() + "\n" + strings.Join(r.Header.Values("Accept-Encoding"), ",")
+}
+
+// newCachedResponse keeps the response to r with header h and body.
+func (fb *FallbackConfig) newCachedResponse(r *http.Request, h http.Header, body []byte) *cachedResponse {
+	res := &cachedResponse{key: fb.lastGoodKey(r), header: h, body: body, vary: make(map[string]string)}
+	for _, name := range headerTokens(h, "Vary") {
+		if name != "accept-encoding" {
+			res.vary[name] = strings.Join(r.Header.Values(name), ",")
+		}
+	}
+	return res
+}
+
+// normalize decodes res in place if it is gzipped, reporting false if it
+// is in another encoding or does not decode within maxLastGoodSize.
+func (res *cachedResponse) normalize() bool {
+	switch strings.ToLower(res.header.Get("Content-Encoding")) {
+	case "", "identity":
+		return true
+	case "gzip":
+	default:
+		return false
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(res.body))
+	if err != nil {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(gz, maxLastGoodSize+1))
+	if err != nil || len(body) > maxLastGoodSize {
+		return false
+	}
+	res.body = body
+	res.header.Del("Content-Encoding")
+	res.header.Set("Content-Length", strconv.Itoa(len(body)))
+	// The decoded body is a different representation, so a strong
+	// validator no longer holds.
+	if etag := res.header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		res.header.Set("ETag", "W/"+etag)
+	}
+	return true
+}
+
+// matches reports whether r sends the same values as the stored request
+// for every header the response Varies on.
+func (res *cachedResponse) matches(r *http.Request) bool {
+	for name, v := range res.vary {
+		if strings.Join(r.Header.Values(name), ",") != v {
+			return false
+		}
+	}
+	return true
+}
+
+// headerTokens returns the lower-cased comma-separated tokens of every
+// name header in h.
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, v := range h.Values(name) {
+		for token := range strings.SplitSeq(v, ",") {
+			if token = strings.ToLower(strings.TrimSpace(token)); token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// allow reports whether a request may be sent at now. Once the cooldown
+// has passed, a single trial request is allowed until its outcome is
+// recorded.
+func (b *breaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.cfg.Failures {
+		return true
+	}
+	if now.Before(b.openUntil) || b.trial {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record notes the outcome of an allowed request, opening the breaker once
+// Failures consecutive requests have failed.
+func (b *breaker) record(success bool, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if success {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.cfg.Failures {
+		b.openUntil = now.Add(cmp.Or(time.Duration(b.cfg.Cooldown), defaultBreakerCooldown))
+	}
+}
+
+// abandonTrial releases the trial request without recording an outcome,
+// such as when its client went away, so the next request becomes the
+// trial.
+func (b *breaker) abandonTrial() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+}
+
+// retryAfter returns the time left until the breaker lets a trial through.
+func (b *breaker) retryAfter(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return max(b.openUntil.Sub(now), 0)
+}
+
+// storeLastGood keeps res as the last-good response for its key, evicting
+// the least recently used response once maxLastGoodEntries are kept.
+func (b *breaker) storeLastGood(res *cachedResponse) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e := b.lastGood[res.key]; e != nil {
+		e.Value = res
+		b.lastGoodLRU.MoveToFront(e)
+		return
+	}
+	b.lastGood[res.key] = b.lastGoodLRU.PushFront(res)
+	if b.lastGoodLRU.Len() > maxLastGoodEntries {
+		oldest := b.lastGoodLRU.Remove(b.lastGoodLRU.Back()).(*cachedResponse)
+		delete(b.lastGood, oldest.key)
+	}
+}
+
+func (b *breaker) loadLastGood(key string) *cachedResponse {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.lastGood[key]
+	if e == nil {
+		return nil
+	}
+	b.lastGoodLRU.MoveToFront(e)
+	return e.Value.(*cachedResponse)
+}
+
+// newRouteBreakers builds the circuit breakers of rts, keeping the breaker
+// in prev of each route whose breaker config is unchanged, so an open
+// breaker stays open across a reload.
+func newRouteBreakers(rts []RouteConfig, prev map[string]*breaker) map[string]*breaker {
+	breakers := make(map[string]*breaker)
+	for _, rt := range rts {
+		if rt.CircuitBreaker == nil {
+			continue
+		}
+		if b := prev[rt.Prefix]; b != nil && b.cfg.equal(*rt.CircuitBreaker) {
+			breakers[rt.Prefix] = b
+		} else {
+			breakers[rt.Prefix] = newBreaker(*rt.CircuitBreaker)
+		}
+	}
+	return breakers
+}
+
+// equal reports whether cc and other configure the same breaker.
+func (cc CircuitBreakerConfig) equal(other CircuitBreakerConfig) bool {
+	if cc.Failures != other.Failures || cc.Cooldown != other.Cooldown {
+		return false
+	}
+	if cc.Fallback == nil || other.Fallback == nil {
+		return cc.Fallback == nil && other.Fallback == nil
+	}
+	return *cc.Fallback == *other.Fallback
+}
+
+// breakerMiddleware fails fast while a route's circuit breaker is open,
+// serving its fallback or a 503 with Retry-After.
+func breakerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stateFrom(r.Context())
+		route, _ := routeMatchFrom(r.Context())
+		b := s.routeBreakers[route.Prefix]
+		if b == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if now := time.Now(); !b.allow(now) {
+			b.serveFallback(w, r, now)
+			return
+		}
+
+		rec := &bodyRecorder{ResponseWriter: w, statusCode: http.StatusOK, keep: b.cfg.Fallback.cacheable(r)}
+		next.ServeHTTP(rec, r)
+		if r.Context().Err() != nil && rec.statusCode >= 500 {
+			// The client went away; the backend is not to blame.
+			b.abandonTrial()
+			return
+		}
+		b.record(rec.statusCode < 500, time.Now())
+		if rec.keep && rec.header == nil {
+			// Nothing was written, so no outer writer has touched the header.
+			rec.header = w.Header().Clone()
+		}
+		if fb := b.cfg.Fallback; rec.keep && rec.statusCode == http.StatusOK && fb.storable(rec.header) {
+			res := fb.newCachedResponse(r, rec.header, rec.body.Bytes())
+			if fb.Store != lastGoodStoreNormalized || res.normalize() {
+				b.storeLastGood(res)
+			}
+		}
+	})
+}
+
+// serveFallback answers a request rejected by the open breaker.
+func (b *breaker) serveFallback(w http.ResponseWriter, r *http.Request, now time.Time) {
+	fb := b.cfg.Fallback
+	if fb.cacheable(r) {
+		if res := b.loadLastGood(fb.lastGoodKey(r)); res != nil && res.matches(r) {
+			for k, v := range res.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("X-Proxy-Fallback", "last-good")
+			w.WriteHeader(http.StatusOK)
+			w.Write(res.body)
+			return
+		}
+	}
+	if fb != nil && (fb.Body != "" || fb.Status != 0) {
+		if fb.ContentType != "" {
+			w.Header().Set("Content-Type", fb.ContentType)
+		}
+		w.Header().Set("X-Proxy-Fallback", "static")
+		w.WriteHeader(cmp.Or(fb.Status, http.StatusOK))
+		w.Write([]byte(fb.Body))
+		return
+	}
+	secs := math.Ceil(b.retryAfter(now).Seconds())
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(secs), 1)))
+	http.Error(w, "circuit breaker open", http.StatusServiceUnavailable)
+}
+
+// bodyRecorder records a response's status and, when keep is set, a copy
+// of its header and of its body up to maxLastGoodSize.
+type bodyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	keep       bool
+	// header is copied as the status is written, before writers further
+	// out, such as compressWriter, rewrite it for the body they send.
+	header      http.Header
+	body        bytes.Buffer
+	wroteHeader bool
+}
+
+func (br *bodyRecorder) WriteHeader(code int) {
+	if !br.wroteHeader && code >= 200 {
+		br.wroteHeader = true
+		br.statusCode = code
+		if br.keep {
+			br.header = br.Header().Clone()
+		}
+	}
+	br.ResponseWriter.WriteHeader(code)
+}
+
+func (br *bodyRecorder) Write(b []byte) (int, error) {
+	if !br.wroteHeader {
+		br.WriteHeader(http.StatusOK)
+	}
+	if br.keep {
+		if br.body.Len()+len(b) > maxLastGoodSize {
+			br.keep = false
+			br.body = bytes.Buffer{}
+		} else {
+			br.body.Write(b)
+		}
+	}
+	return br.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (br *bodyRecorder) Unwrap() http.ResponseWriter {
+	return br.ResponseWriter
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyBackend serves "fresh" until failing is set, then 500s.
+func flakyBackend(t *testing.T, failing *atomic.Bool) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("fresh"))
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func TestBreakerMiddleware_Fallback(t *testing.T) {
+	tests := []struct {
+		name        string
+		fallback    *FallbackConfig
+		warm        bool
+		wantStatus  int
+		wantBody    string
+		wantSource  string
+		wantRetryIn bool
+	}{
+		{
+			name:       "last good",
+			fallback:   &FallbackConfig{LastGood: true},
+			warm:       true,
+			wantStatus: http.StatusOK,
+			wantBody:   "fresh",
+			wantSource: "last-good",
+		},
+		{
+			name:       "static when nothing cached",
+			fallback:   &FallbackConfig{LastGood: true, Status: http.StatusOK, Body: `{"items":[]}`, ContentType: "application/json"},
+			wantStatus: http.StatusOK,
+			wantBody:   `{"items":[]}`,
+			wantSource: "static",
+		},
+		{
+			name:        "no fallback",
+			wantStatus:  http.StatusServiceUnavailable,
+			wantBody:    "circuit breaker open\n",
+			wantRetryIn: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			backend := flakyBackend(t, &failing)
+			withRouteConfigs(t, RouteConfig{
+				Prefix:         "/api",
+				Backend:        backend.URL,
+				CircuitBreaker: &CircuitBreakerConfig{Failures: 2, Cooldown: Duration(time.Minute), Fallback: tt.fallback},
+			})
+			handler := routeMiddleware(breakerMiddleware(newProxy()))
+			get := func() *httptest.ResponseRecorder {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/items", nil))
+				return rr
+			}
+
+			if tt.warm {
+				get()
+			}
+			failing.Store(true)
+			for range 2 {
+				if rr := get(); rr.Code != http.StatusInternalServerError {
+					t.Fatalf("status before breaker opened = %d, want 500", rr.Code)
+				}
+			}
+
+			rr := get()
+			if rr.Code != tt.wantStatus || rr.Body.String() != tt.wantBody {
+				t.Errorf("open breaker served %d %q, want %d %q", rr.Code, rr.Body, tt.wantStatus, tt.wantBody)
+			}
+			if got := rr.Header().Get("X-Proxy-Fallback"); got != tt.wantSource {
+				t.Errorf("X-Proxy-Fallback = %q, want %q", got, tt.wantSource)
+			}
+			if got := rr.Header().Get("Retry-After"); (got != "") != tt.wantRetryIn {
+				t.Errorf("Retry-After = %q", got)
+			}
+		})
+	}
+}
+
+func TestBreaker_HalfOpen(t *testing.T) {
+	b := newBreaker(CircuitBreakerConfig{Failures: 1, Cooldown: Duration(time.Second)})
+	now := time.Now()
+
+	b.record(false, now)
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Fatal("allow() during cooldown = true, want false")
+	}
+	later := now.Add(2 * time.Second)
+	if !b.allow(later) {
+		t.Fatal("allow() after cooldown = false, want a trial request")
+	}
+	if b.allow(later) {
+		t.Fatal("allow() with a trial in flight = true, want false")
+	}
+	b.record(true, later)
+	if !b.allow(later) {
+		t.Error("allow() after a successful trial = false, want closed breaker")
+	}
+}
+
+func TestBreakerMiddleware_CanceledTrial(t *testing.T) {
+	withRouteConfigs(t, RouteConfig{
+		Prefix:         "/api",
+		Backend:        "http://backend.invalid",
+		CircuitBreaker: &CircuitBreakerConfig{Failures: 1, Cooldown: Duration(time.Millisecond)},
+	})
+	calls := 0
+	handler := routeMiddleware(breakerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "boom", http.StatusInternalServerError)
+	})))
+	serve := func(ctx context.Context) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, "GET", "/api", nil))
+	}
+
+	serve(context.Background())
+	time.Sleep(5 * time.Millisecond)
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	serve(canceled)
+	time.Sleep(5 * time.Millisecond)
+	serve(context.Background())
+	if calls != 3 {
+		t.Errorf("requests reaching the backend = %d, want 3: an abandoned trial must not keep the breaker open", calls)
+	}
+}
+
+func TestBreakerMiddleware_AuthenticatedBypass(t *testing.T) {
+	tests := []struct {
+		name               string
+		cacheAuthenticated bool
+		warmHeader         string
+		header             string
+		wantSource         string
+	}{
+		{"authenticated response not stored", false, "Authorization", "", "static"},
+		{"session response not stored", false, "Cookie", "", "static"},
+		{"not served to authenticated request", false, "", "Authorization", "static"},
+		{"anonymous served", false, "", "", "last-good"},
+		{"override stores and serves", true, "Authorization", "Authorization", "last-good"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			backend := flakyBackend(t, &failing)
+			withRouteConfigs(t, RouteConfig{
+				Prefix:  "/api",
+				Backend: backend.URL,
+				CircuitBreaker: &CircuitBreakerConfig{Failures: 1, Cooldown: Duration(time.Minute), Fallback: &FallbackConfig{
+					LastGood:           true,
+					CacheAuthenticated: tt.cacheAuthenticated,
+					Body:               "static",
+				}},
+			})
+			handler := routeMiddleware(breakerMiddleware(newProxy()))
+			get := func(header string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/api/me", nil)
+				if header != "" {
+					req.Header.Set(header, "secret")
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				return rr
+			}
+
+			get(tt.warmHeader)
+			failing.Store(true)
+			get("")
+
+			rr := get(tt.header)
+			if got := rr.Header().Get("X-Proxy-Fallback"); got != tt.wantSource {
+				t.Errorf("X-Proxy-Fallback = %q (body %q), want %q", got, rr.Body, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestBreaker_LastGoodKeyedByQueryAndBounded(t *testing.T) {
+	b := newBreaker(CircuitBreakerConfig{Failures: 1})
+	fb := &FallbackConfig{LastGood: true}
+	keyOf := func(target string) string { return fb.lastGoodKey(httptest.NewRequest("GET", target, nil)) }
+
+	b.storeLastGood(&cachedResponse{key: keyOf("/api/search?q=a"), body: []byte("a")})
+	b.storeLastGood(&cachedResponse{key: keyOf("/api/search?q=b"), body: []byte("b")})
+	if res := b.loadLastGood(keyOf("/api/search?q=a")); res == nil || string(res.body) != "a" {
+		t.Fatalf("last good for ?q=a = %v, want body a", res)
+	}
+	if res := b.loadLastGood(keyOf("/api/search")); res != nil {
+		t.Errorf("last good without query = %q, want none", res.body)
+	}
+
+	for i := range maxLastGoodEntries - 1 {
+		b.storeLastGood(&cachedResponse{key: keyOf(fmt.Sprintf("/api/items/%d", i))})
+	}
+	if got := b.lastGoodLRU.Len(); got != maxLastGoodEntries {
+		t.Errorf("kept %d last-good responses, want %d", got, maxLastGoodEntries)
+	}
+	// ?q=a was used more recently than ?q=b, so ?q=b is evicted first.
+	if b.loadLastGood(keyOf("/api/search?q=b")) != nil {
+		t.Error("least recently used response was not evicted")
+	}
+	if b.loadLastGood(keyOf("/api/search?q=a")) == nil {
+		t.Error("recently used response was evicted")
+	}
+}
+
+func TestBreakerMiddleware_PrivateResponseNotStored(t *testing.T) {
+	tests := []struct {
+		name               string
+		header, value      string
+		cacheAuthenticated bool
+		wantSource         string
+	}{
+		{"set-cookie", "Set-Cookie", "session=abc", false, "static"},
+		{"private", "Cache-Control", "max-age=60, Private", false, "static"},
+		{"private with fields", "Cache-Control", `private="X-User"`, false, "static"},
+		{"no-store", "Cache-Control", "no-store", false, "static"},
+		{"public", "Cache-Control", "public, max-age=60", false, "last-good"},
+		{"override stores", "Set-Cookie", "session=abc", true, "last-good"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					http.Error(w, "boom", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set(tt.header, tt.value)
+				w.Write([]byte("fresh"))
+			}))
+			t.Cleanup(backend.Close)
+			withRouteConfigs(t, RouteConfig{
+				Prefix:  "/api",
+				Backend: backend.URL,
+				CircuitBreaker: &CircuitBreakerConfig{Failures: 1, Cooldown: Duration(time.Minute), Fallback: &FallbackConfig{
+					LastGood:           true,
+					CacheAuthenticated: tt.cacheAuthenticated,
+					Body:               "static",
+				}},
+			})
+			handler := routeMiddleware(breakerMiddleware(newProxy()))
+			get := func() *httptest.ResponseRecorder {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api/me", nil))
+				return rr
+			}
+
+			get()
+			failing.Store(true)
+			get()
+
+			rr := get()
+			if got := rr.Header().Get("X-Proxy-Fallback"); got != tt.wantSource {
+				t.Errorf("X-Proxy-Fallback = %q (body %q), want %q", got, rr.Body, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestBreakerMiddleware_LastGoodThroughCompression(t *testing.T) {
+	tests := []struct {
+		name        string
+		backendGzip bool
+		vary        string
+		warm        http.Header
+		get         http.Header
+		wantSource  string
+		wantGzip    bool
+	}{
+		{
+			name:       "compressed by the proxy on replay",
+			warm:       http.Header{"Accept-Encoding": {"gzip"}},
+			get:        http.Header{"Accept-Encoding": {"gzip"}},
+			wantSource: "last-good",
+			wantGzip:   true,
+		},
+		{
+			name:        "backend gzip replayed to gzip client",
+			backendGzip: true,
+			warm:        http.Header{"Accept-Encoding": {"gzip"}},
+			get:         http.Header{"Accept-Encoding": {"gzip"}},
+			wantSource:  "last-good",
+			wantGzip:    true,
+		},
+		{
+			name:        "backend gzip not replayed to identity client",
+			backendGzip: true,
+			warm:        http.Header{"Accept-Encoding": {"gzip"}},
+			get:         http.Header{},
+			wantSource:  "static",
+		},
+		{
+			name:       "other vary header differs",
+			vary:       "Accept-Language",
+			warm:       http.Header{"Accept-Language": {"en"}},
+			get:        http.Header{"Accept-Language": {"fr"}},
+			wantSource: "static",
+		},
+		{
+			name:       "other vary header matches",
+			vary:       "Accept-Language",
+			warm:       http.Header{"Accept-Language": {"en"}},
+			get:        http.Header{"Accept-Language": {"en"}},
+			wantSource: "last-good",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					http.Error(w, "boom", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				if tt.vary != "" {
+					w.Header().Set("Vary", tt.vary)
+				}
+				if tt.backendGzip && acceptsGzip(r.Header.Get("Accept-Encoding")) {
+					w.Header().Set("Content-Encoding", "gzip")
+					gz := gzip.NewWriter(w)
+					gz.Write([]byte("fresh"))
+					gz.Close()
+					return
+				}
+				w.Write([]byte("fresh"))
+			}))
+			t.Cleanup(backend.Close)
+			zero := int64(0)
+			withConfig(t, func(c *Config) { c.Compression = &CompressionConfig{MinBytes: &zero} })
+			withRouteConfigs(t, RouteConfig{
+				Prefix:  "/api",
+				Backend: backend.URL,
+				CircuitBreaker: &CircuitBreakerConfig{Failures: 1, Cooldown: Duration(time.Minute), Fallback: &FallbackConfig{
+					LastGood: true,
+					Body:     "static",
+				}},
+			})
+			handler := routeMiddleware(compressMiddleware(breakerMiddleware(newProxy())))
+			get := func(h http.Header) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/api/items", nil)
+				req.Header = h.Clone()
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				return rr
+			}
+
+			get(tt.warm)
+			failing.Store(true)
+			get(tt.warm)
+
+			rr := get(tt.get)
+			if got := rr.Header().Get("X-Proxy-Fallback"); got != tt.wantSource {
+				t.Fatalf("X-Proxy-Fallback = %q (body %q), want %q", got, rr.Body, tt.wantSource)
+			}
+			if tt.wantSource != "last-good" {
+				return
+			}
+			if got := rr.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", got, tt.wantGzip)
+			}
+			body := io.Reader(rr.Body)
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatalf("replayed body is not gzip: %v", err)
+				}
+				body = gz
+			}
+			if got, _ := io.ReadAll(body); string(got) != "fresh" {
+				t.Errorf("replayed body = %q, want %q", got, "fresh")
+			}
+		})
+	}
+}
+
+func TestBreakerMiddleware_LastGoodStore(t *testing.T) {
+	tests := []struct {
+		name           string
+		store          string
+		acceptEncoding string
+		wantSource     string
+		wantGzip       bool
+	}{
+		{"normalized to gzip client", lastGoodStoreNormalized, "gzip", "last-good", true},
+		{"normalized to identity client", lastGoodStoreNormalized, "", "last-good", false},
+		{"compressed to gzip client", lastGoodStoreCompressed, "gzip", "last-good", true},
+		{"compressed not to identity client", lastGoodStoreCompressed, "", "static", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var failing atomic.Bool
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing.Load() {
+					http.Error(w, "boom", http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", "gzip")
+				gz := gzip.NewWriter(w)
+				gz.Write([]byte("fresh"))
+				gz.Close()
+			}))
+			t.Cleanup(backend.Close)
+			zero := int64(0)
+			withConfig(t, func(c *Config) { c.Compression = &CompressionConfig{MinBytes: &zero} })
+			withRouteConfigs(t, RouteConfig{
+				Prefix:  "/api",
+				Backend: backend.URL,
+				CircuitBreaker: &CircuitBreakerConfig{Failures: 1, Cooldown: Duration(time.Minute), Fallback: &FallbackConfig{
+					LastGood: true,
+					Store:    tt.store,
+					Body:     "static",
+				}},
+			})
+			handler := routeMiddleware(compressMiddleware(breakerMiddleware(newProxy())))
+			get := func(acceptEncoding string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/api/items", nil)
+				if acceptEncoding != "" {
+					req.Header.Set("Accept-Encoding", acceptEncoding)
+				}
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				return rr
+			}
+
+			get("gzip")
+			failing.Store(true)
+			get("gzip")
+
+			rr := get(tt.acceptEncoding)
+			if got := rr.Header().Get("X-Proxy-Fallback"); got != tt.wantSource {
+				t.Fatalf("X-Proxy-Fallback = %q (body %q), want %q", got, rr.Body, tt.wantSource)
+			}
+			if tt.wantSource != "last-good" {
+				return
+			}
+			if got := rr.Header().Get("Content-Encoding") == "gzip"; got != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", got, tt.wantGzip)
+			}
+			body := io.Reader(rr.Body)
+			if tt.wantGzip {
+				gz, err := gzip.NewReader(rr.Body)
+				if err != nil {
+					t.Fatalf("replayed body is not gzip: %v", err)
+				}
+				body = gz
+			}
+			if got, _ := io.ReadAll(body); string(got) != "fresh" {
+				t.Errorf("replayed body = %q, want %q", got, "fresh")
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCopyBufferSize matches the buffer io.Copy allocates.
+const defaultCopyBufferSize = 32 << 10
+
+// bufferPool is the httputil.BufferPool that lends response copy buffers
+// of Config.CopyBufferSize bytes, so large transfers neither allocate a
+// buffer per response nor make a syscall per 32KB.
+type bufferPool struct {
+	size atomic.Int64
+	pool sync.Pool
+}
+
+// copyBuffers is shared by every proxy; applyConfig sets its size.
+var copyBuffers = newBufferPool(defaultCopyBufferSize)
+
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{}
+	p.size.Store(int64(size))
+	return p
+}
+
+func (p *bufferPool) Get() []byte {
+	size := int(p.size.Load())
+	if b, ok := p.pool.Get().(*[]byte); ok && len(*b) == size {
+		return *b
+	}
+	return make([]byte, size)
+}
+
+// Put returns b to the pool unless the size changed since it was lent.
+func (p *bufferPool) Put(b []byte) {
+	if len(b) == int(p.size.Load()) {
+		p.pool.Put(&b)
+	}
+}
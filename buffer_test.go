@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCopyBufferSize(t *testing.T) {
+	payload := make([]byte, 5<<20+123)
+	rand.Read(payload)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer backend.Close()
+
+	for _, size := range []int{0, 4097, 256 << 10} {
+		withAppliedConfig(t, func(c *Config) {
+			c.CopyBufferSize = size
+			c.Routes = []RouteConfig{{Prefix: "/files", Backend: backend.URL}}
+		})
+		if got, want := len(copyBuffers.Get()), cmp.Or(size, defaultCopyBufferSize); got != want {
+			t.Errorf("copy_buffer_size %d: buffer of %d bytes, want %d", size, got, want)
+		}
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/files", nil))
+		if !bytes.Equal(rr.Body.Bytes(), payload) {
+			t.Errorf("copy_buffer_size %d: received %d bytes differing from the %d sent", size, rr.Body.Len(), len(payload))
+		}
+	}
+}
+
+// discardWriter is a ResponseWriter that allocates nothing per write, so
+// benchmarks measure the proxy's own allocations.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func BenchmarkProxyLargeResponse(b *testing.B) {
+	payload := make([]byte, 1<<20)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer backend.Close()
+	withRoutes(b, map[string]string{"/files": backend.URL})
+
+	for _, bc := range []struct {
+		name string
+		pool bool
+	}{{"no pool", false}, {"pooled", true}} {
+		b.Run(bc.name, func(b *testing.B) {
+			proxy := newProxy()
+			if !bc.pool {
+				proxy.BufferPool = nil
+			}
+			handler := routeMiddleware(proxy)
+			req := httptest.NewRequest("GET", "/files", nil)
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				handler.ServeHTTP(&discardWriter{header: make(http.Header)}, req)
+			}
+		})
+	}
+}
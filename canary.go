@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// CanaryConfig sends the requests of a route that match a condition to a
+// canary backend instead of the route's own, e.g. users with a beta cookie:
+//
+//	{"backend": "http://beta:8080", "if": "cookie.beta == \"1\"", "percent": 20}
+type CanaryConfig struct {
+	Backend string `json:"backend"`
+	// If is an expression in the RewriteRuleConfig.If syntax. An empty If
+	// matches every request.
+	If string `json:"if"`
+	// Percent is the share of matching requests sent to the canary,
+	// chosen by client IP so each client stays on one side. Defaults to
+	// 100.
+	Percent int `json:"percent"`
+}
+
+// canary is a compiled CanaryConfig.
+type canary struct {
+	backend string
+	cond    exprNode
+	percent int
+}
+
+func compileCanary(cc CanaryConfig) (*canary, error) {
+	if err := validateBackendURL(cc.Backend); err != nil {
+		return nil, err
+	}
+	if cc.Percent < 0 || cc.Percent > 100 {
+		return nil, fmt.Errorf("percent %d must be between 0 and 100", cc.Percent)
+	}
+	c := &canary{backend: cc.Backend, percent: cc.Percent}
+	if c.percent == 0 {
+		c.percent = 100
+	}
+	if cc.If != "" {
+		cond, err := parseExpr(cc.If)
+		if err != nil {
+			return nil, fmt.Errorf("if %q: %w", cc.If, err)
+		}
+		c.cond = cond
+	}
+	return c, nil
+}
+
+func newRouteCanaries(rts []RouteConfig) (map[string]*canary, error) {
+	canaries := make(map[string]*canary)
+	for _, rt := range rts {
+		if rt.Canary == nil {
+			continue
+		}
+		c, err := compileCanary(*rt.Canary)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: canary: %w", rt.Prefix, err)
+		}
+		canaries[rt.Prefix] = c
+	}
+	return canaries, nil
+}
+
+// matches reports whether r, routed by prefix with remainder left of its
+// path, goes to the canary.
+func (c *canary) matches(r *http.Request, prefix, remainder string) bool {
+	env := exprEnv{in: r, out: &http.Request{URL: &url.URL{Path: remainder}}, prefix: prefix}
+	if c.cond != nil && !truthy(c.cond.eval(env)) {
+		return false
+	}
+	if c.percent >= 100 {
+		return true
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return int(crc32.ChecksumIEEE([]byte(ip))%100) < c.percent
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanary(t *testing.T) {
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name)
+		}))
+	}
+	stable, canaryBackend := named("stable"), named("canary")
+	defer stable.Close()
+	defer canaryBackend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/app", Backend: stable.URL, Canary: &CanaryConfig{
+			Backend: canaryBackend.URL,
+			If:      `cookie.beta == "1" || header.X-Internal`,
+		}},
+		RouteConfig{Prefix: "/split", Backends: []string{stable.URL}, Canary: &CanaryConfig{
+			Backend: canaryBackend.URL,
+			If:      `header.X-Internal`,
+			Percent: 50,
+		}},
+	)
+	send := func(path, clientIP string, setup func(r *http.Request)) string {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = clientIP + ":1234"
+		if setup != nil {
+			setup(req)
+		}
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	tests := []struct {
+		name  string
+		setup func(r *http.Request)
+		want  string
+	}{
+		{"no attribute", nil, "stable"},
+		{"beta cookie", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "beta", Value: "1"}) }, "canary"},
+		{"other cookie value", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "beta", Value: "0"}) }, "stable"},
+		{"internal header", func(r *http.Request) { r.Header.Set("X-Internal", "yes") }, "canary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := send("/app", "192.0.2.1", tt.setup); got != tt.want {
+				t.Errorf("served by %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("percent within matched set", func(t *testing.T) {
+		internal := func(r *http.Request) { r.Header.Set("X-Internal", "yes") }
+		counts := map[string]int{}
+		for i := range 100 {
+			ip := fmt.Sprintf("198.51.100.%d", i)
+			got := send("/split", ip, internal)
+			counts[got]++
+			if again := send("/split", ip, internal); again != got {
+				t.Errorf("client %s moved from %s to %s", ip, got, again)
+			}
+			if unmatched := send("/split", ip, nil); unmatched != "stable" {
+				t.Errorf("unmatched request from %s served by %s", ip, unmatched)
+			}
+		}
+		if counts["canary"] < 25 || counts["stable"] < 25 {
+			t.Errorf("matched requests split %v, want roughly half each", counts)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxCaptureCount   = 1000
+	defaultCaptureTTL = 5 * time.Minute
+)
+
+// capturedRequest is a debug snapshot of one proxied request.
+type capturedRequest struct {
+	Time       time.Time           `json:"time"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Headers    map[string][]string `json:"headers"`
+	Status     int                 `json:"status"`
+	DurationMs int64               `json:"duration_ms"`
+}
+
+// captureBuffer records the next N requests once armed, until it fills or
+// its deadline passes.
+type captureBuffer struct {
+	mu        sync.Mutex
+	remaining int
+	expires   time.Time
+	entries   []capturedRequest
+}
+
+// capture is the request tap served by the admin API.
+var capture = &captureBuffer{}
+
+// start arms the buffer for the next n requests within ttl, discarding
+// earlier captures.
+func (c *captureBuffer) start(n int, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.remaining = n
+	c.expires = now.Add(ttl)
+	c.entries = make([]capturedRequest, 0, n)
+}
+
+// reserve claims a capture slot for a request starting at now.
+func (c *captureBuffer) reserve(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.remaining == 0 || now.After(c.expires) {
+		c.remaining = 0
+		return false
+	}
+	c.remaining--
+	return true
+}
+
+func (c *captureBuffer) add(entry capturedRequest) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = append(c.entries, entry)
+}
+
+func (c *captureBuffer) snapshot() []capturedRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.entries)
+}
+
+// captureMiddleware records requests into capture while it is armed.
+func captureMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		if !capture.reserve(start) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		headers := redactHeaders(r.Header, stateFrom(r.Context()).config.Admin.RedactHeaders)
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		capture.add(capturedRequest{
+			Time:       start,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Headers:    headers,
+			Status:     recorder.statusCode,
+			DurationMs: time.Since(start).Milliseconds(),
+		})
+	})
+}
+
+// redactHeaders copies h, hiding the values of the headers in redact, or
+// of defaultRedactHeaders if it is nil.
+func redactHeaders(h http.Header, redact []string) map[string][]string {
+	if redact == nil {
+		redact = defaultRedactHeaders
+	}
+	out := make(map[string][]string, len(h))
+	for name, values := range h {
+		out[name] = slices.Clone(values)
+	}
+	for _, name := range redact {
+		if _, ok := out[http.CanonicalHeaderKey(name)]; ok {
+			out[http.CanonicalHeaderKey(name)] = []string{"[REDACTED]"}
+		}
+	}
+	return out
+}
+
+// startCaptureHandler arms the request tap. Query parameters: count (the
+// number of requests, default 10) and ttl (default 5m).
+func startCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	count := 10
+	if v := r.URL.Query().Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxCaptureCount {
+			http.Error(w, "count must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		count = n
+	}
+	ttl := defaultCaptureTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "ttl must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	now := time.Now()
+	capture.start(count, ttl, now)
+	writeJSON(w, http.StatusAccepted, map[string]any{"count": count, "expires": now.Add(ttl)})
+}
+
+// listCaptureHandler returns the requests captured so far.
+func listCaptureHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, capture.snapshot())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withCapture swaps in a fresh capture buffer for the duration of the test.
+func withCapture(t *testing.T) {
+	t.Helper()
+	prev := capture
+	capture = &captureBuffer{}
+	t.Cleanup(func() { capture = prev })
+}
+
+func adminRequest(t *testing.T, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr := httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestAdminAuth(t *testing.T) {
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"wrong token", "Bearer nope", http.StatusUnauthorized},
+		{"not bearer", "secret", http.StatusUnauthorized},
+		{"valid token", "Bearer secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/capture", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			newAdminHandler().ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestCapture(t *testing.T) {
+	withCapture(t)
+	withConfig(t, func(c *Config) {
+		c.Admin = AdminConfig{Listen: ":9090", Token: "secret", RedactHeaders: []string{"x-api-key"}}
+	})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	captureLogs(t)
+	handler := newHandler()
+
+	send := func(path string) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Api-Key", "hunter2")
+		req.Header.Set("X-Trace", "abc")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	send("/service1/before")
+	if rr := adminRequest(t, "POST", "/admin/capture?count=2"); rr.Code != http.StatusAccepted {
+		t.Fatalf("start capture status = %d, want %d", rr.Code, http.StatusAccepted)
+	}
+	send("/service1/one")
+	send("/service1/two")
+	send("/service1/three")
+
+	rr := adminRequest(t, "GET", "/admin/capture")
+	var got []capturedRequest
+	if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding captures: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("captured %d requests, want 2", len(got))
+	}
+	for i, path := range []string{"/service1/one", "/service1/two"} {
+		c := got[i]
+		if c.Method != "GET" || c.Path != path || c.Status != http.StatusTeapot {
+			t.Errorf("capture %d = %s %s %d, want GET %s %d", i, c.Method, c.Path, c.Status, path, http.StatusTeapot)
+		}
+		if v := c.Headers["X-Api-Key"]; len(v) != 1 || v[0] != "[REDACTED]" {
+			t.Errorf("capture %d X-Api-Key = %v, want redacted", i, v)
+		}
+		if v := c.Headers["X-Trace"]; len(v) != 1 || v[0] != "abc" {
+			t.Errorf("capture %d X-Trace = %v, want abc", i, v)
+		}
+	}
+}
+
+func TestCaptureExpires(t *testing.T) {
+	c := &captureBuffer{}
+	now := time.Now()
+	c.start(5, time.Minute, now)
+
+	if !c.reserve(now.Add(30 * time.Second)) {
+		t.Error("reserve before expiry = false, want true")
+	}
+	if c.reserve(now.Add(2 * time.Minute)) {
+		t.Error("reserve after expiry = true, want false")
+	}
+	if c.reserve(now.Add(30 * time.Second)) {
+		t.Error("reserve after expiring once = true, want false")
+	}
+}
+
+func TestRedactHeadersDefaults(t *testing.T) {
+	h := http.Header{"Authorization": {"Bearer x"}, "Cookie": {"a=b"}, "Accept": {"*/*"}}
+
+	got := redactHeaders(h, nil)
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if v := got[name]; len(v) != 1 || v[0] != "[REDACTED]" {
+			t.Errorf("%s = %v, want redacted", name, v)
+		}
+	}
+	if v := got["Accept"]; len(v) != 1 || v[0] != "*/*" {
+		t.Errorf("Accept = %v, want */*", v)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig gzips responses for clients that accept it, unless the
+// backend already encoded them.
+type CompressionConfig struct {
+	// Level is the gzip level, from 1 (fastest) to 9 (smallest). Defaults
+	// to 6, which trades CPU for bandwidth the way most servers do.
+	Level int `json:"level"`
+	// MinBytes leaves responses whose Content-Length is smaller than this
+	// uncompressed. Defaults to 1KiB; 0 compresses responses of any size.
+	MinBytes *int64 `json:"min_bytes"`
+	// ContentTypes lists the media types compressed, which may use subtype
+	// wildcards such as "text/*". Defaults to defaultCompressibleTypes.
+	ContentTypes []string `json:"content_types"`
+}
+
+const (
+	defaultCompressionLevel    = 6
+	defaultCompressionMinBytes = 1 << 10
+)
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func (cc CompressionConfig) validate() error {
+	if cc.Level != 0 && (cc.Level < gzip.BestSpeed || cc.Level > gzip.BestCompression) {
+		return fmt.Errorf("compression: level %d must be between %d and %d", cc.Level, gzip.BestSpeed, gzip.BestCompression)
+	}
+	if cc.MinBytes != nil && *cc.MinBytes < 0 {
+		return fmt.Errorf("compression: min_bytes must not be negative")
+	}
+	return nil
+}
+
+// level returns the gzip level to compress at.
+func (cc CompressionConfig) level() int {
+	if cc.Level == 0 {
+		return defaultCompressionLevel
+	}
+	return cc.Level
+}
+
+// minBytes returns the smallest Content-Length compressed.
+func (cc CompressionConfig) minBytes() int64 {
+	if cc.MinBytes == nil {
+		return defaultCompressionMinBytes
+	}
+	return *cc.MinBytes
+}
+
+// gzipWriters pools gzip writers by level, as each holds several hundred
+// KiB of compressor state.
+var gzipWriters [gzip.BestCompression + 1]sync.Pool
+
+func acquireGzipWriter(w io.Writer, level int) *gzip.Writer {
+	if gz, ok := gzipWriters[level].Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz
+	}
+	// The level is validated with the config, so this cannot fail.
+	gz, _ := gzip.NewWriterLevel(w, level)
+	return gz
+}
+
+func releaseGzipWriter(gz *gzip.Writer, level int) {
+	gz.Reset(io.Discard)
+	gzipWriters[level].Put(gz)
+}
+
+// compressMiddleware gzips responses when Config.Compression is set and
+// the client accepts gzip.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cc := stateFrom(r.Context()).config.Compression
+		if cc == nil || r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, cfg: cc, info: requestInfoFrom(r.Context())}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip. An
+// explicit gzip entry decides on its own; "*" only applies without one.
+func acceptsGzip(acceptEncoding string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		weight := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+			weight = v
+		}
+		if coding == "gzip" {
+			gzipQ = max(gzipQ, weight)
+		} else {
+			wildcardQ = max(wildcardQ, weight)
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
+
+// compressWriter decides whether to compress when the status is written,
+// then gzips the body as it passes through.
+type compressWriter struct {
+	http.ResponseWriter
+	cfg *CompressionConfig
+	// info, if set, receives the size of a compressed body before
+	// compression for the access log.
+	info        *requestInfo
+	gz          *gzip.Writer
+	written     int64
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if !cw.wroteHeader && code >= 200 {
+		cw.wroteHeader = true
+		if cw.compressible(code) {
+			h := cw.Header()
+			h.Del("Content-Length")
+			h.Set("Content-Encoding", "gzip")
+			h.Add("Vary", "Accept-Encoding")
+			// The compressed body is a different representation, so a
+			// strong validator no longer holds.
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+			cw.gz = acquireGzipWriter(cw.ResponseWriter, cw.cfg.level())
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// compressible reports whether the response with status code should be
+// compressed, judging by its headers.
+func (cw *compressWriter) compressible(code int) bool {
+	h := cw.Header()
+	switch {
+	case code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "" || strings.Contains(strings.ToLower(h.Get("Cache-Control")), "no-transform"):
+		return false
+	}
+	types := cw.cfg.ContentTypes
+	if len(types) == 0 {
+		types = defaultCompressibleTypes
+	}
+	if !contentTypeAllowed(h.Get("Content-Type"), types) {
+		return false
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		n, err := strconv.ParseInt(cl, 10, 64)
+		return err == nil && n >= cw.cfg.minBytes()
+	}
+	return true
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		n, err := cw.gz.Write(b)
+		cw.written += int64(n)
+		return n, err
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been compressed so far, so streamed responses keep
+// streaming.
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// close finishes the gzip stream, if the response was compressed.
+func (cw *compressWriter) close() {
+	if cw.gz == nil {
+		return
+	}
+	cw.gz.Close()
+	releaseGzipWriter(cw.gz, cw.cfg.level())
+	cw.gz = nil
+	if cw.info != nil {
+		cw.info.compressed = true
+		cw.info.uncompressedSize = cw.written
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+// for hijacking.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
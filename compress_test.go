@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// compressibleText returns n bytes of text with enough repetition for the
+// gzip levels to produce different output.
+func compressibleText(n int) []byte {
+	words := []string{"proxy", "backend", "route", "request", "response", "header", "timeout", "pool"}
+	rng := rand.New(rand.NewPCG(1, 2))
+	var b bytes.Buffer
+	for b.Len() < n {
+		b.WriteString(words[rng.IntN(len(words))])
+		b.WriteString(strconv.Itoa(rng.IntN(100)))
+		b.WriteByte(' ')
+	}
+	return b.Bytes()[:n]
+}
+
+func TestCompression_Level(t *testing.T) {
+	payload := compressibleText(64 << 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write(payload)
+	}))
+	defer backend.Close()
+
+	// The gzip header's XFL byte records the fastest and smallest levels.
+	tests := []struct {
+		level   int
+		wantXFL byte
+	}{
+		{0, 0},
+		{gzip.BestSpeed, 4},
+		{gzip.BestCompression, 2},
+	}
+	sizes := make(map[int]int)
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("level %d", tt.level), func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.Compression = &CompressionConfig{Level: tt.level} })
+			withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: backend.URL})
+			req := httptest.NewRequest("GET", "/api", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			routeMiddleware(compressMiddleware(newProxy())).ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Content-Encoding"); got != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", got)
+			}
+			compressed := rr.Body.Bytes()
+			if len(compressed) < 10 || compressed[8] != tt.wantXFL {
+				t.Errorf("gzip header = % x, want XFL %d", compressed[:min(len(compressed), 10)], tt.wantXFL)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if plain, err := io.ReadAll(gz); err != nil || !bytes.Equal(plain, payload) {
+				t.Errorf("decompressed body differs from the backend's (err %v)", err)
+			}
+			sizes[tt.level] = len(compressed)
+		})
+	}
+	if sizes[gzip.BestCompression] >= sizes[gzip.BestSpeed] {
+		t.Errorf("level 9 body is %d bytes, want smaller than level 1's %d", sizes[gzip.BestCompression], sizes[gzip.BestSpeed])
+	}
+}
+
+func TestCompression_Skipped(t *testing.T) {
+	payload := compressibleText(4 << 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range r.URL.Query() {
+			w.Header().Set(k, v[0])
+		}
+		w.Write(payload)
+	}))
+	defer backend.Close()
+	minBytes := int64(8 << 10)
+	withConfig(t, func(c *Config) { c.Compression = &CompressionConfig{MinBytes: &minBytes} })
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: backend.URL})
+	handler := routeMiddleware(compressMiddleware(newProxy()))
+
+	tests := []struct {
+		name           string
+		query          string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"compressible", "Content-Type=application/json", "gzip, br", "gzip"},
+		{"client refuses gzip", "Content-Type=application/json", "gzip;q=0, br", ""},
+		{"refusal overrides wildcard", "Content-Type=application/json", "gzip;q=0, *", ""},
+		{"wildcard", "Content-Type=application/json", "br, *;q=0.5", "gzip"},
+		{"no accept-encoding", "Content-Type=application/json", "", ""},
+		{"already encoded", "Content-Type=application/json&Content-Encoding=br", "gzip", "br"},
+		{"incompressible type", "Content-Type=image/png", "gzip", ""},
+		{"below min bytes", "Content-Type=application/json&Content-Length=4096", "gzip", ""},
+		{"no-transform", "Content-Type=application/json&Cache-Control=no-transform", "gzip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api?"+tt.query, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if got := rr.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			if tt.wantEncoding != "" {
+				return
+			}
+			if !bytes.Equal(rr.Body.Bytes(), payload) {
+				t.Errorf("body was altered")
+			}
+		})
+	}
+}
+
+func TestCompression_MinBytes(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("tiny"))
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: backend.URL})
+
+	zero := int64(0)
+	tests := []struct {
+		name         string
+		minBytes     *int64
+		wantEncoding string
+	}{
+		{"default", nil, ""},
+		{"zero compresses everything", &zero, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.Compression = &CompressionConfig{MinBytes: tt.minBytes} })
+			req := httptest.NewRequest("GET", "/api", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			routeMiddleware(compressMiddleware(newProxy())).ServeHTTP(rr, req)
+			if got := rr.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
+
+func TestCompression_LogsSizes(t *testing.T) {
+	payload := compressibleText(16 << 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(payload)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: backend.URL})
+	withConfig(t, func(c *Config) { c.Compression = &CompressionConfig{} })
+	logs := captureLogs(t)
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	routeMiddleware(loggingMiddleware(compressMiddleware(newProxy()))).ServeHTTP(rr, req)
+
+	entry := accessLog(t, logs)
+	if got := entry["response_size"]; got != float64(rr.Body.Len()) {
+		t.Errorf("response_size = %v, want the compressed %d", got, rr.Body.Len())
+	}
+	if got := entry["uncompressed_size"]; got != float64(len(payload)) || entry["compressed"] != true {
+		t.Errorf("uncompressed_size = %v (compressed %v), want %d", got, entry["compressed"], len(payload))
+	}
+}
+
+func TestCompressionConfig_Validate(t *testing.T) {
+	small, negative := int64(256), int64(-1)
+	for _, tt := range []struct {
+		cfg     CompressionConfig
+		wantErr string
+	}{
+		{CompressionConfig{}, ""},
+		{CompressionConfig{Level: 9, MinBytes: &small}, ""},
+		{CompressionConfig{Level: 10}, "level 10 must be between 1 and 9"},
+		{CompressionConfig{Level: -1}, "level -1 must be between 1 and 9"},
+		{CompressionConfig{MinBytes: &negative}, "min_bytes must not be negative"},
+	} {
+		err := tt.cfg.validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("validate(%+v) = %v, want %q", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func BenchmarkCompressionLevels(b *testing.B) {
+	payload := compressibleText(256 << 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(payload)
+	}))
+	defer backend.Close()
+	withRoutes(b, map[string]string{"/files": backend.URL})
+
+	for _, level := range []int{gzip.BestSpeed, gzip.BestCompression} {
+		b.Run(fmt.Sprintf("level %d", level), func(b *testing.B) {
+			withConfig(b, func(c *Config) { c.Compression = &CompressionConfig{Level: level} })
+			handler := compressMiddleware(newTestProxy())
+			req := httptest.NewRequest("GET", "/files", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			var size int
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+				size = rr.Body.Len()
+			}
+			b.ReportMetric(float64(size), "compressed-bytes")
+			b.ReportMetric(float64(size)/float64(len(payload)), "ratio")
+		})
+	}
+}
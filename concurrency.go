@@ -0,0 +1,141 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyConfig caps the requests a route serves at once, so one slow
+// route cannot tie up the proxy at the expense of the others.
+type ConcurrencyConfig struct {
+	// Max is the number of requests served at once.
+	Max int `json:"max"`
+	// Queue is the number of requests that may wait for a free slot once
+	// Max is reached. Others are rejected at once.
+	Queue int `json:"queue"`
+	// QueueTimeout is how long a queued request waits before it is
+	// rejected. Defaults to 1s.
+	QueueTimeout Duration `json:"queue_timeout"`
+}
+
+const defaultQueueTimeout = time.Second
+
+// concurrencyLimit is the semaphore of one route, with counters for the
+// admin API.
+type concurrencyLimit struct {
+	cfg   ConcurrencyConfig
+	slots chan struct{}
+
+	inFlight atomic.Int64
+	queued   atomic.Int64
+	rejected atomic.Uint64
+}
+
+func newConcurrencyLimit(cfg ConcurrencyConfig) *concurrencyLimit {
+	return &concurrencyLimit{cfg: cfg, slots: make(chan struct{}, cfg.Max)}
+}
+
+// acquire takes a slot, queueing for one if the queue has room. It reports
+// false if the request was rejected or gave up.
+func (l *concurrencyLimit) acquire(ctx context.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return true
+	default:
+	}
+	if l.queued.Add(1) > int64(l.cfg.Queue) {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return false
+	}
+	defer l.queued.Add(-1)
+
+	timer := time.NewTimer(cmp.Or(time.Duration(l.cfg.QueueTimeout), defaultQueueTimeout))
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		l.inFlight.Add(1)
+		return true
+	case <-timer.C:
+		l.rejected.Add(1)
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (l *concurrencyLimit) release() {
+	l.inFlight.Add(-1)
+	<-l.slots
+}
+
+// newRouteConcurrency builds the concurrency limits of rts, keeping the
+// limit in prev of each route whose config is unchanged, so requests in
+// flight across a reload keep counting against it.
+func newRouteConcurrency(rts []RouteConfig, prev map[string]*concurrencyLimit) map[string]*concurrencyLimit {
+	limits := make(map[string]*concurrencyLimit)
+	for _, rt := range rts {
+		if rt.Concurrency == nil {
+			continue
+		}
+		if l := prev[rt.Prefix]; l != nil && l.cfg == *rt.Concurrency {
+			limits[rt.Prefix] = l
+		} else {
+			limits[rt.Prefix] = newConcurrencyLimit(*rt.Concurrency)
+		}
+	}
+	return limits
+}
+
+// concurrencyMiddleware rejects requests with 503 once their route is
+// serving its maximum and its queue is full or the wait timed out.
+func concurrencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stateFrom(r.Context())
+		route, _ := routeMatchFrom(r.Context())
+		limit := s.routeConcurrency[route.Prefix]
+		if limit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !limit.acquire(r.Context()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "route at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		defer limit.release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// concurrencyStats is the admin view of a route's concurrency limit.
+type concurrencyStats struct {
+	Prefix   string `json:"prefix"`
+	Max      int    `json:"max"`
+	InFlight int64  `json:"in_flight"`
+	Queued   int64  `json:"queued"`
+	Rejected uint64 `json:"rejected"`
+}
+
+// concurrencyStatsHandler lists the current depth and rejection count of
+// every route with a concurrency limit.
+func concurrencyStatsHandler(w http.ResponseWriter, r *http.Request) {
+	limits := currentState().routeConcurrency
+	stats := make([]concurrencyStats, 0, len(limits))
+	for prefix, l := range limits {
+		stats = append(stats, concurrencyStats{
+			Prefix:   prefix,
+			Max:      l.cfg.Max,
+			InFlight: l.inFlight.Load(),
+			Queued:   l.queued.Load(),
+			Rejected: l.rejected.Load(),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Prefix < stats[j].Prefix })
+	writeJSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyMiddleware(t *testing.T) {
+	reached := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- struct{}{}
+		<-unblock
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/slow", Backend: slow.URL, Concurrency: &ConcurrencyConfig{Max: 2, Queue: 1, QueueTimeout: Duration(time.Minute)}},
+		RouteConfig{Prefix: "/fast", Backend: fast.URL, Concurrency: &ConcurrencyConfig{Max: 2}},
+	)
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	handler := routeMiddleware(concurrencyMiddleware(newProxy()))
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	// Saturate /slow: two requests in flight and one queued.
+	statuses := make(chan int, 3)
+	for range 2 {
+		go func() { statuses <- get("/slow") }()
+		<-reached
+	}
+	go func() { statuses <- get("/slow") }()
+	waitFor(t, func() bool { return currentState().routeConcurrency["/slow"].queued.Load() == 1 })
+
+	if got := get("/slow"); got != http.StatusServiceUnavailable {
+		t.Errorf("/slow over capacity status = %d, want 503", got)
+	}
+	for range 3 {
+		if got := get("/fast"); got != http.StatusOK {
+			t.Errorf("/fast status = %d while /slow is saturated, want 200", got)
+		}
+	}
+
+	var stats []concurrencyStats
+	if err := json.NewDecoder(adminRequest(t, "GET", "/admin/concurrency").Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	want := []concurrencyStats{
+		{Prefix: "/fast", Max: 2},
+		{Prefix: "/slow", Max: 2, InFlight: 2, Queued: 1, Rejected: 1},
+	}
+	if len(stats) != len(want) || stats[0] != want[0] || stats[1] != want[1] {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+
+	close(unblock)
+	for range 3 {
+		if got := <-statuses; got != http.StatusOK {
+			t.Errorf("/slow status = %d, want 200 for admitted and queued requests", got)
+		}
+	}
+}
+
+func TestConcurrencyMiddleware_QueueHoldsNoGlobalSlot(t *testing.T) {
+	reached := make(chan struct{}, 1)
+	unblock := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- struct{}{}
+		<-unblock
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+	captureLogs(t)
+	withAppliedConfig(t, func(c *Config) {
+		c.Concurrency = &ConcurrencyConfig{Max: 2}
+		c.Routes = []RouteConfig{
+			{Prefix: "/slow", Backend: slow.URL, Concurrency: &ConcurrencyConfig{Max: 1, Queue: 1, QueueTimeout: Duration(time.Minute)}},
+			{Prefix: "/fast", Backend: fast.URL},
+		}
+	})
+	handler := newHandler()
+	get := func(path string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	// One /slow request in flight and one queued for its route's slot.
+	statuses := make(chan int, 2)
+	go func() { statuses <- get("/slow") }()
+	<-reached
+	go func() { statuses <- get("/slow") }()
+	waitFor(t, func() bool { return currentState().routeConcurrency["/slow"].queued.Load() == 1 })
+
+	// The queued request holds no proxy-wide slot, so /fast gets the second.
+	if got := get("/fast"); got != http.StatusOK {
+		t.Errorf("/fast status = %d while /slow is queued, want 200", got)
+	}
+
+	close(unblock)
+	for range 2 {
+		if got := <-statuses; got != http.StatusOK {
+			t.Errorf("/slow status = %d, want 200", got)
+		}
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a second.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
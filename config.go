@@ -0,0 +1,863 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Config holds proxy-wide settings.
+type Config struct {
+	// Version is the config schema version. Configs without one are
+	// version 1.
+	Version int `json:"version"`
+
+	Listen string        `json:"listen"`
+	Routes []RouteConfig `json:"routes"`
+	TLS    TLSConfig     `json:"tls"`
+	Log    LogConfig     `json:"log"`
+	Admin  AdminConfig   `json:"admin"`
+	// Listener tunes the socket the proxy listens on.
+	Listener ListenerConfig `json:"listener"`
+
+	Backends map[string]BackendConfig `json:"backends"`
+	// HealthChecks paces the health checks of all backends.
+	HealthChecks HealthChecksConfig `json:"health_checks"`
+	// StartupTimeout bounds the wait for required routes' backends at
+	// startup, after which the proxy exits. Defaults to 60s.
+	StartupTimeout Duration `json:"startup_timeout"`
+
+	// SlowBackendThreshold logs a warning when a backend takes longer than
+	// this to return response headers. Zero disables the warning.
+	SlowBackendThreshold Duration `json:"slow_backend_threshold"`
+
+	// ForwardClientCert forwards the verified client certificate chain to
+	// backends in the X-Forwarded-Client-Cert header when mTLS is in use.
+	ForwardClientCert bool `json:"forward_client_cert"`
+	// ForwardPrefix sends the matched route prefix to backends in the
+	// X-Forwarded-Prefix header so they can build correct self-links.
+	ForwardPrefix bool `json:"forward_prefix"`
+	// ForwardClientPort sends the client's source port to backends in the
+	// X-Client-Port header, for correlating with their logs.
+	ForwardClientPort bool `json:"forward_client_port"`
+	// ForwardRequestStart sends the time the proxy received the request to
+	// backends in the X-Request-Start header, in NGINX's t=<seconds>.<ms>
+	// format, so they can measure time spent queueing.
+	ForwardRequestStart bool `json:"forward_request_start"`
+	// ForwardedFor is the policy for an inbound X-Forwarded-For header:
+	// replace (default), append, sanitize or drop.
+	ForwardedFor string `json:"forwarded_for"`
+
+	// DefaultHost is used as the Host of requests that arrive without one,
+	// as HTTP/1.0 clients may send them, or with a malformed one.
+	DefaultHost string `json:"default_host"`
+	// RequireHost rejects requests without a Host with 400 when no
+	// DefaultHost is set.
+	RequireHost bool `json:"require_host"`
+	// RejectMisdirected answers 421 Misdirected Request to HTTPS requests
+	// whose Host differs from the SNI name their connection was opened
+	// for, so clients reusing a connection across hosts open a new one.
+	RejectMisdirected bool `json:"reject_misdirected"`
+
+	// NormalizeMethods upper-cases standard request methods sent in the
+	// wrong case, such as "get", before routing.
+	NormalizeMethods bool `json:"normalize_methods"`
+	// RejectUnknownMethods rejects methods other than the standard ones
+	// with 501.
+	RejectUnknownMethods bool `json:"reject_unknown_methods"`
+	// AllowedMethods, when set, rejects every other method with 405.
+	AllowedMethods []string `json:"allowed_methods"`
+	// BlockedMethods rejects the listed methods, such as TRACE, with 405.
+	// It cannot be combined with AllowedMethods.
+	BlockedMethods []string `json:"blocked_methods"`
+	// Tunnel enables forward-proxy CONNECT tunnels to allow-listed hosts.
+	Tunnel TunnelConfig `json:"tunnel"`
+
+	// TrustedPeers lists the IP addresses and CIDR prefixes of peers that
+	// may pick a pool backend with the X-Proxy-Backend-Override header, set
+	// their request timeout with the X-Proxy-Timeout header and their
+	// priority class with the X-Proxy-Priority header.
+	TrustedPeers []string `json:"trusted_peers"`
+	// MaxRequestTimeout caps the timeout a trusted peer may request.
+	// Defaults to the standard request timeout.
+	MaxRequestTimeout Duration `json:"max_request_timeout"`
+
+	// DialFallbackDelay is how long a dial to a dual-stack backend waits on
+	// the preferred address family before also trying the other. Zero uses
+	// Go's default of 300ms; a negative delay dials the families in turn.
+	DialFallbackDelay Duration `json:"dial_fallback_delay"`
+
+	// CopyBufferSize is the size, in bytes, of the buffers used to copy
+	// response bodies to clients. Larger buffers mean fewer syscalls for
+	// large transfers. Defaults to 32KiB.
+	CopyBufferSize int `json:"copy_buffer_size"`
+
+	// MaxReplayBody is the largest request body, in bytes, buffered so a
+	// failed request can be retried. Larger bodies are streamed to the
+	// backend and not retried. Defaults to defaultMaxReplayBody.
+	MaxReplayBody int64 `json:"max_replay_body"`
+
+	// Concurrency caps the requests the proxy serves at once across all
+	// routes. Queued requests are admitted by priority class, and the
+	// least important are shed first.
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+
+	// MaxResponseHeaderBytes caps the size of backend response headers.
+	// Larger responses fail with 502. Defaults to 10MB.
+	MaxResponseHeaderBytes int64 `json:"max_response_header_bytes"`
+
+	// Transport tunes connection reuse and timeouts for backends.
+	Transport TransportConfig `json:"transport"`
+
+	// MaxConnsPerIP caps the connections a single client IP may hold open.
+	// Zero means unlimited.
+	MaxConnsPerIP int `json:"max_conns_per_ip"`
+
+	// CaseInsensitiveRoutes matches every route prefix regardless of case,
+	// as RouteConfig.CaseInsensitive does for one route.
+	CaseInsensitiveRoutes bool `json:"case_insensitive_routes"`
+	// DuplicateRoutes is the policy for routes sharing a prefix, as merged
+	// configs can produce: error (default) rejects the config, first keeps
+	// the earliest definition and last the latest.
+	DuplicateRoutes string `json:"duplicate_routes"`
+
+	// Tracing, when set, forwards W3C Trace Context to backends.
+	Tracing *TracingConfig `json:"tracing"`
+
+	// ServerHeader, when set, replaces the Server header of backend
+	// responses so backend software versions do not leak. An empty string
+	// removes it. Route response header rules apply after it.
+	ServerHeader *string `json:"server_header"`
+	// ProxyServerHeader is the Server header of responses the proxy
+	// generates itself, such as errors, health checks and static routes.
+	// Backend responses keep theirs, subject to ServerHeader.
+	ProxyServerHeader string `json:"proxy_server_header"`
+
+	// Compression, when set, gzips responses for clients that accept it.
+	Compression *CompressionConfig `json:"compression"`
+
+	// CollapseHeaders lists request headers forwarded to backends at most
+	// once, dropping repeated occurrences.
+	CollapseHeaders []CollapseHeaderConfig `json:"collapse_headers"`
+
+	// NoRoute customises the response to requests that match no route.
+	NoRoute *NoRouteConfig `json:"no_route"`
+	// BackendTLSError customises the response when the TLS handshake with
+	// a backend fails.
+	BackendTLSError *TLSErrorConfig `json:"backend_tls_error"`
+}
+
+// RouteConfig maps a path prefix to the backend that serves it, along with
+// any per-route options. A route sets either Backend, a Backends pool or a
+// Static response.
+type RouteConfig struct {
+	Prefix  string `json:"prefix"`
+	Backend string `json:"backend"`
+
+	// Static answers the route's requests at the proxy.
+	Static *StaticResponseConfig `json:"static"`
+
+	// CaseInsensitive matches the prefix regardless of case, e.g. for
+	// Windows-hosted services. The path is forwarded in its original case.
+	CaseInsensitive bool `json:"case_insensitive"`
+
+	// Backends is a pool of backends balanced by Strategy: round-robin
+	// (default), least-conn, weighted, random, ewma or consistent-hash.
+	// Members are replicas: each has its own host, and all share a path.
+	Backends []string `json:"backends"`
+	Strategy string   `json:"strategy"`
+
+	RateLimit *RateLimitConfig `json:"rate_limit"`
+	// AllowedContentTypes restricts the media types of request bodies.
+	// Empty allows any.
+	AllowedContentTypes []string `json:"allowed_content_types"`
+	// RequiredHeaders rejects requests missing any of the listed headers
+	// before they reach the backend.
+	RequiredHeaders *RequiredHeadersConfig `json:"required_headers"`
+	// DecompressRequests decompresses gzip and deflate request bodies before
+	// they are checked and forwarded, for backends that cannot. Bodies in
+	// other encodings are rejected with 415.
+	DecompressRequests bool `json:"decompress_requests"`
+	// AnswerOptions answers OPTIONS requests at the proxy with 204 and an
+	// Allow header listing the methods the method policy permits, for
+	// backends that do not handle OPTIONS. CORS preflights are answered
+	// the same way, without CORS headers.
+	AnswerOptions bool `json:"answer_options"`
+	// JSONLimits rejects JSON request bodies that are nested too deeply or
+	// contain arrays that are too long.
+	JSONLimits *JSONLimitsConfig `json:"json_limits"`
+	// Timeouts sets separate connect, first-byte and idle timeouts for the
+	// route's backend requests.
+	Timeouts *TimeoutsConfig `json:"timeouts"`
+	// SLA fails requests fast when the backend is slow to respond.
+	SLA *SLAConfig `json:"sla"`
+	// Quota caps the bytes each client may transfer through the route per
+	// window.
+	Quota *QuotaConfig `json:"quota"`
+	// Priority is the class of the route's requests under the proxy-wide
+	// concurrency limit: high, normal (default) or low.
+	Priority string `json:"priority"`
+	// ConcurrencyWeight is the route's share of queued admissions under
+	// the proxy-wide concurrency limit, relative to other routes of the
+	// same priority class. Defaults to 1.
+	ConcurrencyWeight int `json:"concurrency_weight"`
+	// Concurrency caps the requests the route serves at once.
+	Concurrency *ConcurrencyConfig `json:"concurrency"`
+	// CircuitBreaker fails requests fast while the route's backends keep
+	// failing.
+	CircuitBreaker *CircuitBreakerConfig `json:"circuit_breaker"`
+	// Retry resends requests that fail in the configured ways.
+	Retry *RetryConfig `json:"retry"`
+	// AllowedStatuses lists the backend response statuses passed to
+	// clients, as exact codes such as "404" or classes such as "2xx". Any
+	// other status is logged and answered with 502. Empty allows all.
+	AllowedStatuses []string `json:"allowed_statuses"`
+	// DisableKeepAlives opens a new backend connection for every request of
+	// the route, for backends that mishandle keep-alive. Other routes to the
+	// same backend still reuse connections.
+	DisableKeepAlives bool `json:"disable_keep_alives"`
+	// Upgrades lists the protocols, such as websocket, that clients may
+	// switch to with an Upgrade request. Empty allows any protocol the
+	// backend agrees to; other upgrade requests are sent as plain requests.
+	Upgrades []string `json:"upgrades"`
+	// ResponseHeaders overrides headers of the route's backend responses.
+	ResponseHeaders *HeaderRulesConfig `json:"response_headers"`
+	// Trailers lists the response trailers, such as Grpc-Status, forwarded
+	// to clients. Empty forwards every trailer the backend sends.
+	Trailers []string `json:"trailers"`
+	// Log adds request and response headers to the route's access log.
+	Log *RouteLogConfig `json:"log"`
+	// Rewrites adjust outbound headers and paths with simple expressions.
+	Rewrites []RewriteRuleConfig `json:"rewrites"`
+	// Canary sends matching requests to a canary backend, bypassing the
+	// route's backend or pool.
+	Canary *CanaryConfig `json:"canary"`
+	// BodyRoute sends JSON requests to a backend picked by a value in
+	// their body, bypassing the route's backend or pool.
+	BodyRoute *BodyRouteConfig `json:"body_route"`
+	// Mirror copies the route's requests to a shadow backend.
+	Mirror *MirrorConfig `json:"mirror"`
+	// Required makes the proxy wait at startup, before it listens, until
+	// the route's backend, or one member of its pool, is reachable.
+	Required bool `json:"required"`
+	// RequestID is the policy for the inbound X-Request-ID header:
+	// generate-if-absent (default), trust or regenerate.
+	RequestID string `json:"request_id"`
+	// UpstreamLatency reports the backend's response time to clients in
+	// the X-Upstream-Latency-Ms header: to trusted peers only, or to all
+	// clients. Off by default.
+	UpstreamLatency string `json:"upstream_latency"`
+}
+
+// TLSConfig configures the inbound TLS listener. Setting ClientCAFile turns
+// on mTLS: clients must present a certificate signed by one of those CAs.
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// Duration is a time.Duration that decodes from JSON strings such as "5s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"5s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func defaultConfig() *Config {
+	return &Config{Version: 1, Listen: ":8080"}
+}
+
+// configVersion is the newest config schema version this build supports.
+const configVersion = 2
+
+// versionDefaults changes the defaults of each schema version after 1.
+// Older configs keep the defaults they were written against.
+var versionDefaults = map[int]func(c *Config){
+	// Version 2 sends backends the stripped route prefix, which they
+	// need to build correct self-links.
+	2: func(c *Config) { c.ForwardPrefix = true },
+}
+
+// defaultConfigFor returns the defaults for a config of the given schema
+// version.
+func defaultConfigFor(version int) (*Config, error) {
+	if version < 1 || version > configVersion {
+		return nil, fmt.Errorf("unsupported config version %d (supported: 1 to %d)", version, configVersion)
+	}
+	cfg := defaultConfig()
+	for v := 2; v <= version; v++ {
+		versionDefaults[v](cfg)
+	}
+	cfg.Version = version
+	return cfg, nil
+}
+
+// loadConfig reads and validates the JSON config file at path.
+func loadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var header struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	cfg, err := defaultConfigFor(cmp.Or(header.Version, 1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	cfg.Version = cmp.Or(cfg.Version, 1)
+	// Clients send methods upper-case, and they are matched exactly.
+	cfg.AllowedMethods = upperAll(cfg.AllowedMethods)
+	cfg.BlockedMethods = upperAll(cfg.BlockedMethods)
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cfg.resolveDuplicateRoutes()
+	return cfg, nil
+}
+
+// upperAll returns ss upper-cased.
+func upperAll(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	upper := make([]string, len(ss))
+	for i, s := range ss {
+		upper[i] = strings.ToUpper(s)
+	}
+	return upper
+}
+
+// Policies for Config.DuplicateRoutes.
+const (
+	duplicateRoutesError = "error"
+	duplicateRoutesFirst = "first"
+	duplicateRoutesLast  = "last"
+)
+
+// duplicatePrefixes returns the prefixes of routes defined more than once,
+// in the order they first appear.
+func (c *Config) duplicatePrefixes() []string {
+	seen := make(map[string]int, len(c.Routes))
+	var dups []string
+	for _, rt := range c.Routes {
+		seen[rt.Prefix]++
+		if seen[rt.Prefix] == 2 {
+			dups = append(dups, rt.Prefix)
+		}
+	}
+	return dups
+}
+
+// resolveDuplicateRoutes keeps one route per prefix, the first or last
+// definition as the DuplicateRoutes policy says, logging each one dropped.
+// Kept routes stay in their original order.
+func (c *Config) resolveDuplicateRoutes() {
+	if len(c.duplicatePrefixes()) == 0 {
+		return
+	}
+	keep := make(map[string]int, len(c.Routes))
+	for i, rt := range c.Routes {
+		if _, ok := keep[rt.Prefix]; !ok || c.DuplicateRoutes == duplicateRoutesLast {
+			keep[rt.Prefix] = i
+		}
+	}
+	resolved := make([]RouteConfig, 0, len(keep))
+	for i, rt := range c.Routes {
+		if keep[rt.Prefix] != i {
+			slog.Warn("ignoring duplicate route", "route", rt.Prefix, "index", i, "policy", c.DuplicateRoutes)
+			continue
+		}
+		resolved = append(resolved, rt)
+	}
+	c.Routes = resolved
+}
+
+// validate reports every problem found in the config, not just the first.
+func (c *Config) validate() error {
+	var errs []error
+	for i, rt := range c.Routes {
+		if !strings.HasPrefix(rt.Prefix, "/") || (len(rt.Prefix) > 1 && strings.HasSuffix(rt.Prefix, "/")) {
+			errs = append(errs, fmt.Errorf("route %d: prefix %q must start with / and not end with /", i, rt.Prefix))
+		}
+		switch {
+		case rt.Static != nil:
+			if rt.Backend != "" || len(rt.Backends) > 0 {
+				errs = append(errs, fmt.Errorf("route %q: a static route has no backend", rt.Prefix))
+			}
+			if rt.Required {
+				errs = append(errs, fmt.Errorf("route %q: a static route has no backend to require", rt.Prefix))
+			}
+			if err := rt.Static.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		case rt.Backend != "" && len(rt.Backends) > 0:
+			errs = append(errs, fmt.Errorf("route %q: set backend or backends, not both", rt.Prefix))
+		case len(rt.Backends) > 0:
+			for _, b := range rt.Backends {
+				if err := validateBackendURL(b); err != nil {
+					errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+				}
+			}
+			if _, err := newBalancer(rt.Strategy, nil); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		default:
+			if err := validateBackendURL(rt.Backend); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		}
+		if rt.RateLimit != nil && (rt.RateLimit.RequestsPerSecond <= 0 || rt.RateLimit.Burst < 0) {
+			errs = append(errs, fmt.Errorf("route %q: rate_limit needs a positive rps and a non-negative burst", rt.Prefix))
+		}
+		if rt.SLA != nil && rt.SLA.Timeout <= 0 {
+			errs = append(errs, fmt.Errorf("route %q: sla needs a positive timeout", rt.Prefix))
+		}
+		for _, p := range rt.AllowedStatuses {
+			if !validStatusPattern(p) {
+				errs = append(errs, fmt.Errorf("route %q: invalid allowed status %q", rt.Prefix, p))
+			}
+		}
+		if q := rt.Quota; q != nil && (q.Bytes <= 0 || q.Window <= 0) {
+			errs = append(errs, fmt.Errorf("route %q: quota needs positive bytes and window", rt.Prefix))
+		}
+		if cc := rt.Concurrency; cc != nil && (cc.Max < 1 || cc.Queue < 0 || cc.QueueTimeout < 0) {
+			errs = append(errs, fmt.Errorf("route %q: concurrency needs a positive max and a non-negative queue and queue_timeout", rt.Prefix))
+		}
+		if rt.ConcurrencyWeight < 0 {
+			errs = append(errs, fmt.Errorf("route %q: concurrency_weight must not be negative", rt.Prefix))
+		}
+		if rt.Priority != "" && !slices.Contains(priorities, rt.Priority) {
+			errs = append(errs, fmt.Errorf("route %q: unknown priority %q", rt.Prefix, rt.Priority))
+		}
+		if cb := rt.CircuitBreaker; cb != nil && (cb.Failures < 1 || cb.Cooldown < 0) {
+			errs = append(errs, fmt.Errorf("route %q: circuit_breaker needs at least 1 failure and a non-negative cooldown", rt.Prefix))
+		}
+		if cb := rt.CircuitBreaker; cb != nil && cb.Fallback != nil && !slices.Contains(lastGoodStorePolicies, cb.Fallback.Store) {
+			errs = append(errs, fmt.Errorf("route %q: circuit_breaker: unknown fallback store policy %q", rt.Prefix, cb.Fallback.Store))
+		}
+		if rt.ResponseHeaders != nil {
+			if err := rt.ResponseHeaders.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: response_headers: %w", rt.Prefix, err))
+			}
+		}
+		for _, name := range rt.Trailers {
+			if err := validateHeaderName(name); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: trailers: %w", rt.Prefix, err))
+			}
+		}
+		if rt.Retry != nil {
+			if err := rt.Retry.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		}
+		if rt.RequiredHeaders != nil {
+			if err := rt.RequiredHeaders.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		}
+		if rt.Mirror != nil {
+			if err := rt.Mirror.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		}
+		if rt.BodyRoute != nil {
+			if err := rt.BodyRoute.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("route %q: %w", rt.Prefix, err))
+			}
+		}
+		if !slices.Contains(upstreamLatencyPolicies, rt.UpstreamLatency) {
+			errs = append(errs, fmt.Errorf("route %q: unknown upstream_latency policy %q", rt.Prefix, rt.UpstreamLatency))
+		}
+		if !slices.Contains(requestIDPolicies, rt.RequestID) {
+			errs = append(errs, fmt.Errorf("route %q: unknown request_id policy %q", rt.Prefix, rt.RequestID))
+		}
+	}
+	// A case-insensitive route also matches every prefix that differs from
+	// its own only in case, so no other route may use one.
+	folded := make(map[string][]RouteConfig)
+	for _, rt := range c.Routes {
+		key := strings.ToLower(rt.Prefix)
+		for _, other := range folded[key] {
+			if other.Prefix != rt.Prefix && (c.CaseInsensitiveRoutes || rt.CaseInsensitive || other.CaseInsensitive) {
+				errs = append(errs, fmt.Errorf("route %q: differs only in case from route %q, which is matched regardless of case", rt.Prefix, other.Prefix))
+				break
+			}
+		}
+		folded[key] = append(folded[key], rt)
+	}
+	// Pooled backends keep their runtime state by scheme and host, and a
+	// failover moves a request to another member by swapping only those.
+	pooled := make(map[string]string)
+	for _, rt := range c.Routes {
+		var first *url.URL
+		for _, raw := range rt.Backends {
+			u, err := url.Parse(raw)
+			if err != nil {
+				continue
+			}
+			if other, ok := pooled[backendKey(u)]; ok && other != raw {
+				errs = append(errs, fmt.Errorf("route %q: pooled backend %q shares its host with %q", rt.Prefix, raw, other))
+			} else {
+				pooled[backendKey(u)] = raw
+			}
+			if first == nil {
+				first = u
+			} else if strings.TrimSuffix(u.Path, "/") != strings.TrimSuffix(first.Path, "/") || u.RawQuery != first.RawQuery {
+				errs = append(errs, fmt.Errorf("route %q: pooled backends %q and %q differ in path", rt.Prefix, rt.Backends[0], raw))
+			}
+		}
+	}
+	for backend, bc := range c.Backends {
+		if err := validateBackendURL(backend); err != nil {
+			errs = append(errs, fmt.Errorf("backends: %w", err))
+		}
+		if bc.Weight < 0 {
+			errs = append(errs, fmt.Errorf("backends: %q: weight must not be negative", backend))
+		}
+		if bc.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("backends: %q: timeout must not be negative", backend))
+		}
+		if bc.Proxy != "" {
+			if err := validateProxyURL(bc.Proxy); err != nil {
+				errs = append(errs, fmt.Errorf("backends: %q: %w", backend, err))
+			}
+		}
+		if bc.HTTPFallback != "" {
+			if err := validateHTTPFallback(backend, bc.HTTPFallback); err != nil {
+				errs = append(errs, fmt.Errorf("backends: %q: %w", backend, err))
+			}
+		}
+		if bc.HealthCheck != nil {
+			if err := bc.HealthCheck.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("backends: %q: %w", backend, err))
+			}
+		}
+		if bc.Fuse != nil {
+			if err := bc.Fuse.validate(); err != nil {
+				errs = append(errs, fmt.Errorf("backends: %q: %w", backend, err))
+			}
+		}
+	}
+	if err := c.HealthChecks.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.MaxResponseHeaderBytes < 0 {
+		errs = append(errs, errors.New("max_response_header_bytes must not be negative"))
+	}
+	for _, ch := range c.CollapseHeaders {
+		if err := ch.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Transport.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newBackendTransports(c); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newRouteRewriteRules(c.Routes); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := newRouteCanaries(c.Routes); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Admin.Listen != "" && c.Admin.Token == "" {
+		errs = append(errs, errors.New("admin: token is required when listen is set"))
+	}
+	for _, peer := range c.TrustedPeers {
+		if _, err := parsePeer(peer); err != nil {
+			errs = append(errs, fmt.Errorf("trusted_peers: %w", err))
+		}
+	}
+	if c.Tracing != nil {
+		if err := c.Tracing.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.ServerHeader != nil && strings.ContainsAny(*c.ServerHeader, "\r\n") {
+		errs = append(errs, errors.New("server_header must not contain line breaks"))
+	}
+	if strings.ContainsAny(c.ProxyServerHeader, "\r\n") {
+		errs = append(errs, errors.New("proxy_server_header must not contain line breaks"))
+	}
+	if cc := c.Concurrency; cc != nil && (cc.Max < 1 || cc.Queue < 0 || cc.QueueTimeout < 0) {
+		errs = append(errs, errors.New("concurrency needs a positive max and a non-negative queue and queue_timeout"))
+	}
+	if len(c.AllowedMethods) > 0 && len(c.BlockedMethods) > 0 {
+		errs = append(errs, errors.New("allowed_methods and blocked_methods cannot both be set"))
+	}
+	blank := func(method string) bool { return strings.TrimSpace(method) == "" }
+	if slices.ContainsFunc(c.AllowedMethods, blank) {
+		errs = append(errs, errors.New("allowed_methods must not contain empty methods"))
+	}
+	if slices.ContainsFunc(c.BlockedMethods, blank) {
+		errs = append(errs, errors.New("blocked_methods must not contain empty methods"))
+	}
+	if slices.Contains(c.AllowedMethods, http.MethodConnect) && !c.Tunnel.Enabled() {
+		errs = append(errs, errors.New("allowed_methods: CONNECT requires tunnel allowed_hosts"))
+	}
+	if err := c.Tunnel.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.CopyBufferSize < 0 {
+		errs = append(errs, errors.New("copy_buffer_size must not be negative"))
+	}
+	if c.MaxReplayBody < 0 {
+		errs = append(errs, errors.New("max_replay_body must not be negative"))
+	}
+	if c.MaxConnsPerIP < 0 {
+		errs = append(errs, errors.New("max_conns_per_ip must not be negative"))
+	}
+	if c.NoRoute != nil && c.NoRoute.Status != 0 && (c.NoRoute.Status < 100 || c.NoRoute.Status > 599) {
+		errs = append(errs, fmt.Errorf("no_route: invalid status %d", c.NoRoute.Status))
+	}
+	if c.BackendTLSError != nil && c.BackendTLSError.Status != 0 && (c.BackendTLSError.Status < 100 || c.BackendTLSError.Status > 599) {
+		errs = append(errs, fmt.Errorf("backend_tls_error: invalid status %d", c.BackendTLSError.Status))
+	}
+	if c.StartupTimeout < 0 {
+		errs = append(errs, errors.New("startup_timeout must not be negative"))
+	}
+	if !slices.Contains(forwardedForPolicies, c.ForwardedFor) {
+		errs = append(errs, fmt.Errorf("forwarded_for: unknown policy %q", c.ForwardedFor))
+	}
+	switch c.DuplicateRoutes {
+	case "", duplicateRoutesError:
+		for _, prefix := range c.duplicatePrefixes() {
+			errs = append(errs, fmt.Errorf("route %q: defined more than once", prefix))
+		}
+	case duplicateRoutesFirst, duplicateRoutesLast:
+	default:
+		errs = append(errs, fmt.Errorf("duplicate_routes: unknown policy %q", c.DuplicateRoutes))
+	}
+	if c.Compression != nil {
+		if err := c.Compression.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := c.Listener.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := c.Log.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	for k := range c.Log.Attributes {
+		if slices.Contains(logFields, k) {
+			errs = append(errs, fmt.Errorf("log: attribute %q clashes with a built-in log field", k))
+		}
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls: cert_file and key_file must be set together"))
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		errs = append(errs, errors.New("tls: client_ca_file requires cert_file and key_file"))
+	}
+	return errors.Join(errs...)
+}
+
+func validateBackendURL(backend string) error {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return fmt.Errorf("invalid backend URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("backend %q must be an absolute http or https URL", backend)
+	}
+	return nil
+}
+
+// routeTable returns the prefix -> backend map used for route matching.
+func (c *Config) routeTable() map[string]string {
+	table := make(map[string]string, len(c.Routes))
+	for _, rt := range c.Routes {
+		table[rt.Prefix] = rt.Backend
+	}
+	return table
+}
+
+// routesByPrefix indexes rts by prefix. Of routes sharing a prefix, which
+// loadConfig has already resolved, the first wins.
+func routesByPrefix(rts []RouteConfig) map[string]*RouteConfig {
+	byPrefix := make(map[string]*RouteConfig, len(rts))
+	for i := range rts {
+		if _, ok := byPrefix[rts[i].Prefix]; !ok {
+			byPrefix[rts[i].Prefix] = &rts[i]
+		}
+	}
+	return byPrefix
+}
+
+// configMu serializes applyConfig, so each reload builds on the state the
+// one before it published.
+var configMu sync.Mutex
+
+// applyConfig makes cfg the active configuration.
+func applyConfig(cfg *Config) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	prev := currentState()
+
+	transports, err := newBackendTransports(cfg)
+	if err != nil {
+		return err
+	}
+	pools, states, err := newRoutePools(cfg, prev.backendStates)
+	if err != nil {
+		return err
+	}
+	rewriteRules, err := newRouteRewriteRules(cfg.Routes)
+	if err != nil {
+		return err
+	}
+	canaries, err := newRouteCanaries(cfg.Routes)
+	if err != nil {
+		return err
+	}
+	next := &proxyState{
+		config:            cfg,
+		routes:            cfg.routeTable(),
+		routeConfigs:      routesByPrefix(cfg.Routes),
+		routePools:        pools,
+		backendStates:     states,
+		routeCanaries:     canaries,
+		routeRewriteRules: rewriteRules,
+		routeLimiters:     newRouteLimiters(cfg.Routes, prev.routeLimiters),
+		routeBreakers:     newRouteBreakers(cfg.Routes, prev.routeBreakers),
+		routeConcurrency:  newRouteConcurrency(cfg.Routes, prev.routeConcurrency),
+		routeQuotas:       newRouteQuotas(cfg.Routes, prev.routeQuotas),
+		routeErrorRates:   newRouteErrorRates(cfg.Routes, prev.routeErrorRates),
+		routeMirrors:      newRouteMirrors(cfg.Routes, prev.routeMirrors),
+		backendTransports: transports,
+		backendTimeouts:   newBackendTimeouts(cfg.Backends),
+		backendFallbacks:  newBackendFallbacks(cfg.Backends),
+		backendDialer:     newDialer(time.Duration(cfg.DialFallbackDelay)),
+	}
+	if cfg.Concurrency != nil {
+		next.globalConcurrency = prev.globalConcurrency
+		if l := prev.globalConcurrency; l == nil || l.cfg != *cfg.Concurrency {
+			next.globalConcurrency = newPriorityLimit(*cfg.Concurrency)
+		}
+	}
+	next.caseInsensitiveRoutes = make(map[string]string)
+	for _, rt := range cfg.Routes {
+		if cfg.CaseInsensitiveRoutes || rt.CaseInsensitive {
+			next.caseInsensitiveRoutes[strings.ToLower(rt.Prefix)] = rt.Prefix
+		}
+	}
+
+	next.defaultTransport = prev.defaultTransport
+	if base := newBaseTransport(cfg); !sameTransportSettings(prev.defaultTransport, base) {
+		next.defaultTransport = base
+	}
+	copyBuffers.size.Store(int64(cmp.Or(cfg.CopyBufferSize, defaultCopyBufferSize)))
+	activeState.Store(next)
+	drainRemovedBackends(prev, next, cmp.Or(time.Duration(cfg.Transport.DrainTimeout), defaultBackendDrainTimeout))
+	if prev.defaultTransport != next.defaultTransport {
+		prev.defaultTransport.CloseIdleConnections()
+	}
+
+	applyLogSink(cfg.Log)
+
+	stopHealthChecks()
+	stopHealthChecks = startHealthChecks(cfg, states)
+	return nil
+}
+
+// runCheck validates the config at path and prints the resolved routing
+// table to out. It returns the process exit code.
+func runCheck(path string, out io.Writer) int {
+	if path == "" {
+		fmt.Fprintln(out, "config check failed: no config file given (use -config)")
+		return 1
+	}
+	cfg, err := loadConfig(path)
+	if err != nil {
+		fmt.Fprintf(out, "config check failed:\n%v\n", err)
+		return 1
+	}
+
+	table := cfg.routeTable()
+	byPrefix := routesByPrefix(cfg.Routes)
+	prefixes := make([]string, 0, len(table))
+	for prefix := range table {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tBACKEND")
+	for _, prefix := range prefixes {
+		backend := table[prefix]
+		if rt := byPrefix[prefix]; len(rt.Backends) > 0 {
+			strategy := cmp.Or(rt.Strategy, defaultStrategy)
+			backend = fmt.Sprintf("%s (%s)", strings.Join(rt.Backends, ", "), strategy)
+		} else if rt.Static != nil {
+			backend = fmt.Sprintf("static %d", cmp.Or(rt.Static.Status, http.StatusOK))
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", prefix, backend)
+	}
+	tw.Flush()
+	fmt.Fprintln(out, "config OK")
+	return 0
+}
+
+// Enabled reports whether the listener should serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// serverTLSConfig builds the tls.Config for the inbound listener.
+func (c TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if c.ClientCAFile != "" {
+		pem, err := os.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
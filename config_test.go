@@ -0,0 +1,316 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes contents to a temporary config file and returns its path.
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRunCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantCode int
+		wantOut  string
+	}{
+		{
+			name: "valid config",
+			config: `{"routes": [
+				{"prefix": "/service1", "backend": "http://localhost:8081"},
+				{"prefix": "/api", "backend": "https://api.internal:8443"}
+			]}`,
+			wantCode: 0,
+			wantOut:  "/service1  http://localhost:8081",
+		},
+		{
+			name:     "malformed JSON",
+			config:   `{"routes": [`,
+			wantCode: 1,
+			wantOut:  "config check failed",
+		},
+		{
+			name:     "unknown field",
+			config:   `{"rotues": []}`,
+			wantCode: 1,
+			wantOut:  "unknown field",
+		},
+		{
+			name:     "relative backend URL",
+			config:   `{"routes": [{"prefix": "/service1", "backend": "localhost:8081"}]}`,
+			wantCode: 1,
+			wantOut:  "must be an absolute http or https URL",
+		},
+		{
+			name: "case-insensitive routes differing only in case",
+			config: `{"routes": [
+				{"prefix": "/api", "backend": "http://localhost:8081", "case_insensitive": true},
+				{"prefix": "/API", "backend": "http://localhost:8082"}
+			]}`,
+			wantCode: 1,
+			wantOut:  "differs only in case",
+		},
+		{
+			name: "globally case-insensitive routes differing only in case",
+			config: `{"case_insensitive_routes": true, "routes": [
+				{"prefix": "/api", "backend": "http://localhost:8081"},
+				{"prefix": "/Api", "backend": "http://localhost:8082"}
+			]}`,
+			wantCode: 1,
+			wantOut:  "differs only in case",
+		},
+		{
+			name: "case-sensitive routes differing only in case",
+			config: `{"routes": [
+				{"prefix": "/api", "backend": "http://localhost:8081"},
+				{"prefix": "/API", "backend": "http://localhost:8082"}
+			]}`,
+			wantCode: 0,
+			wantOut:  "config OK",
+		},
+		{
+			name:     "unknown last-good store policy",
+			config:   `{"routes": [{"prefix": "/api", "backend": "http://localhost:8081", "circuit_breaker": {"failures": 1, "fallback": {"last_good": true, "store": "both"}}}]}`,
+			wantCode: 1,
+			wantOut:  "unknown fallback store policy",
+		},
+		{
+			name:     "pooled backends sharing a host",
+			config:   `{"routes": [{"prefix": "/api", "backends": ["http://h:8081/a", "http://h:8081/b"]}]}`,
+			wantCode: 1,
+			wantOut:  "shares its host",
+		},
+		{
+			name: "pooled backends sharing a host across routes",
+			config: `{"routes": [
+				{"prefix": "/a", "backends": ["http://h:8081/a"]},
+				{"prefix": "/b", "backends": ["http://h:8081/b"]}
+			]}`,
+			wantCode: 1,
+			wantOut:  "shares its host",
+		},
+		{
+			name:     "pooled backends differing in path",
+			config:   `{"routes": [{"prefix": "/api", "backends": ["http://a:8081/v1", "http://b:8081/v2"]}]}`,
+			wantCode: 1,
+			wantOut:  "differ in path",
+		},
+		{
+			name:     "pooled replicas",
+			config:   `{"routes": [{"prefix": "/api", "backends": ["http://a:8081/v1", "http://b:8081/v1/"]}]}`,
+			wantCode: 0,
+			wantOut:  "config OK",
+		},
+		{
+			name:     "prefix without leading slash",
+			config:   `{"routes": [{"prefix": "service1", "backend": "http://localhost:8081"}]}`,
+			wantCode: 1,
+			wantOut:  "must start with /",
+		},
+		{
+			name:     "client CA without server cert",
+			config:   `{"tls": {"client_ca_file": "ca.pem"}}`,
+			wantCode: 1,
+			wantOut:  "client_ca_file requires",
+		},
+		{
+			name:     "unknown request_id policy",
+			config:   `{"routes": [{"prefix": "/api", "backend": "http://localhost:8081", "request_id": "keep"}]}`,
+			wantCode: 1,
+			wantOut:  "unknown request_id policy",
+		},
+		{
+			name:     "unknown retry failure class",
+			config:   `{"routes": [{"prefix": "/api", "backend": "http://localhost:8081", "retry": {"attempts": 2, "on": ["4xx"]}}]}`,
+			wantCode: 1,
+			wantOut:  "unknown failure class",
+		},
+		{
+			name:     "invalid allowed status",
+			config:   `{"routes": [{"prefix": "/api", "backend": "http://localhost:8081", "allowed_statuses": ["2xx", "20"]}]}`,
+			wantCode: 1,
+			wantOut:  `invalid allowed status "20"`,
+		},
+		{
+			name:     "allowed and blocked methods",
+			config:   `{"allowed_methods": ["GET"], "blocked_methods": ["TRACE"]}`,
+			wantCode: 1,
+			wantOut:  "cannot both be set",
+		},
+		{
+			name:     "empty allowed method",
+			config:   `{"allowed_methods": ["GET", ""]}`,
+			wantCode: 1,
+			wantOut:  "allowed_methods must not contain empty methods",
+		},
+		{
+			name:     "blank blocked method",
+			config:   `{"blocked_methods": [" "]}`,
+			wantCode: 1,
+			wantOut:  "blocked_methods must not contain empty methods",
+		},
+		{
+			name:     "lower-case CONNECT needs a tunnel",
+			config:   `{"allowed_methods": ["get", "connect"]}`,
+			wantCode: 1,
+			wantOut:  "CONNECT requires tunnel allowed_hosts",
+		},
+		{
+			name:     "invalid response header name",
+			config:   `{"routes": [{"prefix": "/api", "backend": "http://localhost:8081", "response_headers": {"set": {"Bad Header": ["x"]}}}]}`,
+			wantCode: 1,
+			wantOut:  `invalid header name "Bad Header"`,
+		},
+		{
+			name:     "admin listener without token",
+			config:   `{"admin": {"listen": ":9090"}}`,
+			wantCode: 1,
+			wantOut:  "token is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			code := runCheck(writeConfig(t, tt.config), &out)
+			if code != tt.wantCode {
+				t.Errorf("exit code = %d, want %d (output: %s)", code, tt.wantCode, out.String())
+			}
+			if !strings.Contains(out.String(), tt.wantOut) {
+				t.Errorf("output = %q, want it to contain %q", out.String(), tt.wantOut)
+			}
+		})
+	}
+}
+
+func TestRunCheck_MissingFile(t *testing.T) {
+	var out strings.Builder
+	if code := runCheck(filepath.Join(t.TempDir(), "missing.json"), &out); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if code := runCheck("", &out); code != 1 {
+		t.Errorf("exit code without -config = %d, want 1", code)
+	}
+}
+
+func TestDurationUnmarshalJSON(t *testing.T) {
+	path := writeConfig(t, `{"slow_backend_threshold": "750ms"}`)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := time.Duration(cfg.SlowBackendThreshold); got != 750*time.Millisecond {
+		t.Errorf("SlowBackendThreshold = %v, want 750ms", got)
+	}
+
+	if _, err := loadConfig(writeConfig(t, `{"slow_backend_threshold": 5}`)); err == nil {
+		t.Error("loadConfig accepted a bare number as a duration")
+	}
+}
+
+func TestLoadConfig_Versions(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            string
+		wantVersion       int
+		wantForwardPrefix bool
+		wantErr           string
+	}{
+		{"unversioned is v1", `{}`, 1, false, ""},
+		{"v1", `{"version": 1}`, 1, false, ""},
+		{"v2 defaults", `{"version": 2}`, 2, true, ""},
+		{"v2 explicit override", `{"version": 2, "forward_prefix": false}`, 2, false, ""},
+		{"future version", `{"version": 99}`, 0, false, "unsupported config version 99"},
+		{"negative version", `{"version": -1}`, 0, false, "unsupported config version -1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfig(t, tt.config))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			if cfg.Version != tt.wantVersion {
+				t.Errorf("Version = %d, want %d", cfg.Version, tt.wantVersion)
+			}
+			if cfg.ForwardPrefix != tt.wantForwardPrefix {
+				t.Errorf("ForwardPrefix = %v, want %v", cfg.ForwardPrefix, tt.wantForwardPrefix)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_UpperCasesMethods(t *testing.T) {
+	cfg, err := loadConfig(writeConfig(t, `{"allowed_methods": ["get", "Post"]}`))
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if want := []string{"GET", "POST"}; !slices.Equal(cfg.AllowedMethods, want) {
+		t.Errorf("allowed_methods = %v, want %v", cfg.AllowedMethods, want)
+	}
+}
+
+func TestLoadConfig_DuplicateRoutes(t *testing.T) {
+	const routesJSON = `"routes": [
+		{"prefix": "/a", "backend": "http://first:8080"},
+		{"prefix": "/b", "backend": "http://other:8080"},
+		{"prefix": "/a", "backend": "http://last:8080"}
+	]`
+	tests := []struct {
+		name        string
+		policy      string
+		wantBackend string
+		wantOrder   []string
+		wantErr     string
+	}{
+		{"default rejects", ``, "", nil, `route "/a": defined more than once`},
+		{"error rejects", `"duplicate_routes": "error",`, "", nil, `route "/a": defined more than once`},
+		{"first wins", `"duplicate_routes": "first",`, "http://first:8080", []string{"/a", "/b"}, ""},
+		{"last wins", `"duplicate_routes": "last",`, "http://last:8080", []string{"/b", "/a"}, ""},
+		{"unknown policy", `"duplicate_routes": "merge",`, "", nil, `duplicate_routes: unknown policy "merge"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfig(writeConfig(t, "{"+tt.policy+routesJSON+"}"))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfig error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+			var prefixes []string
+			for _, rt := range cfg.Routes {
+				prefixes = append(prefixes, rt.Prefix)
+			}
+			if !slices.Equal(prefixes, tt.wantOrder) {
+				t.Fatalf("routes = %v, want %v", prefixes, tt.wantOrder)
+			}
+			if rt := routesByPrefix(cfg.Routes)["/a"]; rt.Backend != tt.wantBackend {
+				t.Errorf("route /a backend = %q, want %q", rt.Backend, tt.wantBackend)
+			}
+			if got := cfg.routeTable()["/a"]; got != tt.wantBackend {
+				t.Errorf("routing table /a = %q, want %q", got, tt.wantBackend)
+			}
+		})
+	}
+}
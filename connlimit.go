@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+)
+
+// connLimitListener refuses connections from a client IP that already has
+// max connections open, by closing them as soon as they are accepted.
+type connLimitListener struct {
+	net.Listener
+	max int
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+func newConnLimitListener(ln net.Listener, max int) *connLimitListener {
+	return &connLimitListener{Listener: ln, max: max, conns: make(map[string]int)}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			ip = conn.RemoteAddr().String()
+		}
+
+		l.mu.Lock()
+		if l.conns[ip] >= l.max {
+			l.mu.Unlock()
+			slog.Warn("connection limit reached", "client_ip", ip, "max_conns_per_ip", l.max)
+			conn.Close()
+			continue
+		}
+		l.conns[ip]++
+		l.mu.Unlock()
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *connLimitListener) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// limitedConn gives its slot back to the listener when closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
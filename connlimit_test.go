@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// closedByPeer reports whether conn was closed by the other side.
+func closedByPeer(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+func TestConnLimitListener(t *testing.T) {
+	captureLogs(t)
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newConnLimitListener(inner, 2)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+
+	first, second := dial(), dial()
+	serverFirst := <-accepted
+	<-accepted
+	excess := dial()
+
+	if !closedByPeer(t, excess) {
+		t.Error("third connection from the same IP was not refused")
+	}
+	if closedByPeer(t, first) || closedByPeer(t, second) {
+		t.Error("connections within the limit were closed")
+	}
+
+	serverFirst.Close()
+	replacement := dial()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("connection after a slot was released was not accepted")
+	}
+	if closedByPeer(t, replacement) {
+		t.Error("connection after a slot was released was refused")
+	}
+}
@@ -1,3 +1,11 @@
 package main
 
+import "time"
+
 const maxBodySize = 10 * 1024 * 1024 // 10MB
+
+const backendTimeout = 60 * time.Second
+
+// statusClientClosedRequest is logged when the client disconnects before the
+// response completes, following NGINX.
+const statusClientClosedRequest = 499
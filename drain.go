@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// requestTracker counts requests in flight so shutdown can report how many
+// were drained and how many had to be force-closed.
+type requestTracker struct {
+	inFlight  atomic.Int64
+	completed atomic.Int64
+}
+
+// tracker tracks every request served by the main server.
+var tracker = &requestTracker{}
+
+func (rt *requestTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.inFlight.Add(1)
+		defer func() {
+			rt.inFlight.Add(-1)
+			rt.completed.Add(1)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// drainSummary describes the outcome of a graceful shutdown.
+type drainSummary struct {
+	Drained int64
+	Forced  int64
+}
+
+// shutdownServer gracefully shuts server down, waiting until ctx expires for
+// in-flight requests to finish before force-closing the remaining
+// connections. It logs and returns a summary of the drain.
+func shutdownServer(ctx context.Context, server *http.Server, rt *requestTracker) drainSummary {
+	completedBefore := rt.completed.Load()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		server.Close()
+	}
+
+	summary := drainSummary{
+		Drained: rt.completed.Load() - completedBefore,
+		Forced:  rt.inFlight.Load(),
+	}
+	if err != nil {
+		slog.Warn("forced shutdown after deadline", "drained", summary.Drained, "forced", summary.Forced, "error", err)
+	} else {
+		slog.Info("shutdown complete", "drained", summary.Drained, "forced", summary.Forced)
+	}
+	return summary
+}
+
+// defaultBackendDrainTimeout is how long a backend removed by a reload
+// keeps its connections for requests in flight.
+const defaultBackendDrainTimeout = 30 * time.Second
+
+// backendDrainPoll is how often a draining backend is checked for requests
+// still in flight.
+var backendDrainPoll = 50 * time.Millisecond
+
+// connRegistry tracks open backend connections by the backendKey they were
+// dialed for, so those of a backend removed by a reload can be closed once
+// it has drained. Keying by backend rather than by dialed address keeps
+// backends reached through one upstream proxy apart, though HTTP backends
+// sharing a transport may reuse each other's idle proxy connections, which
+// stay tracked under the backend they were dialed for.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[string]map[*trackedConn]struct{}
+}
+
+// backendConns tracks every connection dialed to a backend.
+var backendConns = &connRegistry{conns: make(map[string]map[*trackedConn]struct{})}
+
+func (cr *connRegistry) track(key string, c net.Conn) net.Conn {
+	tc := &trackedConn{Conn: c, key: key, registry: cr}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	if cr.conns[key] == nil {
+		cr.conns[key] = make(map[*trackedConn]struct{})
+	}
+	cr.conns[key][tc] = struct{}{}
+	return tc
+}
+
+func (cr *connRegistry) remove(tc *trackedConn) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.conns[tc.key], tc)
+	if len(cr.conns[tc.key]) == 0 {
+		delete(cr.conns, tc.key)
+	}
+}
+
+// count returns the number of open connections dialed for the backend with
+// key.
+func (cr *connRegistry) count(key string) int {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return len(cr.conns[key])
+}
+
+// closeBackend closes every open connection dialed for the backend with
+// key, returning how many there were.
+func (cr *connRegistry) closeBackend(key string) int {
+	cr.mu.Lock()
+	conns := make([]*trackedConn, 0, len(cr.conns[key]))
+	for tc := range cr.conns[key] {
+		conns = append(conns, tc)
+	}
+	cr.mu.Unlock()
+	for _, tc := range conns {
+		tc.Close()
+	}
+	return len(conns)
+}
+
+// trackedConn removes itself from its registry when closed.
+type trackedConn struct {
+	net.Conn
+	key      string
+	registry *connRegistry
+	once     sync.Once
+}
+
+func (tc *trackedConn) Close() error {
+	tc.once.Do(func() { tc.registry.remove(tc) })
+	return tc.Conn.Close()
+}
+
+type connBackendKey struct{}
+
+// withConnBackend attaches to an outbound request context the backendKey of
+// the backend it is sent to, so the connections dialed for it are tracked
+// under that backend.
+func withConnBackend(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), connBackendKey{}, backendKey(req.URL)))
+}
+
+func connBackendFrom(ctx context.Context) string {
+	key, _ := ctx.Value(connBackendKey{}).(string)
+	return key
+}
+
+// backendRouted reports whether s sends requests to the backend with key:
+// pooled, directly, as a canary, by body routing or as a mirror.
+func backendRouted(s *proxyState, key string) bool {
+	if s.backendStates[key] != nil {
+		return true
+	}
+	is := func(raw string) bool {
+		u, err := url.Parse(raw)
+		return err == nil && backendKey(u) == key
+	}
+	for _, raw := range s.routes {
+		if is(raw) {
+			return true
+		}
+	}
+	for _, c := range s.routeCanaries {
+		if is(c.backend) {
+			return true
+		}
+	}
+	for _, m := range s.routeMirrors {
+		if is(m.cfg.Backend) {
+			return true
+		}
+	}
+	for _, rt := range s.config.Routes {
+		if rt.BodyRoute == nil {
+			continue
+		}
+		for _, raw := range rt.BodyRoute.Backends {
+			if is(raw) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drainingBackends holds the backends being drained, keyed by backendKey.
+// A backend a later reload routes to again is dropped from it and keeps
+// its connections.
+var (
+	drainMu          sync.Mutex
+	drainingBackends = map[string]*backend{}
+)
+
+// drainRemovedBackends tears down the pooled backends a reload removed. New
+// requests already avoid them; each keeps its connections until its
+// requests in flight finish, or timeout passes, and then has them closed.
+// next is the state now active in place of prev.
+func drainRemovedBackends(prev, next *proxyState, timeout time.Duration) {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	for key := range drainingBackends {
+		if backendRouted(next, key) {
+			delete(drainingBackends, key)
+		}
+	}
+	for key, b := range prev.backendStates {
+		if backendRouted(next, key) {
+			continue
+		}
+		drainingBackends[key] = b
+		go drainBackend(key, b, prev.backendTransports[key], timeout)
+	}
+}
+
+// drainBackend waits for b's requests in flight to finish, up to timeout,
+// then closes its connections, including any idle in its dedicated
+// transport t.
+func drainBackend(key string, b *backend, t *http.Transport, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for b.inFlight.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(backendDrainPoll)
+	}
+	forced := b.inFlight.Load()
+
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	if drainingBackends[key] != b {
+		return
+	}
+	delete(drainingBackends, key)
+	if t != nil {
+		t.CloseIdleConnections()
+	}
+	closed := backendConns.closeBackend(key)
+	if forced > 0 {
+		slog.Warn("removed backend not drained before timeout, closing connections", "backend", b.url, "forced", forced, "conns", closed)
+	} else {
+		slog.Info("removed backend drained", "backend", b.url, "conns", closed)
+	}
+}
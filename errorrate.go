@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errorRateBuckets and errorRateBucketWidth make up the rolling window over
+// which each route's error rate is computed.
+const (
+	errorRateBuckets     = 6
+	errorRateBucketWidth = 10 * time.Second
+)
+
+// errorRate counts a route's requests and errors over a rolling window of
+// fixed-width buckets, so old outcomes age out a bucket at a time.
+type errorRate struct {
+	mu      sync.Mutex
+	buckets [errorRateBuckets]rateBucket
+}
+
+type rateBucket struct {
+	// slot is the index of the bucket's time slice since the epoch.
+	slot     int64
+	requests uint64
+	errors   uint64
+}
+
+func (e *errorRate) record(failed bool, now time.Time) {
+	slot := now.UnixNano() / int64(errorRateBucketWidth)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	b := &e.buckets[slot%errorRateBuckets]
+	if b.slot != slot {
+		*b = rateBucket{slot: slot}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+}
+
+// counts returns the requests and errors seen over the window ending at now.
+func (e *errorRate) counts(now time.Time) (requests, errors uint64) {
+	slot := now.UnixNano() / int64(errorRateBucketWidth)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, b := range e.buckets {
+		if b.slot > slot-errorRateBuckets && b.slot <= slot {
+			requests += b.requests
+			errors += b.errors
+		}
+	}
+	return requests, errors
+}
+
+// isErrorStatus reports whether a logged status counts against a route's
+// error rate: any 5xx, including the proxy's own 502 and 504 answers.
+func isErrorStatus(status int) bool {
+	return status >= 500 && status < 600
+}
+
+// newRouteErrorRates builds the error rates of rts, keeping the one in prev
+// of each route that was already configured.
+func newRouteErrorRates(rts []RouteConfig, prev map[string]*errorRate) map[string]*errorRate {
+	rates := make(map[string]*errorRate, len(rts))
+	for _, rt := range rts {
+		if e := prev[rt.Prefix]; e != nil {
+			rates[rt.Prefix] = e
+		} else {
+			rates[rt.Prefix] = &errorRate{}
+		}
+	}
+	return rates
+}
+
+// recordRouteStatus counts a logged status against the route of s at
+// prefix.
+func recordRouteStatus(s *proxyState, prefix string, status int) {
+	if e := s.routeErrorRates[prefix]; e != nil {
+		e.record(isErrorStatus(status), time.Now())
+	}
+}
+
+// errorRateStats describes one route's error rate in the admin API.
+type errorRateStats struct {
+	Prefix    string  `json:"prefix"`
+	WindowMs  int64   `json:"window_ms"`
+	Requests  uint64  `json:"requests"`
+	Errors    uint64  `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// errorRatesHandler lists the rolling error rate of every route.
+func errorRatesHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	rates := currentState().routeErrorRates
+	stats := make([]errorRateStats, 0, len(rates))
+	for prefix, e := range rates {
+		s := errorRateStats{Prefix: prefix, WindowMs: (errorRateBuckets * errorRateBucketWidth).Milliseconds()}
+		s.Requests, s.Errors = e.counts(now)
+		if s.Requests > 0 {
+			s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Prefix < stats[j].Prefix })
+	writeJSON(w, http.StatusOK, stats)
+}
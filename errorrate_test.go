@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestErrorRates(t *testing.T) {
+	captureLogs(t)
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/api", Backend: "http://localhost:8081"},
+		RouteConfig{Prefix: "/idle", Backend: "http://localhost:8082"},
+	)
+	// The handler answers with the status given in the query string.
+	handler := routeMiddleware(loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, _ := strconv.Atoi(r.URL.Query().Get("status"))
+		w.WriteHeader(status)
+	})))
+	for _, status := range []int{200, 200, 201, 302, 404, 429, 500, 502, 503, 504} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api?status="+strconv.Itoa(status), nil))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/unrouted?status=500", nil))
+
+	rr := adminRequest(t, "GET", "/admin/error-rates")
+	var stats []errorRateStats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	want := []errorRateStats{
+		{Prefix: "/api", WindowMs: 60000, Requests: 10, Errors: 4, ErrorRate: 0.4},
+		{Prefix: "/idle", WindowMs: 60000},
+	}
+	if len(stats) != len(want) {
+		t.Fatalf("error rates = %+v, want %+v", stats, want)
+	}
+	for i := range want {
+		if stats[i] != want[i] {
+			t.Errorf("error rates[%d] = %+v, want %+v", i, stats[i], want[i])
+		}
+	}
+}
+
+func TestErrorRate_RollingWindow(t *testing.T) {
+	var e errorRate
+	start := time.Unix(1000, 0)
+	e.record(true, start)
+	e.record(false, start.Add(5*time.Second))
+	e.record(false, start.Add(30*time.Second))
+
+	tests := []struct {
+		at           time.Duration
+		wantRequests uint64
+		wantErrors   uint64
+	}{
+		{30 * time.Second, 3, 1},
+		{59 * time.Second, 3, 1},
+		// The first bucket ages out once the window has moved past it.
+		{60 * time.Second, 1, 0},
+		{90 * time.Second, 0, 0},
+	}
+	for _, tt := range tests {
+		requests, errors := e.counts(start.Add(tt.at))
+		if requests != tt.wantRequests || errors != tt.wantErrors {
+			t.Errorf("counts at +%v = %d requests, %d errors, want %d, %d", tt.at, requests, errors, tt.wantRequests, tt.wantErrors)
+		}
+	}
+
+	// A bucket reused for a later time slice starts from zero.
+	e.record(true, start.Add(60*time.Second))
+	if requests, errors := e.counts(start.Add(60 * time.Second)); requests != 2 || errors != 1 {
+		t.Errorf("counts after reuse = %d requests, %d errors, want 2, 1", requests, errors)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// RewriteRuleConfig rewrites the outbound request when its condition holds.
+//
+// If is an expression over request attributes, for example
+//
+//	header.X-Env == "beta" && !(path ^= "/admin")
+//
+// Attributes are method, host, path (the outbound path after prefix
+// stripping), prefix, client_ip, header.<Name>, query.<name> and
+// cookie.<name>. Operators
+// are == and != for equality, ^= for prefix, $= for suffix, *= for
+// substring, && and || and !, with parentheses for grouping. A bare
+// attribute is true when non-empty. An empty If always holds.
+//
+// SetHeaders and Path are templates in which ${attribute} is replaced by the
+// attribute's value.
+type RewriteRuleConfig struct {
+	If         string            `json:"if"`
+	SetHeaders map[string]string `json:"set_headers"`
+	Path       string            `json:"path"`
+}
+
+// rewriteRule is a compiled RewriteRuleConfig.
+type rewriteRule struct {
+	cond       exprNode
+	setHeaders map[string]template
+	path       template
+}
+
+func compileRewriteRule(rc RewriteRuleConfig) (*rewriteRule, error) {
+	rule := &rewriteRule{setHeaders: make(map[string]template)}
+	if rc.If != "" {
+		cond, err := parseExpr(rc.If)
+		if err != nil {
+			return nil, fmt.Errorf("if %q: %w", rc.If, err)
+		}
+		rule.cond = cond
+	}
+	for name, value := range rc.SetHeaders {
+		tmpl, err := parseTemplate(value)
+		if err != nil {
+			return nil, fmt.Errorf("set_headers %s: %w", name, err)
+		}
+		rule.setHeaders[name] = tmpl
+	}
+	if rc.Path != "" {
+		tmpl, err := parseTemplate(rc.Path)
+		if err != nil {
+			return nil, fmt.Errorf("path: %w", err)
+		}
+		rule.path = tmpl
+	}
+	return rule, nil
+}
+
+func newRouteRewriteRules(rts []RouteConfig) (map[string][]*rewriteRule, error) {
+	rules := make(map[string][]*rewriteRule)
+	for _, rt := range rts {
+		for i, rc := range rt.Rewrites {
+			rule, err := compileRewriteRule(rc)
+			if err != nil {
+				return nil, fmt.Errorf("route %q: rewrite %d: %w", rt.Prefix, i, err)
+			}
+			rules[rt.Prefix] = append(rules[rt.Prefix], rule)
+		}
+	}
+	return rules, nil
+}
+
+// applyRewriteRules applies each matching rule to out, in order. Later rules
+// see the path written by earlier ones.
+func applyRewriteRules(rules []*rewriteRule, in, out *http.Request, prefix string) {
+	for _, rule := range rules {
+		env := exprEnv{in: in, out: out, prefix: prefix}
+		if rule.cond != nil && !truthy(rule.cond.eval(env)) {
+			continue
+		}
+		for name, tmpl := range rule.setHeaders {
+			out.Header.Set(name, tmpl.expand(env))
+		}
+		if rule.path != nil {
+			out.URL.Path = rule.path.expand(env)
+			out.URL.RawPath = ""
+		}
+	}
+}
+
+// exprEnv resolves attributes against the inbound and outbound request.
+type exprEnv struct {
+	in, out *http.Request
+	prefix  string
+}
+
+func (env exprEnv) lookup(attr string) string {
+	if name, ok := strings.CutPrefix(attr, "header."); ok {
+		return env.in.Header.Get(name)
+	}
+	if name, ok := strings.CutPrefix(attr, "query."); ok {
+		return env.in.URL.Query().Get(name)
+	}
+	if name, ok := strings.CutPrefix(attr, "cookie."); ok {
+		if c, err := env.in.Cookie(name); err == nil {
+			return c.Value
+		}
+		return ""
+	}
+	switch attr {
+	case "method":
+		return env.in.Method
+	case "host":
+		return env.in.Host
+	case "path":
+		return env.out.URL.Path
+	case "prefix":
+		return env.prefix
+	case "client_ip":
+		ip, _, err := net.SplitHostPort(env.in.RemoteAddr)
+		if err != nil {
+			return env.in.RemoteAddr
+		}
+		return ip
+	}
+	return ""
+}
+
+func validAttribute(attr string) bool {
+	switch attr {
+	case "method", "host", "path", "prefix", "client_ip":
+		return true
+	}
+	for _, kind := range []string{"header.", "query.", "cookie."} {
+		if name, ok := strings.CutPrefix(attr, kind); ok {
+			return name != ""
+		}
+	}
+	return false
+}
+
+// exprNode is a node of a parsed expression. Every value is a string;
+// booleans are "true" and "".
+type exprNode interface {
+	eval(env exprEnv) string
+}
+
+type literalNode string
+
+func (n literalNode) eval(exprEnv) string { return string(n) }
+
+type attrNode string
+
+func (n attrNode) eval(env exprEnv) string { return env.lookup(string(n)) }
+
+type notNode struct{ x exprNode }
+
+func (n notNode) eval(env exprEnv) string { return boolString(!truthy(n.x.eval(env))) }
+
+type binaryNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n binaryNode) eval(env exprEnv) string {
+	switch n.op {
+	case "&&":
+		return boolString(truthy(n.l.eval(env)) && truthy(n.r.eval(env)))
+	case "||":
+		return boolString(truthy(n.l.eval(env)) || truthy(n.r.eval(env)))
+	}
+	l, r := n.l.eval(env), n.r.eval(env)
+	switch n.op {
+	case "==":
+		return boolString(l == r)
+	case "!=":
+		return boolString(l != r)
+	case "^=":
+		return boolString(strings.HasPrefix(l, r))
+	case "$=":
+		return boolString(strings.HasSuffix(l, r))
+	case "*=":
+		return boolString(strings.Contains(l, r))
+	}
+	return ""
+}
+
+func truthy(s string) bool { return s != "" }
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+var errUnexpectedEnd = errors.New("unexpected end of expression")
+
+// parseExpr parses an expression in the RewriteRuleConfig.If syntax.
+func parseExpr(src string) (exprNode, error) {
+	toks, err := tokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.toks[p.pos].text)
+	}
+	return node, nil
+}
+
+type tokenKind int
+
+const (
+	tokString tokenKind = iota
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+var exprOps = []string{"&&", "||", "==", "!=", "^=", "$=", "*=", "!", "(", ")"}
+
+func tokenize(src string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, errors.New("unterminated string")
+			}
+			toks = append(toks, token{tokString, src[i+1 : i+1+end]})
+			i += end + 2
+		case isIdentByte(c):
+			start := i
+			for i < len(src) && isIdentByte(src[i]) {
+				i++
+			}
+			toks = append(toks, token{tokIdent, src[start:i]})
+		default:
+			op := ""
+			for _, o := range exprOps {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q", c)
+			}
+			toks = append(toks, token{tokOp, op})
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+func isIdentByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.'
+}
+
+type exprParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *exprParser) peekOp(op string) bool {
+	return p.pos < len(p.toks) && p.toks[p.pos].kind == tokOp && p.toks[p.pos].text == op
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	l, err := p.parseAnd()
+	for err == nil && p.peekOp("||") {
+		p.pos++
+		var r exprNode
+		r, err = p.parseAnd()
+		l = binaryNode{"||", l, r}
+	}
+	return l, err
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	l, err := p.parseUnary()
+	for err == nil && p.peekOp("&&") {
+		p.pos++
+		var r exprNode
+		r, err = p.parseUnary()
+		l = binaryNode{"&&", l, r}
+	}
+	return l, err
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.peekOp("!") {
+		p.pos++
+		x, err := p.parseUnary()
+		return notNode{x}, err
+	}
+	l, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "^=", "$=", "*="} {
+		if p.peekOp(op) {
+			p.pos++
+			r, err := p.parseOperand()
+			return binaryNode{op, l, r}, err
+		}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseOperand() (exprNode, error) {
+	if p.pos >= len(p.toks) {
+		return nil, errUnexpectedEnd
+	}
+	tok := p.toks[p.pos]
+	p.pos++
+	switch {
+	case tok.kind == tokString:
+		return literalNode(tok.text), nil
+	case tok.kind == tokIdent:
+		if !validAttribute(tok.text) {
+			return nil, fmt.Errorf("unknown attribute %q", tok.text)
+		}
+		return attrNode(tok.text), nil
+	case tok.text == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.peekOp(")") {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return node, nil
+	}
+	return nil, fmt.Errorf("unexpected %q", tok.text)
+}
+
+// template is a string with ${attribute} placeholders.
+type template []exprNode
+
+func parseTemplate(src string) (template, error) {
+	var tmpl template
+	for {
+		start := strings.Index(src, "${")
+		if start < 0 {
+			if src != "" {
+				tmpl = append(tmpl, literalNode(src))
+			}
+			return tmpl, nil
+		}
+		end := strings.IndexByte(src[start:], '}')
+		if end < 0 {
+			return nil, errors.New("unterminated ${")
+		}
+		attr := src[start+2 : start+end]
+		if !validAttribute(attr) {
+			return nil, fmt.Errorf("unknown attribute %q", attr)
+		}
+		if start > 0 {
+			tmpl = append(tmpl, literalNode(src[:start]))
+		}
+		tmpl = append(tmpl, attrNode(attr))
+		src = src[start+end+1:]
+	}
+}
+
+func (t template) expand(env exprEnv) string {
+	var b strings.Builder
+	for _, part := range t {
+		b.WriteString(part.eval(env))
+	}
+	return b.String()
+}
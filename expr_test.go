@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	req := httptest.NewRequest("POST", "/api/users?tier=gold", nil)
+	req.Header.Set("X-Env", "beta")
+	env := exprEnv{in: req, out: req, prefix: "/api"}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`method == "POST"`, true},
+		{`method != "POST"`, false},
+		{`header.X-Env == "beta" && query.tier == "gold"`, true},
+		{`header.X-Env == "prod" || path ^= "/api"`, true},
+		{`!(path $= "/users")`, false},
+		{`path *= "user"`, true},
+		{`header.X-Missing`, false},
+		{`header.X-Env`, true},
+		{`prefix == "/api" && !header.X-Missing`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			node, err := parseExpr(tt.expr)
+			if err != nil {
+				t.Fatalf("parseExpr: %v", err)
+			}
+			if got := truthy(node.eval(env)); got != tt.want {
+				t.Errorf("eval = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExpr_Errors(t *testing.T) {
+	for _, expr := range []string{
+		`method ==`,
+		`os.exec == "x"`,
+		`(method == "GET"`,
+		`method == "GET`,
+		`method = "GET"`,
+		`method == "GET" "POST"`,
+	} {
+		if _, err := parseExpr(expr); err == nil {
+			t.Errorf("parseExpr(%q) = nil error, want error", expr)
+		}
+	}
+	if _, err := parseTemplate("/v2${unknown}"); err == nil {
+		t.Error("parseTemplate accepted an unknown attribute")
+	}
+}
+
+func TestRewriteRules(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s tenant=%s", r.URL.Path, r.Header.Get("X-Tenant"))
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{
+		Prefix:  "/api",
+		Backend: backend.URL,
+		Rewrites: []RewriteRuleConfig{
+			{If: `header.X-Env == "beta"`, Path: "/beta${path}"},
+			{If: `query.tenant`, SetHeaders: map[string]string{"X-Tenant": "${query.tenant}-${method}"}},
+		},
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		env    string
+		want   string
+	}{
+		{"no rule matches", "/api/users", "", "/users tenant="},
+		{"path rewritten", "/api/users", "beta", "/beta/users tenant="},
+		{"header templated", "/api/users?tenant=acme", "", "/users tenant=acme-GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.env != "" {
+				req.Header.Set("X-Env", tt.env)
+			}
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+			if rr.Body.String() != tt.want {
+				t.Errorf("backend saw %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Policies for an inbound X-Forwarded-For header, set by
+// Config.ForwardedFor. In every case the client IP is appended.
+const (
+	// forwardedForReplace discards the inbound chain. This is the default.
+	forwardedForReplace = "replace"
+	// forwardedForAppend keeps the inbound chain as-is.
+	forwardedForAppend = "append"
+	// forwardedForSanitize keeps only the entries that are valid IPs.
+	forwardedForSanitize = "sanitize"
+	// forwardedForDrop keeps the inbound chain only if every entry is valid.
+	forwardedForDrop = "drop"
+)
+
+var forwardedForPolicies = []string{"", forwardedForReplace, forwardedForAppend, forwardedForSanitize, forwardedForDrop}
+
+// inboundForwardedFor returns the X-Forwarded-For entries from an inbound
+// request that should be kept under policy, logging any it discards.
+func inboundForwardedFor(r *http.Request, policy string) []string {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 || policy == "" || policy == forwardedForReplace {
+		return nil
+	}
+	if policy == forwardedForAppend {
+		return values
+	}
+
+	var valid, invalid []string
+	for _, v := range values {
+		for _, entry := range strings.Split(v, ",") {
+			entry = strings.TrimSpace(entry)
+			if validForwardedFor(entry) {
+				valid = append(valid, entry)
+			} else {
+				invalid = append(invalid, entry)
+			}
+		}
+	}
+	if len(invalid) == 0 {
+		return []string{strings.Join(valid, ", ")}
+	}
+
+	slog.Warn("invalid X-Forwarded-For entries",
+		"policy", policy,
+		"path", r.URL.Path,
+		"remote_addr", r.RemoteAddr,
+		"invalid", invalid,
+	)
+	if policy == forwardedForDrop || len(valid) == 0 {
+		return nil
+	}
+	return []string{strings.Join(valid, ", ")}
+}
+
+// validForwardedFor reports whether entry is an IP address, optionally with
+// a port.
+func validForwardedFor(entry string) bool {
+	if _, err := netip.ParseAddr(entry); err == nil {
+		return true
+	}
+	_, err := netip.ParseAddrPort(entry)
+	return err == nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedForPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-For"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	const inbound = "203.0.113.7, not-an-ip, 2001:db8::1, <script>"
+	tests := []struct {
+		policy   string
+		inbound  string
+		want     string
+		wantWarn bool
+	}{
+		{"", inbound, "192.0.2.1", false},
+		{forwardedForReplace, inbound, "192.0.2.1", false},
+		{forwardedForAppend, inbound, inbound + ", 192.0.2.1", false},
+		{forwardedForSanitize, inbound, "203.0.113.7, 2001:db8::1, 192.0.2.1", true},
+		{forwardedForSanitize, "203.0.113.7, 198.51.100.2:4711", "203.0.113.7, 198.51.100.2:4711, 192.0.2.1", false},
+		{forwardedForSanitize, "garbage", "192.0.2.1", true},
+		{forwardedForDrop, inbound, "192.0.2.1", true},
+		{forwardedForDrop, "203.0.113.7", "203.0.113.7, 192.0.2.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.inbound, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForwardedFor = tt.policy })
+			logs := captureLogs(t)
+
+			req := httptest.NewRequest("GET", "/service1", nil)
+			req.Header.Set("X-Forwarded-For", tt.inbound)
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+
+			if rr.Body.String() != tt.want {
+				t.Errorf("X-Forwarded-For = %q, want %q", rr.Body.String(), tt.want)
+			}
+			var warned bool
+			for _, rec := range logRecords(t, logs) {
+				warned = warned || rec["msg"] == "invalid X-Forwarded-For entries"
+			}
+			if warned != tt.wantWarn {
+				t.Errorf("warning logged = %v, want %v", warned, tt.wantWarn)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// framingListener guards plaintext HTTP/1.x connections against request
+// smuggling through conflicting message framing: a request carrying both
+// Content-Length and Transfer-Encoding. net/http lets Transfer-Encoding win
+// and drops Content-Length before handlers run, so the conflict is only
+// visible on the wire. TLS listeners are not wrapped, as net/http needs the
+// *tls.Conn itself.
+type framingListener struct {
+	net.Listener
+}
+
+func (l framingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &framingConn{Conn: conn}, nil
+}
+
+// framingConn scans the requests read from a client connection. Requests
+// are numbered in the order they are read, so framingMiddleware can reject
+// the offending one even when later pipelined requests were read ahead.
+type framingConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	scanner framingScanner
+	// served counts the requests that reached framingMiddleware.
+	served int
+}
+
+func (c *framingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.mu.Lock()
+	c.scanner.scan(p[:n])
+	c.mu.Unlock()
+	return n, err
+}
+
+// nextConflicts reports whether the next request served on c had
+// conflicting framing.
+func (c *framingConn) nextConflicts() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.served++
+	return slices.Contains(c.scanner.conflicts, c.served)
+}
+
+type framingConnKey struct{}
+
+// withFramingConn is the http.Server ConnContext hook that makes a
+// framingConn available to framingMiddleware.
+func withFramingConn(ctx context.Context, c net.Conn) context.Context {
+	if fc, ok := c.(*framingConn); ok {
+		return context.WithValue(ctx, framingConnKey{}, fc)
+	}
+	return ctx
+}
+
+// framingMiddleware rejects requests whose framing headers conflicted with
+// 400 and closes the connection, as the bytes that follow cannot be trusted.
+func framingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fc, ok := r.Context().Value(framingConnKey{}).(*framingConn); ok && fc.nextConflicts() {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "conflicting Content-Length and Transfer-Encoding", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// States of a framingScanner.
+const (
+	scanHeaders = iota
+	scanBody
+	scanChunkSize
+	scanChunkData
+	scanTrailers
+	// scanOff stops scanning once the stream is no longer plain HTTP/1.x
+	// requests, or is one net/http will reject and close anyway.
+	scanOff
+)
+
+// maxScannedLine bounds a buffered header block or chunk line, just above
+// net/http's default header limit.
+const maxScannedLine = http.DefaultMaxHeaderBytes + 4096
+
+// framingScanner follows the HTTP/1.x request stream of a connection,
+// skipping bodies the way net/http frames them, and records which requests
+// had conflicting framing headers.
+type framingScanner struct {
+	state     int
+	line      []byte
+	remaining int64
+	// requests counts the request heads seen.
+	requests int
+	// conflicts holds the 1-based numbers of the conflicting requests.
+	conflicts []int
+}
+
+func (s *framingScanner) scan(b []byte) {
+	for len(b) > 0 && s.state != scanOff {
+		switch s.state {
+		case scanBody, scanChunkData:
+			n := min(int64(len(b)), s.remaining)
+			b = b[n:]
+			if s.remaining -= n; s.remaining == 0 {
+				if s.state == scanBody {
+					s.state = scanHeaders
+				} else {
+					s.state = scanChunkSize
+				}
+			}
+		default:
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				s.line = append(s.line, b...)
+				b = nil
+			} else {
+				s.line = append(s.line, b[:i+1]...)
+				b = b[i+1:]
+			}
+			if len(s.line) > maxScannedLine {
+				s.state = scanOff
+			} else if i >= 0 {
+				s.endLine()
+			}
+		}
+	}
+}
+
+// endLine handles a complete line, or for scanHeaders a complete head once
+// it ends with an empty line.
+func (s *framingScanner) endLine() {
+	switch s.state {
+	case scanHeaders:
+		if !bytes.HasSuffix(s.line, []byte("\n\n")) && !bytes.HasSuffix(s.line, []byte("\n\r\n")) {
+			if len(bytes.TrimRight(s.line, "\r\n")) == 0 {
+				s.line = s.line[:0] // blank line before a request
+			}
+			return
+		}
+		s.endHead()
+	case scanChunkSize:
+		size, _, _ := strings.Cut(strings.TrimSpace(string(s.line)), ";")
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		switch {
+		case err != nil || n < 0:
+			s.state = scanOff
+		case n == 0:
+			s.state = scanTrailers
+		default:
+			s.remaining = n + 2 // the chunk data and its CRLF
+			s.state = scanChunkData
+		}
+	case scanTrailers:
+		if len(bytes.TrimRight(s.line, "\r\n")) == 0 {
+			s.state = scanHeaders
+		}
+	}
+	s.line = s.line[:0]
+}
+
+// endHead parses a complete request head and sets up skipping its body.
+func (s *framingScanner) endHead() {
+	lines := strings.Split(strings.TrimRight(string(s.line), "\r\n"), "\n")
+	s.line = s.line[:0]
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) != 3 {
+		s.state = scanOff
+		return
+	}
+	method, target, proto := requestLine[0], requestLine[1], requestLine[2]
+	// net/http answers "OPTIONS *" itself, so it never reaches
+	// framingMiddleware and is not counted.
+	if method != http.MethodOptions || target != "*" {
+		s.requests++
+	}
+
+	var contentLength, transferEncoding []string
+	upgrade := false
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(strings.TrimRight(line, "\r"), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			contentLength = append(contentLength, value)
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			transferEncoding = append(transferEncoding, value)
+		case strings.EqualFold(name, "Upgrade"):
+			upgrade = true
+		}
+	}
+	if len(contentLength) > 0 && len(transferEncoding) > 0 {
+		s.conflicts = append(s.conflicts, s.requests)
+	}
+
+	major, minor, ok := http.ParseHTTPVersion(proto)
+	switch {
+	case !ok || method == http.MethodConnect || upgrade:
+		// The connection may stop carrying HTTP requests after this one.
+		s.state = scanOff
+	case len(transferEncoding) > 0 && (major > 1 || minor >= 1):
+		if len(transferEncoding) != 1 || !strings.EqualFold(transferEncoding[0], "chunked") {
+			s.state = scanOff // rejected by net/http with 501
+			return
+		}
+		s.state = scanChunkSize
+	case len(contentLength) > 0:
+		n, err := strconv.ParseInt(contentLength[0], 10, 64)
+		if err != nil || n < 0 {
+			s.state = scanOff // rejected by net/http with 400
+			return
+		}
+		s.remaining = n
+		if n > 0 {
+			s.state = scanBody
+		}
+	}
+}
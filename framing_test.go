@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newFramingServer serves an echo handler behind the framing defenses, the
+// way main wires them.
+func newFramingServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(framingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	})))
+	srv.Listener = framingListener{srv.Listener}
+	srv.Config.ConnContext = withFramingConn
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+func TestFraming(t *testing.T) {
+	addr := newFramingServer(t)
+	smuggled := "GET / HTTP/1.1\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	tests := []struct {
+		name       string
+		raw        string
+		wantStatus []int
+	}{
+		{
+			name: "content-length and chunked",
+			raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 4\r\nTransfer-Encoding: chunked\r\n\r\n" +
+				"0\r\n\r\n",
+			wantStatus: []int{http.StatusBadRequest},
+		},
+		{
+			name:       "content-length and chunked on HTTP/1.0",
+			raw:        "POST / HTTP/1.0\r\nHost: x\r\nContent-Length: 0\r\nTransfer-Encoding: chunked\r\n\r\n",
+			wantStatus: []int{http.StatusBadRequest},
+		},
+		{
+			name:       "chunked only",
+			raw:        "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n",
+			wantStatus: []int{http.StatusOK},
+		},
+		{
+			name: "conflict pipelined after a clean request",
+			raw: "POST / HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n4\r\nbody\r\n0\r\n\r\n" +
+				"POST / HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			wantStatus: []int{http.StatusOK, http.StatusBadRequest},
+		},
+		{
+			name: "conflicting headers inside a body",
+			raw: "POST / HTTP/1.1\r\nHost: x\r\nContent-Length: " + strconv.Itoa(len(smuggled)) + "\r\n\r\n" +
+				smuggled + "GET / HTTP/1.1\r\nHost: x\r\n\r\n",
+			wantStatus: []int{http.StatusOK, http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, tt.raw)
+
+			br := bufio.NewReader(conn)
+			for i, want := range tt.wantStatus {
+				res, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("response %d: %v", i, err)
+				}
+				io.Copy(io.Discard, res.Body)
+				if res.StatusCode != want {
+					t.Errorf("response %d status = %d, want %d", i, res.StatusCode, want)
+				}
+			}
+		})
+	}
+}
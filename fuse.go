@@ -0,0 +1,145 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FuseConfig takes a pooled backend out of service for good once every
+// request sent to it over a window has failed. Unlike a circuit breaker it
+// never recovers on its own: an operator resets it through the admin API.
+// It stays blown across config reloads that keep the backend.
+type FuseConfig struct {
+	// Window is how long the backend must fail without a single success.
+	Window Duration `json:"window"`
+	// MinRequests is the number of failures the window must see, so an
+	// idle backend is not fused on a handful of errors. Defaults to 10.
+	MinRequests int `json:"min_requests"`
+}
+
+const defaultFuseMinRequests = 10
+
+func (fc FuseConfig) validate() error {
+	if fc.Window <= 0 || fc.MinRequests < 0 {
+		return fmt.Errorf("fuse: window must be positive and min_requests not negative")
+	}
+	return nil
+}
+
+// fuse tracks a backend's unbroken run of failures.
+type fuse struct {
+	cfg FuseConfig
+
+	mu           sync.Mutex
+	failingSince time.Time
+	failures     int
+	blown        bool
+}
+
+// record counts the outcome of one request, reporting whether it blew the
+// fuse.
+func (f *fuse) record(failed bool, now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.blown {
+		return false
+	}
+	if !failed {
+		f.failures = 0
+		return false
+	}
+	if f.failures == 0 {
+		f.failingSince = now
+	}
+	f.failures++
+	if f.failures >= cmp.Or(f.cfg.MinRequests, defaultFuseMinRequests) &&
+		now.Sub(f.failingSince) >= time.Duration(f.cfg.Window) {
+		f.blown = true
+		return true
+	}
+	return false
+}
+
+func (f *fuse) isBlown() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.blown
+}
+
+// carryOver copies prev's run of failures and whether it blew into f.
+func (f *fuse) carryOver(prev *fuse) {
+	prev.mu.Lock()
+	failingSince, failures, blown := prev.failingSince, prev.failures, prev.blown
+	prev.mu.Unlock()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failingSince, f.failures, f.blown = failingSince, failures, blown
+}
+
+func (f *fuse) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blown = false
+	f.failures = 0
+}
+
+// recordOutcome feeds the result of a request sent with ctx to b's fuse, if
+// it has one. A request that failed because its client went away says
+// nothing about the backend and is not counted.
+func (b *backend) recordOutcome(ctx context.Context, res *http.Response, err error) {
+	if b.fuse == nil || err != nil && errors.Is(context.Cause(ctx), context.Canceled) {
+		return
+	}
+	failed := err != nil || res.StatusCode >= 500
+	if b.fuse.record(failed, time.Now()) {
+		slog.Error("backend fused after failing every request, reset it through the admin API",
+			"backend", b.url,
+			"window_ms", time.Duration(b.fuse.cfg.Window).Milliseconds(),
+		)
+	}
+}
+
+// fuseStatus describes one fused backend in the admin API.
+type fuseStatus struct {
+	Backend string `json:"backend"`
+	Fused   bool   `json:"fused"`
+}
+
+// listFusesHandler lists the backends whose fuse has blown.
+func listFusesHandler(w http.ResponseWriter, r *http.Request) {
+	fused := []fuseStatus{}
+	for _, b := range currentState().backendStates {
+		if b.fuse != nil && b.fuse.isBlown() {
+			fused = append(fused, fuseStatus{Backend: b.url, Fused: true})
+		}
+	}
+	sort.Slice(fused, func(i, j int) bool { return fused[i].Backend < fused[j].Backend })
+	writeJSON(w, http.StatusOK, fused)
+}
+
+// resetFuseHandler puts the backend named by the backend query parameter
+// back into service.
+func resetFuseHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(r.URL.Query().Get("backend"))
+	if err != nil || u.Host == "" {
+		http.Error(w, "backend must be a backend URL", http.StatusBadRequest)
+		return
+	}
+	b := currentState().backendStates[backendKey(u)]
+	if b == nil || b.fuse == nil {
+		http.Error(w, "no fuse for backend", http.StatusNotFound)
+		return
+	}
+	b.fuse.reset()
+	slog.Info("backend fuse reset", "backend", b.url)
+	writeJSON(w, http.StatusOK, fuseStatus{Backend: b.url})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFuse(t *testing.T) {
+	var broken atomic.Bool
+	broken.Store(true)
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if broken.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		io.WriteString(w, "flaky")
+	}))
+	defer flaky.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "good")
+	}))
+	defer good.Close()
+	captureLogs(t)
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{flaky.URL, good.URL}}}
+		c.Backends = map[string]BackendConfig{
+			flaky.URL: {Fuse: &FuseConfig{Window: Duration(30 * time.Millisecond), MinRequests: 3}},
+		}
+	})
+	get := func() string {
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+		return rr.Body.String()
+	}
+	served := func(n int) map[string]int {
+		counts := map[string]int{}
+		for range n {
+			counts[get()]++
+		}
+		return counts
+	}
+	fused := func() []fuseStatus {
+		var list []fuseStatus
+		if err := json.NewDecoder(adminRequest(t, "GET", "/admin/fuses").Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	// Three failures within the window are not enough: it must fail for
+	// the whole window.
+	served(6)
+	if list := fused(); len(list) != 0 {
+		t.Fatalf("fused = %v before the window passed", list)
+	}
+	time.Sleep(40 * time.Millisecond)
+	served(2)
+	if list := fused(); len(list) != 1 || list[0].Backend != flaky.URL {
+		t.Fatalf("fused = %v, want %s", list, flaky.URL)
+	}
+
+	// The fuse holds after the backend recovers, until it is reset.
+	broken.Store(false)
+	time.Sleep(40 * time.Millisecond)
+	if counts := served(4); counts["good"] != 4 {
+		t.Errorf("served = %v while fused, want only good", counts)
+	}
+	if rr := adminRequest(t, "POST", "/admin/fuses/reset?backend="+url.QueryEscape(good.URL)); rr.Code != http.StatusNotFound {
+		t.Errorf("reset of backend without a fuse = %d, want 404", rr.Code)
+	}
+	if rr := adminRequest(t, "POST", "/admin/fuses/reset?backend="+url.QueryEscape(flaky.URL)); rr.Code != http.StatusOK {
+		t.Fatalf("reset = %d, want 200", rr.Code)
+	}
+	if counts := served(4); counts["flaky"] != 2 || counts["good"] != 2 {
+		t.Errorf("served = %v after reset, want both backends", counts)
+	}
+	if list := fused(); len(list) != 0 {
+		t.Errorf("fused = %v after reset, want none", list)
+	}
+}
+
+func TestFuse_SuccessRestartsWindow(t *testing.T) {
+	f := &fuse{cfg: FuseConfig{Window: Duration(time.Minute), MinRequests: 2}}
+	now := time.Now()
+	f.record(true, now)
+	f.record(false, now.Add(30*time.Second))
+	if f.record(true, now.Add(time.Minute)) || f.record(true, now.Add(90*time.Second)) {
+		t.Error("fuse blew although a request succeeded within the window")
+	}
+	if !f.record(true, now.Add(2*time.Minute)) {
+		t.Error("fuse held after a full window of failures")
+	}
+}
+
+func TestFuse_ClientCancellationNotCounted(t *testing.T) {
+	reached := make(chan struct{}, 4)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- struct{}{}
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	captureLogs(t)
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{backend.URL}}}
+		c.Backends = map[string]BackendConfig{
+			backend.URL: {Fuse: &FuseConfig{Window: Duration(time.Nanosecond), MinRequests: 1}},
+		}
+	})
+
+	for range 3 {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-reached
+			cancel()
+		}()
+		newQuietTestProxy().ServeHTTP(httptest.NewRecorder(), httptest.NewRequestWithContext(ctx, "GET", "/api", nil))
+	}
+	if currentState().backendStates[backend.URL].fuse.isBlown() {
+		t.Error("fuse blew on requests their clients canceled")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// HeaderRulesConfig overrides headers of a route's backend responses, e.g.
+// a Content-Security-Policy that differs between an admin UI and public
+// pages. Remove is applied first, then Set, then Add.
+type HeaderRulesConfig struct {
+	// Set replaces every value of each header with the listed values.
+	Set map[string][]string `json:"set"`
+	// Add appends the listed values, keeping those from the backend.
+	Add map[string][]string `json:"add"`
+	// Remove deletes the listed headers.
+	Remove []string `json:"remove"`
+}
+
+func (c *HeaderRulesConfig) validate() error {
+	for _, m := range []map[string][]string{c.Set, c.Add} {
+		for name, values := range m {
+			if err := validateHeaderName(name); err != nil {
+				return err
+			}
+			for _, v := range values {
+				if strings.ContainsAny(v, "\r\n\x00") {
+					return fmt.Errorf("header %q: value contains a line break or NUL", name)
+				}
+			}
+		}
+	}
+	for _, name := range c.Remove {
+		if err := validateHeaderName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CollapseHeaderConfig forwards a request header to backends at most once,
+// for backends that misbehave when a header such as Content-Type repeats.
+type CollapseHeaderConfig struct {
+	Name string `json:"name"`
+	// Keep is the occurrence forwarded: first (default) or last.
+	Keep string `json:"keep"`
+}
+
+func (c CollapseHeaderConfig) validate() error {
+	if err := validateHeaderName(c.Name); err != nil {
+		return fmt.Errorf("collapse_headers: %w", err)
+	}
+	if c.Keep != "" && c.Keep != "first" && c.Keep != "last" {
+		return fmt.Errorf("collapse_headers: %q: keep must be first or last", c.Name)
+	}
+	return nil
+}
+
+// collapseHeaders drops all but one occurrence of each header in rules.
+func collapseHeaders(h http.Header, rules []CollapseHeaderConfig) {
+	for _, rule := range rules {
+		key := http.CanonicalHeaderKey(rule.Name)
+		values := h[key]
+		if len(values) < 2 {
+			continue
+		}
+		if rule.Keep == "last" {
+			h[key] = values[len(values)-1:]
+		} else {
+			h[key] = values[:1]
+		}
+	}
+}
+
+// validateHeaderName reports an error unless name is a valid field name
+// token (RFC 9110, section 5.1).
+func validateHeaderName(name string) error {
+	if name == "" {
+		return errors.New("empty header name")
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte(`"(),/:;<=>?@[\]{}`, c) >= 0 {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// apply rewrites h according to the rules.
+func (c *HeaderRulesConfig) apply(h http.Header) {
+	for _, name := range c.Remove {
+		h.Del(name)
+	}
+	for name, values := range c.Set {
+		h[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+	for name, values := range c.Add {
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+}
+
+// serverIdentityKey holds the identityWriter of a request, so the proxy can
+// mark responses that came from a backend.
+type serverIdentityKey struct{}
+
+// serverIdentityMiddleware sets Config.ProxyServerHeader as the Server
+// header of responses the proxy generates itself, such as errors, health
+// checks and static routes, unless one is already set. Backend responses
+// are left to ServerHeader.
+func serverIdentityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := currentState().config.ProxyServerHeader
+		if identity == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		iw := &identityWriter{ResponseWriter: w, identity: identity}
+		next.ServeHTTP(iw, r.WithContext(context.WithValue(r.Context(), serverIdentityKey{}, iw)))
+	})
+}
+
+// markBackendResponse records that the response to the request with ctx
+// is a backend's, which keeps its own Server header.
+func markBackendResponse(ctx context.Context) {
+	if iw, ok := ctx.Value(serverIdentityKey{}).(*identityWriter); ok {
+		iw.fromBackend = true
+	}
+}
+
+// identityWriter sets the Server header as the response is written, unless
+// it came from a backend.
+type identityWriter struct {
+	http.ResponseWriter
+	identity    string
+	fromBackend bool
+	wroteHeader bool
+}
+
+func (iw *identityWriter) WriteHeader(code int) {
+	if !iw.wroteHeader && code >= 200 {
+		iw.wroteHeader = true
+		if !iw.fromBackend && iw.Header().Get("Server") == "" {
+			iw.Header().Set("Server", iw.identity)
+		}
+	}
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *identityWriter) Write(b []byte) (int, error) {
+	if !iw.wroteHeader {
+		iw.WriteHeader(http.StatusOK)
+	}
+	return iw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+// for flushing and hijacking.
+func (iw *identityWriter) Unwrap() http.ResponseWriter {
+	return iw.ResponseWriter
+}
+
+// filterTrailers limits the trailers of res to those in allowed. The
+// trailers declared up front are filtered at once, so clients are only told
+// to expect allowed ones; those received with the body, declared or not,
+// are filtered when it ends, before the proxy forwards them.
+func filterTrailers(res *http.Response, allowed []string) {
+	keep := func(name string) bool {
+		return slices.ContainsFunc(allowed, func(a string) bool { return strings.EqualFold(a, name) })
+	}
+	filter := func() {
+		for name := range res.Trailer {
+			if !keep(name) {
+				delete(res.Trailer, name)
+			}
+		}
+	}
+	filter()
+	res.Body = &trailerFilterBody{ReadCloser: res.Body, atEOF: filter}
+}
+
+// trailerFilterBody calls atEOF once the body has been read to the end,
+// when the transport has filled in the response trailers.
+type trailerFilterBody struct {
+	io.ReadCloser
+	atEOF func()
+}
+
+func (b *trailerFilterBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.atEOF()
+	}
+	return n, err
+}
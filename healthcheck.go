@@ -0,0 +1,324 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// HealthCheckConfig actively probes a pooled backend. Balancers skip a
+// backend whose last probe failed until a probe succeeds again.
+type HealthCheckConfig struct {
+	// Type is http (default), a GET of Path that must answer 2xx or 3xx,
+	// or tcp, which only requires the backend to accept a connection.
+	Type string `json:"type"`
+	// Path is the HTTP probe path. Defaults to /health.
+	Path string `json:"path"`
+	// Interval is the time between probes. Defaults to 10s.
+	Interval Duration `json:"interval"`
+	// Timeout bounds each probe. Defaults to 2s.
+	Timeout Duration `json:"timeout"`
+}
+
+// HealthChecksConfig spreads the health checks of all backends out, so
+// they do not probe in lockstep.
+type HealthChecksConfig struct {
+	// Concurrency caps the probes in flight at once. Zero means unlimited.
+	Concurrency int `json:"concurrency"`
+	// Jitter delays each probe by a random time up to this long.
+	Jitter Duration `json:"jitter"`
+}
+
+func (hc HealthChecksConfig) validate() error {
+	if hc.Concurrency < 0 || hc.Jitter < 0 {
+		return fmt.Errorf("health_checks: concurrency and jitter must not be negative")
+	}
+	return nil
+}
+
+var healthCheckTypes = []string{"", "http", "tcp"}
+
+const (
+	defaultHealthCheckPath     = "/health"
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+)
+
+func (hc HealthCheckConfig) validate() error {
+	if !slices.Contains(healthCheckTypes, hc.Type) {
+		return fmt.Errorf("health_check: unknown type %q", hc.Type)
+	}
+	if hc.Path != "" && hc.Path[0] != '/' {
+		return fmt.Errorf("health_check: path %q must start with /", hc.Path)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("health_check: interval and timeout must not be negative")
+	}
+	return nil
+}
+
+// probe checks backend once, returning nil if it is healthy.
+func (hc HealthCheckConfig) probe(ctx context.Context, backend string) error {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return err
+	}
+	if hc.Type == "tcp" {
+		return probeTCP(ctx, u)
+	}
+	return probeHTTP(ctx, backend, cmp.Or(hc.Path, defaultHealthCheckPath))
+}
+
+// probeTCP succeeds if the backend accepts a connection.
+func probeTCP(ctx context.Context, u *url.URL) error {
+	addr := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeHTTP succeeds if a GET of path on the backend answers 2xx or 3xx.
+func probeHTTP(ctx context.Context, backend, path string) error {
+	target, err := joinBackendURL(backend, path)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", target.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := currentState().transportFor(target).RoundTrip(withConnBackend(req))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 400 {
+		return fmt.Errorf("health check returned status %d", res.StatusCode)
+	}
+	return nil
+}
+
+const defaultStartupTimeout = 60 * time.Second
+
+// startupProbeInterval is the time between startup probes of a required
+// backend that is not yet reachable.
+var startupProbeInterval = time.Second
+
+// waitForRequiredBackends blocks until every required route in cfg has a
+// reachable backend, probing each with its health check, or a tcp check if
+// it has none. It fails with the routes still unreachable once
+// cfg.StartupTimeout passes or ctx is done.
+func waitForRequiredBackends(ctx context.Context, cfg *Config) error {
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(time.Duration(cfg.StartupTimeout), defaultStartupTimeout))
+	defer cancel()
+	results := make(chan error)
+	var waiting int
+	for _, rt := range cfg.Routes {
+		if !rt.Required {
+			continue
+		}
+		backends := rt.Backends
+		if len(backends) == 0 {
+			backends = []string{rt.Backend}
+		}
+		waiting++
+		go func() { results <- waitForRoute(ctx, cfg, rt.Prefix, backends) }()
+	}
+	var errs []error
+	for range waiting {
+		if err := <-results; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// waitForRoute probes backends in turn until one is reachable.
+func waitForRoute(ctx context.Context, cfg *Config, prefix string, backends []string) error {
+	slog.Info("waiting for required route", "route", prefix, "backends", backends)
+	ticker := time.NewTicker(startupProbeInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		for _, backend := range backends {
+			hc := HealthCheckConfig{Type: "tcp"}
+			if bc := cfg.Backends[backend].HealthCheck; bc != nil {
+				hc = *bc
+			}
+			probeCtx, cancel := context.WithTimeout(ctx, cmp.Or(time.Duration(hc.Timeout), defaultHealthCheckTimeout))
+			err := hc.probe(probeCtx, backend)
+			cancel()
+			if err == nil {
+				slog.Info("required route ready", "route", prefix, "backend", backend)
+				return nil
+			}
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("route %q: no backend reachable before startup timeout: %w", prefix, lastErr)
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopHealthChecks stops the probes started for the active config.
+var stopHealthChecks = func() {}
+
+// startHealthChecks probes every pooled backend that has a health check
+// configured until the returned function is called.
+func startHealthChecks(cfg *Config, states map[string]*backend) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &probeScheduler{jitter: time.Duration(cfg.HealthChecks.Jitter)}
+	if cfg.HealthChecks.Concurrency > 0 {
+		s.slots = make(chan struct{}, cfg.HealthChecks.Concurrency)
+	}
+	for raw, bc := range cfg.Backends {
+		if bc.HealthCheck == nil {
+			continue
+		}
+		u, err := url.Parse(raw)
+		if err != nil {
+			continue
+		}
+		if b := states[backendKey(u)]; b != nil {
+			go runHealthCheck(ctx, s, b, *bc.HealthCheck)
+		}
+	}
+	return cancel
+}
+
+// probeScheduler paces the probes of every backend.
+type probeScheduler struct {
+	jitter time.Duration
+	// slots holds a token per probe in flight, or is nil if unbounded.
+	slots chan struct{}
+}
+
+// acquire waits out a random jitter and then for a free probe slot. It
+// returns false if ctx is done first.
+func (s *probeScheduler) acquire(ctx context.Context) bool {
+	if s.jitter > 0 {
+		t := time.NewTimer(rand.N(s.jitter))
+		defer t.Stop()
+		select {
+		case <-ctx.Done():
+			return false
+		case <-t.C:
+		}
+	}
+	if s.slots == nil {
+		return ctx.Err() == nil
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case s.slots <- struct{}{}:
+		return true
+	}
+}
+
+func (s *probeScheduler) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// runHealthCheck probes b every interval until ctx is done, logging each
+// change in its health. The probe timeout starts once s grants a slot, so a
+// slow backend holds one for at most the timeout.
+func runHealthCheck(ctx context.Context, s *probeScheduler, b *backend, hc HealthCheckConfig) {
+	interval := cmp.Or(time.Duration(hc.Interval), defaultHealthCheckInterval)
+	timeout := cmp.Or(time.Duration(hc.Timeout), defaultHealthCheckTimeout)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !s.acquire(ctx) {
+			return
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := hc.probe(probeCtx, b.url)
+		cancel()
+		s.release()
+		if ctx.Err() != nil {
+			return
+		}
+		b.setHealth(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setHealth records the result of a probe of b, logging a change in its
+// health.
+func (b *backend) setHealth(err error) {
+	if wasUnhealthy := b.unhealthy.Swap(err != nil); wasUnhealthy != (err != nil) {
+		if err != nil {
+			slog.Warn("backend unhealthy", "backend", b.url, "error", err)
+		} else {
+			slog.Info("backend healthy", "backend", b.url)
+		}
+	}
+}
+
+// probeResult is the admin view of an on-demand probe.
+type probeResult struct {
+	Backend string `json:"backend"`
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// probeHandler probes the pooled backend named by the backend query
+// parameter at once, with its configured health check or the default one,
+// and records the result as its health.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := url.Parse(r.URL.Query().Get("backend"))
+	if err != nil || u.Host == "" {
+		http.Error(w, "backend must be a backend URL", http.StatusBadRequest)
+		return
+	}
+	s := currentState()
+	b := s.backendStates[backendKey(u)]
+	var hc HealthCheckConfig
+	if b != nil && s.config.Backends[b.url].HealthCheck != nil {
+		hc = *s.config.Backends[b.url].HealthCheck
+	}
+	if b == nil {
+		http.Error(w, "no pooled backend "+u.String(), http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), cmp.Or(time.Duration(hc.Timeout), defaultHealthCheckTimeout))
+	defer cancel()
+	err = hc.probe(ctx, b.url)
+	if r.Context().Err() != nil {
+		return
+	}
+	b.setHealth(err)
+	res := probeResult{Backend: b.url, Healthy: err == nil}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckProbe(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	refusing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refusing.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	tests := []struct {
+		name    string
+		hc      HealthCheckConfig
+		backend string
+		healthy bool
+	}{
+		{"tcp accepting", HealthCheckConfig{Type: "tcp"}, "http://" + ln.Addr().String(), true},
+		{"tcp refusing", HealthCheckConfig{Type: "tcp"}, "http://" + refusing.Addr().String(), false},
+		{"http ok", HealthCheckConfig{Path: "/ready"}, healthy.URL, true},
+		{"http wrong path", HealthCheckConfig{}, healthy.URL, false},
+		{"http error status", HealthCheckConfig{}, failing.URL, false},
+		{"http refusing", HealthCheckConfig{}, "http://" + refusing.Addr().String(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err := tt.hc.probe(ctx, tt.backend)
+			if (err == nil) != tt.healthy {
+				t.Errorf("probe error = %v, want healthy %v", err, tt.healthy)
+			}
+		})
+	}
+}
+
+func TestHealthCheck_SkipsUnhealthyBackend(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("up"))
+	}))
+	defer up.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downURL := "http://" + down.Addr().String()
+	down.Close()
+
+	captureLogs(t)
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{downURL, up.URL}}}
+		c.Backends = map[string]BackendConfig{
+			downURL: {HealthCheck: &HealthCheckConfig{Type: "tcp", Interval: Duration(10 * time.Millisecond)}},
+		}
+	})
+
+	deadline := time.Now().Add(time.Second)
+	for currentState().backendStates[downURL].healthy() {
+		if time.Now().After(deadline) {
+			t.Fatal("backend never marked unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "up" {
+			t.Errorf("request %d: status %d body %q, want 200 up", i, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+func TestBalancers_AllUnhealthy(t *testing.T) {
+	backends := testBackends("http://a", "http://b")
+	for _, b := range backends {
+		b.unhealthy.Store(true)
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for strategy := range balancerFactories {
+		p, _ := newPool(strategy, backends)
+		if got := p.Pick(req); got != nil {
+			t.Errorf("%s: Pick = %s, want nil", strategy, got.url)
+		}
+	}
+}
+
+// probedBackends starts n backends that answer health checks through
+// handler, returning the config and backend states that probe them.
+func probedBackends(t *testing.T, n int, hc HealthCheckConfig, handler http.HandlerFunc) (*Config, map[string]*backend) {
+	t.Helper()
+	cfg := &Config{Backends: map[string]BackendConfig{}}
+	states := map[string]*backend{}
+	for range n {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		cfg.Backends[srv.URL] = BackendConfig{HealthCheck: &hc}
+		states[srv.URL] = &backend{url: srv.URL}
+	}
+	return cfg, states
+}
+
+func TestHealthChecks_Concurrency(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, peak, probes int
+	cfg, states := probedBackends(t, 6, HealthCheckConfig{Interval: Duration(10 * time.Millisecond)},
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			inFlight++
+			peak = max(peak, inFlight)
+			probes++
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		})
+	cfg.HealthChecks.Concurrency = 2
+
+	stop := startHealthChecks(cfg, states)
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return probes >= 12
+	})
+	stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if peak > 2 {
+		t.Errorf("peak probes in flight = %d, want at most 2", peak)
+	}
+}
+
+func TestHealthChecks_Jitter(t *testing.T) {
+	var mu sync.Mutex
+	first := map[string]time.Time{}
+	cfg, states := probedBackends(t, 8, HealthCheckConfig{Interval: Duration(time.Minute)},
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := first[r.Host]; !ok {
+				first[r.Host] = time.Now()
+			}
+		})
+	cfg.HealthChecks.Jitter = Duration(200 * time.Millisecond)
+
+	stop := startHealthChecks(cfg, states)
+	defer stop()
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(first) == 8
+	})
+
+	mu.Lock()
+	defer mu.Unlock()
+	var earliest, latest time.Time
+	for _, at := range first {
+		if earliest.IsZero() || at.Before(earliest) {
+			earliest = at
+		}
+		if at.After(latest) {
+			latest = at
+		}
+	}
+	if spread := latest.Sub(earliest); spread < 20*time.Millisecond {
+		t.Errorf("first probes spread over %v, want them staggered", spread)
+	}
+}
+
+func TestHealthChecks_SlowProbeDoesNotBlockOthers(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	var probes atomic.Int64
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+	}))
+	defer fast.Close()
+
+	hc := HealthCheckConfig{Interval: Duration(10 * time.Millisecond), Timeout: Duration(time.Minute)}
+	cfg := &Config{
+		Backends:     map[string]BackendConfig{slow.URL: {HealthCheck: &hc}, fast.URL: {HealthCheck: &hc}},
+		HealthChecks: HealthChecksConfig{Concurrency: 2},
+	}
+	states := map[string]*backend{slow.URL: {url: slow.URL}, fast.URL: {url: fast.URL}}
+	stop := startHealthChecks(cfg, states)
+	defer stop()
+
+	waitFor(t, func() bool { return probes.Load() >= 5 })
+}
+
+func TestProbeHandler(t *testing.T) {
+	var failing atomic.Bool
+	var probes atomic.Int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	captureLogs(t)
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{srv.URL}}}
+		c.Backends = map[string]BackendConfig{srv.URL: {HealthCheck: &HealthCheckConfig{Interval: Duration(time.Hour)}}}
+	})
+	// Let the scheduled first probe finish before probing on demand.
+	waitFor(t, func() bool { return probes.Load() == 1 })
+
+	probe := func() probeResult {
+		t.Helper()
+		rr := adminRequest(t, "POST", "/admin/health/probe?backend="+url.QueryEscape(srv.URL))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("probe status = %d, want 200", rr.Code)
+		}
+		var res probeResult
+		if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	failing.Store(true)
+	if res := probe(); res.Healthy || res.Error == "" {
+		t.Errorf("probe of failing backend = %+v, want unhealthy with an error", res)
+	}
+	if currentState().backendStates[srv.URL].healthy() {
+		t.Error("backend still healthy after a failed on-demand probe")
+	}
+	failing.Store(false)
+	if res := probe(); !res.Healthy {
+		t.Errorf("probe of recovered backend = %+v, want healthy", res)
+	}
+	if !currentState().backendStates[srv.URL].healthy() {
+		t.Error("backend still unhealthy after a passing on-demand probe")
+	}
+	if got := probes.Load(); got != 3 {
+		t.Errorf("backend probed %d times, want 3", got)
+	}
+
+	if rr := adminRequest(t, "POST", "/admin/health/probe?backend=http://unknown.example"); rr.Code != http.StatusNotFound {
+		t.Errorf("probe of unknown backend = %d, want 404", rr.Code)
+	}
+}
+
+func TestWaitForRequiredBackends(t *testing.T) {
+	prevInterval := startupProbeInterval
+	startupProbeInterval = 5 * time.Millisecond
+	t.Cleanup(func() { startupProbeInterval = prevInterval })
+	captureLogs(t)
+
+	// starting answers its health check with 503 until ready is set.
+	var ready atomic.Bool
+	starting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer starting.Close()
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	downURL := "http://" + down.Addr().String()
+	down.Close()
+
+	newConfig := func(timeout time.Duration, required bool) *Config {
+		return &Config{
+			StartupTimeout: Duration(timeout),
+			Routes: []RouteConfig{
+				{Prefix: "/api", Backends: []string{downURL, starting.URL}, Required: required},
+				// Optional routes never hold up startup.
+				{Prefix: "/optional", Backend: downURL},
+			},
+			Backends: map[string]BackendConfig{
+				starting.URL: {HealthCheck: &HealthCheckConfig{Path: "/ready"}},
+			},
+		}
+	}
+
+	t.Run("blocks until reachable", func(t *testing.T) {
+		ready.Store(false)
+		const readyAfter = 50 * time.Millisecond
+		time.AfterFunc(readyAfter, func() { ready.Store(true) })
+		start := time.Now()
+		if err := waitForRequiredBackends(context.Background(), newConfig(time.Second, true)); err != nil {
+			t.Fatalf("waitForRequiredBackends: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < readyAfter {
+			t.Errorf("returned after %v, before the backend was ready", elapsed)
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		ready.Store(false)
+		const timeout = 50 * time.Millisecond
+		start := time.Now()
+		err := waitForRequiredBackends(context.Background(), newConfig(timeout, true))
+		if err == nil || !strings.Contains(err.Error(), `route "/api"`) {
+			t.Fatalf("waitForRequiredBackends = %v, want the /api route unreachable", err)
+		}
+		if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+			t.Errorf("gave up after %v, want about %v", elapsed, timeout)
+		}
+	})
+
+	t.Run("no required routes", func(t *testing.T) {
+		ready.Store(false)
+		if err := waitForRequiredBackends(context.Background(), newConfig(time.Second, false)); err != nil {
+			t.Errorf("waitForRequiredBackends = %v, want no wait", err)
+		}
+	})
+}
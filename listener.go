@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ListenerConfig tunes the proxy's TCP listener for high connection rates.
+type ListenerConfig struct {
+	// Backlog is the length of the queue of connections waiting to be
+	// accepted. Zero uses the system default, net.core.somaxconn on Linux.
+	Backlog int `json:"backlog"`
+	// ReusePort sets SO_REUSEPORT, so several proxy processes can listen
+	// on the same address and the kernel spreads connections across them.
+	// SO_REUSEADDR is always set, so a restart can rebind at once.
+	ReusePort bool `json:"reuse_port"`
+}
+
+func (lc ListenerConfig) validate() error {
+	if lc.Backlog < 0 {
+		return errors.New("listener: backlog must not be negative")
+	}
+	if (lc.Backlog > 0 || lc.ReusePort) && !socketOptionsSupported {
+		return errors.New("listener: backlog and reuse_port are not supported on this platform")
+	}
+	return nil
+}
+
+// listen opens the TCP listener on addr with the socket options of lc.
+func listen(addr string, lc ListenerConfig) (net.Listener, error) {
+	cfg := net.ListenConfig{}
+	if lc.ReusePort {
+		cfg.Control = setReusePort
+	}
+	ln, err := cfg.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if lc.Backlog > 0 {
+		if err := setBacklog(ln.(*net.TCPListener), lc.Backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
@@ -0,0 +1,43 @@
+//go:build linux && !(mips || mipsle || mips64 || mips64le)
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+const socketOptionsSupported = true
+
+// soReusePort is SO_REUSEPORT, which package syscall does not define on
+// Linux. MIPS numbers it differently and falls back to listener_other.go.
+const soReusePort = 0xf
+
+// setReusePort sets SO_REUSEPORT on a socket before it is bound.
+func setReusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setBacklog resizes the accept queue of a listening socket. Linux applies
+// a repeated listen call to the socket in place.
+func setBacklog(ln *net.TCPListener, backlog int) error {
+	rc, err := ln.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	err = rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return listenErr
+}
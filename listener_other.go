@@ -0,0 +1,21 @@
+//go:build !linux || mips || mipsle || mips64 || mips64le
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const socketOptionsSupported = false
+
+var errSocketOptions = errors.New("socket options are not supported on this platform")
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errSocketOptions
+}
+
+func setBacklog(ln *net.TCPListener, backlog int) error {
+	return errSocketOptions
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestListen_ReusePort(t *testing.T) {
+	if !socketOptionsSupported {
+		t.Skip("socket options not supported on this platform")
+	}
+	tests := []struct {
+		name      string
+		cfg       ListenerConfig
+		wantShare bool
+	}{
+		{"default", ListenerConfig{}, false},
+		{"reuse port", ListenerConfig{ReusePort: true}, true},
+		{"reuse port with backlog", ListenerConfig{ReusePort: true, Backlog: 16}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			first, err := listen("127.0.0.1:0", tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer first.Close()
+			second, err := listen(first.Addr().String(), tt.cfg)
+			if err == nil {
+				defer second.Close()
+			}
+			if shared := err == nil; shared != tt.wantShare {
+				t.Errorf("second bind succeeded = %v (%v), want %v", shared, err, tt.wantShare)
+			}
+		})
+	}
+}
+
+func TestListen_Backlog(t *testing.T) {
+	if !socketOptionsSupported {
+		t.Skip("socket options not supported on this platform")
+	}
+	ln, err := listen("127.0.0.1:0", ListenerConfig{Backlog: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("Accept() after resizing the backlog: %v", err)
+	}
+	accepted.Close()
+
+	if err := (ListenerConfig{Backlog: -1}).validate(); err == nil {
+		t.Error("validate() accepted a negative backlog")
+	}
+}
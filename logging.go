@@ -1,28 +1,104 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// LogConfig enriches every access log entry.
+type LogConfig struct {
+	// Attributes are static key/value pairs, e.g. region or instance id.
+	Attributes map[string]string `json:"attributes"`
+	// Headers lists request headers whose values are logged.
+	Headers []string `json:"headers"`
+	// RedactHeaders lists logged headers whose values are hidden. Defaults
+	// to defaultRedactHeaders.
+	RedactHeaders []string `json:"redact_headers"`
+	// FailClosed answers 500 instead of the backend's response when the
+	// access log entry cannot be written. Responses are then held until
+	// logged, so they are not streamed, up to maxHeldResponseSize. A larger
+	// response streams once it passes that size, and its connection is
+	// aborted instead if its entry cannot be written.
+	FailClosed bool `json:"fail_closed"`
+	// BalancerDecisions logs the balancing strategy that picked a pool
+	// backend, or "override", and why other pool members were skipped.
+	BalancerDecisions bool `json:"balancer_decisions"`
+	// Sink is where entries are written: slog (default), the process
+	// logger, or otlp, an OpenTelemetry collector configured by OTLP.
+	Sink string         `json:"sink"`
+	OTLP *OTLPLogConfig `json:"otlp"`
+}
+
+// RouteLogConfig adds headers to the access log entries of one route.
+type RouteLogConfig struct {
+	RequestHeaders  []string `json:"request_headers"`
+	ResponseHeaders []string `json:"response_headers"`
+}
+
+// logFields are the built-in access log keys, which configured attributes
+// may not override.
+var logFields = []string{
+	"timestamp", "method", "host", "path", "backend", "status", "latency_ms",
+	"client_ip", "client_port", "request_size", "response_size", "client_stall_ms",
+	"headers", "response_headers", "canceled", "strategy", "skipped", "replay",
+	"compressed", "uncompressed_size",
+}
+
 type LogEntry struct {
-	Timestamp    time.Time
-	Method       string
-	Path         string
-	Backend      string
-	Status       int
-	LatencyMs    int64
-	ClientIP     string
+	Timestamp time.Time
+	Method    string
+	Host      string
+	Path      string
+	Backend   string
+	Status    int
+	LatencyMs int64
+	ClientIP  string
+	// ClientPort is the client's source port, or 0 if unknown.
+	ClientPort   int
 	RequestSize  int
 	ResponseSize int
+	// ClientStallMs is the time spent blocked writing the response to a
+	// slow client, as opposed to waiting on the backend.
+	ClientStallMs int64
+	Headers       map[string]string
+	// ResponseHeaders holds the response headers configured for the route.
+	ResponseHeaders map[string]string
+	// Canceled is set when the client went away before the response
+	// completed. Status is then statusClientClosedRequest.
+	Canceled bool
+	// Strategy is the balancing strategy that picked the backend, and
+	// Skipped maps the pool members it passed over to the reason why.
+	Strategy string
+	Skipped  map[string]string
+	// Replay is set for requests replayed through the admin API.
+	Replay bool
+	// Attributes are the static Config.Log.Attributes.
+	Attributes map[string]string
+	// Compressed is set when the proxy gzipped the response. ResponseSize
+	// is then the compressed size and UncompressedSize the size before.
+	Compressed       bool
+	UncompressedSize int64
 }
 
-func LogRequest(entry LogEntry) {
-	slog.Info("proxy request",
+// LogRequest writes entry to the default logger, or the OTLP sink if one
+// is configured, returning the error of a failed write.
+func LogRequest(entry LogEntry) error {
+	args := []any{
 		"timestamp", entry.Timestamp.Format(time.RFC3339),
 		"method", entry.Method,
+		"host", entry.Host,
 		"path", entry.Path,
 		"backend", entry.Backend,
 		"status", entry.Status,
@@ -30,33 +106,276 @@ func LogRequest(entry LogEntry) {
 		"client_ip", entry.ClientIP,
 		"request_size", entry.RequestSize,
 		"response_size", entry.ResponseSize,
-	)
+		"client_stall_ms", entry.ClientStallMs,
+	}
+	if entry.ClientPort != 0 {
+		args = append(args, "client_port", entry.ClientPort)
+	}
+	if len(entry.Headers) > 0 {
+		args = append(args, "headers", entry.Headers)
+	}
+	if len(entry.ResponseHeaders) > 0 {
+		args = append(args, "response_headers", entry.ResponseHeaders)
+	}
+	if entry.Canceled {
+		args = append(args, "canceled", true)
+	}
+	if entry.Strategy != "" {
+		args = append(args, "strategy", entry.Strategy)
+	}
+	if len(entry.Skipped) > 0 {
+		args = append(args, "skipped", entry.Skipped)
+	}
+	if entry.Replay {
+		args = append(args, "replay", true)
+	}
+	if entry.Compressed {
+		args = append(args, "compressed", true, "uncompressed_size", entry.UncompressedSize)
+	}
+
+	keys := make([]string, 0, len(entry.Attributes))
+	for k := range entry.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, k, entry.Attributes[k])
+	}
+
+	if sink := logSink.Load(); sink != nil {
+		return sink.Emit(newOTLPLogRecord(time.Now(), "proxy request", args))
+	}
+
+	ctx := context.Background()
+	h := slog.Default().Handler()
+	if !h.Enabled(ctx, slog.LevelInfo) {
+		return nil
+	}
+	rec := slog.NewRecord(time.Now(), slog.LevelInfo, "proxy request", 0)
+	rec.Add(args...)
+	return h.Handle(ctx, rec)
+}
+
+// loggedHeaders picks the named headers present on h, redacting the values
+// of those in redact, or in defaultRedactHeaders if it is nil.
+func loggedHeaders(h http.Header, names, redact []string) map[string]string {
+	if redact == nil {
+		redact = defaultRedactHeaders
+	}
+	var headers map[string]string
+	for _, name := range names {
+		v := h.Get(name)
+		if v == "" {
+			continue
+		}
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		if slices.ContainsFunc(redact, func(r string) bool { return strings.EqualFold(r, name) }) {
+			v = "[REDACTED]"
+		}
+		headers[http.CanonicalHeaderKey(name)] = v
+	}
+	return headers
+}
+
+// requestInfo collects details about a request as it passes through the
+// proxy, for the access log.
+type requestInfo struct {
+	// backend is the backend the request was forwarded to.
+	backend string
+	// start is when the proxy received the request.
+	start time.Time
+	// strategy and skipped record the balancer decision, when
+	// Config.Log.BalancerDecisions is on.
+	strategy string
+	skipped  map[string]string
+	// status overrides the logged status when the response was not written
+	// through the ResponseWriter, e.g. a hijacked and closed connection.
+	status int
+	// compressed and uncompressedSize record a response gzipped by
+	// compressMiddleware and its size before compression.
+	compressed       bool
+	uncompressedSize int64
+}
+
+type requestInfoKey struct{}
+
+// requestInfoFrom returns the requestInfo attached by loggingMiddleware, or
+// nil if there is none.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
-		w = recorder
 		start := time.Now()
+		info := &requestInfo{start: start}
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		s := stateFrom(r.Context())
+		lc := s.config.Log
+		var held *heldResponse
+		if lc.FailClosed {
+			held = &heldResponse{ResponseWriter: w}
+			w = held
+		}
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK, head: r.Method == http.MethodHead}
+		w = recorder
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
 
 		next.ServeHTTP(w, r)
 
 		clientIP, _, _ := net.SplitHostPort(r.RemoteAddr)
-		requestSize := int(r.ContentLength)
-		if requestSize < 0 {
-			requestSize = 0
-		}
-		_, backend, _ := matchRoute(r.URL.Path, routes)
-		LogRequest(LogEntry{
-			Timestamp:    start,
-			Method:       r.Method,
-			Path:         r.URL.Path,
-			Backend:      backend,
-			Status:       recorder.statusCode,
-			LatencyMs:    time.Since(start).Milliseconds(),
-			ClientIP:     clientIP,
-			RequestSize:  requestSize,
-			ResponseSize: recorder.bytesWritten,
+		status := cmp.Or(info.status, recorder.statusCode)
+		canceled := errors.Is(r.Context().Err(), context.Canceled)
+		if canceled {
+			status = statusClientClosedRequest
+		}
+		route, _ := routeMatchFrom(r.Context())
+		backend := cmp.Or(info.backend, route.Backend)
+		if route.Prefix != "" {
+			recordRouteStatus(s, route.Prefix, status)
+		}
+		var routeLog RouteLogConfig
+		if route.Config.Log != nil {
+			routeLog = *route.Config.Log
+		}
+		err := LogRequest(LogEntry{
+			Timestamp:        start,
+			Method:           r.Method,
+			Host:             r.Host,
+			Path:             r.URL.Path,
+			Backend:          backend,
+			Status:           status,
+			LatencyMs:        time.Since(start).Milliseconds(),
+			ClientIP:         clientIP,
+			ClientPort:       clientPort(r.RemoteAddr),
+			RequestSize:      int(body.n),
+			ResponseSize:     recorder.bytesWritten,
+			ClientStallMs:    recorder.writeTime.Milliseconds(),
+			Headers:          loggedHeaders(r.Header, slices.Concat(lc.Headers, routeLog.RequestHeaders), lc.RedactHeaders),
+			ResponseHeaders:  loggedHeaders(recorder.Header(), routeLog.ResponseHeaders, lc.RedactHeaders),
+			Canceled:         canceled,
+			Strategy:         info.strategy,
+			Skipped:          info.skipped,
+			Replay:           replayFrom(r.Context()) != nil,
+			Attributes:       lc.Attributes,
+			Compressed:       info.compressed,
+			UncompressedSize: info.uncompressedSize,
 		})
+		if held == nil {
+			return
+		}
+		if err != nil && held.streaming {
+			// Too late to replace the response; cut it short instead.
+			panic(http.ErrAbortHandler)
+		}
+		if err != nil && !held.hijacked {
+			held.discard()
+			http.Error(held.ResponseWriter, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		held.commit()
 	})
 }
+
+// maxHeldResponseSize bounds the body a heldResponse keeps in memory.
+const maxHeldResponseSize = 1 << 20
+
+// heldResponse holds a response back from the client until it is committed,
+// so it can still be replaced. Flushes are deferred to the commit; a
+// hijacked connection is handed over at once. A body larger than
+// maxHeldResponseSize is sent on as it grows past it, and streams from then
+// on.
+type heldResponse struct {
+	http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	hijacked  bool
+	streaming bool
+}
+
+func (h *heldResponse) WriteHeader(code int) {
+	if h.status == 0 {
+		h.status = code
+	}
+}
+
+func (h *heldResponse) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	if !h.streaming && h.body.Len()+len(b) > maxHeldResponseSize {
+		h.stream()
+	}
+	if h.streaming {
+		return h.ResponseWriter.Write(b)
+	}
+	return h.body.Write(b)
+}
+
+// stream sends what is held and passes the rest of the response through.
+func (h *heldResponse) stream() {
+	h.streaming = true
+	h.ResponseWriter.WriteHeader(h.status)
+	h.ResponseWriter.Write(h.body.Bytes())
+	h.body = bytes.Buffer{}
+}
+
+// FlushError defers the flush to commit, unless the response streams.
+func (h *heldResponse) FlushError() error {
+	if h.streaming {
+		return http.NewResponseController(h.ResponseWriter).Flush()
+	}
+	return nil
+}
+
+func (h *heldResponse) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(h.ResponseWriter).Hijack()
+	if err == nil {
+		h.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// commit sends the held response to the client.
+func (h *heldResponse) commit() {
+	if h.hijacked || h.streaming {
+		return
+	}
+	h.ResponseWriter.WriteHeader(cmp.Or(h.status, http.StatusOK))
+	h.ResponseWriter.Write(h.body.Bytes())
+}
+
+// discard drops the held response, including its headers.
+func (h *heldResponse) discard() {
+	clear(h.ResponseWriter.Header())
+	h.body.Reset()
+}
+
+// clientPort returns the source port in a RemoteAddr, or 0 if it has none.
+func clientPort(remoteAddr string) int {
+	_, port, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(port)
+	return n
+}
+
+// countingReader counts the bytes read through a request body, so chunked
+// uploads without a Content-Length are still sized accurately.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
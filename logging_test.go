@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLogs redirects the default slog logger to a JSON buffer for the
+// duration of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	return &buf
+}
+
+// logRecords decodes every JSON log line written to buf.
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var records []map[string]any
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var rec map[string]any
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("decoding log line: %v", err)
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// accessLog returns the single "proxy request" record written to buf.
+func accessLog(t *testing.T, buf *bytes.Buffer) map[string]any {
+	t.Helper()
+	for _, rec := range logRecords(t, buf) {
+		if rec["msg"] == "proxy request" {
+			return rec
+		}
+	}
+	t.Fatal("no access log record written")
+	return nil
+}
+
+func TestLoggingMiddleware_ChunkedRequestSize(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	logs := captureLogs(t)
+
+	payload := strings.Repeat("x", 12345)
+	req := httptest.NewRequest("POST", "/service1/upload", strings.NewReader(payload))
+	req.ContentLength = -1
+	req.TransferEncoding = []string{"chunked"}
+	rr := httptest.NewRecorder()
+
+	routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(rr, req)
+
+	entry := accessLog(t, logs)
+	if got := entry["request_size"]; got != float64(len(payload)) {
+		t.Errorf("request_size = %v, want %v", got, len(payload))
+	}
+}
+
+func TestLogRequest_ExtraAttributes(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.Log = LogConfig{
+			Attributes: map[string]string{"region": "eu-west-1", "instance_id": "proxy-7"},
+			Headers:    []string{"X-Tenant-ID", "User-Agent"},
+		}
+	})
+	logs := captureLogs(t)
+
+	req := httptest.NewRequest("GET", "/unknown", nil)
+	req.Header.Set("X-Tenant-ID", "acme")
+	req.Header.Set("Authorization", "Bearer secret")
+	routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := accessLog(t, logs)
+	if entry["region"] != "eu-west-1" || entry["instance_id"] != "proxy-7" {
+		t.Errorf("static attributes missing from %v", entry)
+	}
+	headers, _ := entry["headers"].(map[string]any)
+	if headers["X-Tenant-Id"] != "acme" {
+		t.Errorf("headers = %v, want X-Tenant-Id=acme", headers)
+	}
+	if _, ok := headers["Authorization"]; ok {
+		t.Errorf("headers = %v, unconfigured header logged", headers)
+	}
+	if _, ok := headers["User-Agent"]; ok {
+		t.Errorf("headers = %v, absent header logged", headers)
+	}
+}
+
+func TestLoggingMiddleware_RouteHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Cache", "HIT")
+		w.Header().Set("Set-Cookie", "session=abc")
+		w.Header().Set("X-Other", "unlogged")
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{
+		Prefix:  "/api",
+		Backend: backend.URL,
+		Log: &RouteLogConfig{
+			RequestHeaders:  []string{"X-Client", "Authorization"},
+			ResponseHeaders: []string{"X-Cache", "Set-Cookie"},
+		},
+	})
+	logs := captureLogs(t)
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set("X-Client", "mobile")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Unlogged", "x")
+	routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := accessLog(t, logs)
+	want := map[string]map[string]any{
+		"headers":          {"X-Client": "mobile", "Authorization": "[REDACTED]"},
+		"response_headers": {"X-Cache": "HIT", "Set-Cookie": "[REDACTED]"},
+	}
+	for key, wantHeaders := range want {
+		got, _ := entry[key].(map[string]any)
+		if len(got) != len(wantHeaders) {
+			t.Errorf("%s = %v, want %v", key, got, wantHeaders)
+			continue
+		}
+		for name, v := range wantHeaders {
+			if got[name] != v {
+				t.Errorf("%s[%s] = %v, want %v", key, name, got[name], v)
+			}
+		}
+	}
+}
+
+func TestLoggingMiddleware_ClientPort(t *testing.T) {
+	tests := []struct {
+		remoteAddr string
+		want       any
+	}{
+		{"192.0.2.1:51234", float64(51234)},
+		{"[2001:db8::1]:443", float64(443)},
+		{"192.0.2.1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest("GET", "/unknown", nil)
+			req.RemoteAddr = tt.remoteAddr
+			routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), req)
+
+			if got := accessLog(t, logs)["client_port"]; got != tt.want {
+				t.Errorf("client_port = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigValidate_LogAttributeClash(t *testing.T) {
+	for _, name := range []string{"status", "compressed", "uncompressed_size"} {
+		c := &Config{Log: LogConfig{Attributes: map[string]string{name: "x"}}}
+		if err := c.validate(); err == nil {
+			t.Errorf("validate() = nil, want error for attribute %q overriding a built-in field", name)
+		}
+	}
+}
+
+func TestLoggingMiddleware_ClientCanceled(t *testing.T) {
+	backendReached := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(backendReached)
+		<-r.Context().Done()
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	logs := captureLogs(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-backendReached
+		cancel()
+	}()
+	req := httptest.NewRequest("GET", "/service1", nil).WithContext(ctx)
+	routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), req)
+
+	entry := accessLog(t, logs)
+	if entry["status"] != float64(statusClientClosedRequest) {
+		t.Errorf("status = %v, want %v", entry["status"], statusClientClosedRequest)
+	}
+	if entry["canceled"] != true {
+		t.Errorf("canceled = %v, want true", entry["canceled"])
+	}
+}
+
+func TestLoggingMiddleware_ClientStall(t *testing.T) {
+	payload := bytes.Repeat([]byte("x"), 16<<20)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload)
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	logs := captureLogs(t)
+
+	done := make(chan struct{})
+	handler := routeMiddleware(loggingMiddleware(newProxy()))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /service1 HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+
+	// Let the socket buffers fill before reading anything.
+	const stall = 300 * time.Millisecond
+	time.Sleep(stall)
+	io.Copy(io.Discard, conn)
+	<-done
+
+	entry := accessLog(t, logs)
+	if got := entry["client_stall_ms"].(float64); got < float64(stall.Milliseconds()/2) {
+		t.Errorf("client_stall_ms = %v, want at least %v", got, stall.Milliseconds()/2)
+	}
+}
+
+func TestLoggingMiddleware_Host(t *testing.T) {
+	logs := captureLogs(t)
+	req := httptest.NewRequest("GET", "/unknown", nil)
+	req.Host = "api.example.com"
+	routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), req)
+
+	if entry := accessLog(t, logs); entry["host"] != "api.example.com" {
+		t.Errorf("host = %v, want api.example.com", entry["host"])
+	}
+}
+
+func TestLoggingMiddleware_UnknownLength(t *testing.T) {
+	// rawBackend answers with a close-delimited body, without
+	// Content-Length or chunking, and flushes between the two halves.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	release := make(chan struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method == http.MethodHead {
+					io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 1234\r\n\r\n")
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nfirst ")
+				<-release
+				io.WriteString(conn, "second")
+			}()
+		}
+	}()
+	withRoute(t, "/raw", "http://"+ln.Addr().String())
+	proxy := httptest.NewServer(newHandler())
+	defer proxy.Close()
+
+	t.Run("GET", func(t *testing.T) {
+		logs := captureLogs(t)
+		res, err := http.Get(proxy.URL + "/raw")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.ContentLength != -1 || len(res.TransferEncoding) != 1 || res.TransferEncoding[0] != "chunked" {
+			t.Errorf("framing = Content-Length %d, Transfer-Encoding %v, want chunked", res.ContentLength, res.TransferEncoding)
+		}
+		// The first half arrives while the backend is still sending.
+		first := make([]byte, len("first "))
+		if _, err := io.ReadFull(res.Body, first); err != nil {
+			t.Fatal(err)
+		}
+		close(release)
+		rest, _ := io.ReadAll(res.Body)
+		if got := string(first) + string(rest); got != "first second" {
+			t.Errorf("body = %q, want %q", got, "first second")
+		}
+		res.Body.Close()
+		if got := accessLog(t, logs)["response_size"]; got != float64(len("first second")) {
+			t.Errorf("response_size = %v, want %d", got, len("first second"))
+		}
+	})
+
+	tests := []struct {
+		path     string
+		wantSize string
+	}{
+		{"/raw", "1234"},
+		{"/unknown", "16"},
+	}
+	for _, tt := range tests {
+		t.Run("HEAD "+tt.path, func(t *testing.T) {
+			logs := captureLogs(t)
+			res, err := http.Head(proxy.URL + tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if got := res.Header.Get("Content-Length"); got != tt.wantSize {
+				t.Errorf("Content-Length = %q, want %q", got, tt.wantSize)
+			}
+			if got := accessLog(t, logs)["response_size"]; got != float64(0) {
+				t.Errorf("response_size = %v, want 0 for a HEAD response", got)
+			}
+		})
+	}
+}
+
+// failingWriter rejects every write, like a full disk or a closed pipe.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("sink unavailable") }
+
+func TestLoggingMiddleware_FailClosed(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	tests := []struct {
+		name       string
+		failClosed bool
+		sink       io.Writer
+		wantStatus int
+		wantBody   string
+	}{
+		{"fail open, failing sink", false, failingWriter{}, http.StatusCreated, "created"},
+		{"fail closed, working sink", true, io.Discard, http.StatusCreated, "created"},
+		{"fail closed, failing sink", true, failingWriter{}, http.StatusInternalServerError, "Internal Server Error\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.Log.FailClosed = tt.failClosed })
+			prev := slog.Default()
+			slog.SetDefault(slog.New(slog.NewJSONHandler(tt.sink, nil)))
+			t.Cleanup(func() { slog.SetDefault(prev) })
+
+			rr := httptest.NewRecorder()
+			routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(rr, httptest.NewRequest("GET", "/service1", nil))
+			if rr.Code != tt.wantStatus || rr.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", rr.Code, rr.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if backendHeader := rr.Header().Get("X-Backend"); (backendHeader != "") != (tt.wantStatus != http.StatusInternalServerError) {
+				t.Errorf("X-Backend = %q in a %d response", backendHeader, rr.Code)
+			}
+		})
+	}
+}
+
+func TestLoggingMiddleware_FailClosedLargeResponse(t *testing.T) {
+	payload := strings.Repeat("x", maxHeldResponseSize+1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload)
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	withConfig(t, func(c *Config) { c.Log.FailClosed = true })
+	handler := routeMiddleware(loggingMiddleware(newProxy()))
+
+	t.Run("working sink", func(t *testing.T) {
+		captureLogs(t)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/service1", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != payload {
+			t.Errorf("response = %d with %d bytes, want 200 with %d", rr.Code, rr.Body.Len(), len(payload))
+		}
+	})
+
+	t.Run("failing sink", func(t *testing.T) {
+		prev := slog.Default()
+		slog.SetDefault(slog.New(slog.NewJSONHandler(failingWriter{}, nil)))
+		t.Cleanup(func() { slog.SetDefault(prev) })
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("recovered %v, want the streamed response aborted", v)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/service1", nil))
+	})
+}
+
+func TestLoggingMiddleware_BalancerDecisions(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer good.Close()
+	sick := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer sick.Close()
+	fused := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fused.Close()
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{sick.URL, fused.URL, good.URL}, Strategy: "least-conn"}}
+		c.Backends = map[string]BackendConfig{fused.URL: {Fuse: &FuseConfig{Window: Duration(time.Minute)}}}
+	})
+	currentState().backendStates[sick.URL].unhealthy.Store(true)
+	currentState().backendStates[fused.URL].fuse.blown = true
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprint("enabled=", enabled), func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.Log.BalancerDecisions = enabled })
+			logs := captureLogs(t)
+			routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+
+			entry := accessLog(t, logs)
+			if entry["backend"] != good.URL {
+				t.Errorf("backend = %v, want %s", entry["backend"], good.URL)
+			}
+			if !enabled {
+				if _, ok := entry["strategy"]; ok {
+					t.Errorf("strategy logged while disabled: %v", entry)
+				}
+				return
+			}
+			if entry["strategy"] != "least-conn" {
+				t.Errorf("strategy = %v, want least-conn", entry["strategy"])
+			}
+			skipped, _ := entry["skipped"].(map[string]any)
+			if len(skipped) != 2 || skipped[sick.URL] != "unhealthy" || skipped[fused.URL] != "fused" {
+				t.Errorf("skipped = %v, want %s unhealthy and %s fused", skipped, sick.URL, fused.URL)
+			}
+		})
+	}
+}
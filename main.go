@@ -2,32 +2,80 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
 )
 
-// routes simulates a constant map (e.g., from etcd)
-var routes = map[string]string{
-	"/service1": "http://localhost:8081",
-	"/service2": "http://localhost:8082",
-}
-
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	fmt.Fprintf(w, "OK")
 }
 
+// newHandler builds the handler chain that serves all proxied paths.
+func newHandler() http.Handler {
+	handler := timeoutMiddleware(newProxy(), backendTimeout)
+	handler = breakerMiddleware(handler)
+	handler = mirrorMiddleware(handler)
+	handler = staticMiddleware(handler)
+	handler = bodyRouteMiddleware(handler)
+	handler = jsonLimitsMiddleware(handler)
+	handler = decompressMiddleware(handler)
+	handler = contentTypeMiddleware(handler)
+	handler = requiredHeadersMiddleware(handler)
+	// A request waits for its route's slot before taking a proxy-wide one,
+	// so a saturated route's queue holds no global capacity.
+	handler = priorityMiddleware(handler)
+	handler = concurrencyMiddleware(handler)
+	handler = rateLimitMiddleware(handler)
+	handler = quotaMiddleware(handler)
+	handler = hostMiddleware(handler)
+	handler = optionsMiddleware(handler)
+	handler = tunnelMiddleware(handler)
+	handler = methodMiddleware(handler)
+	handler = captureMiddleware(handler)
+	handler = compressMiddleware(handler)
+	handler = recoverMiddleware(handler)
+	return routeMiddleware(loggingMiddleware(handler))
+}
+
 func main() {
+	configPath := flag.String("config", "", "path to a JSON config file")
+	check := flag.Bool("check", false, "validate the config, print the routing table and exit")
+	flag.Parse()
+
+	if *check {
+		os.Exit(runCheck(*configPath, os.Stdout))
+	}
+	if *configPath != "" {
+		cfg, err := loadConfig(*configPath)
+		if err != nil {
+			fmt.Printf("Invalid config: %v\n", err)
+			os.Exit(1)
+		}
+		if err := applyConfig(cfg); err != nil {
+			fmt.Printf("Invalid config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	config := currentState().config
+	if err := waitForRequiredBackends(context.Background(), config); err != nil {
+		fmt.Printf("Required backends unavailable: %v\n", err)
+		os.Exit(1)
+	}
+
 	fmt.Println("Starting server...")
 
+	proxyHandler := newHandler()
 	server := &http.Server{
-		Addr:              ":8080",
-		Handler:           nil,               // Use default m ux
+		Addr:              config.Listen,
+		Handler:           serverIdentityMiddleware(tracker.middleware(framingMiddleware(routeConnect(http.DefaultServeMux, proxyHandler)))),
+		ConnContext:       withFramingConn,
 		ReadTimeout:       10 * time.Second,  // Max time to read request (headers + body)
 		WriteTimeout:      60 * time.Second,  // Max time to write response
 		IdleTimeout:       120 * time.Second, // Max time for keep-alive connections
@@ -36,22 +84,69 @@ func main() {
 
 	http.HandleFunc("/health", healthCheckHandler)
 
-	proxy := &httputil.ReverseProxy{
-		Rewrite:      rewriteRequest,
-		ErrorHandler: errorHandler,
+	http.Handle("/", proxyHandler)
+
+	if config.TLS.Enabled() {
+		tlsConfig, err := config.TLS.serverTLSConfig()
+		if err != nil {
+			fmt.Printf("Invalid TLS config: %v\n", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = tlsConfig
 	}
 
-	http.Handle("/", proxy)
+	ln, err := listen(server.Addr, config.Listener)
+	if err != nil {
+		fmt.Printf("Failed to start server: %v\n", err)
+		os.Exit(1)
+	}
+	if config.MaxConnsPerIP > 0 {
+		ln = newConnLimitListener(ln, config.MaxConnsPerIP)
+	}
+	if server.TLSConfig == nil {
+		ln = framingListener{ln}
+	}
 
 	sigChan := make(chan os.Signal, 1)
 	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
 			fmt.Printf("Failed to start server: %v\n", err)
 		}
 	}()
 
+	var adminServer *http.Server
+	if config.Admin.Enabled() {
+		adminServer = &http.Server{
+			Addr:              config.Admin.Listen,
+			Handler:           serverIdentityMiddleware(newAdminHandler()),
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Printf("Failed to start admin server: %v\n", err)
+			}
+		}()
+	}
+
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM) // Listen for interrupt signals (e.g., Ctrl+C)
 
+	if *configPath != "" {
+		r := &reloader{path: *configPath}
+		hupChan := make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		go func() {
+			for range hupChan {
+				r.Reload()
+			}
+		}()
+	}
+
 	<-sigChan //Block until a signal is received
 
 	fmt.Println("Shutting down...")
@@ -61,8 +156,10 @@ func main() {
 	defer cancel()
 
 	// attempt graceful shutdown
-	if err := server.Shutdown(ctx); err != nil {
-		fmt.Printf("Forced shutdown: %v\n", err)
+	if adminServer != nil {
+		adminServer.Shutdown(ctx)
 	}
+	shutdownServer(ctx, server, tracker)
+	flushLogSink(ctx)
 	fmt.Println("Server stopped")
 }
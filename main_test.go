@@ -1,10 +1,19 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"net/http/httputil"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHealthCheck(t *testing.T) {
@@ -85,7 +94,7 @@ func TestMatchRoute(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			match, target, suffix := matchRoute(tt.path, testRoutes)
+			match, target, suffix := matchRoute(tt.path, testRoutes, nil)
 			if match != tt.wantMatch {
 				t.Errorf("match = %q, want %q", match, tt.wantMatch)
 			}
@@ -99,11 +108,136 @@ func TestMatchRoute(t *testing.T) {
 	}
 }
 
-func newTestProxy() *httputil.ReverseProxy {
-	return &httputil.ReverseProxy{
-		Rewrite:      rewriteRequest,
-		ErrorHandler: errorHandler,
+// matchRouteLinear is the reference matcher: it tries every route.
+func matchRouteLinear(path string, routes, caseInsensitive map[string]string) (match, target, suffix string) {
+	for prefix, t := range routes {
+		s, found := strings.CutPrefix(path, prefix)
+		if !found && caseInsensitive[strings.ToLower(prefix)] == prefix && len(path) >= len(prefix) && strings.EqualFold(path[:len(prefix)], prefix) {
+			s, found = path[len(prefix):], true
+		}
+		if found && (s == "" || strings.HasPrefix(s, "/")) && len(prefix) > len(match) {
+			match, target, suffix = prefix, t, s
+		}
 	}
+	return
+}
+
+// generatedRoutes returns n nested route prefixes such as /svc12/v2/items,
+// and paths that hit, miss and partially overlap them.
+func generatedRoutes(n int) (routes map[string]string, paths []string) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	segments := []string{"v1", "v2", "items", "users", "Admin", "api", "x", ""}
+	routes = make(map[string]string, n)
+	for len(routes) < n {
+		prefix := fmt.Sprintf("/svc%d", rng.IntN(n/4+1))
+		for range rng.IntN(3) {
+			prefix += "/" + segments[rng.IntN(len(segments))]
+		}
+		routes[prefix] = "http://backend" + strconv.Itoa(len(routes))
+	}
+	for prefix := range routes {
+		paths = append(paths,
+			prefix,
+			prefix+"/",
+			prefix+"/"+segments[rng.IntN(len(segments))]+"/deep",
+			prefix+"extra",
+			strings.ToUpper(prefix)+"/x",
+			prefix[:rng.IntN(len(prefix))],
+		)
+	}
+	return routes, append(paths, "", "/", "//", "/unknown/svc1")
+}
+
+func TestMatchRoute_MatchesLinear(t *testing.T) {
+	routes, paths := generatedRoutes(500)
+	for _, caseInsensitive := range []bool{false, true} {
+		insensitive := map[string]string{}
+		if caseInsensitive {
+			for prefix := range routes {
+				if strings.Contains(prefix, "v2") {
+					insensitive[strings.ToLower(prefix)] = prefix
+				}
+			}
+		}
+		for _, path := range paths {
+			m, tg, s := matchRoute(path, routes, insensitive)
+			wm, wt, ws := matchRouteLinear(path, routes, insensitive)
+			if m != wm || tg != wt || s != ws {
+				t.Errorf("matchRoute(%q) = %q, %q, %q, want %q, %q, %q (case-insensitive %v)", path, m, tg, s, wm, wt, ws, caseInsensitive)
+			}
+		}
+	}
+}
+
+func BenchmarkMatchRoute(b *testing.B) {
+	for _, n := range []int{10, 5000} {
+		routes, paths := generatedRoutes(n)
+		for _, matcher := range []struct {
+			name  string
+			match func(string, map[string]string, map[string]string) (string, string, string)
+		}{
+			{"linear", matchRouteLinear},
+			{"segments", matchRoute},
+		} {
+			b.Run(fmt.Sprintf("%s/routes=%d", matcher.name, n), func(b *testing.B) {
+				for i := 0; b.Loop(); i++ {
+					matcher.match(paths[i%len(paths)], routes, nil)
+				}
+			})
+		}
+	}
+}
+
+func TestMatchRoute_CaseInsensitive(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		global     bool
+		route      bool
+		path       string
+		wantStatus int
+		wantPath   string
+	}{
+		{"case-sensitive by default", false, false, "/Service1/Foo", http.StatusNotFound, ""},
+		{"route option", false, true, "/Service1/Foo", http.StatusOK, "/Foo"},
+		{"global option", true, false, "/SERVICE1/Foo", http.StatusOK, "/Foo"},
+		{"exact case still matches", false, true, "/service1/foo", http.StatusOK, "/foo"},
+		{"partial prefix not matched", false, true, "/Service1extra", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAppliedConfig(t, func(c *Config) {
+				c.CaseInsensitiveRoutes = tt.global
+				c.Routes = []RouteConfig{{Prefix: "/service1", Backend: backend.URL, CaseInsensitive: tt.route}}
+			})
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rr.Body.String() != tt.wantPath {
+				t.Errorf("backend path = %q, want %q", rr.Body.String(), tt.wantPath)
+			}
+		})
+	}
+}
+
+// newTestProxy returns the proxy behind routeMiddleware, which matches
+// each request to its route as newHandler does.
+func newTestProxy() http.Handler {
+	return routeMiddleware(newProxy())
+}
+
+// newQuietTestProxy is newTestProxy with the proxy's error log discarded,
+// for tests that expect backend errors.
+func newQuietTestProxy() http.Handler {
+	proxy := newProxy()
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	return routeMiddleware(proxy)
 }
 
 func TestReverseProxy_NoRoute(t *testing.T) {
@@ -125,7 +259,7 @@ func TestReverseProxy(t *testing.T) {
 	}))
 	defer backend.Close()
 
-	routes["/service1"] = backend.URL
+	withRoute(t, "/service1", backend.URL)
 
 	req := httptest.NewRequest("GET", "/service1/test", nil)
 	rr := httptest.NewRecorder()
@@ -140,3 +274,160 @@ func TestReverseProxy(t *testing.T) {
 		t.Errorf("handler returned unexpected body: got %v want %v", rr.Body.String(), expected)
 	}
 }
+
+// swapState publishes a copy of the active state modified by fn for the
+// duration of the test.
+func swapState(t testing.TB, fn func(s *proxyState)) {
+	t.Helper()
+	prev := currentState()
+	s := *prev
+	fn(&s)
+	activeState.Store(&s)
+	t.Cleanup(func() { activeState.Store(prev) })
+}
+
+// withConfig swaps in a copy of the active config modified by fn for the
+// duration of the test.
+func withConfig(t testing.TB, fn func(c *Config)) {
+	t.Helper()
+	swapState(t, func(s *proxyState) {
+		c := *s.config
+		fn(&c)
+		s.config = &c
+		s.routeConfigs = routesByPrefix(c.Routes)
+	})
+}
+
+// withRoute registers prefix -> backend in the route table for the duration
+// of the test.
+func withRoute(t *testing.T, prefix, backend string) {
+	t.Helper()
+	swapState(t, func(s *proxyState) {
+		s.routes = maps.Clone(s.routes)
+		s.routes[prefix] = backend
+	})
+}
+
+// withRoutes replaces the route table for the duration of the test.
+func withRoutes(t testing.TB, routes map[string]string) {
+	t.Helper()
+	swapState(t, func(s *proxyState) { s.routes = routes })
+}
+
+// withAppliedConfig applies a copy of the active config modified by fn,
+// including the state derived from it, for the duration of the test.
+func withAppliedConfig(t *testing.T, fn func(c *Config)) {
+	t.Helper()
+	prev := currentState()
+	c := *prev.config
+	fn(&c)
+	if err := applyConfig(&c); err != nil {
+		t.Fatalf("applyConfig: %v", err)
+	}
+	t.Cleanup(func() {
+		applyConfig(prev.config)
+		// Restore routes that did not come from a config, such as the
+		// defaults.
+		swapped := *currentState()
+		swapped.routes = prev.routes
+		activeState.Store(&swapped)
+	})
+}
+
+// withRouteConfigs applies a copy of the active config whose routes are rts
+// for the duration of the test.
+func withRouteConfigs(t *testing.T, rts ...RouteConfig) {
+	t.Helper()
+	withAppliedConfig(t, func(c *Config) { c.Routes = rts })
+}
+
+func TestShutdownServer_DrainSummary(t *testing.T) {
+	rt := &requestTracker{}
+	started := make(chan struct{}, 2)
+	releaseQuick, releaseStuck := make(chan struct{}), make(chan struct{})
+	defer close(releaseStuck)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/quick", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-releaseQuick
+	})
+	mux.HandleFunc("/stuck", func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-releaseStuck
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: rt.middleware(mux)}
+	go server.Serve(ln)
+
+	for _, path := range []string{"/quick", "/stuck"} {
+		go http.Get("http://" + ln.Addr().String() + path)
+	}
+	<-started
+	<-started
+
+	time.AfterFunc(50*time.Millisecond, func() { close(releaseQuick) })
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	captureLogs(t)
+	summary := shutdownServer(ctx, server, rt)
+
+	if summary.Drained != 1 || summary.Forced != 1 {
+		t.Errorf("summary = %+v, want 1 drained and 1 forced", summary)
+	}
+}
+
+func TestRouteMiddleware(t *testing.T) {
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/api", Backend: "http://localhost:8081", DisableKeepAlives: true},
+		RouteConfig{Prefix: "/pool", Backends: []string{"http://localhost:8082", "http://localhost:8083"}},
+	)
+
+	tests := []struct {
+		path   string
+		wantOK bool
+		want   routeMatch
+	}{
+		{"/api/users", true, routeMatch{Prefix: "/api", Backend: "http://localhost:8081", Suffix: "/users"}},
+		{"/pool/x", true, routeMatch{Prefix: "/pool", Suffix: "/x"}},
+		{"/unknown", false, routeMatch{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			var got routeMatch
+			var ok bool
+			handler := routeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, ok = routeMatchFrom(r.Context())
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.path, nil))
+
+			if ok != tt.wantOK || got.Prefix != tt.want.Prefix || got.Backend != tt.want.Backend || got.Suffix != tt.want.Suffix {
+				t.Errorf("routeMatchFrom = %q %q %q %v, want %q %q %q %v", got.Prefix, got.Backend, got.Suffix, ok, tt.want.Prefix, tt.want.Backend, tt.want.Suffix, tt.wantOK)
+			}
+			if ok && got.Config.Prefix != got.Prefix {
+				t.Errorf("Config.Prefix = %q, want the matched route's config", got.Config.Prefix)
+			}
+		})
+	}
+	if m, _ := routeMatchFrom(context.Background()); m.Prefix != "" {
+		t.Errorf("routeMatchFrom without a match = %+v", m)
+	}
+}
+
+func TestRouteMiddleware_MatchOutlivesReload(t *testing.T) {
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Static: &StaticResponseConfig{Body: "static"}})
+	handler := routeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A reload after the request was routed does not change its route.
+		withRouteConfigs(t)
+		staticMiddleware(http.NotFoundHandler()).ServeHTTP(w, r)
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+	if rr.Body.String() != "static" {
+		t.Errorf("body = %q, want the route matched before the reload", rr.Body)
+	}
+}
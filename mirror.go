@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// MirrorConfig copies a route's requests to a shadow backend, such as a
+// rewrite being validated against live traffic. Shadow responses never
+// reach the client.
+type MirrorConfig struct {
+	Backend string `json:"backend"`
+	// Compare checks each shadow response's status against the primary's,
+	// logging and counting divergences.
+	Compare bool `json:"compare"`
+	// CompareBody also compares a hash of the response bodies. The primary
+	// body is hashed as it streams to the client.
+	CompareBody bool `json:"compare_body"`
+}
+
+func (mc MirrorConfig) validate() error {
+	if err := validateBackendURL(mc.Backend); err != nil {
+		return fmt.Errorf("mirror: %w", err)
+	}
+	if mc.CompareBody && !mc.Compare {
+		return fmt.Errorf("mirror: compare_body requires compare")
+	}
+	return nil
+}
+
+// mirror is the runtime state of a route's MirrorConfig.
+type mirror struct {
+	cfg MirrorConfig
+
+	mirrored atomic.Uint64
+	compared atomic.Uint64
+	diverged atomic.Uint64
+}
+
+// newRouteMirrors builds the mirrors of rts, keeping the mirror in prev of
+// each route whose mirror config is unchanged, along with its counters.
+func newRouteMirrors(rts []RouteConfig, prev map[string]*mirror) map[string]*mirror {
+	mirrors := make(map[string]*mirror)
+	for _, rt := range rts {
+		if rt.Mirror == nil {
+			continue
+		}
+		if m := prev[rt.Prefix]; m != nil && m.cfg == *rt.Mirror {
+			mirrors[rt.Prefix] = m
+		} else {
+			mirrors[rt.Prefix] = &mirror{cfg: *rt.Mirror}
+		}
+	}
+	return mirrors
+}
+
+// responseSummary is what a compare-mode mirror compares: the status and,
+// with CompareBody, a hash of the body.
+type responseSummary struct {
+	status int
+	hash   []byte
+}
+
+// mirrorMiddleware sends a copy of each request on a mirrored route to its
+// shadow backend in the background. Bodies larger than MaxReplayBody are
+// not mirrored.
+func mirrorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stateFrom(r.Context())
+		route, _ := routeMatchFrom(r.Context())
+		prefix, remainder := route.Prefix, route.Suffix
+		m := s.routeMirrors[prefix]
+		limit := cmp.Or(s.config.MaxReplayBody, defaultMaxReplayBody)
+		if m == nil || !bufferForReplay(r, limit) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		shadow, err := newShadowRequest(r, s.config, m.cfg.Backend, remainder)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m.mirrored.Add(1)
+		if !m.cfg.Compare {
+			go sendShadow(shadow, false)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		shadowResult := make(chan *responseSummary, 1)
+		go func() { shadowResult <- sendShadow(shadow, m.cfg.CompareBody) }()
+		cw := &comparingWriter{ResponseWriter: w, status: http.StatusOK}
+		if m.cfg.CompareBody {
+			cw.hash = sha256.New()
+		}
+		next.ServeHTTP(cw, r)
+		primary := responseSummary{status: cw.status}
+		if cw.hash != nil {
+			primary.hash = cw.hash.Sum(nil)
+		}
+		go m.compare(prefix, r.URL.Path, primary, shadowResult)
+	})
+}
+
+// newShadowRequest copies r for the shadow backend, detached from the
+// client so it may outlive the primary response. Its headers are cleaned up
+// as they are for the primary backend.
+func newShadowRequest(r *http.Request, config *Config, backend, remainder string) (*http.Request, error) {
+	target, err := joinBackendURL(backend, remainder)
+	if err != nil {
+		return nil, err
+	}
+	out := rewound(r, context.WithoutCancel(r.Context()))
+	out.RequestURI = ""
+	out.URL.Scheme = target.Scheme
+	out.URL.Host = target.Host
+	out.URL.Path = target.Path
+	out.URL.RawPath = ""
+	out.Host = ""
+	removeHopByHopHeaders(out.Header)
+	stripInboundHeaders(out.Header, config, backend)
+	return out, nil
+}
+
+// hopHeaders are the hop-by-hop headers, which apply to one connection and
+// are not forwarded.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// removeHopByHopHeaders deletes the hop-by-hop headers from h, including
+// those its Connection header lists, as httputil.ReverseProxy does for the
+// primary request.
+func removeHopByHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for name := range strings.SplitSeq(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// sendShadow sends req to its shadow backend, summarizing the response, or
+// returning nil if there was none.
+func sendShadow(req *http.Request, hashBody bool) *responseSummary {
+	ctx, cancel := context.WithTimeout(req.Context(), backendTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	res, err := stateFrom(req.Context()).transportFor(req.URL).RoundTrip(withConnBackend(req))
+	if err != nil {
+		slog.Warn("shadow request failed", "backend", backendKey(req.URL), "path", req.URL.Path, "error", err)
+		return nil
+	}
+	defer res.Body.Close()
+	summary := &responseSummary{status: res.StatusCode}
+	if hashBody {
+		h := sha256.New()
+		if _, err := io.Copy(h, res.Body); err != nil {
+			return nil
+		}
+		summary.hash = h.Sum(nil)
+	} else {
+		io.Copy(io.Discard, res.Body)
+	}
+	return summary
+}
+
+// compare waits for the shadow response and counts it as diverged if it
+// differs from the primary's.
+func (m *mirror) compare(prefix, path string, primary responseSummary, shadowResult <-chan *responseSummary) {
+	shadow := <-shadowResult
+	if shadow == nil {
+		return
+	}
+	m.compared.Add(1)
+	bodyDiffers := primary.hash != nil && !bytes.Equal(primary.hash, shadow.hash)
+	if shadow.status == primary.status && !bodyDiffers {
+		return
+	}
+	m.diverged.Add(1)
+	slog.Warn("shadow response diverged",
+		"route", prefix,
+		"path", path,
+		"shadow", m.cfg.Backend,
+		"primary_status", primary.status,
+		"shadow_status", shadow.status,
+		"body_differs", bodyDiffers,
+	)
+}
+
+// comparingWriter records the status of the primary response and hashes
+// its body as it is written.
+type comparingWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	hash        hash.Hash
+}
+
+func (cw *comparingWriter) WriteHeader(code int) {
+	if !cw.wroteHeader && code >= 200 {
+		cw.wroteHeader = true
+		cw.status = code
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *comparingWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	n, err := cw.ResponseWriter.Write(b)
+	if cw.hash != nil {
+		cw.hash.Write(b[:n])
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+// for flushing and hijacking.
+func (cw *comparingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// mirrorStats describes one route's mirror in the admin API.
+type mirrorStats struct {
+	Prefix         string  `json:"prefix"`
+	Backend        string  `json:"backend"`
+	Mirrored       uint64  `json:"mirrored"`
+	Compared       uint64  `json:"compared"`
+	Diverged       uint64  `json:"diverged"`
+	DivergenceRate float64 `json:"divergence_rate"`
+}
+
+// mirrorStatsHandler lists the mirrored and diverged counts of every
+// mirrored route.
+func mirrorStatsHandler(w http.ResponseWriter, r *http.Request) {
+	mirrors := currentState().routeMirrors
+	stats := make([]mirrorStats, 0, len(mirrors))
+	for prefix, m := range mirrors {
+		s := mirrorStats{
+			Prefix:   prefix,
+			Backend:  m.cfg.Backend,
+			Mirrored: m.mirrored.Load(),
+			Compared: m.compared.Load(),
+			Diverged: m.diverged.Load(),
+		}
+		if s.Compared > 0 {
+			s.DivergenceRate = float64(s.Diverged) / float64(s.Compared)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Prefix < stats[j].Prefix })
+	writeJSON(w, http.StatusOK, stats)
+}
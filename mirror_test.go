@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMirror_Compare(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "v1")
+	}))
+	defer primary.Close()
+	shadowBodies := make(chan string, 8)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- r.Method + " " + r.URL.Path + " " + string(body)
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/fail"):
+			w.WriteHeader(http.StatusInternalServerError)
+		case strings.HasSuffix(r.URL.Path, "/body"):
+			io.WriteString(w, "v2")
+		default:
+			io.WriteString(w, "v1")
+		}
+	}))
+	defer shadow.Close()
+	captureLogs(t)
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/orders", Backend: primary.URL, Mirror: &MirrorConfig{Backend: shadow.URL, Compare: true, CompareBody: true}},
+		RouteConfig{Prefix: "/status", Backend: primary.URL, Mirror: &MirrorConfig{Backend: shadow.URL, Compare: true}},
+	)
+	handler := routeMiddleware(mirrorMiddleware(newProxy()))
+	stats := func() map[string]mirrorStats {
+		var list []mirrorStats
+		if err := json.NewDecoder(adminRequest(t, "GET", "/admin/mirrors").Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		byPrefix := map[string]mirrorStats{}
+		for _, s := range list {
+			byPrefix[s.Prefix] = s
+		}
+		return byPrefix
+	}
+
+	for _, path := range []string{"/orders/same", "/orders/fail", "/orders/body", "/status/body"} {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", path, strings.NewReader("payload")))
+		// The client always gets the primary's response.
+		if rr.Code != http.StatusOK || rr.Body.String() != "v1" {
+			t.Errorf("%s: response = %d %q, want the primary's 200 v1", path, rr.Code, rr.Body.String())
+		}
+		if got, want := <-shadowBodies, "POST "+strings.TrimPrefix(strings.TrimPrefix(path, "/orders"), "/status")+" payload"; got != want {
+			t.Errorf("shadow received %q, want %q", got, want)
+		}
+	}
+
+	waitFor(t, func() bool { return stats()["/orders"].Compared == 3 && stats()["/status"].Compared == 1 })
+	got := stats()
+	// A different status and a different body both diverge; only the
+	// status counts on a route that does not compare bodies.
+	if s := got["/orders"]; s.Mirrored != 3 || s.Diverged != 2 || s.DivergenceRate < 0.66 || s.DivergenceRate > 0.67 {
+		t.Errorf("/orders stats = %+v, want 2 of 3 diverged", s)
+	}
+	if s := got["/status"]; s.Diverged != 0 {
+		t.Errorf("/status stats = %+v, want no divergence", s)
+	}
+}
+
+func TestMirror_WithoutCompare(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "primary")
+	}))
+	defer primary.Close()
+	mirrored := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.URL.RequestURI()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+	captureLogs(t)
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: primary.URL, Mirror: &MirrorConfig{Backend: shadow.URL}})
+
+	rr := httptest.NewRecorder()
+	routeMiddleware(mirrorMiddleware(newProxy())).ServeHTTP(rr, httptest.NewRequest("GET", "/api/items?page=2", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "primary" {
+		t.Errorf("response = %d %q, want the primary's", rr.Code, rr.Body.String())
+	}
+	if got := <-mirrored; got != "/items?page=2" {
+		t.Errorf("shadow received %q, want /items?page=2", got)
+	}
+	if m := currentState().routeMirrors["/api"]; m.compared.Load() != 0 || m.diverged.Load() != 0 {
+		t.Errorf("compared %d, want no comparisons without compare mode", m.compared.Load())
+	}
+}
+
+func TestMirror_StripsHeaders(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer primary.Close()
+	mirrored := make(chan http.Header, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r.Header
+	}))
+	defer shadow.Close()
+	captureLogs(t)
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backend: primary.URL, Mirror: &MirrorConfig{Backend: shadow.URL}}}
+		c.Backends = map[string]BackendConfig{
+			shadow.URL: {StripHeaders: []string{"Cookie", "authorization"}},
+		}
+	})
+
+	req := httptest.NewRequest("GET", "/api/items", nil)
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("X-Forwarded-Client-Cert", "forged")
+	req.Header.Set("X-Tenant", "acme")
+	routeMiddleware(mirrorMiddleware(newProxy())).ServeHTTP(httptest.NewRecorder(), req)
+
+	got := <-mirrored
+	for _, h := range []string{"Cookie", "Authorization", "X-Hop", "X-Forwarded-Client-Cert"} {
+		if v := got.Get(h); v != "" {
+			t.Errorf("shadow received %s: %q, want it stripped", h, v)
+		}
+	}
+	if v := got.Get("X-Tenant"); v != "acme" {
+		t.Errorf("shadow received X-Tenant %q, want acme", v)
+	}
+}
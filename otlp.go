@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OTLPLogConfig sends access log entries to an OpenTelemetry collector as
+// OTLP log records, over HTTP with JSON encoding.
+type OTLPLogConfig struct {
+	// Endpoint is the collector's logs URL, e.g.
+	// "http://collector:4318/v1/logs".
+	Endpoint string `json:"endpoint"`
+	// Headers are sent with every export, e.g. an API key.
+	Headers map[string]string `json:"headers"`
+	// BatchSize is the most records sent in one export. Defaults to 512.
+	BatchSize int `json:"batch_size"`
+	// FlushInterval is the longest a record waits to be exported. Defaults
+	// to 5s.
+	FlushInterval Duration `json:"flush_interval"`
+	// Timeout bounds each export. Defaults to 10s.
+	Timeout Duration `json:"timeout"`
+}
+
+const (
+	defaultOTLPBatchSize     = 512
+	defaultOTLPFlushInterval = 5 * time.Second
+	defaultOTLPTimeout       = 10 * time.Second
+)
+
+// logSinks are the values accepted for LogConfig.Sink.
+var logSinks = []string{"", "slog", "otlp"}
+
+func (c LogConfig) validate() error {
+	if !slices.Contains(logSinks, c.Sink) {
+		return fmt.Errorf("log: unknown sink %q", c.Sink)
+	}
+	if c.Sink != "otlp" {
+		return nil
+	}
+	if c.OTLP == nil {
+		return errors.New("log: the otlp sink requires otlp settings")
+	}
+	if u, err := url.Parse(c.OTLP.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("log: otlp: endpoint %q must be an http or https URL", c.OTLP.Endpoint)
+	}
+	for name := range c.OTLP.Headers {
+		if err := validateHeaderName(name); err != nil {
+			return fmt.Errorf("log: otlp: %w", err)
+		}
+	}
+	if c.OTLP.BatchSize < 0 || c.OTLP.FlushInterval < 0 || c.OTLP.Timeout < 0 {
+		return errors.New("log: otlp: batch_size, flush_interval and timeout must not be negative")
+	}
+	return nil
+}
+
+// otlpLogRecord is an OTLP LogRecord in its JSON encoding.
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 map[string]any `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+}
+
+type otlpKeyValue struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+// otlpSeverityInfo is the OTLP severity number of INFO.
+const otlpSeverityInfo = 9
+
+// newOTLPLogRecord maps an access log entry, given as the key/value pairs
+// passed to slog, to an OTLP log record.
+func newOTLPLogRecord(t time.Time, msg string, args []any) otlpLogRecord {
+	rec := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(t.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       otlpSeverityInfo,
+		SeverityText:         "INFO",
+		Body:                 otlpValue(msg),
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		key, _ := args[i].(string)
+		rec.Attributes = append(rec.Attributes, otlpKeyValue{Key: key, Value: otlpValue(args[i+1])})
+	}
+	return rec
+}
+
+// otlpValue encodes v as an OTLP AnyValue. 64-bit integers are strings in
+// the JSON encoding.
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case map[string]string:
+		values := make([]otlpKeyValue, 0, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			values = append(values, otlpKeyValue{Key: k, Value: otlpValue(v[k])})
+		}
+		return map[string]any{"kvlistValue": map[string]any{"values": values}}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// logExporter delivers a batch of log records to a collector.
+type logExporter interface {
+	Export(ctx context.Context, records []otlpLogRecord) error
+}
+
+// otlpHTTPExporter posts batches to an OTLP/HTTP endpoint.
+type otlpHTTPExporter struct {
+	endpoint string
+	headers  map[string]string
+	client   *http.Client
+}
+
+func (e *otlpHTTPExporter) Export(ctx context.Context, records []otlpLogRecord) error {
+	payload := map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpKeyValue{
+				{Key: "service.name", Value: otlpValue("reverse-proxy")},
+			}},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "reverse-proxy"},
+				"logRecords": records,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp export: collector answered %s", res.Status)
+	}
+	return nil
+}
+
+// errLogDropped fails an access log entry the OTLP sink had no room for.
+var errLogDropped = errors.New("otlp log queue full, entry dropped")
+
+// otlpLogSink batches log records and exports them in the background, when
+// a batch fills up or the flush interval passes.
+type otlpLogSink struct {
+	cfg      OTLPLogConfig
+	exporter logExporter
+	records  chan otlpLogRecord
+
+	// mu guards closing records against concurrent emits.
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newOTLPLogSink(cfg OTLPLogConfig, exporter logExporter) *otlpLogSink {
+	batch := cmp.Or(cfg.BatchSize, defaultOTLPBatchSize)
+	s := &otlpLogSink{
+		cfg:      cfg,
+		exporter: exporter,
+		records:  make(chan otlpLogRecord, 4*batch),
+		done:     make(chan struct{}),
+	}
+	go s.run(batch, cmp.Or(time.Duration(cfg.FlushInterval), defaultOTLPFlushInterval))
+	return s
+}
+
+// Emit queues rec for export without blocking.
+func (s *otlpLogSink) Emit(rec otlpLogRecord) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return errLogDropped
+	}
+	select {
+	case s.records <- rec:
+		return nil
+	default:
+		return errLogDropped
+	}
+}
+
+func (s *otlpLogSink) run(batch int, interval time.Duration) {
+	defer close(s.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pending := make([]otlpLogRecord, 0, batch)
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cmp.Or(time.Duration(s.cfg.Timeout), defaultOTLPTimeout))
+		if err := s.exporter.Export(ctx, pending); err != nil {
+			slog.Error("failed to export access logs", "records", len(pending), "error", err)
+		}
+		cancel()
+		pending = make([]otlpLogRecord, 0, batch)
+	}
+	for {
+		select {
+		case rec, ok := <-s.records:
+			if !ok {
+				flush()
+				return
+			}
+			pending = append(pending, rec)
+			if len(pending) >= batch {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// Shutdown stops accepting records and waits for the queued ones to be
+// exported, or for ctx to end.
+func (s *otlpLogSink) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.records)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// logSink is the active OTLP sink, or nil when access logs go to slog.
+var logSink atomic.Pointer[otlpLogSink]
+
+// applyLogSink starts the sink cfg selects, shutting down the previous one
+// in the background. An unchanged OTLP sink is kept.
+func applyLogSink(cfg LogConfig) {
+	prev := logSink.Load()
+	var next *otlpLogSink
+	if cfg.Sink == "otlp" {
+		if prev != nil && reflect.DeepEqual(prev.cfg, *cfg.OTLP) {
+			return
+		}
+		next = newOTLPLogSink(*cfg.OTLP, &otlpHTTPExporter{
+			endpoint: cfg.OTLP.Endpoint,
+			headers:  cfg.OTLP.Headers,
+			client:   &http.Client{},
+		})
+	}
+	logSink.Store(next)
+	if prev != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), defaultOTLPTimeout)
+			defer cancel()
+			prev.Shutdown(ctx)
+		}()
+	}
+}
+
+// flushLogSink exports the access log entries still queued, at shutdown.
+func flushLogSink(ctx context.Context) {
+	if s := logSink.Load(); s != nil {
+		if err := s.Shutdown(ctx); err != nil {
+			slog.Warn("access logs not flushed before shutdown", "error", err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryExporter collects exported log records.
+type memoryExporter struct {
+	mu      sync.Mutex
+	batches [][]otlpLogRecord
+}
+
+func (e *memoryExporter) Export(ctx context.Context, records []otlpLogRecord) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.batches = append(e.batches, records)
+	return nil
+}
+
+func (e *memoryExporter) records() []otlpLogRecord {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var all []otlpLogRecord
+	for _, b := range e.batches {
+		all = append(all, b...)
+	}
+	return all
+}
+
+// withLogSink makes s the active log sink for the duration of the test.
+func withLogSink(t *testing.T, s *otlpLogSink) {
+	t.Helper()
+	prev := logSink.Swap(s)
+	t.Cleanup(func() {
+		logSink.Store(prev)
+		s.Shutdown(context.Background())
+	})
+}
+
+// attribute returns the value of the record attribute named key.
+func (rec otlpLogRecord) attribute(key string) map[string]any {
+	for _, kv := range rec.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPLogSink(t *testing.T) {
+	withRoute(t, "/api", "http://localhost:8081")
+	withConfig(t, func(c *Config) { c.Log.Headers = []string{"X-Tenant"} })
+	exporter := &memoryExporter{}
+	sink := newOTLPLogSink(OTLPLogConfig{BatchSize: 2, FlushInterval: Duration(time.Hour)}, exporter)
+	withLogSink(t, sink)
+	logs := captureLogs(t)
+
+	handler := routeMiddleware(loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	})))
+	for range 3 {
+		req := httptest.NewRequest("POST", "/api/orders", nil)
+		req.Header.Set("X-Tenant", "acme")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// A full batch is exported at once; the rest waits for a flush.
+	waitFor(t, func() bool { return len(exporter.records()) == 2 })
+	if err := sink.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records := exporter.records()
+	if len(records) != 3 {
+		t.Fatalf("exported %d records, want 3 after shutdown", len(records))
+	}
+	if logs.Len() != 0 {
+		t.Errorf("access log also written to slog: %s", logs)
+	}
+
+	rec := records[0]
+	if rec.SeverityText != "INFO" || rec.Body["stringValue"] != "proxy request" {
+		t.Errorf("record severity and body = %s %v, want INFO proxy request", rec.SeverityText, rec.Body)
+	}
+	want := map[string]map[string]any{
+		"method":        {"stringValue": "POST"},
+		"path":          {"stringValue": "/api/orders"},
+		"backend":       {"stringValue": "http://localhost:8081"},
+		"status":        {"intValue": "201"},
+		"response_size": {"intValue": "4"},
+	}
+	for key, v := range want {
+		if got := rec.attribute(key); !reflect.DeepEqual(got, v) {
+			t.Errorf("attribute %s = %v, want %v", key, got, v)
+		}
+	}
+	headers, _ := rec.attribute("headers")["kvlistValue"].(map[string]any)
+	if values, _ := headers["values"].([]otlpKeyValue); len(values) != 1 || values[0].Key != "X-Tenant" || values[0].Value["stringValue"] != "acme" {
+		t.Errorf("headers attribute = %v, want X-Tenant: acme", rec.attribute("headers"))
+	}
+
+	if err := sink.Emit(rec); err != errLogDropped {
+		t.Errorf("Emit after shutdown = %v, want errLogDropped", err)
+	}
+}
+
+func TestOTLPHTTPExporter(t *testing.T) {
+	var payload struct {
+		ResourceLogs []struct {
+			ScopeLogs []struct {
+				LogRecords []otlpLogRecord `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	var gotKey, gotType string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotKey, gotType = r.Header.Get("X-Api-Key"), r.Header.Get("Content-Type")
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	e := &otlpHTTPExporter{endpoint: collector.URL + "/v1/logs", headers: map[string]string{"X-Api-Key": "k"}, client: collector.Client()}
+	rec := newOTLPLogRecord(time.Unix(1, 0), "proxy request", []any{"status", 200, "canceled", true})
+	if err := e.Export(context.Background(), []otlpLogRecord{rec}); err != nil {
+		t.Fatal(err)
+	}
+	if gotKey != "k" || gotType != "application/json" {
+		t.Errorf("headers = %q, %q, want the API key and application/json", gotKey, gotType)
+	}
+	if len(payload.ResourceLogs) != 1 || len(payload.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("payload = %+v, want one resource and scope", payload)
+	}
+	got := payload.ResourceLogs[0].ScopeLogs[0].LogRecords
+	if len(got) != 1 || got[0].TimeUnixNano != "1000000000" || got[0].attribute("status")["intValue"] != "200" || got[0].attribute("canceled")["boolValue"] != true {
+		t.Errorf("log records = %+v", got)
+	}
+
+	failing := &otlpHTTPExporter{endpoint: collector.URL, client: collector.Client()}
+	collector.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	if err := failing.Export(context.Background(), []otlpLogRecord{rec}); err == nil {
+		t.Error("Export succeeded against a failing collector")
+	}
+}
+
+func TestLogConfig_ValidateSink(t *testing.T) {
+	tests := []struct {
+		name string
+		log  LogConfig
+		ok   bool
+	}{
+		{"default", LogConfig{}, true},
+		{"otlp", LogConfig{Sink: "otlp", OTLP: &OTLPLogConfig{Endpoint: "http://collector:4318/v1/logs"}}, true},
+		{"otlp without settings", LogConfig{Sink: "otlp"}, false},
+		{"otlp without endpoint", LogConfig{Sink: "otlp", OTLP: &OTLPLogConfig{}}, false},
+		{"unknown sink", LogConfig{Sink: "syslog"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.log.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// backendOverrideHeader lets a trusted peer send a request to a specific
+// pool member, bypassing the balancer, e.g. to debug a single instance.
+const backendOverrideHeader = "X-Proxy-Backend-Override"
+
+// peerTrusted reports whether the direct peer of r is in
+// Config.TrustedPeers.
+func peerTrusted(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	for _, peer := range stateFrom(r.Context()).config.TrustedPeers {
+		if prefix, err := parsePeer(peer); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePeer parses a TrustedPeers entry, an IP address or CIDR prefix.
+func parsePeer(peer string) (netip.Prefix, error) {
+	if strings.Contains(peer, "/") {
+		return netip.ParsePrefix(peer)
+	}
+	addr, err := netip.ParseAddr(peer)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// override returns the pool member named by r's backendOverrideHeader, or
+// nil if there is none, the peer is not trusted or the named backend is
+// not in the pool.
+func (p *pool) override(r *http.Request) *backend {
+	want := r.Header.Get(backendOverrideHeader)
+	if rp := replayFrom(r.Context()); rp != nil && rp.backend != "" {
+		// A replay goes to the backend the original request was logged
+		// with.
+		want = rp.backend
+	} else if want == "" || !peerTrusted(r) {
+		return nil
+	}
+	for _, b := range p.backends {
+		if b.url == want {
+			recordDecision(r, "override", nil)
+			return b
+		}
+	}
+	slog.Warn("ignoring backend override outside the pool", "backend", want, "path", r.URL.Path)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBackendOverride(t *testing.T) {
+	newBackend := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.Header.Get(backendOverrideHeader))
+		}))
+	}
+	a, b, outside := newBackend("a"), newBackend("b"), newBackend("outside")
+	defer a.Close()
+	defer b.Close()
+	defer outside.Close()
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{a.URL, b.URL}}}
+		c.TrustedPeers = []string{"10.1.0.0/16", "192.0.2.7"}
+	})
+	captureLogs(t)
+
+	tests := []struct {
+		name     string
+		peer     string
+		override string
+		want     string
+	}{
+		{"trusted CIDR", "10.1.2.3:5000", b.URL, "b "},
+		{"trusted address", "192.0.2.7:5000", b.URL, "b "},
+		{"untrusted peer", "203.0.113.9:5000", b.URL, "a "},
+		{"backend outside pool", "10.1.2.3:5000", outside.URL, "a "},
+		{"no override", "10.1.2.3:5000", "", "a "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAppliedConfig(t, func(c *Config) {}) // fresh round-robin state
+			req := httptest.NewRequest("GET", "/api", nil)
+			req.RemoteAddr = tt.peer
+			if tt.override != "" {
+				req.Header.Set(backendOverrideHeader, tt.override)
+			}
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+			if rr.Body.String() != tt.want {
+				t.Errorf("response = %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Priority classes, from most to least important. Under saturation, the
+// proxy-wide concurrency limit admits queued requests in this order and
+// sheds the least important first.
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+var priorities = []string{priorityHigh, priorityNormal, priorityLow}
+
+// priorityHeader lets a trusted peer set the priority class of a request,
+// overriding its route's.
+const priorityHeader = "X-Proxy-Priority"
+
+// requestPriority returns the index in priorities of r's class: the one a
+// trusted peer asked for, else its route's, else normal.
+func requestPriority(r *http.Request) int {
+	class := ""
+	if v := r.Header.Get(priorityHeader); v != "" && peerTrusted(r) {
+		class = v
+	}
+	if !slices.Contains(priorities, class) {
+		route, _ := routeMatchFrom(r.Context())
+		class = route.Config.Priority
+	}
+	if i := slices.Index(priorities, class); i >= 0 {
+		return i
+	}
+	return slices.Index(priorities, priorityNormal)
+}
+
+// priorityWaiter is a request queued for a slot. granted receives true when
+// it is handed a slot and false when a more important request evicts it.
+type priorityWaiter struct {
+	priority int
+	// finish is the waiter's virtual finish time for fair queueing.
+	finish  float64
+	granted chan bool
+}
+
+// priorityLimit is a concurrency limit whose queue is ordered by priority.
+// Within a class, routes are admitted by weighted fair queueing, so a busy
+// route cannot starve the others of slots. A full queue makes room for a
+// newcomer by shedding the last waiter of a less important class.
+type priorityLimit struct {
+	cfg ConcurrencyConfig
+
+	mu       sync.Mutex
+	inFlight int
+	waiters  []*priorityWaiter
+	// virtual is the fair queueing clock: the finish time of the waiter
+	// admitted last. finish holds each route's latest finish time.
+	virtual float64
+	finish  map[string]float64
+}
+
+func newPriorityLimit(cfg ConcurrencyConfig) *priorityLimit {
+	return &priorityLimit{cfg: cfg, finish: make(map[string]float64)}
+}
+
+// acquire takes a slot for a request of the given priority from route,
+// queueing for one if there is room. A queued request's turn comes sooner
+// the larger its route's weight. It reports false if the request was shed
+// or gave up.
+func (l *priorityLimit) acquire(ctx context.Context, priority int, route string, weight int) bool {
+	l.mu.Lock()
+	if l.inFlight < l.cfg.Max {
+		l.inFlight++
+		l.mu.Unlock()
+		return true
+	}
+	if len(l.waiters) >= l.cfg.Queue && !l.shedBelow(priority) {
+		l.mu.Unlock()
+		return false
+	}
+	// Each queued request of a route costs it 1/weight of virtual time, so
+	// routes are admitted in proportion to their weights.
+	finish := max(l.virtual, l.finish[route]) + 1/float64(max(weight, 1))
+	l.finish[route] = finish
+	w := &priorityWaiter{priority: priority, finish: finish, granted: make(chan bool, 1)}
+	// Queue behind every more important waiter, and every waiter of the
+	// same class with an earlier finish.
+	i := slices.IndexFunc(l.waiters, func(o *priorityWaiter) bool {
+		return o.priority > priority || (o.priority == priority && o.finish > finish)
+	})
+	if i < 0 {
+		i = len(l.waiters)
+	}
+	l.waiters = slices.Insert(l.waiters, i, w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(cmp.Or(time.Duration(l.cfg.QueueTimeout), defaultQueueTimeout))
+	defer timer.Stop()
+	select {
+	case ok := <-w.granted:
+		return ok
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	l.mu.Lock()
+	if i := slices.Index(l.waiters, w); i >= 0 {
+		l.waiters = slices.Delete(l.waiters, i, i+1)
+		l.mu.Unlock()
+		return false
+	}
+	l.mu.Unlock()
+	// Granted or shed while giving up.
+	if <-w.granted {
+		l.release()
+	}
+	return false
+}
+
+// shedBelow evicts the last waiter less important than priority,
+// reporting whether there was one. l.mu must be held.
+func (l *priorityLimit) shedBelow(priority int) bool {
+	last := len(l.waiters) - 1
+	if last < 0 || l.waiters[last].priority <= priority {
+		return false
+	}
+	l.waiters[last].granted <- false
+	l.waiters = l.waiters[:last]
+	return true
+}
+
+// release frees a slot, handing it to the most important waiter.
+func (l *priorityLimit) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.inFlight--
+		return
+	}
+	w := l.waiters[0]
+	l.waiters = l.waiters[1:]
+	l.virtual = max(l.virtual, w.finish)
+	w.granted <- true
+}
+
+// priorityMiddleware admits requests through the proxy-wide concurrency
+// limit by priority class and route weight, rejecting shed requests with
+// 503.
+func priorityMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stateFrom(r.Context())
+		limit := s.globalConcurrency
+		if limit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		route, _ := routeMatchFrom(r.Context())
+		if !limit.acquire(r.Context(), requestPriority(r), route.Prefix, route.Config.ConcurrencyWeight) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "proxy at capacity", http.StatusServiceUnavailable)
+			return
+		}
+		defer limit.release()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityMiddleware(t *testing.T) {
+	reached := make(chan struct{}, 4)
+	unblock := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached <- struct{}{}
+		if r.URL.RawQuery == "block" {
+			<-unblock
+		}
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/slow", Backend: backend.URL},
+		RouteConfig{Prefix: "/batch", Backend: backend.URL, Priority: priorityLow},
+		RouteConfig{Prefix: "/checkout", Backend: backend.URL, Priority: priorityHigh},
+	)
+	withAppliedConfig(t, func(c *Config) {
+		c.Concurrency = &ConcurrencyConfig{Max: 1, Queue: 1, QueueTimeout: Duration(time.Minute)}
+		c.TrustedPeers = []string{"192.0.2.1"}
+	})
+	handler := routeMiddleware(priorityMiddleware(newProxy()))
+	send := func(path, remoteAddr, priority string) chan int {
+		status := make(chan int, 1)
+		go func() {
+			req := httptest.NewRequest("GET", path, nil)
+			req.RemoteAddr = remoteAddr
+			if priority != "" {
+				req.Header.Set(priorityHeader, priority)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			status <- rr.Code
+		}()
+		return status
+	}
+	queued := func() int {
+		limit := currentState().globalConcurrency
+		limit.mu.Lock()
+		defer limit.mu.Unlock()
+		return len(limit.waiters)
+	}
+
+	// Saturate the proxy, then queue a low-priority request.
+	slow := send("/slow?block", "198.51.100.1:1", "")
+	<-reached
+	batch := send("/batch", "198.51.100.1:1", "")
+	waitFor(t, func() bool { return queued() == 1 })
+
+	// A high-priority request sheds the queued low-priority one.
+	checkout := send("/checkout", "198.51.100.1:1", "")
+	if got := <-batch; got != http.StatusServiceUnavailable {
+		t.Errorf("low priority status = %d, want 503", got)
+	}
+	// Another low-priority request finds nothing less important to shed,
+	// even when an untrusted peer asks for high priority.
+	if got := <-send("/batch", "198.51.100.1:1", priorityHigh); got != http.StatusServiceUnavailable {
+		t.Errorf("untrusted priority header status = %d, want 503", got)
+	}
+	// A trusted peer can raise its priority, but not above a waiting
+	// request of the same class.
+	if got := <-send("/batch", "192.0.2.1:1", priorityHigh); got != http.StatusServiceUnavailable {
+		t.Errorf("trusted high priority status = %d with a high request queued, want 503", got)
+	}
+
+	close(unblock)
+	for name, status := range map[string]chan int{"/slow": slow, "/checkout": checkout} {
+		if got := <-status; got != http.StatusOK {
+			t.Errorf("%s status = %d, want 200", name, got)
+		}
+	}
+}
+
+func TestPriorityLimit_AdmitsByPriority(t *testing.T) {
+	l := newPriorityLimit(ConcurrencyConfig{Max: 1, Queue: 3, QueueTimeout: Duration(time.Minute)})
+	ctx := t.Context()
+	if !l.acquire(ctx, 0, "", 1) {
+		t.Fatal("first acquire failed")
+	}
+	order := make(chan int, 3)
+	for _, p := range []int{2, 1, 0} {
+		go func() {
+			if l.acquire(ctx, p, "", 1) {
+				order <- p
+				l.release()
+			}
+		}()
+		waitFor(t, func() bool {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return len(l.waiters) == 3-p
+		})
+	}
+	l.release()
+	for _, want := range []int{0, 1, 2} {
+		if got := <-order; got != want {
+			t.Errorf("admitted priority %d, want %d", got, want)
+		}
+	}
+}
+
+func TestPriorityLimit_FairQueueing(t *testing.T) {
+	l := newPriorityLimit(ConcurrencyConfig{Max: 1, Queue: 16, QueueTimeout: Duration(time.Minute)})
+	ctx := t.Context()
+	if !l.acquire(ctx, 1, "/hold", 1) {
+		t.Fatal("first acquire failed")
+	}
+	admitted := make(chan string, 16)
+	for i := range 16 {
+		route, weight := "/heavy", 3
+		if i%2 == 1 {
+			route, weight = "/light", 1
+		}
+		go func() {
+			if l.acquire(ctx, 1, route, weight) {
+				admitted <- route
+			}
+		}()
+		waitFor(t, func() bool {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			return len(l.waiters) == i+1
+		})
+	}
+
+	// Admit the first eight one at a time: the heavy route gets three
+	// slots for each of the light route's.
+	counts := map[string]int{}
+	for range 8 {
+		l.release()
+		counts[<-admitted]++
+	}
+	if counts["/heavy"] != 6 || counts["/light"] != 2 {
+		t.Errorf("admitted %v, want 6 /heavy and 2 /light", counts)
+	}
+}
+
+func TestPriorityMiddleware_WeightedThroughput(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(2 * time.Millisecond)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/reports", Backend: backend.URL, ConcurrencyWeight: 3},
+		RouteConfig{Prefix: "/search", Backend: backend.URL},
+	)
+	withAppliedConfig(t, func(c *Config) {
+		c.Concurrency = &ConcurrencyConfig{Max: 1, Queue: 32, QueueTimeout: Duration(time.Minute)}
+	})
+	handler := routeMiddleware(priorityMiddleware(newProxy()))
+
+	// Keep both routes backlogged with clients sending back to back.
+	var mu sync.Mutex
+	served := map[string]int{}
+	stop := time.Now().Add(300 * time.Millisecond)
+	var wg sync.WaitGroup
+	for _, path := range []string{"/reports", "/search"} {
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for time.Now().Before(stop) {
+					rr := httptest.NewRecorder()
+					handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+					if rr.Code == http.StatusOK {
+						mu.Lock()
+						served[path]++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	ratio := float64(served["/reports"]) / float64(max(served["/search"], 1))
+	if ratio < 2 || ratio > 4.5 {
+		t.Errorf("served %v, a ratio of %.2f, want about 3", served, ratio)
+	}
+}
@@ -1,63 +1,478 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // matchRoute finds the longest matching route prefix for the given path.
 // Returns the matched prefix, target URL, and remaining path suffix.
-// If no route matches, all return values are empty strings.
-func matchRoute(path string, routes map[string]string) (match, target, suffix string) {
-	for prefix, t := range routes {
-		s, found := strings.CutPrefix(path, prefix)
-		if found && (s == "" || strings.HasPrefix(s, "/")) {
-			if len(prefix) > len(match) {
-				match = prefix
-				target = t
-				suffix = s
-			}
+// If no route matches, all return values are empty strings. Prefixes in
+// caseInsensitive, keyed by their lower-cased form, match in any case; the
+// suffix keeps the case of path.
+//
+// A prefix matches the whole path or ends where a path segment starts, so
+// only those candidates are looked up, longest first. This keeps lookups
+// proportional to the path's depth rather than the number of routes.
+func matchRoute(path string, routes, caseInsensitive map[string]string) (match, target, suffix string) {
+	for end := len(path); end > 0; end = strings.LastIndexByte(path[:end], '/') {
+		candidate := path[:end]
+		if t, ok := routes[candidate]; ok {
+			return candidate, t, path[end:]
+		}
+		if len(caseInsensitive) == 0 {
+			continue
+		}
+		prefix, ok := caseInsensitive[strings.ToLower(candidate)]
+		if !ok || len(prefix) != len(candidate) || !strings.EqualFold(prefix, candidate) {
+			continue
+		}
+		if t, ok := routes[prefix]; ok {
+			return prefix, t, path[end:]
 		}
 	}
-	return
+	return "", "", ""
 }
 
-func rewriteRequest(pr *httputil.ProxyRequest) {
-	ctx, _ := context.WithTimeout(pr.Out.Context(), 60*time.Second)
-	pr.Out = pr.Out.WithContext(ctx)
+// routeMatch is the route a request matched, attached to its context by
+// routeMiddleware so later middleware need not match it again.
+type routeMatch struct {
+	Prefix string
+	// Backend is the route's single backend, or "" for a pool, whose
+	// member is only picked when the request is forwarded.
+	Backend string
+	// Suffix is the rest of the path after the prefix.
+	Suffix string
+	Config RouteConfig
+}
+
+type routeMatchKey struct{}
+
+// routeMatchFrom returns the route attached by routeMiddleware. ok is
+// false if the request matched no route or was not seen by routeMiddleware.
+func routeMatchFrom(ctx context.Context) (m routeMatch, ok bool) {
+	m, ok = ctx.Value(routeMatchKey{}).(routeMatch)
+	return m, ok
+}
+
+// routeMiddleware loads the active state and matches the request to a
+// route once, attaching both to its context.
+func routeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := currentState()
+		r = r.WithContext(withState(r.Context(), s))
+		prefix, backend, suffix := matchRoute(r.URL.Path, s.routes, s.caseInsensitiveRoutes)
+		if prefix != "" {
+			rt, _ := s.route(prefix)
+			m := routeMatch{Prefix: prefix, Backend: backend, Suffix: suffix, Config: rt}
+			r = r.WithContext(context.WithValue(r.Context(), routeMatchKey{}, m))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newProxy returns the reverse proxy that forwards matched routes to their
+// backends.
+func newProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite:        rewriteRequest,
+		Transport:      backendRoundTripper{},
+		ModifyResponse: modifyResponse,
+		ErrorHandler:   errorHandler,
+		BufferPool:     copyBuffers,
+	}
+}
+
+// unexpectedStatusError reports a backend response whose status is not in
+// the route's AllowedStatuses.
+type unexpectedStatusError struct {
+	status int
+}
+
+func (e *unexpectedStatusError) Error() string {
+	return fmt.Sprintf("backend returned unexpected status %d", e.status)
+}
+
+// modifyResponse checks a backend response against the route's
+// AllowedStatuses and applies its ResponseHeaders and Trailers rules.
+func modifyResponse(res *http.Response) error {
+	discardForbiddenBody(res)
+	route, _ := routeMatchFrom(res.Request.Context())
+	s := stateFrom(res.Request.Context())
+	rt := route.Config
+	server := s.config.ServerHeader
+	if err := checkResponseStatus(res, rt); err != nil {
+		return err
+	}
+	if server != nil && *server == "" {
+		res.Header.Del("Server")
+	} else if server != nil {
+		res.Header.Set("Server", *server)
+	}
+	if l := upstreamLatencyFrom(res.Request.Context()); l != nil {
+		res.Header.Set(upstreamLatencyHeader, strconv.FormatInt(time.Duration(l.Load()).Milliseconds(), 10))
+	}
+	if rt.ResponseHeaders != nil {
+		rt.ResponseHeaders.apply(res.Header)
+	}
+	if len(rt.Trailers) > 0 && res.StatusCode != http.StatusSwitchingProtocols {
+		filterTrailers(res, rt.Trailers)
+	}
+	markBackendResponse(res.Request.Context())
+	return nil
+}
 
-	prefix, backend, remainder := matchRoute(pr.In.URL.Path, routes)
-	if prefix == "" {
+// discardForbiddenBody drops the body a misbehaving backend framed on a 204
+// or 304 response, which must not have one, so the client gets a clean
+// response. The transport never reads such a body; the stray bytes left on
+// the connection make it close the connection rather than reuse it.
+func discardForbiddenBody(res *http.Response) {
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusNotModified {
+		return
+	}
+	// A 304's Content-Length describes the representation it stands for,
+	// so only chunking shows it framed a body. A 204 has no content at all.
+	framed := len(res.TransferEncoding) > 0
+	if cl := res.Header.Get("Content-Length"); res.StatusCode == http.StatusNoContent && cl != "" && cl != "0" {
+		framed = true
+	}
+	if !framed {
+		return
+	}
+	slog.Warn("backend sent a body with a bodiless response, discarding it",
+		"backend", backendKey(res.Request.URL),
+		"path", res.Request.URL.Path,
+		"status", res.StatusCode,
+	)
+	res.Body.Close()
+	res.Body = http.NoBody
+	res.ContentLength = 0
+	res.TransferEncoding = nil
+	if res.StatusCode == http.StatusNoContent {
+		res.Header.Del("Content-Length")
+	}
+}
+
+// checkResponseStatus fails responses whose status rt does not allow, so
+// the client gets a normalized 502 instead.
+func checkResponseStatus(res *http.Response, rt RouteConfig) error {
+	if len(rt.AllowedStatuses) == 0 || statusAllowed(res.StatusCode, rt.AllowedStatuses) {
+		return nil
+	}
+	slog.Warn("unexpected backend status",
+		"backend", backendKey(res.Request.URL),
+		"path", res.Request.URL.Path,
+		"status", res.StatusCode,
+	)
+	return &unexpectedStatusError{status: res.StatusCode}
+}
+
+// statusAllowed reports whether status matches an entry of allowed: an
+// exact code such as "404" or a class such as "2xx".
+func statusAllowed(status int, allowed []string) bool {
+	code := strconv.Itoa(status)
+	for _, a := range allowed {
+		if a == code || (strings.HasSuffix(a, "xx") && len(a) == 3 && a[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// validStatusPattern reports whether p is an AllowedStatuses entry.
+func validStatusPattern(p string) bool {
+	if len(p) != 3 || p[0] < '1' || p[0] > '5' {
+		return false
+	}
+	if p[1:] == "xx" {
+		return true
+	}
+	_, err := strconv.Atoi(p)
+	return err == nil
+}
+
+// timeoutHeader lets a trusted peer set its own request timeout, such as
+// "5s", bounded by Config.MaxRequestTimeout.
+const timeoutHeader = "X-Proxy-Timeout"
+
+// timeoutMiddleware bounds the lifetime of each request, including the
+// backend round trip, to d, or to the timeoutHeader of a trusted peer.
+func timeoutMiddleware(next http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := d
+		if v := r.Header.Get(timeoutHeader); v != "" && peerTrusted(r) {
+			if requested, err := time.ParseDuration(v); err == nil && requested > 0 {
+				maxTimeout := time.Duration(stateFrom(r.Context()).config.MaxRequestTimeout)
+				d = min(requested, cmp.Or(maxTimeout, backendTimeout))
+			}
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientPortHeader carries the client's source port to backends when
+// Config.ForwardClientPort is on.
+const clientPortHeader = "X-Client-Port"
+
+// requestStartHeader carries the time the proxy received the request to
+// backends when Config.ForwardRequestStart is on.
+const requestStartHeader = "X-Request-Start"
+
+// requestStartValue formats t as NGINX's "t=${msec}": Unix seconds with
+// millisecond resolution.
+func requestStartValue(t time.Time) string {
+	ms := t.UnixMilli()
+	return fmt.Sprintf("t=%d.%03d", ms/1000, ms%1000)
+}
+
+// rewriteRequest points the outbound request at the backend for its route.
+// If the route has no backend available, the request is left without a host
+// and the transport fails it with errNoBackend.
+func rewriteRequest(pr *httputil.ProxyRequest) {
+	s := stateFrom(pr.In.Context())
+	config := s.config
+	route, ok := routeMatchFrom(pr.In.Context())
+	if !ok {
 		return
 	}
+	prefix, backend, remainder := route.Prefix, route.Backend, route.Suffix
+	if b := bodyRouteBackend(pr.In); b != "" {
+		backend = b
+	} else if c := s.routeCanaries[prefix]; c != nil && c.matches(pr.In, prefix, remainder) {
+		backend = c.backend
+	} else if pool := s.routePools[prefix]; pool != nil {
+		picked := pool.override(pr.In)
+		if picked == nil {
+			picked = pool.Pick(pr.In)
+		}
+		if picked == nil {
+			return
+		}
+		backend = picked.url
+	}
+	if backend == "" {
+		return
+	}
+	if info := requestInfoFrom(pr.In.Context()); info != nil {
+		info.backend = backend
+	}
+	stripInboundHeaders(pr.Out.Header, config, backend)
+	if rp := replayFrom(pr.In.Context()); rp != nil {
+		rp.backend = backend
+		pr.Out.Header.Set(replayHeader, "1")
+	}
 
-	backendURL, err := url.Parse(backend + remainder)
+	target, err := joinBackendURL(backend, remainder)
 	if err != nil {
 		return
 	}
 
-	pr.SetURL(backendURL)
+	pr.Out.URL.Scheme = target.Scheme
+	pr.Out.URL.Host = target.Host
+	pr.Out.URL.Path = target.Path
+	pr.Out.URL.RawPath = ""
+	if target.RawQuery != "" && pr.Out.URL.RawQuery != "" {
+		pr.Out.URL.RawQuery = target.RawQuery + "&" + pr.Out.URL.RawQuery
+	} else if target.RawQuery != "" {
+		pr.Out.URL.RawQuery = target.RawQuery
+	}
+	pr.Out.Host = ""
+	rt := route.Config
+	if rt.Timeouts != nil {
+		pr.Out = pr.Out.WithContext(withRouteTimeouts(pr.Out.Context(), *rt.Timeouts))
+	}
+	if rt.SLA != nil {
+		pr.Out = pr.Out.WithContext(withRouteSLA(pr.Out.Context(), *rt.SLA))
+	}
+	if rt.Retry != nil {
+		pr.Out = pr.Out.WithContext(withRouteRetry(pr.Out.Context(), *rt.Retry))
+	}
+	if exposesUpstreamLatency(pr.In, rt.UpstreamLatency) {
+		pr.Out = pr.Out.WithContext(withUpstreamLatency(pr.Out.Context()))
+	}
+	if up := pr.Out.Header.Get("Upgrade"); up != "" && len(rt.Upgrades) > 0 &&
+		!slices.ContainsFunc(rt.Upgrades, func(p string) bool { return strings.EqualFold(p, up) }) {
+		// Forward the request without the upgrade, as a server may ignore it.
+		pr.Out.Header.Del("Upgrade")
+		pr.Out.Header.Del("Connection")
+	}
+	if rt.DisableKeepAlives && pr.Out.Header.Get("Upgrade") == "" {
+		// Sends Connection: close and keeps the connection out of the pool.
+		pr.Out.Close = true
+	}
+	if id := outboundRequestID(pr.In, rt.RequestID); id != "" {
+		pr.Out.Header.Set("X-Request-ID", id)
+	} else {
+		pr.Out.Header.Del("X-Request-ID")
+	}
+	pr.Out.Header["X-Forwarded-For"] = inboundForwardedFor(pr.In, config.ForwardedFor)
 	pr.SetXForwarded()
+	if config.ForwardPrefix {
+		pr.Out.Header.Set("X-Forwarded-Prefix", prefix)
+	}
+	if config.ForwardClientPort {
+		pr.Out.Header.Del(clientPortHeader)
+		if port := clientPort(pr.In.RemoteAddr); port != 0 {
+			pr.Out.Header.Set(clientPortHeader, strconv.Itoa(port))
+		}
+	}
+
+	if config.Tracing != nil {
+		tp, continued := outboundTraceparent(pr.In.Header.Get(traceparentHeader), config.Tracing.SampleRatio)
+		pr.Out.Header.Set(traceparentHeader, tp)
+		if !continued {
+			// The state belongs to a trace the request is no longer part of.
+			pr.Out.Header.Del(tracestateHeader)
+		}
+	}
+
+	if config.ForwardRequestStart {
+		start := time.Now()
+		if info := requestInfoFrom(pr.In.Context()); info != nil && !info.start.IsZero() {
+			start = info.start
+		}
+		pr.Out.Header.Set(requestStartHeader, requestStartValue(start))
+	}
+
+	if config.ForwardClientCert && pr.In.TLS != nil && len(pr.In.TLS.PeerCertificates) > 0 {
+		pr.Out.Header.Set("X-Forwarded-Client-Cert", clientCertHeader(pr.In.TLS.PeerCertificates))
+	}
+
+	applyRewriteRules(s.routeRewriteRules[prefix], pr.In, pr.Out, prefix)
+	collapseHeaders(pr.Out.Header, config.CollapseHeaders)
 }
 
-func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
-	prefix, _, _ := matchRoute(r.URL.Path, routes)
-	if prefix == "" {
+// stripInboundHeaders removes from h, the header of a request being sent
+// to backend, the headers a client must not pass on: the proxy's own
+// control headers, an X-Forwarded-Client-Cert, which the client could
+// forge, and the backend's StripHeaders.
+func stripInboundHeaders(h http.Header, config *Config, backend string) {
+	h.Del(replayHeader)
+	h.Del(backendOverrideHeader)
+	h.Del(timeoutHeader)
+	h.Del(priorityHeader)
+	h.Del("X-Forwarded-Client-Cert")
+	for _, name := range config.Backends[backend].StripHeaders {
+		h.Del(name)
+	}
+}
+
+// joinBackendURL appends the path remaining after the route prefix to the
+// backend URL, keeping any path the backend already has and never doubling
+// or dropping the slash between them.
+func joinBackendURL(backend, remainder string) (*url.URL, error) {
+	u, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case remainder == "":
+		if u.Path == "" {
+			u.Path = "/"
+		}
+	case strings.HasSuffix(u.Path, "/"):
+		u.Path += strings.TrimPrefix(remainder, "/")
+	default:
+		u.Path += remainder
+	}
+	u.RawPath = ""
+	return u, nil
+}
+
+// clientCertHeader formats a client certificate chain for the
+// X-Forwarded-Client-Cert header: the leaf and the full chain, each as
+// URL-encoded PEM.
+func clientCertHeader(chain []*x509.Certificate) string {
+	var all bytes.Buffer
+	for _, cert := range chain {
+		pem.Encode(&all, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	leaf := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw})
+	return fmt.Sprintf("Cert=%q;Chain=%q", url.QueryEscape(string(leaf)), url.QueryEscape(all.String()))
+}
+
+// NoRouteConfig customises the response to requests that match no route.
+type NoRouteConfig struct {
+	// Status defaults to 404. statusCloseConnection (444) closes the
+	// connection without sending a response.
+	Status      int    `json:"status"`
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+}
+
+// statusCloseConnection closes the client connection without a response,
+// following NGINX.
+const statusCloseConnection = 444
+
+// writeNoRoute responds to a request that matched no route.
+func writeNoRoute(w http.ResponseWriter, r *http.Request) {
+	nr := stateFrom(r.Context()).config.NoRoute
+	if nr == nil {
 		http.Error(w, "Route not found", http.StatusNotFound)
 		return
 	}
 
+	if nr.Status == statusCloseConnection {
+		if conn, _, err := http.NewResponseController(w).Hijack(); err == nil {
+			conn.Close()
+			if info := requestInfoFrom(r.Context()); info != nil {
+				info.status = statusCloseConnection
+			}
+			return
+		}
+	}
+
+	status := nr.Status
+	if status == 0 || status == statusCloseConnection {
+		status = http.StatusNotFound
+	}
+	w.Header().Set("Content-Type", cmp.Or(nr.ContentType, "text/plain; charset=utf-8"))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	io.WriteString(w, nr.Body)
+}
+
+func errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if _, routed := routeMatchFrom(r.Context()); !routed {
+		writeNoRoute(w, r)
+		return
+	}
+
 	var maxBytesErr *http.MaxBytesError
-	if errors.As(err, &maxBytesErr) {
+	var statusErr *unexpectedStatusError
+	var jsonErr *invalidJSONError
+	if errors.As(err, &statusErr) {
+		http.Error(w, "Unexpected backend response", http.StatusBadGateway)
+	} else if errors.Is(err, errNoBackend) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "No backend available", http.StatusServiceUnavailable)
+	} else if errors.As(err, &maxBytesErr) {
 		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+	} else if errors.As(err, &jsonErr) {
+		http.Error(w, jsonErr.Error(), http.StatusBadRequest)
 	} else if os.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
 		http.Error(w, "backend timeout", http.StatusGatewayTimeout)
+	} else if isResponseHeadersTooLarge(err) {
+		http.Error(w, "Backend response headers too large", http.StatusBadGateway)
+	} else if category, detail := classifyTLSError(err); category != "" {
+		writeTLSError(w, r, category, detail, err)
 	} else {
 		http.Error(w, "Failed to reach target service", http.StatusBadGateway)
 	}
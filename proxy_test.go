@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate for commonName.
+func newTestCert(t *testing.T, commonName string) tls.Certificate {
+	t.Helper()
+	return newTestCertValid(t, commonName, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+}
+
+// newTestCertValid returns a self-signed certificate for commonName valid
+// between notBefore and notAfter.
+func newTestCertValid(t *testing.T, commonName string, notBefore, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Client-Cert"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	withConfig(t, func(c *Config) { c.ForwardClientCert = true })
+
+	proxy := httptest.NewUnstartedServer(newTestProxy())
+	proxy.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	proxy.StartTLS()
+	defer proxy.Close()
+
+	clientCert := newTestCert(t, "client.example")
+	client := proxy.Client()
+	client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{clientCert}
+
+	req, _ := http.NewRequest("GET", proxy.URL+"/service1", nil)
+	req.Header.Set("X-Forwarded-Client-Cert", "spoofed")
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	wantPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Leaf.Raw}))
+	want := `Cert="` + url.QueryEscape(wantPEM) + `"`
+	if !strings.HasPrefix(string(body), want) {
+		t.Errorf("X-Forwarded-Client-Cert = %q, want prefix %q", body, want)
+	}
+	if !strings.Contains(string(body), "Chain=") {
+		t.Errorf("X-Forwarded-Client-Cert = %q, want Chain element", body)
+	}
+}
+
+func TestForwardClientCert_StripsInboundHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Client-Cert"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	for _, forward := range []bool{true, false} {
+		t.Run(fmt.Sprintf("forward_client_cert=%v", forward), func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForwardClientCert = forward })
+			req := httptest.NewRequest("GET", "/service1", nil)
+			req.Header.Set("X-Forwarded-Client-Cert", "spoofed")
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+
+			if rr.Body.String() != "" {
+				t.Errorf("X-Forwarded-Client-Cert = %q, want it stripped", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestReverseProxy_MultipleSetCookie(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Path=/; HttpOnly")
+		w.Header().Add("Set-Cookie", "theme=dark; Path=/")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	captureLogs(t)
+
+	req := httptest.NewRequest("GET", "/service1", nil)
+	rr := httptest.NewRecorder()
+	newHandler().ServeHTTP(rr, req)
+
+	got := rr.Result().Header.Values("Set-Cookie")
+	want := []string{"session=abc; Path=/; HttpOnly", "theme=dark; Path=/"}
+	if len(got) != len(want) {
+		t.Fatalf("Set-Cookie = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Set-Cookie[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestForwardPrefix(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Prefix"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	withRoute(t, "/service1/nested", backend.URL)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		path    string
+		want    string
+	}{
+		{"disabled", false, "/service1/foo", ""},
+		{"route prefix", true, "/service1/foo", "/service1"},
+		{"longest matched prefix", true, "/service1/nested/foo", "/service1/nested"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForwardPrefix = tt.enabled })
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("X-Forwarded-Prefix", "/spoofed")
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+			if tt.enabled && rr.Body.String() != tt.want {
+				t.Errorf("X-Forwarded-Prefix = %q, want %q", rr.Body.String(), tt.want)
+			}
+			if !tt.enabled && rr.Body.String() != "/spoofed" {
+				t.Errorf("X-Forwarded-Prefix = %q, want client value passed through", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestNoRouteResponse(t *testing.T) {
+	withConfig(t, func(c *Config) {
+		c.NoRoute = &NoRouteConfig{
+			Status:      http.StatusNotFound,
+			Body:        `{"error":"no such service"}`,
+			ContentType: "application/json",
+		}
+	})
+
+	rr := httptest.NewRecorder()
+	newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/unknown", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("status = %v, want %v", rr.Code, http.StatusNotFound)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	if got := rr.Body.String(); got != `{"error":"no such service"}` {
+		t.Errorf("body = %q, want configured body", got)
+	}
+}
+
+func TestNoRouteResponse_CloseConnection(t *testing.T) {
+	withConfig(t, func(c *Config) { c.NoRoute = &NoRouteConfig{Status: statusCloseConnection} })
+	logs := captureLogs(t)
+	done := make(chan struct{})
+	handler := routeMiddleware(loggingMiddleware(newProxy()))
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/unknown")
+	if err == nil {
+		res.Body.Close()
+		t.Fatalf("got response %v, want the connection closed", res.Status)
+	}
+	<-done
+	if entry := accessLog(t, logs); entry["status"] != float64(statusCloseConnection) {
+		t.Errorf("logged status = %v, want %v", entry["status"], statusCloseConnection)
+	}
+}
+
+func TestBackendStripHeaders(t *testing.T) {
+	echo := func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "cookie=%q auth=%q tenant=%q",
+			r.Header.Get("Cookie"), r.Header.Get("Authorization"), r.Header.Get("X-Tenant"))
+	}
+	untrusted := httptest.NewServer(http.HandlerFunc(echo))
+	defer untrusted.Close()
+	trusted := httptest.NewServer(http.HandlerFunc(echo))
+	defer trusted.Close()
+
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{
+			{Prefix: "/partner", Backend: untrusted.URL},
+			{Prefix: "/internal", Backend: trusted.URL},
+		}
+		c.Backends = map[string]BackendConfig{
+			untrusted.URL: {StripHeaders: []string{"Cookie", "authorization"}},
+		}
+	})
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/partner", `cookie="" auth="" tenant="acme"`},
+		{"/internal", `cookie="session=abc" auth="Bearer secret" tenant="acme"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.Header.Set("Cookie", "session=abc")
+			req.Header.Set("Authorization", "Bearer secret")
+			req.Header.Set("X-Tenant", "acme")
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+			if rr.Body.String() != tt.want {
+				t.Errorf("backend saw %s, want %s", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCollapseHeaders(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "type=%q tenant=%q accept=%q",
+			r.Header.Values("Content-Type"), r.Header.Values("X-Tenant"), r.Header.Values("Accept"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/api", backend.URL)
+
+	tests := []struct {
+		name  string
+		rules []CollapseHeaderConfig
+		want  string
+	}{
+		{"no rules", nil, `type=["application/json" "text/plain"] tenant=["acme" "acme"] accept=["a" "b"]`},
+		{"keep first", []CollapseHeaderConfig{{Name: "content-type"}, {Name: "X-Tenant", Keep: "first"}},
+			`type=["application/json"] tenant=["acme"] accept=["a" "b"]`},
+		{"keep last", []CollapseHeaderConfig{{Name: "Content-Type", Keep: "last"}},
+			`type=["text/plain"] tenant=["acme" "acme"] accept=["a" "b"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.CollapseHeaders = tt.rules })
+			req := httptest.NewRequest("POST", "/api", nil)
+			req.Header["Content-Type"] = []string{"application/json", "text/plain"}
+			req.Header["X-Tenant"] = []string{"acme", "acme"}
+			req.Header["Accept"] = []string{"a", "b"}
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+			if rr.Body.String() != tt.want {
+				t.Errorf("backend saw %s, want %s", rr.Body.String(), tt.want)
+			}
+		})
+	}
+
+	c := &Config{CollapseHeaders: []CollapseHeaderConfig{{Name: "Content-Type", Keep: "middle"}}}
+	if err := c.validate(); err == nil {
+		t.Error("validate() accepted keep \"middle\"")
+	}
+}
+
+func TestJoinBackendURL(t *testing.T) {
+	tests := []struct {
+		backend   string
+		remainder string
+		want      string
+	}{
+		{"http://host", "", "http://host/"},
+		{"http://host", "/users", "http://host/users"},
+		{"http://host/", "/users", "http://host/users"},
+		{"http://host/api", "", "http://host/api"},
+		{"http://host/api", "/", "http://host/api/"},
+		{"http://host/api", "/users", "http://host/api/users"},
+		{"http://host/api/", "", "http://host/api/"},
+		{"http://host/api/", "/users", "http://host/api/users"},
+		{"http://host/api?v=2", "/users", "http://host/api/users?v=2"},
+	}
+	for _, tt := range tests {
+		got, err := joinBackendURL(tt.backend, tt.remainder)
+		if err != nil {
+			t.Errorf("joinBackendURL(%q, %q): %v", tt.backend, tt.remainder, err)
+			continue
+		}
+		if got.String() != tt.want {
+			t.Errorf("joinBackendURL(%q, %q) = %q, want %q", tt.backend, tt.remainder, got, tt.want)
+		}
+	}
+}
+
+func TestReverseProxy_BackendPath(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name    string
+		backend string
+		target  string
+		want    string
+	}{
+		{"no backend path", backend.URL, "/svc/users?id=1", "/users?id=1"},
+		{"backend path", backend.URL + "/api", "/svc/users", "/api/users"},
+		{"backend path with trailing slash", backend.URL + "/api/", "/svc/users", "/api/users"},
+		{"prefix only", backend.URL + "/api", "/svc", "/api"},
+		{"backend query merged", backend.URL + "/api?v=2", "/svc/users?id=1", "/api/users?v=2&id=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRoute(t, "/svc", tt.backend)
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", tt.target, nil))
+			if rr.Body.String() != tt.want {
+				t.Errorf("backend saw %q, want %q", rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutMiddleware_Header(t *testing.T) {
+	tests := []struct {
+		name   string
+		peer   string
+		header string
+		max    time.Duration
+		want   time.Duration
+	}{
+		{"no header", "10.0.0.1:1234", "", 0, 30 * time.Second},
+		{"trusted peer", "10.0.0.1:1234", "5s", 0, 5 * time.Second},
+		{"untrusted peer", "203.0.113.1:1234", "5s", 0, 30 * time.Second},
+		{"clamped to max", "10.0.0.1:1234", "10m", 2 * time.Minute, 2 * time.Minute},
+		{"clamped to default max", "10.0.0.1:1234", "10m", 0, backendTimeout},
+		{"invalid header", "10.0.0.1:1234", "soon", 0, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.TrustedPeers = []string{"10.0.0.0/8"}
+				c.MaxRequestTimeout = Duration(tt.max)
+			})
+			var got time.Duration
+			handler := timeoutMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				deadline, _ := r.Context().Deadline()
+				got = time.Until(deadline)
+			}), 30*time.Second)
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.peer
+			if tt.header != "" {
+				req.Header.Set(timeoutHeader, tt.header)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			if got > tt.want || got < tt.want-time.Second {
+				t.Errorf("timeout = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedStatuses(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, _ := strconv.Atoi(r.URL.Query().Get("code"))
+		w.WriteHeader(code)
+		io.WriteString(w, "backend body")
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: backend.URL, AllowedStatuses: []string{"2xx", "404"}})
+
+	tests := []struct {
+		code       int
+		wantStatus int
+	}{
+		{200, 200},
+		{204, 204},
+		{404, 404},
+		{418, http.StatusBadGateway},
+		{500, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.code), func(t *testing.T) {
+			logs := captureLogs(t)
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", fmt.Sprintf("/api?code=%d", tt.code), nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			remapped := tt.wantStatus != tt.code
+			if remapped && strings.Contains(rr.Body.String(), "backend body") {
+				t.Errorf("body = %q, want the backend body withheld", rr.Body.String())
+			}
+			var logged any
+			for _, rec := range logRecords(t, logs) {
+				if rec["msg"] == "unexpected backend status" {
+					logged = rec["status"]
+				}
+			}
+			if remapped && logged != float64(tt.code) {
+				t.Errorf("logged status = %v, want %d", logged, tt.code)
+			} else if !remapped && logged != nil {
+				t.Errorf("allowed status %d logged as unexpected", tt.code)
+			}
+		})
+	}
+}
+
+func TestForwardClientPort(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(clientPortHeader))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		remoteAddr string
+		want       string
+	}{
+		{"disabled", false, "192.0.2.1:51234", "spoofed"},
+		{"host and port", true, "192.0.2.1:51234", "51234"},
+		{"no port", true, "192.0.2.1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ForwardClientPort = tt.enabled })
+			req := httptest.NewRequest("GET", "/service1", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set(clientPortHeader, "spoofed")
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+			if rr.Body.String() != tt.want {
+				t.Errorf("%s = %q, want %q", clientPortHeader, rr.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardRequestStart(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(requestStartHeader))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	captureLogs(t)
+
+	t.Run("disabled", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/service1", nil)
+		req.Header.Set(requestStartHeader, "t=1")
+		rr := httptest.NewRecorder()
+		routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(rr, req)
+		if rr.Body.String() != "t=1" {
+			t.Errorf("%s = %q, want inbound value kept", requestStartHeader, rr.Body.String())
+		}
+	})
+
+	t.Run("enabled", func(t *testing.T) {
+		withConfig(t, func(c *Config) { c.ForwardRequestStart = true })
+		req := httptest.NewRequest("GET", "/service1", nil)
+		req.Header.Set(requestStartHeader, "t=1")
+		rr := httptest.NewRecorder()
+		before := time.Now().Truncate(time.Millisecond)
+		routeMiddleware(loggingMiddleware(newProxy())).ServeHTTP(rr, req)
+		after := time.Now()
+
+		v, ok := strings.CutPrefix(rr.Body.String(), "t=")
+		if !ok {
+			t.Fatalf("%s = %q, want t=<seconds>", requestStartHeader, rr.Body.String())
+		}
+		secs, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			t.Fatalf("%s = %q: %v", requestStartHeader, rr.Body.String(), err)
+		}
+		got := time.UnixMilli(int64(math.Round(secs * 1000)))
+		if got.Before(before) || got.After(after) {
+			t.Errorf("%s = %v, want between %v and %v", requestStartHeader, got, before, after)
+		}
+	})
+}
+
+func TestServerHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	proxyName, empty := "edge", ""
+	tests := []struct {
+		name    string
+		server  *string
+		want    string
+		present bool
+	}{
+		{"unset keeps the backend's", nil, "Apache/2.4.41 (Ubuntu)", true},
+		{"replaced", &proxyName, "edge", true},
+		{"removed", &empty, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.ServerHeader = tt.server })
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/service1", nil))
+			got, present := rr.Header()["Server"]
+			if present != tt.present || rr.Header().Get("Server") != tt.want {
+				t.Errorf("Server = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyServerHeader(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "Apache/2.4.41 (Ubuntu)")
+		if r.URL.Query().Has("fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/service1", Backend: backend.URL},
+		RouteConfig{Prefix: "/checked", Backend: backend.URL, AllowedStatuses: []string{"2xx"}},
+		RouteConfig{Prefix: "/down", Backend: "http://127.0.0.1:1"},
+		RouteConfig{Prefix: "/robots.txt", Static: &StaticResponseConfig{Body: "User-agent: *"}},
+		RouteConfig{Prefix: "/named", Static: &StaticResponseConfig{Headers: map[string]string{"Server": "custom"}}},
+	)
+	captureLogs(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthCheckHandler)
+	mux.Handle("/", newHandler())
+	handler := serverIdentityMiddleware(mux)
+
+	normalized := "edge"
+	tests := []struct {
+		name       string
+		path       string
+		server     *string
+		wantStatus int
+		want       string
+	}{
+		{"health check", "/health", nil, http.StatusOK, "reverse-proxy"},
+		{"static route", "/robots.txt", nil, http.StatusOK, "reverse-proxy"},
+		{"static route with its own Server", "/named", nil, http.StatusOK, "custom"},
+		{"no route", "/missing", nil, http.StatusNotFound, "reverse-proxy"},
+		{"backend unreachable", "/down", nil, http.StatusBadGateway, "reverse-proxy"},
+		{"backend status rejected", "/checked?fail", nil, http.StatusBadGateway, "reverse-proxy"},
+		{"backend response keeps its own", "/service1", nil, http.StatusOK, "Apache/2.4.41 (Ubuntu)"},
+		{"backend error keeps its own", "/service1?fail", nil, http.StatusInternalServerError, "Apache/2.4.41 (Ubuntu)"},
+		{"backend response normalized", "/service1", &normalized, http.StatusOK, "edge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.ProxyServerHeader = "reverse-proxy"
+				c.ServerHeader = tt.server
+			})
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != tt.wantStatus || rr.Header().Get("Server") != tt.want {
+				t.Errorf("response = %d with Server %q, want %d with %q", rr.Code, rr.Header().Get("Server"), tt.wantStatus, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseHeaders_CSPPerRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", "default-src 'self'")
+		w.Header().Set("X-Powered-By", "backend")
+	}))
+	defer backend.Close()
+
+	// A long policy of the kind admin UIs need, well past typical line
+	// lengths.
+	relaxed := "default-src 'self'; script-src 'self' 'unsafe-inline' 'unsafe-eval' " +
+		strings.Repeat("https://cdn.example.com/assets/ ", 64) + "; img-src * data:"
+	strict := []string{"default-src 'none'", "frame-ancestors 'none'; base-uri 'none'"}
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/admin", Backend: backend.URL, ResponseHeaders: &HeaderRulesConfig{
+			Set: map[string][]string{"Content-Security-Policy": {relaxed}},
+		}},
+		RouteConfig{Prefix: "/public", Backend: backend.URL, ResponseHeaders: &HeaderRulesConfig{
+			Set:    map[string][]string{"content-security-policy": strict},
+			Add:    map[string][]string{"Content-Security-Policy-Report-Only": {"default-src 'self'", "script-src 'none'"}},
+			Remove: []string{"X-Powered-By"},
+		}},
+		RouteConfig{Prefix: "/plain", Backend: backend.URL},
+	)
+
+	tests := []struct {
+		path        string
+		wantCSP     []string
+		wantReport  []string
+		wantPowered string
+	}{
+		{"/admin", []string{relaxed}, nil, "backend"},
+		{"/public", strict, []string{"default-src 'self'", "script-src 'none'"}, ""},
+		{"/plain", []string{"default-src 'self'"}, nil, "backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			h := rr.Result().Header
+			if got := h.Values("Content-Security-Policy"); !slices.Equal(got, tt.wantCSP) {
+				t.Errorf("Content-Security-Policy = %q, want %q", got, tt.wantCSP)
+			}
+			if got := h.Values("Content-Security-Policy-Report-Only"); !slices.Equal(got, tt.wantReport) {
+				t.Errorf("Content-Security-Policy-Report-Only = %q, want %q", got, tt.wantReport)
+			}
+			if got := h.Get("X-Powered-By"); got != tt.wantPowered {
+				t.Errorf("X-Powered-By = %q, want %q", got, tt.wantPowered)
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		io.WriteString(w, "body")
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "ok")
+		w.Header().Set(http.TrailerPrefix+"X-Debug", "undeclared")
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name     string
+		trailers []string
+		want     http.Header
+	}{
+		{
+			name: "all forwarded by default",
+			want: http.Header{"Grpc-Status": {"0"}, "Grpc-Message": {"ok"}, "X-Debug": {"undeclared"}},
+		},
+		{
+			name:     "allow-list",
+			trailers: []string{"grpc-status"},
+			want:     http.Header{"Grpc-Status": {"0"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRouteConfigs(t, RouteConfig{Prefix: "/grpc", Backend: backend.URL, Trailers: tt.trailers})
+			proxy := httptest.NewServer(newHandler())
+			defer proxy.Close()
+
+			res, err := http.Get(proxy.URL + "/grpc")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if string(body) != "body" {
+				t.Errorf("body = %q, want body", body)
+			}
+			if len(res.Trailer) != len(tt.want) {
+				t.Errorf("trailers = %v, want %v", res.Trailer, tt.want)
+			}
+			for name, want := range tt.want {
+				if got := res.Trailer.Values(name); !slices.Equal(got, want) {
+					t.Errorf("trailer %s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamLatencyHeader(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		policy     string
+		remoteAddr string
+		want       bool
+	}{
+		{"off", "", "10.0.0.1:1234", false},
+		{"trusted peer", "trusted", "10.0.0.1:1234", true},
+		{"untrusted peer", "trusted", "203.0.113.9:1234", false},
+		{"all clients", "all", "203.0.113.9:1234", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withAppliedConfig(t, func(c *Config) {
+				c.Routes = []RouteConfig{{Prefix: "/api", Backend: backend.URL, UpstreamLatency: tt.policy}}
+				c.TrustedPeers = []string{"10.0.0.0/8"}
+			})
+			req := httptest.NewRequest("GET", "/api", nil)
+			req.RemoteAddr = tt.remoteAddr
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			newTestProxy().ServeHTTP(rr, req)
+			elapsed := time.Since(start)
+
+			v := rr.Header().Get(upstreamLatencyHeader)
+			if !tt.want {
+				if v != "" {
+					t.Errorf("%s = %q, want none", upstreamLatencyHeader, v)
+				}
+				return
+			}
+			ms, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				t.Fatalf("%s = %q, want milliseconds", upstreamLatencyHeader, v)
+			}
+			if ms < delay.Milliseconds() || ms > elapsed.Milliseconds() {
+				t.Errorf("%s = %dms, want between the backend's %v delay and the request's %v", upstreamLatencyHeader, ms, delay, elapsed)
+			}
+		})
+	}
+}
+
+func TestBodilessResponseWithBody(t *testing.T) {
+	// rawBackend frames a body on 204 and 304 responses, which must not
+	// have one, and answers anything else normally.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				for {
+					req, err := http.ReadRequest(br)
+					if err != nil {
+						return
+					}
+					switch strings.TrimPrefix(req.URL.Path, "/raw") {
+					case "/not-modified":
+						io.WriteString(conn, "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nstale\r\n0\r\n\r\n")
+					case "/no-content":
+						io.WriteString(conn, "HTTP/1.1 204 No Content\r\nContent-Length: 5\r\n\r\nstale")
+					default:
+						io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nfresh")
+					}
+				}
+			}()
+		}
+	}()
+	withRoute(t, "/raw", "http://"+ln.Addr().String())
+	proxy := httptest.NewServer(newHandler())
+	defer proxy.Close()
+
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/raw/not-modified", http.StatusNotModified},
+		{"/raw/no-content", http.StatusNoContent},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			logs := captureLogs(t)
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			io.WriteString(conn, "GET "+tt.path+" HTTP/1.1\r\nHost: proxy\r\nConnection: close\r\n\r\n")
+			raw, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			head, rest, _ := strings.Cut(string(raw), "\r\n\r\n")
+			if !strings.HasPrefix(head, "HTTP/1.1 "+strconv.Itoa(tt.want)) {
+				t.Fatalf("response = %q, want %d", raw, tt.want)
+			}
+			if rest != "" || strings.Contains(head, "Transfer-Encoding") {
+				t.Errorf("response = %q, want no body or body framing", raw)
+			}
+			if !strings.Contains(logs.String(), "backend sent a body with a bodiless response") {
+				t.Errorf("discarded body not logged:\n%s", logs)
+			}
+
+			// The backend connection holding the stray body is not reused.
+			res, err := http.Get(proxy.URL + "/raw/next")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK || string(body) != "fresh" {
+				t.Errorf("next response = %d %q, want 200 %q", res.StatusCode, body, "fresh")
+			}
+		})
+	}
+}
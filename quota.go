@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// QuotaConfig caps the bytes each client IP may transfer through a route
+// per window, counting request and response bodies.
+type QuotaConfig struct {
+	Bytes  int64    `json:"bytes"`
+	Window Duration `json:"window"`
+}
+
+// quotaTracker holds the usage of one route's quota, by client IP. Entries
+// expire with their window.
+type quotaTracker struct {
+	cfg QuotaConfig
+
+	mu        sync.Mutex
+	clients   map[string]*quotaUsage
+	lastSweep time.Time
+}
+
+type quotaUsage struct {
+	bytes int64
+	reset time.Time
+}
+
+func newQuotaTracker(cfg QuotaConfig) *quotaTracker {
+	return &quotaTracker{cfg: cfg, clients: make(map[string]*quotaUsage)}
+}
+
+// remaining returns the bytes client may still transfer and the time until
+// its window resets.
+func (q *quotaTracker) remaining(client string, now time.Time) (int64, time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.clients[client]
+	if u == nil || !now.Before(u.reset) {
+		return q.cfg.Bytes, time.Duration(q.cfg.Window)
+	}
+	return q.cfg.Bytes - u.bytes, u.reset.Sub(now)
+}
+
+// add charges n bytes to client, starting a new window if its last one
+// ended, and drops expired entries once per window.
+func (q *quotaTracker) add(client string, n int64, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if now.Sub(q.lastSweep) >= time.Duration(q.cfg.Window) {
+		for c, u := range q.clients {
+			if !now.Before(u.reset) {
+				delete(q.clients, c)
+			}
+		}
+		q.lastSweep = now
+	}
+	u := q.clients[client]
+	if u == nil || !now.Before(u.reset) {
+		u = &quotaUsage{reset: now.Add(time.Duration(q.cfg.Window))}
+		q.clients[client] = u
+	}
+	u.bytes += n
+}
+
+// newRouteQuotas builds the quota trackers of rts, keeping the tracker in
+// prev of each route whose quota is unchanged, so clients' usage survives a
+// reload.
+func newRouteQuotas(rts []RouteConfig, prev map[string]*quotaTracker) map[string]*quotaTracker {
+	quotas := make(map[string]*quotaTracker)
+	for _, rt := range rts {
+		if rt.Quota == nil {
+			continue
+		}
+		if q := prev[rt.Prefix]; q != nil && q.cfg == *rt.Quota {
+			quotas[rt.Prefix] = q
+		} else {
+			quotas[rt.Prefix] = newQuotaTracker(*rt.Quota)
+		}
+	}
+	return quotas
+}
+
+// quotaMiddleware rejects requests from clients that used up their quota
+// on the route with 429, and requests declaring a body larger than the
+// whole quota with 413. A request in progress is never cut off; its bytes
+// count against the next one.
+func quotaMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stateFrom(r.Context())
+		route, _ := routeMatchFrom(r.Context())
+		quota := s.routeQuotas[route.Prefix]
+		if quota == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			client = r.RemoteAddr
+		}
+
+		if r.ContentLength > quota.cfg.Bytes {
+			http.Error(w, "Request body exceeds quota", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if left, reset := quota.remaining(client, time.Now()); left <= 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(reset.Seconds()))))
+			http.Error(w, "quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = body
+		}
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK, head: r.Method == http.MethodHead}
+		next.ServeHTTP(recorder, r)
+		quota.add(client, body.n+int64(recorder.bytesWritten), time.Now())
+	})
+}
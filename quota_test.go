@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotaMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("r", 100)))
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/metered", Backend: backend.URL, Quota: &QuotaConfig{Bytes: 500, Window: Duration(time.Minute)}},
+		RouteConfig{Prefix: "/free", Backend: backend.URL},
+	)
+	handler := routeMiddleware(quotaMiddleware(newProxy()))
+	send := func(path, client string, body int) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", path, strings.NewReader(strings.Repeat("q", body)))
+		req.RemoteAddr = client + ":1234"
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Each request moves 50 bytes up and 100 down: the quota is used up
+	// after the fourth.
+	for i := range 4 {
+		if rr := send("/metered", "192.0.2.1", 50); rr.Code != http.StatusOK {
+			t.Fatalf("request %d status = %d, want 200", i, rr.Code)
+		}
+	}
+	rr := send("/metered", "192.0.2.1", 50)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("over quota status = %d, want 429", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got == "" || got == "0" {
+		t.Errorf("Retry-After = %q, want the time left in the window", got)
+	}
+	if got := send("/metered", "192.0.2.2", 50).Code; got != http.StatusOK {
+		t.Errorf("other client status = %d, want 200", got)
+	}
+	if got := send("/free", "192.0.2.1", 50).Code; got != http.StatusOK {
+		t.Errorf("unmetered route status = %d, want 200", got)
+	}
+	if got := send("/metered", "192.0.2.3", 501).Code; got != http.StatusRequestEntityTooLarge {
+		t.Errorf("body larger than quota status = %d, want 413", got)
+	}
+}
+
+func TestQuotaTracker_Window(t *testing.T) {
+	q := newQuotaTracker(QuotaConfig{Bytes: 100, Window: Duration(time.Minute)})
+	now := time.Now()
+	q.add("a", 100, now)
+	q.add("b", 10, now)
+	if left, _ := q.remaining("a", now.Add(30*time.Second)); left != 0 {
+		t.Errorf("remaining mid-window = %d, want 0", left)
+	}
+	if left, reset := q.remaining("a", now.Add(time.Minute)); left != 100 || reset != time.Minute {
+		t.Errorf("remaining after window = %d, %v, want 100, 1m", left, reset)
+	}
+
+	// Adding after the window starts a fresh one and drops expired clients.
+	q.add("a", 30, now.Add(time.Minute))
+	if left, _ := q.remaining("a", now.Add(time.Minute)); left != 70 {
+		t.Errorf("remaining in new window = %d, want 70", left)
+	}
+	if _, ok := q.clients["b"]; ok {
+		t.Error("expired client b not swept")
+	}
+}
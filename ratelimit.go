@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig caps the request rate of a route across all clients.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `json:"rps"`
+	// Burst is the number of requests allowed at once. Defaults to
+	// RequestsPerSecond rounded up.
+	Burst int `json:"burst"`
+}
+
+// tokenBucket is a thread-safe token bucket rate limiter.
+type tokenBucket struct {
+	cfg RateLimitConfig
+
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// allow refills the bucket for the time elapsed since the last call and
+// takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// newRouteLimiters builds the token buckets of rts, keeping the bucket in
+// prev of each route whose limit is unchanged.
+func newRouteLimiters(rts []RouteConfig, prev map[string]*tokenBucket) map[string]*tokenBucket {
+	limiters := make(map[string]*tokenBucket)
+	for _, rt := range rts {
+		if rt.RateLimit == nil {
+			continue
+		}
+		if b := prev[rt.Prefix]; b != nil && b.cfg == *rt.RateLimit {
+			limiters[rt.Prefix] = b
+		} else {
+			b = newTokenBucket(rt.RateLimit.RequestsPerSecond, rt.RateLimit.Burst)
+			b.cfg = *rt.RateLimit
+			limiters[rt.Prefix] = b
+		}
+	}
+	return limiters
+}
+
+// rateLimitMiddleware rejects requests with 429 once their route's token
+// bucket is empty. Routes without a limit are not affected.
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := stateFrom(r.Context())
+		route, _ := routeMatchFrom(r.Context())
+		if limiter := s.routeLimiters[route.Prefix]; limiter != nil && !limiter.allow(time.Now()) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
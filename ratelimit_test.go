@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, 2)
+	b.last = start
+
+	if !b.allow(start) || !b.allow(start) {
+		t.Fatal("burst of 2 should be allowed")
+	}
+	if b.allow(start) {
+		t.Error("third request in the same instant should be rejected")
+	}
+	if !b.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("one token should refill after 500ms at 2 rps")
+	}
+	if b.allow(start.Add(500 * time.Millisecond)) {
+		t.Error("bucket should be empty again")
+	}
+}
+
+func TestRateLimitMiddleware_PerRoute(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/expensive", Backend: backend.URL, RateLimit: &RateLimitConfig{RequestsPerSecond: 0.001, Burst: 2}},
+		RouteConfig{Prefix: "/cheap", Backend: backend.URL},
+	)
+	handler := routeMiddleware(rateLimitMiddleware(newProxy()))
+
+	serve := func(path string) int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr.Code
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := serve("/expensive"); code != http.StatusOK {
+			t.Fatalf("request %d within burst: got %v want %v", i, code, http.StatusOK)
+		}
+	}
+	if code := serve("/expensive"); code != http.StatusTooManyRequests {
+		t.Errorf("request over limit: got %v want %v", code, http.StatusTooManyRequests)
+	}
+	for i := 0; i < 5; i++ {
+		if code := serve("/cheap"); code != http.StatusOK {
+			t.Errorf("unlimited route: got %v want %v", code, http.StatusOK)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverMiddleware turns a panic in next into a 500 response and an error
+// log with the stack, instead of a dropped connection. http.ErrAbortHandler
+// is re-raised, since it deliberately aborts the response.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			slog.Error("panic serving request",
+				"error", fmt.Sprint(v),
+				"method", r.Method,
+				"host", r.Host,
+				"path", r.URL.Path,
+				"client_ip", r.RemoteAddr,
+				"stack", string(debug.Stack()),
+			)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
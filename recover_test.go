@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	logs := captureLogs(t)
+	handler := loggingMiddleware(recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("transform exploded")
+	})))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/service1/boom", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusInternalServerError)
+	}
+	var panicLog map[string]any
+	for _, rec := range logRecords(t, logs) {
+		switch rec["msg"] {
+		case "panic serving request":
+			panicLog = rec
+		case "proxy request":
+			if rec["status"] != float64(http.StatusInternalServerError) {
+				t.Errorf("access log status = %v, want 500", rec["status"])
+			}
+		}
+	}
+	if panicLog == nil {
+		t.Fatal("no panic log record")
+	}
+	if panicLog["error"] != "transform exploded" || panicLog["path"] != "/service1/boom" {
+		t.Errorf("panic log = %v, want error and request context", panicLog)
+	}
+	if stack, _ := panicLog["stack"].(string); !strings.Contains(stack, "TestRecoverMiddleware") {
+		t.Errorf("stack = %q, want the panicking frame", stack)
+	}
+}
+
+func TestRecoverMiddleware_AbortHandler(t *testing.T) {
+	handler := recoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler re-raised", v)
+		}
+	}()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+)
+
+// reloader re-applies a config file on demand, such as on SIGHUP.
+type reloader struct {
+	path string
+	mu   sync.Mutex
+}
+
+// Reload re-reads the config file and applies it, logging the outcome. If
+// the file is invalid the active config is left unchanged. Listener
+// settings (listen, tls, admin and max_conns_per_ip) only take effect on
+// restart.
+func (r *reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cfg, err := loadConfig(r.path)
+	if err == nil {
+		err = applyConfig(cfg)
+	}
+	if err != nil {
+		slog.Error("config reload failed", "path", r.path, "error", err)
+		return err
+	}
+	slog.Info("config reloaded", "path", r.path, "routes", len(cfg.Routes))
+	return nil
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReload(t *testing.T) {
+	first := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first"))
+	}))
+	defer first.Close()
+	second := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("second"))
+	}))
+	defer second.Close()
+
+	withAppliedConfig(t, func(c *Config) {})
+	logs := captureLogs(t)
+	path := writeConfig(t, `{"routes": [{"prefix": "/app", "backend": "`+first.URL+`"}]}`)
+	r := &reloader{path: path}
+
+	get := func(target string) string {
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", target, nil))
+		return rr.Body.String()
+	}
+
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := get("/app"); got != "first" {
+		t.Errorf("/app = %q, want first", got)
+	}
+
+	changed := `{"routes": [{"prefix": "/new", "backend": "` + second.URL + `"}]}`
+	if err := os.WriteFile(path, []byte(changed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := get("/new"); got != "second" {
+		t.Errorf("/new = %q, want second", got)
+	}
+	if got := get("/app"); !strings.Contains(got, "Route not found") {
+		t.Errorf("/app after reload = %q, want route not found", got)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"routes": [{"prefix": "bad"}]}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload of invalid config succeeded, want error")
+	}
+	if got := get("/new"); got != "second" {
+		t.Errorf("/new after failed reload = %q, want second", got)
+	}
+	if !strings.Contains(logs.String(), "config reload failed") {
+		t.Errorf("logs = %s, want a reload failure", logs)
+	}
+}
+
+func TestReload_ConcurrentHandlerChain(t *testing.T) {
+	captureLogs(t)
+	// Static routes keep the requests off the network, whose locks would
+	// order them against the reloads and hide races.
+	configs := []func(c *Config){
+		func(c *Config) {
+			c.Routes = []RouteConfig{{
+				Prefix:          "/api",
+				Static:          &StaticResponseConfig{Body: strings.Repeat("ok", 1024)},
+				RateLimit:       &RateLimitConfig{RequestsPerSecond: 1e6},
+				Quota:           &QuotaConfig{Bytes: 1 << 30, Window: Duration(time.Minute)},
+				RequiredHeaders: &RequiredHeadersConfig{Names: []string{"X-Tenant"}},
+				CircuitBreaker:  &CircuitBreakerConfig{Failures: 5},
+			}}
+			c.Compression = &CompressionConfig{}
+			c.AllowedMethods = []string{"GET"}
+		},
+		func(c *Config) {
+			c.Routes = []RouteConfig{{Prefix: "/api", Static: &StaticResponseConfig{Status: http.StatusNoContent}}}
+			c.Log.Attributes = map[string]string{"region": "test"}
+		},
+	}
+	withAppliedConfig(t, configs[0])
+	base := *currentState().config
+
+	handler := newHandler()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	var served atomic.Int64
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				req := httptest.NewRequest("GET", "/api/items", nil)
+				req.Header.Set("X-Tenant", "a")
+				req.Header.Set("Accept-Encoding", "gzip")
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+				served.Add(1)
+			}
+		}()
+	}
+	for i := range 20 {
+		c := base
+		configs[i%len(configs)](&c)
+		if err := applyConfig(&c); err != nil {
+			t.Fatalf("applyConfig: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	wg.Wait()
+	if served.Load() == 0 {
+		t.Fatal("no requests served during the reloads")
+	}
+}
+
+func TestReload_NoBackendAvailable(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backends: []string{backend.URL}})
+
+	// A state that has the pooled route while its pool is missing, as a
+	// request could see halfway through an unguarded swap.
+	swapState(t, func(s *proxyState) { s.routePools = map[string]*pool{} })
+
+	rr := httptest.NewRecorder()
+	newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+}
+
+func TestReload_ConcurrentRequests(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	withAppliedConfig(t, func(c *Config) {})
+	captureLogs(t)
+	configs := []string{
+		`{"routes": [{"prefix": "/api", "backend": "` + backend.URL + `"}]}`,
+		`{"routes": [{"prefix": "/api", "backends": ["` + backend.URL + `"]}]}`,
+	}
+	r := &reloader{path: writeConfig(t, configs[0])}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			os.WriteFile(r.path, []byte(configs[i%2]), 0o600)
+			r.Reload()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status during reload = %d, want %d", rr.Code, http.StatusOK)
+		}
+	}
+}
+
+func TestReload_DrainsRemovedBackend(t *testing.T) {
+	var closed atomic.Int32
+	release := make(chan struct{})
+	removed := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("removed"))
+	}))
+	removed.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	removed.Start()
+	defer removed.Close()
+	kept := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("kept"))
+	}))
+	defer kept.Close()
+	prevPoll := backendDrainPoll
+	backendDrainPoll = time.Millisecond
+	t.Cleanup(func() { backendDrainPoll = prevPoll })
+	captureLogs(t)
+
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backends: []string{removed.URL}})
+	state := currentState().backendStates[removed.URL]
+	handler := newTestProxy()
+	inFlight := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+		inFlight <- rr
+	}()
+	waitFor(t, func() bool { return state.inFlight.Load() == 1 })
+
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backends: []string{kept.URL}})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+	if rr.Body.String() != "kept" {
+		t.Errorf("new request served by %q, want the kept backend", rr.Body.String())
+	}
+	time.Sleep(10 * backendDrainPoll)
+	if n := closed.Load(); n != 0 {
+		t.Fatalf("%d connections to the removed backend closed with a request in flight", n)
+	}
+
+	close(release)
+	if rr := <-inFlight; rr.Code != http.StatusOK || rr.Body.String() != "removed" {
+		t.Errorf("in-flight request = %d %q, want 200 %q", rr.Code, rr.Body.String(), "removed")
+	}
+	waitFor(t, func() bool { return closed.Load() == 1 })
+	if n := backendConns.count(removed.URL); n != 0 {
+		t.Errorf("%d connections to the removed backend still tracked", n)
+	}
+}
+
+func TestReload_DrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer stuck.Close()
+	defer close(release)
+	prevPoll := backendDrainPoll
+	backendDrainPoll = time.Millisecond
+	t.Cleanup(func() { backendDrainPoll = prevPoll })
+	captureLogs(t)
+
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{stuck.URL}}}
+		c.Transport = TransportConfig{DrainTimeout: Duration(20 * time.Millisecond)}
+	})
+	state := currentState().backendStates[stuck.URL]
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestProxy().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api", nil))
+	}()
+	waitFor(t, func() bool { return state.inFlight.Load() == 1 })
+
+	withAppliedConfig(t, func(c *Config) { c.Routes = []RouteConfig{{Prefix: "/other", Backend: "http://localhost:8081"}} })
+	// The stuck request is cut off once the drain timeout passes.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request to the removed backend not cut off after the drain timeout")
+	}
+	if n := backendConns.count(stuck.URL); n != 0 {
+		t.Errorf("%d connections to the removed backend still tracked", n)
+	}
+}
+
+func TestReload_DrainThroughUpstreamProxy(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		if r.Host == "stuck.test" {
+			<-release
+		}
+	}))
+	defer upstream.Close()
+	defer close(release)
+	prevPoll := backendDrainPoll
+	backendDrainPoll = time.Millisecond
+	t.Cleanup(func() { backendDrainPoll = prevPoll })
+	captureLogs(t)
+
+	kept := RouteConfig{Prefix: "/kept", Backends: []string{"http://kept.test"}}
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/stuck", Backends: []string{"http://stuck.test"}}, kept}
+		c.Transport = TransportConfig{Proxy: upstream.URL, DrainTimeout: Duration(20 * time.Millisecond)}
+	})
+	state := currentState().backendStates["http://stuck.test"]
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		newTestProxy().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stuck", nil))
+	}()
+	waitFor(t, func() bool { return state.inFlight.Load() == 1 })
+	rr := httptest.NewRecorder()
+	newTestProxy().ServeHTTP(rr, httptest.NewRequest("GET", "/kept", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("kept backend = %d, want 200", rr.Code)
+	}
+
+	withAppliedConfig(t, func(c *Config) { c.Routes = []RouteConfig{kept} })
+	// Both backends are dialed at the proxy, but only the removed one's
+	// connection is cut off.
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("request to the removed backend not cut off after the drain timeout")
+	}
+	if n := backendConns.count("http://stuck.test"); n != 0 {
+		t.Errorf("%d connections to the removed backend still tracked", n)
+	}
+	if n := backendConns.count("http://kept.test"); n != 1 {
+		t.Errorf("%d connections to the kept backend tracked, want 1", n)
+	}
+}
+
+func TestReload_KeepsBackendState(t *testing.T) {
+	const a, b = "http://a.test", "http://b.test"
+	fc := &FuseConfig{Window: Duration(time.Minute)}
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = []RouteConfig{{Prefix: "/api", Backends: []string{a, b}}}
+		c.Backends = map[string]BackendConfig{a: {Fuse: fc}}
+	})
+	before := currentState().backendStates[a]
+	before.unhealthy.Store(true)
+	before.observe(40 * time.Millisecond)
+	before.fuse.blown = true
+
+	// Adding a route keeps the backend's state as it is, including its
+	// requests in flight.
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = append(c.Routes, RouteConfig{Prefix: "/other", Backends: []string{a}})
+	})
+	if got := currentState().backendStates[a]; got != before {
+		t.Fatal("reload with unchanged backend settings replaced its state")
+	}
+
+	// Changing its weight carries its health, latency and fuse over.
+	withAppliedConfig(t, func(c *Config) {
+		c.Backends = map[string]BackendConfig{a: {Weight: 3, Fuse: fc}}
+	})
+	after := currentState().backendStates[a]
+	if after == before || after.weight != 3 {
+		t.Fatalf("weight = %d after reload, want 3", after.weight)
+	}
+	if !after.unhealthy.Load() || !after.fuse.isBlown() {
+		t.Error("reload reset the backend's health or fuse")
+	}
+	if after.latency() != before.latency() {
+		t.Errorf("latency = %v after reload, want %v", after.latency(), before.latency())
+	}
+	if !currentState().backendStates[b].healthy() {
+		t.Error("reload marked an untouched backend unhealthy")
+	}
+}
+
+func TestReload_KeepsRouteState(t *testing.T) {
+	withAppliedConfig(t, func(c *Config) {
+		c.Concurrency = &ConcurrencyConfig{Max: 10}
+		c.Routes = []RouteConfig{{
+			Prefix:         "/api",
+			Backend:        "http://a.test",
+			Concurrency:    &ConcurrencyConfig{Max: 1},
+			RateLimit:      &RateLimitConfig{RequestsPerSecond: 1},
+			Quota:          &QuotaConfig{Bytes: 100, Window: Duration(time.Minute)},
+			CircuitBreaker: &CircuitBreakerConfig{Failures: 1, Fallback: &FallbackConfig{Body: "down"}},
+			Mirror:         &MirrorConfig{Backend: "http://shadow.test"},
+		}}
+	})
+	before := currentState()
+
+	// Adding a route keeps the limits, counters and breaker of the one
+	// that did not change.
+	withAppliedConfig(t, func(c *Config) {
+		c.Routes = append(c.Routes, RouteConfig{Prefix: "/other", Backend: "http://b.test"})
+	})
+	after := currentState()
+	for _, tt := range []struct {
+		name string
+		same bool
+	}{
+		{"concurrency", after.routeConcurrency["/api"] == before.routeConcurrency["/api"]},
+		{"global concurrency", after.globalConcurrency == before.globalConcurrency},
+		{"rate limit", after.routeLimiters["/api"] == before.routeLimiters["/api"]},
+		{"quota", after.routeQuotas["/api"] == before.routeQuotas["/api"]},
+		{"breaker", after.routeBreakers["/api"] == before.routeBreakers["/api"]},
+		{"error rate", after.routeErrorRates["/api"] == before.routeErrorRates["/api"]},
+		{"mirror", after.routeMirrors["/api"] == before.routeMirrors["/api"]},
+	} {
+		if !tt.same {
+			t.Errorf("reload replaced the unchanged route's %s", tt.name)
+		}
+	}
+
+	// Changing a setting starts it afresh.
+	withAppliedConfig(t, func(c *Config) {
+		rt := c.Routes[0]
+		rt.RateLimit = &RateLimitConfig{RequestsPerSecond: 2}
+		rt.CircuitBreaker = &CircuitBreakerConfig{Failures: 1, Fallback: &FallbackConfig{Body: "still down"}}
+		c.Routes = []RouteConfig{rt}
+	})
+	changed := currentState()
+	if changed.routeLimiters["/api"] == before.routeLimiters["/api"] {
+		t.Error("reload kept the rate limit of a route whose limit changed")
+	}
+	if changed.routeBreakers["/api"] == before.routeBreakers["/api"] {
+		t.Error("reload kept the breaker of a route whose fallback changed")
+	}
+	if changed.routeConcurrency["/api"] != before.routeConcurrency["/api"] {
+		t.Error("reload replaced the unchanged concurrency limit")
+	}
+}
+
+func TestBackendRouted(t *testing.T) {
+	const moved = "http://moved.test"
+	tests := []struct {
+		name string
+		rt   RouteConfig
+		want bool
+	}{
+		{"pooled", RouteConfig{Backends: []string{moved}}, true},
+		{"direct", RouteConfig{Backend: moved}, true},
+		{"canary", RouteConfig{Backend: "http://main.test", Canary: &CanaryConfig{Backend: moved}}, true},
+		{"body route", RouteConfig{Backend: "http://main.test", BodyRoute: &BodyRouteConfig{Pointer: "/type", Backends: map[string]string{"refund": moved}}}, true},
+		{"mirror", RouteConfig{Backend: "http://main.test", Mirror: &MirrorConfig{Backend: moved}}, true},
+		{"gone", RouteConfig{Backend: "http://main.test"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.rt.Prefix = "/api"
+			withRouteConfigs(t, tt.rt)
+			if got := backendRouted(currentState(), moved); got != tt.want {
+				t.Errorf("backendRouted = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
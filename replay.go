@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// replayHeader marks requests replayed through the admin API, so backends
+// can tell them from live traffic. Inbound values are dropped.
+const replayHeader = "X-Proxy-Replay"
+
+// maxReplayResponseBody is the most of a replayed response's body returned
+// to the operator.
+const maxReplayResponseBody = 64 << 10
+
+// replayRequest describes a past request to send again, as found in a
+// request capture or access log entry.
+type replayRequest struct {
+	Method string `json:"method"`
+	// Path is the request path, with any query string.
+	Path    string            `json:"path"`
+	Host    string            `json:"host"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// Backend, if set, is the pool member the request goes to, as the
+	// backend logged for it. Otherwise the balancer picks one.
+	Backend string `json:"backend"`
+}
+
+// replayResult is the response to a replayed request.
+type replayResult struct {
+	Status     int                 `json:"status"`
+	Backend    string              `json:"backend"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body"`
+	Truncated  bool                `json:"truncated"`
+	DurationMs int64               `json:"duration_ms"`
+}
+
+// replay is attached to the context of a replayed request.
+type replay struct {
+	// backend is the backend asked for, then the one the request went to.
+	backend string
+}
+
+type replayKey struct{}
+
+func replayFrom(ctx context.Context) *replay {
+	rp, _ := ctx.Value(replayKey{}).(*replay)
+	return rp
+}
+
+// replayHandler sends the request described in the body through the proxy
+// again and returns the backend's response. The replay is logged and
+// forwarded with replayHeader, and bypasses rate limits and quotas.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	var rr replayRequest
+	if err := json.NewDecoder(r.Body).Decode(&rr); err != nil {
+		http.Error(w, "body must be a JSON replay request", http.StatusBadRequest)
+		return
+	}
+	if rr.Method == "" {
+		rr.Method = http.MethodGet
+	}
+	if !strings.HasPrefix(rr.Path, "/") {
+		http.Error(w, "path must start with /", http.StatusBadRequest)
+		return
+	}
+	rp := &replay{backend: rr.Backend}
+	ctx := context.WithValue(r.Context(), replayKey{}, rp)
+	req, err := http.NewRequestWithContext(ctx, rr.Method, "http://replay"+rr.Path, strings.NewReader(rr.Body))
+	if err != nil {
+		http.Error(w, "invalid replay request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	s := currentState()
+	prefix, _, _ := matchRoute(req.URL.Path, s.routes, s.caseInsensitiveRoutes)
+	if prefix == "" {
+		http.Error(w, "path matches no route", http.StatusBadRequest)
+		return
+	}
+	req.Host = rr.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.RequestURI = rr.Path
+	for name, v := range rr.Headers {
+		req.Header.Set(name, v)
+	}
+
+	start := time.Now()
+	rec := &replayRecorder{header: make(http.Header), status: http.StatusOK}
+	routeMiddleware(loggingMiddleware(timeoutMiddleware(newProxy(), backendTimeout))).ServeHTTP(rec, req)
+	writeJSON(w, http.StatusOK, replayResult{
+		Status:     rec.status,
+		Backend:    rp.backend,
+		Headers:    rec.header,
+		Body:       rec.body.String(),
+		Truncated:  rec.truncated,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+}
+
+// replayRecorder holds a replayed response for the operator, keeping the
+// start of its body.
+type replayRecorder struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+	truncated   bool
+}
+
+func (rr *replayRecorder) Header() http.Header { return rr.header }
+
+func (rr *replayRecorder) WriteHeader(code int) {
+	if !rr.wroteHeader {
+		rr.wroteHeader = true
+		rr.status = code
+	}
+}
+
+func (rr *replayRecorder) Write(b []byte) (int, error) {
+	rr.WriteHeader(http.StatusOK)
+	if room := maxReplayResponseBody - rr.body.Len(); len(b) > room {
+		rr.body.Write(b[:max(room, 0)])
+		rr.truncated = true
+	} else {
+		rr.body.Write(b)
+	}
+	return len(b), nil
+}
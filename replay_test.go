@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	// Each backend echoes its name and what it received.
+	named := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			w.Header().Set("X-Backend", name)
+			fmt.Fprintf(w, "%s %s %s replay=%q tenant=%q body=%q", name, r.Method, r.URL.RequestURI(),
+				r.Header.Get(replayHeader), r.Header.Get("X-Tenant"), body)
+		}))
+	}
+	a, b := named("a"), named("b")
+	defer a.Close()
+	defer b.Close()
+	withConfig(t, func(c *Config) { c.Admin = AdminConfig{Listen: ":9090", Token: "secret"} })
+	withRouteConfigs(t, RouteConfig{Prefix: "/api", Backends: []string{a.URL, b.URL}})
+	logs := captureLogs(t)
+	replay := func(body string) (int, replayResult) {
+		req := httptest.NewRequest("POST", "/admin/replay", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		newAdminHandler().ServeHTTP(rr, req)
+		var res replayResult
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code, res
+	}
+
+	code, res := replay(fmt.Sprintf(`{"method":"PUT","path":"/api/orders/7?dry=1","headers":{"X-Tenant":"acme"},"body":"qty=2","backend":%q}`, b.URL))
+	if code != http.StatusOK {
+		t.Fatalf("replay status = %d, want 200", code)
+	}
+	want := `b PUT /orders/7?dry=1 replay="1" tenant="acme" body="qty=2"`
+	if res.Status != http.StatusOK || res.Backend != b.URL || res.Body != want || res.Headers["X-Backend"][0] != "b" {
+		t.Errorf("replay result = %+v, want %s from %s", res, want, b.URL)
+	}
+	entry := accessLog(t, logs)
+	if entry["replay"] != true || entry["path"] != "/api/orders/7" || entry["method"] != "PUT" || entry["backend"] != b.URL {
+		t.Errorf("access log = %v, want a replay of PUT /api/orders/7 to %s", entry, b.URL)
+	}
+
+	// Without a backend the balancer picks one.
+	logs.Reset()
+	if code, res := replay(`{"path":"/api/ping"}`); code != http.StatusOK || (res.Backend != a.URL && res.Backend != b.URL) {
+		t.Errorf("replay without backend = %d %+v, want a pool member", code, res)
+	}
+
+	for _, body := range []string{`{"path":"api"}`, `{"path":"/other"}`, `not json`} {
+		if code, _ := replay(body); code != http.StatusBadRequest {
+			t.Errorf("replay of %s = %d, want 400", body, code)
+		}
+	}
+}
+
+func TestReplayHeaderStripped(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(replayHeader))
+	}))
+	defer backend.Close()
+	withRoute(t, "/api", backend.URL)
+
+	req := httptest.NewRequest("GET", "/api", nil)
+	req.Header.Set(replayHeader, "1")
+	rr := httptest.NewRecorder()
+	newTestProxy().ServeHTTP(rr, req)
+	if rr.Body.String() != "" {
+		t.Errorf("backend saw %s %q on live traffic, want it stripped", replayHeader, rr.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// Policies for an inbound X-Request-ID header, set per route by
+// RouteConfig.RequestID.
+const (
+	// requestIDGenerateIfAbsent keeps the inbound ID and generates one when
+	// it is missing. This is the default.
+	requestIDGenerateIfAbsent = "generate-if-absent"
+	// requestIDTrust forwards the inbound ID, or none, unchanged.
+	requestIDTrust = "trust"
+	// requestIDRegenerate always replaces the inbound ID, so external
+	// clients cannot spoof correlation IDs.
+	requestIDRegenerate = "regenerate"
+)
+
+var requestIDPolicies = []string{"", requestIDGenerateIfAbsent, requestIDTrust, requestIDRegenerate}
+
+// outboundRequestID returns the X-Request-ID to send to the backend for an
+// inbound request under policy, or "" to send none.
+func outboundRequestID(r *http.Request, policy string) string {
+	id := r.Header.Get("X-Request-ID")
+	switch policy {
+	case requestIDTrust:
+		return id
+	case requestIDRegenerate:
+		return newRequestID()
+	}
+	if id == "" {
+		return newRequestID()
+	}
+	return id
+}
+
+// newRequestID returns a random 128-bit ID in hex.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestIDPolicy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Request-ID")))
+	}))
+	defer backend.Close()
+
+	tests := []struct {
+		policy  string
+		inbound string
+		want    string // "new" expects a freshly generated ID
+	}{
+		{"", "abc", "abc"},
+		{"", "", "new"},
+		{"generate-if-absent", "abc", "abc"},
+		{"generate-if-absent", "", "new"},
+		{"trust", "abc", "abc"},
+		{"trust", "", ""},
+		{"regenerate", "abc", "new"},
+		{"regenerate", "", "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.inbound, func(t *testing.T) {
+			withRouteConfigs(t, RouteConfig{Prefix: "/api", Backend: backend.URL, RequestID: tt.policy})
+			req := httptest.NewRequest("GET", "/api", nil)
+			if tt.inbound != "" {
+				req.Header.Set("X-Request-ID", tt.inbound)
+			}
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+
+			got := rr.Body.String()
+			if tt.want == "new" {
+				if len(got) != 32 || got == tt.inbound {
+					t.Errorf("backend saw X-Request-ID %q, want a new ID", got)
+				}
+			} else if got != tt.want {
+				t.Errorf("backend saw X-Request-ID %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
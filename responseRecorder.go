@@ -1,11 +1,21 @@
 package main
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+)
 
 type responseRecorder struct {
 	http.ResponseWriter
-	statusCode   int
+	statusCode int
+	// bytesWritten counts the body bytes sent to the client, which stays 0
+	// for HEAD requests: net/http discards their bodies.
 	bytesWritten int
+	// head is set for HEAD requests.
+	head bool
+	// writeTime is the time spent blocked writing to the client, which
+	// grows when a slow reader applies backpressure.
+	writeTime time.Duration
 }
 
 func (rr *responseRecorder) WriteHeader(code int) {
@@ -14,7 +24,17 @@ func (rr *responseRecorder) WriteHeader(code int) {
 }
 
 func (rr *responseRecorder) Write(b []byte) (int, error) {
+	start := time.Now()
 	n, err := rr.ResponseWriter.Write(b)
-	rr.bytesWritten += n
+	rr.writeTime += time.Since(start)
+	if !rr.head {
+		rr.bytesWritten += n
+	}
 	return n, err
 }
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter
+// for flushing and hijacking.
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+)
+
+// RetryConfig resends a route's failed backend requests, to another backend
+// in the pool when there is one. Requests with a body are resent only when
+// it fits in Config.MaxReplayBody.
+type RetryConfig struct {
+	// Attempts is the total number of tries, including the first.
+	Attempts int `json:"attempts"`
+	// On lists the failures that are retried: connection-refused,
+	// connection-reset, timeout and 5xx. Defaults to connection-refused.
+	On []string `json:"on"`
+	// Methods lists the request methods that may be retried. Defaults to
+	// GET, HEAD and OPTIONS.
+	Methods []string `json:"methods"`
+	// Budget bounds all attempts together, so retries cannot multiply a
+	// slow route's latency. Each attempt gets at most what is left of it,
+	// including attempts to backends with their own timeout.
+	Budget Duration `json:"budget"`
+}
+
+// Failure classes for RetryConfig.On.
+const (
+	retryOnConnectionRefused = "connection-refused"
+	retryOnConnectionReset   = "connection-reset"
+	retryOnTimeout           = "timeout"
+	retryOn5xx               = "5xx"
+)
+
+var retryClasses = []string{retryOnConnectionRefused, retryOnConnectionReset, retryOnTimeout, retryOn5xx}
+
+var (
+	defaultRetryOn      = []string{retryOnConnectionRefused}
+	defaultRetryMethods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+)
+
+func (rc RetryConfig) validate() error {
+	if rc.Attempts < 1 {
+		return errors.New("retry: attempts must be at least 1")
+	}
+	if rc.Budget < 0 {
+		return errors.New("retry: budget must not be negative")
+	}
+	for _, class := range rc.On {
+		if !slices.Contains(retryClasses, class) {
+			return fmt.Errorf("retry: unknown failure class %q", class)
+		}
+	}
+	return nil
+}
+
+// failureClass classifies the outcome of a backend round trip, returning ""
+// for a success or a failure that is never retried.
+func failureClass(res *http.Response, err error) string {
+	switch {
+	case err == nil && res.StatusCode >= 500:
+		return retryOn5xx
+	case err == nil:
+		return ""
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return retryOnConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET):
+		return retryOnConnectionReset
+	case os.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded):
+		return retryOnTimeout
+	}
+	return ""
+}
+
+// shouldRetry reports whether a failed round trip of req may be retried.
+func (rc RetryConfig) shouldRetry(req *http.Request, res *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	if !replayable(req) {
+		return false
+	}
+	if !slices.Contains(orDefault(rc.Methods, defaultRetryMethods), req.Method) {
+		return false
+	}
+	class := failureClass(res, err)
+	return class != "" && slices.Contains(orDefault(rc.On, defaultRetryOn), class)
+}
+
+// orDefault returns s, or def if s is empty.
+func orDefault(s, def []string) []string {
+	if len(s) == 0 {
+		return def
+	}
+	return s
+}
+
+type routeRetryKey struct{}
+
+// withRouteRetry attaches a route's retry policy to an outbound request
+// context for the transport to enforce.
+func withRouteRetry(ctx context.Context, rc RetryConfig) context.Context {
+	return context.WithValue(ctx, routeRetryKey{}, rc)
+}
+
+func routeRetryFrom(ctx context.Context) RetryConfig {
+	rc, _ := ctx.Value(routeRetryKey{}).(RetryConfig)
+	return rc
+}
+
+type retryBudgetKey struct{}
+
+// retryBudgetFrom returns the deadline of the retry budget req draws from,
+// if it has one.
+func retryBudgetFrom(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(retryBudgetKey{}).(time.Time)
+	return deadline, ok
+}
+
+// defaultMaxReplayBody is the default for Config.MaxReplayBody.
+const defaultMaxReplayBody = 64 << 10
+
+// replayable reports whether req can be sent again: it has no body, or its
+// body was buffered by bufferForReplay.
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// rewound returns a copy of req with ctx whose body, if any, starts over.
+func rewound(req *http.Request, ctx context.Context) *http.Request {
+	out := req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err == nil {
+			out.Body = body
+		}
+	}
+	return out
+}
+
+// bufferForReplay reads req's body into memory so it can be resent, unless
+// it is larger than limit bytes. A larger body is left to stream to the
+// backend, including the part already read, and false is returned.
+func bufferForReplay(req *http.Request, limit int64) bool {
+	if replayable(req) {
+		return true
+	}
+	if req.ContentLength > limit {
+		return false
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return false
+	}
+	req.Body = io.NopCloser(bytes.NewReader(buf))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	return true
+}
+
+// roundTripWithRetry sends req, retrying failures as the route's policy
+// allows, within the policy's budget.
+func roundTripWithRetry(req *http.Request) (*http.Response, error) {
+	policy := routeRetryFrom(req.Context())
+	if policy.Attempts > 1 && slices.Contains(orDefault(policy.Methods, defaultRetryMethods), req.Method) {
+		limit := cmp.Or(stateFrom(req.Context()).config.MaxReplayBody, defaultMaxReplayBody)
+		if !bufferForReplay(req, limit) {
+			slog.Info("request body too large to replay, not retrying",
+				"path", req.URL.Path,
+				"max_replay_body", limit,
+			)
+			policy.Attempts = 1
+		}
+	}
+	release := func() {}
+	if d := time.Duration(policy.Budget); d > 0 {
+		deadline := time.Now().Add(d)
+		ctx, cancel := context.WithDeadline(context.WithValue(req.Context(), retryBudgetKey{}, deadline), deadline)
+		req, release = req.WithContext(ctx), cancel
+	}
+	res, err := roundTripWithRetryBudget(req, policy)
+	if err != nil {
+		release()
+	} else {
+		res.Body = releaseOnClose(res.Body, release)
+	}
+	return res, err
+}
+
+// roundTripWithRetryBudget sends req and its retries, all bounded by req's
+// context.
+func roundTripWithRetryBudget(req *http.Request, policy RetryConfig) (*http.Response, error) {
+	res, err := roundTripWithFailover(req)
+	for attempt := 2; attempt <= policy.Attempts && policy.shouldRetry(req, res, err); attempt++ {
+		if res != nil {
+			res.Body.Close()
+		}
+		next := failoverRequest(req)
+		if next == nil {
+			next = rewound(req, req.Context())
+		}
+		slog.Warn("retrying backend request",
+			"backend", backendKey(req.URL),
+			"retry_backend", backendKey(next.URL),
+			"attempt", attempt,
+			"failure", failureClass(res, err),
+		)
+		req = next
+		res, err = roundTripWithFailover(req)
+	}
+	return res, err
+}
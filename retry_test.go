@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	var failingHits atomic.Int64
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name        string
+		backends    []string
+		retry       *RetryConfig
+		method      string
+		body        string
+		wantStatus  int
+		wantFailing int64
+	}{
+		{
+			name:       "connection refused is retried",
+			backends:   []string{refused, ok.URL},
+			retry:      &RetryConfig{Attempts: 2},
+			method:     "GET",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no retry policy",
+			backends:   []string{refused, ok.URL},
+			method:     "GET",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:        "500 is not retried by default",
+			backends:    []string{failing.URL, ok.URL},
+			retry:       &RetryConfig{Attempts: 2},
+			method:      "GET",
+			wantStatus:  http.StatusInternalServerError,
+			wantFailing: 1,
+		},
+		{
+			name:        "500 is retried when configured",
+			backends:    []string{failing.URL, ok.URL},
+			retry:       &RetryConfig{Attempts: 2, On: []string{"5xx"}},
+			method:      "GET",
+			wantStatus:  http.StatusOK,
+			wantFailing: 1,
+		},
+		{
+			name:       "method not retried",
+			backends:   []string{refused, ok.URL},
+			retry:      &RetryConfig{Attempts: 2},
+			method:     "DELETE",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:       "configured method retried",
+			backends:   []string{refused, ok.URL},
+			retry:      &RetryConfig{Attempts: 2, Methods: []string{"DELETE"}},
+			method:     "DELETE",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "request with body retried",
+			backends:   []string{refused, ok.URL},
+			retry:      &RetryConfig{Attempts: 2, Methods: []string{"POST"}},
+			method:     "POST",
+			body:       "payload",
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failingHits.Store(0)
+			withRouteConfigs(t, RouteConfig{Prefix: "/api", Backends: tt.backends, Retry: tt.retry})
+			captureLogs(t)
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, httptest.NewRequest(tt.method, "/api", strings.NewReader(tt.body)))
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if got := failingHits.Load(); got != tt.wantFailing {
+				t.Errorf("failing backend hit %d times, want %d", got, tt.wantFailing)
+			}
+		})
+	}
+}
+
+func TestRetry_ReplayLimit(t *testing.T) {
+	echo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer echo.Close()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := "http://" + ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name       string
+		body       string
+		chunked    bool
+		wantStatus int
+		wantLogged bool
+	}{
+		{"small body replayed", "payload", false, http.StatusOK, false},
+		{"small chunked body replayed", "payload", true, http.StatusOK, false},
+		{"large body streamed", strings.Repeat("x", 32), false, http.StatusBadGateway, true},
+		{"large chunked body streamed", strings.Repeat("x", 32), true, http.StatusBadGateway, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRouteConfigs(t, RouteConfig{
+				Prefix:   "/api",
+				Backends: []string{refused, echo.URL},
+				Retry:    &RetryConfig{Attempts: 2, Methods: []string{"POST"}},
+			})
+			withConfig(t, func(c *Config) { c.MaxReplayBody = 16 })
+			logs := captureLogs(t)
+			req := httptest.NewRequest("POST", "/api", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rr := httptest.NewRecorder()
+			newTestProxy().ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rr.Body.String() != tt.body {
+				t.Errorf("replayed body = %q, want %q", rr.Body.String(), tt.body)
+			}
+			logged := false
+			for _, rec := range logRecords(t, logs) {
+				logged = logged || rec["msg"] == "request body too large to replay, not retrying"
+			}
+			if logged != tt.wantLogged {
+				t.Errorf("replay limit logged = %v, want %v", logged, tt.wantLogged)
+			}
+		})
+	}
+}
+
+func TestRetry_Budget(t *testing.T) {
+	var hits atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	captureLogs(t)
+
+	// Each attempt times out after 60ms; five of them would take 300ms.
+	attempt := Duration(60 * time.Millisecond)
+	budget := Duration(150 * time.Millisecond)
+	tests := []struct {
+		name     string
+		route    RouteConfig
+		backends map[string]BackendConfig
+	}{
+		{
+			name:  "first byte timeout",
+			route: RouteConfig{Timeouts: &TimeoutsConfig{FirstByte: attempt}},
+		},
+		{
+			name:     "backend timeout",
+			backends: map[string]BackendConfig{slow.URL: {Timeout: attempt}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := tt.route
+			rt.Prefix, rt.Backends = "/api", []string{slow.URL}
+			for _, b := range []Duration{0, budget} {
+				rt.Retry = &RetryConfig{Attempts: 5, On: []string{"timeout"}, Budget: b}
+				withAppliedConfig(t, func(c *Config) {
+					c.Routes = []RouteConfig{rt}
+					c.Backends = tt.backends
+				})
+				hits.Store(0)
+
+				proxy := newQuietTestProxy()
+				rr := httptest.NewRecorder()
+				start := time.Now()
+				proxy.ServeHTTP(rr, httptest.NewRequest("GET", "/api", nil))
+				elapsed := time.Since(start)
+
+				if rr.Code != http.StatusGatewayTimeout {
+					t.Errorf("budget %v: status = %d, want 504", time.Duration(b), rr.Code)
+				}
+				if b == 0 && hits.Load() != 5 {
+					t.Errorf("without a budget: %d attempts, want 5", hits.Load())
+				}
+				if b > 0 && (elapsed > time.Duration(b)+50*time.Millisecond || hits.Load() >= 5) {
+					t.Errorf("budget %v: took %v over %d attempts, want fewer attempts within the budget", time.Duration(b), elapsed, hits.Load())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// SLAConfig fails a route's requests fast when the backend is slow to
+// respond, independently of the overall request timeout.
+type SLAConfig struct {
+	// Timeout is the longest the backend may take to send response
+	// headers before the request fails with 504.
+	Timeout Duration `json:"timeout"`
+	// Failover resends a request that breached the SLA to another backend
+	// in the route's pool before failing. Only requests without a body are
+	// resent, and only once.
+	Failover bool `json:"failover"`
+}
+
+var errSLAExceeded = fmt.Errorf("backend exceeded the route SLA: %w", context.DeadlineExceeded)
+
+type routeSLAKey struct{}
+
+// withRouteSLA attaches a route's SLA to an outbound request context for
+// the transport to enforce.
+func withRouteSLA(ctx context.Context, sla SLAConfig) context.Context {
+	return context.WithValue(ctx, routeSLAKey{}, sla)
+}
+
+func routeSLAFrom(ctx context.Context) SLAConfig {
+	sla, _ := ctx.Value(routeSLAKey{}).(SLAConfig)
+	return sla
+}
+
+// roundTripWithSLA sends req, failing with errSLAExceeded if response
+// headers do not arrive within d.
+func roundTripWithSLA(req *http.Request, d time.Duration) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	timer := time.AfterFunc(d, func() { cancel(errSLAExceeded) })
+	res, err := roundTripWithHTTPFallback(req.WithContext(ctx))
+	if !timer.Stop() && err == nil {
+		res.Body.Close()
+		res, err = nil, errSLAExceeded
+	}
+	if err != nil {
+		if context.Cause(ctx) == errSLAExceeded {
+			err = errSLAExceeded
+		}
+		cancel(nil)
+		return nil, err
+	}
+	res.Body = releaseOnClose(res.Body, func() { cancel(nil) })
+	return res, nil
+}
+
+type triedBackendsKey struct{}
+
+// withTriedBackend records that b already failed to serve a request, so
+// balancers pick another backend for it.
+func withTriedBackend(ctx context.Context, b *backend) context.Context {
+	tried, _ := ctx.Value(triedBackendsKey{}).([]*backend)
+	return context.WithValue(ctx, triedBackendsKey{}, append(slices.Clone(tried), b))
+}
+
+// usable reports whether a balancer may pick b for r: b is healthy and has
+// not already been tried for r.
+func usable(r *http.Request, b *backend) bool {
+	return skipReason(r, b) == ""
+}
+
+// skipReason returns why a balancer may not pick b for r, or "" if it may.
+func skipReason(r *http.Request, b *backend) string {
+	tried, _ := r.Context().Value(triedBackendsKey{}).([]*backend)
+	switch {
+	case b.unhealthy.Load():
+		return "unhealthy"
+	case b.fuse != nil && b.fuse.isBlown():
+		return "fused"
+	case slices.Contains(tried, b):
+		return "already tried"
+	}
+	return ""
+}
+
+// failoverRequest returns req redirected to another backend in its route's
+// pool, or nil if there is none or req has a body that cannot be resent.
+// Only the scheme and host change, as validate makes pool members share a
+// path.
+func failoverRequest(req *http.Request) *http.Request {
+	if !replayable(req) {
+		return nil
+	}
+	route, _ := routeMatchFrom(req.Context())
+	s := stateFrom(req.Context())
+	pool := s.routePools[route.Prefix]
+	current := s.backendStates[backendKey(req.URL)]
+	if pool == nil || current == nil {
+		return nil
+	}
+	ctx := withTriedBackend(req.Context(), current)
+	next := pool.Pick(req.WithContext(ctx))
+	if next == nil {
+		return nil
+	}
+	u, err := url.Parse(next.url)
+	if err != nil {
+		return nil
+	}
+	if info := requestInfoFrom(ctx); info != nil {
+		info.backend = next.url
+	}
+	out := rewound(req, ctx)
+	out.URL.Scheme = u.Scheme
+	out.URL.Host = u.Host
+	return out
+}
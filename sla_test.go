@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteSLA(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+	sla := Duration(50 * time.Millisecond)
+
+	tests := []struct {
+		name       string
+		route      RouteConfig
+		method     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "breach fails fast",
+			route:      RouteConfig{Prefix: "/api", Backend: slow.URL, SLA: &SLAConfig{Timeout: sla}},
+			method:     "GET",
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "within SLA",
+			route:      RouteConfig{Prefix: "/api", Backend: fast.URL, SLA: &SLAConfig{Timeout: sla}},
+			method:     "GET",
+			wantStatus: http.StatusOK,
+			wantBody:   "fast",
+		},
+		{
+			name:       "breach without failover",
+			route:      RouteConfig{Prefix: "/api", Backends: []string{slow.URL, fast.URL}, SLA: &SLAConfig{Timeout: sla}},
+			method:     "GET",
+			wantStatus: http.StatusGatewayTimeout,
+		},
+		{
+			name:       "breach fails over",
+			route:      RouteConfig{Prefix: "/api", Backends: []string{slow.URL, fast.URL}, SLA: &SLAConfig{Timeout: sla, Failover: true}},
+			method:     "GET",
+			wantStatus: http.StatusOK,
+			wantBody:   "fast",
+		},
+		{
+			name:       "request with body is not resent",
+			route:      RouteConfig{Prefix: "/api", Backends: []string{slow.URL, fast.URL}, SLA: &SLAConfig{Timeout: sla, Failover: true}},
+			method:     "POST",
+			body:       "payload",
+			wantStatus: http.StatusGatewayTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRouteConfigs(t, tt.route)
+			captureLogs(t)
+			req := httptest.NewRequest(tt.method, "/api", strings.NewReader(tt.body))
+			if tt.body == "" {
+				req.Body = http.NoBody
+			}
+			rr := httptest.NewRecorder()
+			start := time.Now()
+			newTestProxy().ServeHTTP(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+			if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+				t.Errorf("took %v, want a fast failure", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// proxyState is the active config together with the runtime state built
+// from it. applyConfig builds a new one for every config it applies and
+// publishes it whole; it is never modified afterwards, so a request that
+// loads it once sees a single consistent config from start to finish.
+type proxyState struct {
+	config *Config
+	// routes maps each route prefix to its single backend, or "" for a
+	// pool or static route.
+	routes map[string]string
+	// caseInsensitiveRoutes maps the lower-cased prefix of each route
+	// matched regardless of case to the prefix.
+	caseInsensitiveRoutes map[string]string
+	// routeConfigs holds the config of each route, keyed by prefix.
+	routeConfigs map[string]*RouteConfig
+
+	// routePools holds the pool of each route served by one, keyed by
+	// route prefix.
+	routePools map[string]*pool
+	// backendStates holds the runtime state of every pooled backend, keyed
+	// by backendKey.
+	backendStates map[string]*backend
+	// routeCanaries holds the canary of each route that has one.
+	routeCanaries map[string]*canary
+	// routeRewriteRules holds the compiled rewrite rules of each route.
+	routeRewriteRules map[string][]*rewriteRule
+	// routeLimiters holds a token bucket for each rate-limited route prefix.
+	routeLimiters map[string]*tokenBucket
+	// routeBreakers holds the circuit breaker of each route that has one.
+	routeBreakers map[string]*breaker
+	// routeConcurrency holds the concurrency limit of each route that has
+	// one.
+	routeConcurrency map[string]*concurrencyLimit
+	// routeQuotas holds the quota tracker of each route that has a quota.
+	routeQuotas map[string]*quotaTracker
+	// routeErrorRates holds the error rate of every route, keyed by route
+	// prefix.
+	routeErrorRates map[string]*errorRate
+	// routeMirrors holds the mirror of each route that has one, keyed by
+	// route prefix.
+	routeMirrors map[string]*mirror
+	// globalConcurrency is the proxy-wide limit, or nil if there is none.
+	globalConcurrency *priorityLimit
+
+	// defaultTransport serves backends without custom settings.
+	defaultTransport *http.Transport
+	// backendTransports holds a dedicated transport for each backend with
+	// custom settings, keyed by backendKey.
+	backendTransports map[string]*http.Transport
+	// backendTimeouts holds the timeout of each backend that overrides the
+	// request timeout, keyed by backendKey.
+	backendTimeouts map[string]time.Duration
+	// backendFallbacks holds the HTTP fallback of each backend that has
+	// one, keyed by backendKey.
+	backendFallbacks map[string]*url.URL
+	// backendDialer is the dialer for backend connections.
+	backendDialer *net.Dialer
+}
+
+// defaultRoutes simulates a constant map (e.g., from etcd), served until a
+// config is applied.
+var defaultRoutes = map[string]string{
+	"/service1": "http://localhost:8081",
+	"/service2": "http://localhost:8082",
+}
+
+// activeState is the state requests are served with.
+var activeState atomic.Pointer[proxyState]
+
+func init() {
+	activeState.Store(&proxyState{
+		config:           defaultConfig(),
+		routes:           defaultRoutes,
+		defaultTransport: newBaseTransport(&Config{}),
+		backendDialer:    newDialer(0),
+	})
+}
+
+// currentState returns the state of the active config.
+func currentState() *proxyState {
+	return activeState.Load()
+}
+
+type stateKey struct{}
+
+// withState attaches s to ctx, so everything serving the request uses the
+// state it was routed with.
+func withState(ctx context.Context, s *proxyState) context.Context {
+	return context.WithValue(ctx, stateKey{}, s)
+}
+
+// stateFrom returns the state attached by routeMiddleware, or the current
+// state for work outside a routed request, such as health checks.
+func stateFrom(ctx context.Context) *proxyState {
+	if s, ok := ctx.Value(stateKey{}).(*proxyState); ok {
+		return s
+	}
+	return currentState()
+}
+
+// route returns the config for the route with the given prefix.
+func (s *proxyState) route(prefix string) (RouteConfig, bool) {
+	if rt := s.routeConfigs[prefix]; rt != nil {
+		return *rt, true
+	}
+	return RouteConfig{}, false
+}
+
+// transportFor returns the transport configured for the backend at u.
+func (s *proxyState) transportFor(u *url.URL) *http.Transport {
+	if t := s.backendTransports[backendKey(u)]; t != nil {
+		return t
+	}
+	return s.defaultTransport
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// StaticResponseConfig makes a route answer at the proxy with a fixed
+// response, such as /robots.txt, instead of forwarding to a backend.
+type StaticResponseConfig struct {
+	// Status defaults to 200.
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+func (sc StaticResponseConfig) validate() error {
+	if sc.Status != 0 && (sc.Status < 200 || sc.Status > 599) {
+		return fmt.Errorf("static: status %d must be between 200 and 599", sc.Status)
+	}
+	for name := range sc.Headers {
+		if err := validateHeaderName(name); err != nil {
+			return fmt.Errorf("static: %w", err)
+		}
+	}
+	return nil
+}
+
+// staticMiddleware answers requests for static routes without forwarding
+// them.
+func staticMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := routeMatchFrom(r.Context())
+		rt := route.Config
+		if rt.Static == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for name, v := range rt.Static.Headers {
+			w.Header().Set(name, v)
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(rt.Static.Body)))
+		w.WriteHeader(cmp.Or(rt.Static.Status, http.StatusOK))
+		io.WriteString(w, rt.Static.Body)
+	})
+}
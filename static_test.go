@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStaticRoute(t *testing.T) {
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/robots.txt", Static: &StaticResponseConfig{Body: "User-agent: *\nDisallow: /\n"}},
+		RouteConfig{Prefix: "/status", Static: &StaticResponseConfig{
+			Status:  http.StatusServiceUnavailable,
+			Headers: map[string]string{"Content-Type": "application/json", "Retry-After": "120"},
+			Body:    `{"status":"maintenance"}`,
+		}},
+	)
+	logs := captureLogs(t)
+	handler := newHandler()
+
+	tests := []struct {
+		path        string
+		wantStatus  int
+		wantType    string
+		wantBody    string
+		wantHeaders map[string]string
+	}{
+		{"/robots.txt", http.StatusOK, "text/plain; charset=utf-8", "User-agent: *\nDisallow: /\n", nil},
+		{"/status/detail", http.StatusServiceUnavailable, "application/json", `{"status":"maintenance"}`, map[string]string{"Retry-After": "120"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			logs.Reset()
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+			if rr.Code != tt.wantStatus || rr.Body.String() != tt.wantBody {
+				t.Errorf("response = %d %q, want %d %q", rr.Code, rr.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got := rr.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+			for name, want := range tt.wantHeaders {
+				if got := rr.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			entry := accessLog(t, logs)
+			if entry["path"] != tt.path || entry["status"] != float64(tt.wantStatus) || entry["response_size"] != float64(len(tt.wantBody)) {
+				t.Errorf("access log = %v, want path %s, status %d and size %d", entry, tt.path, tt.wantStatus, len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestStaticRoute_Validate(t *testing.T) {
+	tests := []struct {
+		name string
+		rt   RouteConfig
+		ok   bool
+	}{
+		{"static only", RouteConfig{Prefix: "/a", Static: &StaticResponseConfig{}}, true},
+		{"static with backend", RouteConfig{Prefix: "/a", Backend: "http://localhost:8081", Static: &StaticResponseConfig{}}, false},
+		{"invalid status", RouteConfig{Prefix: "/a", Static: &StaticResponseConfig{Status: 99}}, false},
+		{"invalid header", RouteConfig{Prefix: "/a", Static: &StaticResponseConfig{Headers: map[string]string{"Bad Name": "x"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Config{Routes: []RouteConfig{tt.rt}}
+			if err := c.validate(); (err == nil) != tt.ok {
+				t.Errorf("validate() = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
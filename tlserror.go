@@ -0,0 +1,81 @@
+package main
+
+import (
+	"cmp"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// TLSErrorConfig customises the response sent when the TLS handshake with a
+// backend fails.
+type TLSErrorConfig struct {
+	// Status defaults to 502.
+	Status int `json:"status"`
+	// Body defaults to a description of the failure, such as "Backend TLS
+	// handshake failed: certificate expired".
+	Body string `json:"body"`
+}
+
+// Categories of backend TLS handshake failures.
+const (
+	tlsCertExpired      = "certificate expired"
+	tlsNameMismatch     = "certificate name mismatch"
+	tlsUnknownAuthority = "certificate signed by unknown authority"
+	tlsCertInvalid      = "certificate invalid"
+	tlsHandshakeFailed  = "handshake failed"
+)
+
+// classifyTLSError returns the category of a backend TLS handshake error
+// and log attributes detailing it, or "" if err is not one.
+func classifyTLSError(err error) (string, []any) {
+	var (
+		invalid  x509.CertificateInvalidError
+		hostname x509.HostnameError
+		unknown  x509.UnknownAuthorityError
+		verify   *tls.CertificateVerificationError
+		record   tls.RecordHeaderError
+		alert    tls.AlertError
+	)
+	switch {
+	case errors.As(err, &invalid) && invalid.Reason == x509.Expired:
+		return tlsCertExpired, []any{
+			"not_before", invalid.Cert.NotBefore.Format(time.RFC3339),
+			"not_after", invalid.Cert.NotAfter.Format(time.RFC3339),
+		}
+	case errors.As(err, &invalid):
+		return tlsCertInvalid, nil
+	case errors.As(err, &hostname):
+		return tlsNameMismatch, []any{"server_name", hostname.Host, "cert_names", hostname.Certificate.DNSNames}
+	case errors.As(err, &unknown):
+		return tlsUnknownAuthority, []any{"issuer", unknown.Cert.Issuer.String()}
+	case errors.As(err, &verify):
+		return tlsCertInvalid, nil
+	case errors.As(err, &record), errors.As(err, &alert):
+		return tlsHandshakeFailed, nil
+	}
+	return "", nil
+}
+
+// writeTLSError logs a failed backend TLS handshake and responds with
+// Config.BackendTLSError.
+func writeTLSError(w http.ResponseWriter, r *http.Request, category string, detail []any, err error) {
+	args := append([]any{
+		"backend", backendKey(r.URL),
+		"path", r.URL.Path,
+		"category", category,
+		"error", err,
+	}, detail...)
+	slog.Warn("backend TLS handshake failed", args...)
+
+	var te TLSErrorConfig
+	if cfg := stateFrom(r.Context()).config; cfg.BackendTLSError != nil {
+		te = *cfg.BackendTLSError
+	}
+	http.Error(w,
+		cmp.Or(te.Body, "Backend TLS handshake failed: "+category),
+		cmp.Or(te.Status, http.StatusBadGateway))
+}
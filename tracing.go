@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// TracingConfig propagates W3C Trace Context to backends, so the proxy's
+// hop appears in their traces.
+type TracingConfig struct {
+	// SampleRatio is the share of new traces, started for requests without
+	// a valid traceparent, that are sampled. A sampling decision in an
+	// inbound traceparent is always kept.
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+func (tc TracingConfig) validate() error {
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		return errors.New("tracing: sample_ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+const (
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// traceFlagSampled is the sampled bit of the traceparent flags.
+const traceFlagSampled = 0x01
+
+// traceparent is a parsed W3C traceparent header.
+type traceparent struct {
+	traceID [16]byte
+	spanID  [8]byte
+	flags   byte
+}
+
+func (tp traceparent) String() string {
+	return "00-" + hex.EncodeToString(tp.traceID[:]) + "-" + hex.EncodeToString(tp.spanID[:]) + "-" + hex.EncodeToString([]byte{tp.flags})
+}
+
+func (tp traceparent) sampled() bool {
+	return tp.flags&traceFlagSampled != 0
+}
+
+// parseTraceparent parses v, reporting false if it is not a valid
+// traceparent. Versions after 00 may append fields, which are ignored.
+func parseTraceparent(v string) (traceparent, bool) {
+	var tp traceparent
+	parts := strings.Split(v, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return tp, false
+	}
+	var version, flags [1]byte
+	if !decodeLowerHex(version[:], parts[0]) || !decodeLowerHex(tp.traceID[:], parts[1]) ||
+		!decodeLowerHex(tp.spanID[:], parts[2]) || !decodeLowerHex(flags[:], parts[3]) {
+		return tp, false
+	}
+	if tp.traceID == [16]byte{} || tp.spanID == [8]byte{} {
+		return tp, false
+	}
+	tp.flags = flags[0]
+	return tp, true
+}
+
+// decodeLowerHex decodes s into dst, which it must exactly fill, reporting
+// false if s is not lower-case hex.
+func decodeLowerHex(dst []byte, s string) bool {
+	if len(s) != 2*len(dst) || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// sampleTrace decides whether to sample a new trace by its ID, so every
+// hop using the same ratio agrees. It mirrors OpenTelemetry's
+// TraceIDRatioBased sampler.
+func sampleTrace(traceID [16]byte, ratio float64) bool {
+	if ratio >= 1 {
+		return true
+	}
+	x := binary.BigEndian.Uint64(traceID[8:]) >> 1
+	return x < uint64(ratio*(1<<63))
+}
+
+// outboundTraceparent returns the traceparent to send to the backend for an
+// inbound one: the same trace and sampling decision under a new span ID for
+// the proxy's hop, or a new trace sampled at ratio if inbound is missing or
+// invalid. continued reports whether the inbound trace was kept.
+func outboundTraceparent(inbound string, ratio float64) (v string, continued bool) {
+	tp, continued := parseTraceparent(inbound)
+	if !continued {
+		rand.Read(tp.traceID[:])
+		tp.flags = 0
+		if sampleTrace(tp.traceID, ratio) {
+			tp.flags = traceFlagSampled
+		}
+	}
+	rand.Read(tp.spanID[:])
+	return tp.String(), continued
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOutboundTraceparent_SampleRatio(t *testing.T) {
+	for _, ratio := range []float64{0, 0.1, 0.5, 1} {
+		const n = 20000
+		sampled := 0
+		for range n {
+			v, continued := outboundTraceparent("", ratio)
+			tp, ok := parseTraceparent(v)
+			if !ok || continued {
+				t.Fatalf("outboundTraceparent = %q, %v, want a valid new trace", v, continued)
+			}
+			if tp.sampled() {
+				sampled++
+			}
+		}
+		if got := float64(sampled) / n; got < ratio-0.02 || got > ratio+0.02 {
+			t.Errorf("ratio %v: sampled %v of new traces", ratio, got)
+		}
+	}
+}
+
+func TestOutboundTraceparent_Inbound(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		inbound     string
+		ratio       float64
+		wantTrace   bool
+		wantSampled bool
+	}{
+		{"sampled kept at ratio 0", "00-" + traceID + "-00f067aa0ba902b7-01", 0, true, true},
+		{"unsampled kept at ratio 1", "00-" + traceID + "-00f067aa0ba902b7-00", 1, true, false},
+		{"future version", "01-" + traceID + "-00f067aa0ba902b7-01-extra", 0, true, true},
+		{"upper-case hex", "00-" + "4BF92F3577B34DA6A3CE929D0E0E4736" + "-00f067aa0ba902b7-01", 0, false, false},
+		{"zero trace id", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", 0, false, false},
+		{"version ff", "ff-" + traceID + "-00f067aa0ba902b7-01", 0, false, false},
+		{"extra field in version 00", "00-" + traceID + "-00f067aa0ba902b7-01-x", 0, false, false},
+		{"garbage", "not-a-trace", 0, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, continued := outboundTraceparent(tt.inbound, tt.ratio)
+			tp, ok := parseTraceparent(v)
+			if !ok {
+				t.Fatalf("outbound %q is not a valid traceparent", v)
+			}
+			if continued != tt.wantTrace || (hexTraceID(tp) == traceID) != tt.wantTrace {
+				t.Errorf("outbound %q continued = %v, want %v", v, continued, tt.wantTrace)
+			}
+			if tp.sampled() != tt.wantSampled {
+				t.Errorf("outbound %q sampled = %v, want %v", v, tp.sampled(), tt.wantSampled)
+			}
+			if v[36:52] == "00f067aa0ba902b7" {
+				t.Errorf("outbound %q reuses the inbound span ID", v)
+			}
+		})
+	}
+}
+
+func hexTraceID(tp traceparent) string {
+	return tp.String()[3:35]
+}
+
+func TestTracing_Proxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get(traceparentHeader)+"|"+r.Header.Get(tracestateHeader))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	send := func(traceparent string) string {
+		req := httptest.NewRequest("GET", "/service1", nil)
+		req.Header.Set(traceparentHeader, traceparent)
+		req.Header.Set(tracestateHeader, "vendor=abc")
+		rr := httptest.NewRecorder()
+		newTestProxy().ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+	inbound := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	if got := send(inbound); got != inbound+"|vendor=abc" {
+		t.Errorf("tracing disabled: backend got %q, want headers unchanged", got)
+	}
+
+	withConfig(t, func(c *Config) { c.Tracing = &TracingConfig{SampleRatio: 0} })
+	got := send(inbound)
+	if got[:36] != inbound[:36] || got[52:] != "-01|vendor=abc" {
+		t.Errorf("backend got %q, want trace %s continued, sampled, with its state", got, inbound[3:35])
+	}
+	if got := send("garbage"); got[52:] != "-00|" {
+		t.Errorf("backend got %q, want a new unsampled trace without state", got)
+	}
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BackendConfig holds per-backend settings, keyed in Config.Backends by the
+// backend URL used in routes.
+type BackendConfig struct {
+	// ServerName overrides the TLS server name sent in SNI and verified
+	// against the backend's certificate, for backends dialed by IP.
+	ServerName string `json:"server_name"`
+	// CAFile is a PEM bundle trusted for the backend's certificate instead
+	// of the system roots.
+	CAFile string `json:"ca_file"`
+	// Weight is the backend's share of traffic under the weighted
+	// strategy. Defaults to 1.
+	Weight int `json:"weight"`
+	// StripHeaders lists inbound request headers, such as Cookie or
+	// Authorization, never sent to this backend.
+	StripHeaders []string `json:"strip_headers"`
+	// HealthCheck probes the backend when it is part of a pool.
+	HealthCheck *HealthCheckConfig `json:"health_check"`
+	// Fuse takes the backend out of its pool until an operator resets it,
+	// once it fails every request over a window.
+	Fuse *FuseConfig `json:"fuse"`
+	// Timeout bounds each request to this backend in place of the request
+	// timeout, such as a longer one for a slow legacy instance in a pool.
+	Timeout Duration `json:"timeout"`
+	// HTTPFallback is a plain HTTP URL, such as "http://10.0.0.5:8080",
+	// that requests are resent to when the backend's HTTPS endpoint
+	// cannot be reached or fails the TLS handshake. This downgrades the
+	// connection, so it is off unless set. Requests with a body larger
+	// than MaxReplayBody are not resent.
+	HTTPFallback string `json:"http_fallback"`
+	// Proxy is an upstream HTTP(S) proxy this backend is reached through,
+	// in place of Transport.Proxy.
+	Proxy string `json:"proxy"`
+}
+
+// validateProxyURL checks that proxy is the URL of an HTTP or HTTPS proxy.
+func validateProxyURL(proxy string) error {
+	u, err := url.Parse(proxy)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("proxy %q must be an http or https URL", proxy)
+	}
+	return nil
+}
+
+// validateHTTPFallback checks that fallback is a plain HTTP URL standing in
+// for an HTTPS backend.
+func validateHTTPFallback(backend, fallback string) error {
+	if u, err := url.Parse(backend); err != nil || u.Scheme != "https" {
+		return errors.New("http_fallback requires an https backend")
+	}
+	u, err := url.Parse(fallback)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		return fmt.Errorf("http_fallback %q must be an http URL", fallback)
+	}
+	return nil
+}
+
+// TimeoutsConfig splits a route's backend timeout into phases, each
+// enforced independently. Zero leaves a phase bounded only by the overall
+// request timeout.
+type TimeoutsConfig struct {
+	// Connect bounds establishing a new connection to the backend.
+	Connect Duration `json:"connect"`
+	// FirstByte bounds the wait for response headers once the request is
+	// sent.
+	FirstByte Duration `json:"first_byte"`
+	// Idle bounds the gap between bytes of the response body, so long
+	// streams stay open while stalled ones are cut off.
+	Idle Duration `json:"idle"`
+}
+
+var (
+	errFirstByteTimeout = fmt.Errorf("backend did not send response headers in time: %w", context.DeadlineExceeded)
+	errIdleTimeout      = fmt.Errorf("backend response body stalled: %w", context.DeadlineExceeded)
+)
+
+type routeTimeoutsKey struct{}
+
+// withRouteTimeouts attaches a route's phase timeouts to an outbound
+// request context for the transport to enforce.
+func withRouteTimeouts(ctx context.Context, t TimeoutsConfig) context.Context {
+	return context.WithValue(ctx, routeTimeoutsKey{}, t)
+}
+
+func routeTimeoutsFrom(ctx context.Context) TimeoutsConfig {
+	t, _ := ctx.Value(routeTimeoutsKey{}).(TimeoutsConfig)
+	return t
+}
+
+// upstreamLatencyHeader reports to clients how long the backend took to
+// return response headers, in milliseconds.
+const upstreamLatencyHeader = "X-Upstream-Latency-Ms"
+
+// Policies for RouteConfig.UpstreamLatency.
+const (
+	upstreamLatencyTrusted = "trusted"
+	upstreamLatencyAll     = "all"
+)
+
+var upstreamLatencyPolicies = []string{"", upstreamLatencyTrusted, upstreamLatencyAll}
+
+// exposesUpstreamLatency reports whether the response to r reports its
+// upstream latency under policy.
+func exposesUpstreamLatency(r *http.Request, policy string) bool {
+	return policy == upstreamLatencyAll || (policy == upstreamLatencyTrusted && peerTrusted(r))
+}
+
+type upstreamLatencyKey struct{}
+
+// withUpstreamLatency attaches to an outbound request context a slot for
+// the latency of the backend's response, which the transport fills in.
+func withUpstreamLatency(ctx context.Context) context.Context {
+	return context.WithValue(ctx, upstreamLatencyKey{}, new(atomic.Int64))
+}
+
+func upstreamLatencyFrom(ctx context.Context) *atomic.Int64 {
+	l, _ := ctx.Value(upstreamLatencyKey{}).(*atomic.Int64)
+	return l
+}
+
+// newDialer returns the dialer for backend connections. For backends with
+// both IPv4 and IPv6 addresses it races the two families, starting the
+// second after fallbackDelay (Happy Eyeballs). Zero uses Go's default of
+// 300ms and a negative delay disables the race.
+func newDialer(fallbackDelay time.Duration) *net.Dialer {
+	return &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second, FallbackDelay: fallbackDelay}
+}
+
+// dial opens backend connections. Tests replace it to simulate slow
+// networks.
+var dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return stateFrom(ctx).backendDialer.DialContext(ctx, network, addr)
+}
+
+// dialBackend dials a backend, bounded by the route's connect timeout, and
+// tracks the connection under the backend set by withConnBackend.
+func dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d := time.Duration(routeTimeoutsFrom(ctx).Connect); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return backendConns.track(connBackendFrom(ctx), conn), nil
+}
+
+// TransportConfig tunes the connections to backends. Zero keeps each
+// default.
+type TransportConfig struct {
+	// IdleConnTimeout closes a pooled connection left idle this long.
+	// Defaults to 90s.
+	IdleConnTimeout Duration `json:"idle_conn_timeout"`
+	// ResponseHeaderTimeout bounds the wait for response headers once the
+	// request is sent, failing stuck backends with 504. Defaults to no
+	// limit beyond the request timeout.
+	ResponseHeaderTimeout Duration `json:"response_header_timeout"`
+	// ExpectContinueTimeout is how long a request with "Expect:
+	// 100-continue" waits for the backend's go-ahead before sending the
+	// body anyway. Defaults to 1s.
+	ExpectContinueTimeout Duration `json:"expect_continue_timeout"`
+	// BodyIdleTimeout aborts a response body once the backend sends no
+	// bytes for this long, for routes without their own Timeouts.Idle.
+	// Zero lets a stalled body hang until the request timeout.
+	BodyIdleTimeout Duration `json:"body_idle_timeout"`
+	// Proxy is an upstream HTTP(S) proxy, such as a corporate egress
+	// proxy, that backends are reached through. HTTP backends are sent
+	// absolute-form requests and HTTPS ones are tunnelled with CONNECT.
+	// Credentials in the URL are sent as Proxy-Authorization. Defaults to
+	// the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy string `json:"proxy"`
+	// DrainTimeout is how long a pooled backend removed by a reload keeps
+	// its connections for requests in flight before they are closed.
+	// Defaults to 30s.
+	DrainTimeout Duration `json:"drain_timeout"`
+}
+
+func (tc TransportConfig) validate() error {
+	if tc.IdleConnTimeout < 0 || tc.ResponseHeaderTimeout < 0 || tc.ExpectContinueTimeout < 0 || tc.BodyIdleTimeout < 0 || tc.DrainTimeout < 0 {
+		return errors.New("transport: timeouts must not be negative")
+	}
+	if tc.Proxy != "" {
+		if err := validateProxyURL(tc.Proxy); err != nil {
+			return fmt.Errorf("transport: %w", err)
+		}
+	}
+	return nil
+}
+
+// setUpstreamProxy routes t through the proxy at proxy, if one is set.
+// The URL has been validated with the config.
+func setUpstreamProxy(t *http.Transport, proxy string) {
+	if proxy == "" {
+		return
+	}
+	if u, err := url.Parse(proxy); err == nil {
+		t.Proxy = http.ProxyURL(u)
+	}
+}
+
+// proxyProbe is a request used to compare the proxies transports send
+// backend requests through.
+var proxyProbe = &http.Request{URL: &url.URL{Scheme: "http", Host: "backend.invalid"}}
+
+func upstreamProxy(t *http.Transport) string {
+	if t.Proxy == nil {
+		return ""
+	}
+	u, err := t.Proxy(proxyProbe)
+	if err != nil || u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+// newBaseTransport returns the transport settings shared by all backends.
+// maxHeaderBytes caps the size of response headers, zero meaning Go's
+// default of 10MB.
+func newBaseTransport(cfg *Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = dialBackend
+	t.MaxResponseHeaderBytes = cfg.MaxResponseHeaderBytes
+	if d := time.Duration(cfg.Transport.IdleConnTimeout); d > 0 {
+		t.IdleConnTimeout = d
+	}
+	t.ResponseHeaderTimeout = time.Duration(cfg.Transport.ResponseHeaderTimeout)
+	if d := time.Duration(cfg.Transport.ExpectContinueTimeout); d > 0 {
+		t.ExpectContinueTimeout = d
+	}
+	setUpstreamProxy(t, cfg.Transport.Proxy)
+	return t
+}
+
+// sameTransportSettings reports whether a and b were built from the same
+// settings, so a reload can keep a's pooled connections.
+func sameTransportSettings(a, b *http.Transport) bool {
+	return a.MaxResponseHeaderBytes == b.MaxResponseHeaderBytes &&
+		a.IdleConnTimeout == b.IdleConnTimeout &&
+		a.ResponseHeaderTimeout == b.ResponseHeaderTimeout &&
+		a.ExpectContinueTimeout == b.ExpectContinueTimeout &&
+		upstreamProxy(a) == upstreamProxy(b)
+}
+
+func newBackendTimeouts(backends map[string]BackendConfig) map[string]time.Duration {
+	timeouts := make(map[string]time.Duration)
+	for backend, bc := range backends {
+		u, err := url.Parse(backend)
+		if err != nil || bc.Timeout <= 0 {
+			continue
+		}
+		timeouts[backendKey(u)] = time.Duration(bc.Timeout)
+	}
+	return timeouts
+}
+
+func newBackendFallbacks(backends map[string]BackendConfig) map[string]*url.URL {
+	fallbacks := make(map[string]*url.URL)
+	for backend, bc := range backends {
+		if bc.HTTPFallback == "" {
+			continue
+		}
+		u, err := url.Parse(backend)
+		if err != nil {
+			continue
+		}
+		if f, err := url.Parse(bc.HTTPFallback); err == nil {
+			fallbacks[backendKey(u)] = f
+		}
+	}
+	return fallbacks
+}
+
+// roundTripWithHTTPFallback sends req to its backend once, resending it to
+// the backend's HTTP fallback if the HTTPS attempt fails without a
+// response. The body is buffered for the resend up to MaxReplayBody.
+func roundTripWithHTTPFallback(req *http.Request) (*http.Response, error) {
+	s := stateFrom(req.Context())
+	fallback := s.backendFallbacks[backendKey(req.URL)]
+	limit := cmp.Or(s.config.MaxReplayBody, defaultMaxReplayBody)
+	if fallback == nil || req.URL.Scheme != "https" || !bufferForReplay(req, limit) {
+		return roundTripOnce(req)
+	}
+	res, err := roundTripOnce(req)
+	if err == nil || req.Context().Err() != nil {
+		return res, err
+	}
+	slog.Warn("backend HTTPS request failed, falling back to HTTP",
+		"backend", backendKey(req.URL),
+		"fallback", backendKey(fallback),
+		"error", err,
+	)
+	next := rewound(req, req.Context())
+	next.URL.Scheme = fallback.Scheme
+	next.URL.Host = fallback.Host
+	return roundTripOnce(next)
+}
+
+// withBackendTimeout returns req bounded by d instead of its context's
+// deadline, though never past its retry budget. Cancellation of the request
+// still propagates. release frees the timer once the response is done with.
+func withBackendTimeout(req *http.Request, d time.Duration) (out *http.Request, release func()) {
+	parent := req.Context()
+	deadline := time.Now().Add(d)
+	if budget, ok := retryBudgetFrom(parent); ok && budget.Before(deadline) {
+		deadline = budget
+	}
+	ctx, cancel := context.WithDeadline(context.WithoutCancel(parent), deadline)
+	stop := context.AfterFunc(parent, func() {
+		if !errors.Is(parent.Err(), context.DeadlineExceeded) {
+			cancel()
+		}
+	})
+	return req.WithContext(ctx), func() {
+		stop()
+		cancel()
+	}
+}
+
+// errResponseHeadersTooLarge is how net/http fails a response whose headers
+// exceed the transport's MaxResponseHeaderBytes. It has no exported error.
+const errResponseHeadersTooLarge = "server response headers exceeded"
+
+func isResponseHeadersTooLarge(err error) bool {
+	return err != nil && strings.Contains(err.Error(), errResponseHeadersTooLarge)
+}
+
+// backendKey identifies a backend by scheme and host.
+func backendKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+func newBackendTransports(cfg *Config) (map[string]*http.Transport, error) {
+	transports := make(map[string]*http.Transport, len(cfg.Backends))
+	for backend, bc := range cfg.Backends {
+		u, err := url.Parse(backend)
+		if err != nil {
+			return nil, err
+		}
+		t := newBaseTransport(cfg)
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.ServerName = bc.ServerName
+		setUpstreamProxy(t, bc.Proxy)
+		if bc.CAFile != "" {
+			pem, err := os.ReadFile(bc.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("backend %q: %w", backend, err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("backend %q: %w", backend, errors.New("no certificates found in ca_file"))
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+		transports[backendKey(u)] = t
+	}
+	return transports, nil
+}
+
+// backendRoundTripper sends each request through the transport configured
+// for its backend, falling back to defaultTransport. It also enforces the
+// route's retry policy, its SLA and its first-byte and idle timeouts, and
+// resends to a backend's HTTP fallback.
+type backendRoundTripper struct{}
+
+func (backendRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return roundTripWithRetry(req)
+}
+
+// roundTripWithFailover sends req within the route's SLA, failing over to
+// another backend on a breach if the route allows it.
+func roundTripWithFailover(req *http.Request) (*http.Response, error) {
+	sla := routeSLAFrom(req.Context())
+	d := time.Duration(sla.Timeout)
+	if d <= 0 {
+		return roundTripWithHTTPFallback(req)
+	}
+	res, err := roundTripWithSLA(req, d)
+	if errors.Is(err, errSLAExceeded) && sla.Failover {
+		if next := failoverRequest(req); next != nil {
+			slog.Warn("backend SLA exceeded, failing over",
+				"backend", backendKey(req.URL),
+				"failover", backendKey(next.URL),
+				"sla_ms", d.Milliseconds(),
+			)
+			res, err = roundTripWithSLA(next, d)
+		}
+	}
+	return res, err
+}
+
+// errNoBackend fails a routed request whose route had no backend to pick,
+// such as a pool whose backends are all unhealthy.
+var errNoBackend = errors.New("no backend available")
+
+// roundTripOnce sends req to its backend once.
+func roundTripOnce(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "" {
+		return nil, errNoBackend
+	}
+	req = withConnBackend(req)
+	s := stateFrom(req.Context())
+	transport := s.transportFor(req.URL)
+	state := s.backendStates[backendKey(req.URL)]
+	threshold := time.Duration(s.config.SlowBackendThreshold)
+	backendTimeout := s.backendTimeouts[backendKey(req.URL)]
+	bodyIdle := s.config.Transport.BodyIdleTimeout
+
+	release := func() {}
+	if backendTimeout > 0 {
+		req, release = withBackendTimeout(req, backendTimeout)
+	}
+
+	timeouts := routeTimeoutsFrom(req.Context())
+	timeouts.Idle = cmp.Or(timeouts.Idle, bodyIdle)
+	var cancel context.CancelCauseFunc = func(error) {}
+	var firstByte *time.Timer
+	if timeouts.FirstByte > 0 || timeouts.Idle > 0 {
+		var ctx context.Context
+		ctx, cancel = context.WithCancelCause(req.Context())
+		req = req.WithContext(ctx)
+		if d := time.Duration(timeouts.FirstByte); d > 0 {
+			firstByte = time.AfterFunc(d, func() { cancel(errFirstByteTimeout) })
+		}
+	}
+
+	if state != nil {
+		state.inFlight.Add(1)
+	}
+
+	start := time.Now()
+	res, err := transport.RoundTrip(req)
+	ttfb := time.Since(start)
+	if l := upstreamLatencyFrom(req.Context()); l != nil {
+		l.Store(int64(ttfb))
+	}
+	if firstByte != nil && !firstByte.Stop() && err == nil {
+		// Headers arrived just as the timer fired and cancelled the body.
+		res.Body.Close()
+		res, err = nil, errFirstByteTimeout
+	}
+	if err != nil {
+		if cause := context.Cause(req.Context()); errors.Is(cause, errFirstByteTimeout) {
+			err = cause
+		}
+		cancel(nil)
+		release()
+	} else if d := time.Duration(timeouts.Idle); d > 0 && res.StatusCode != http.StatusSwitchingProtocols {
+		res.Body = &idleTimeoutBody{ReadCloser: res.Body, idle: d, cancel: cancel, ctx: req.Context(), backend: backendKey(req.URL), path: req.URL.Path}
+	} else {
+		res.Body = releaseOnClose(res.Body, func() { cancel(nil) })
+	}
+	if err == nil {
+		res.Body = releaseOnClose(res.Body, release)
+	}
+	if state != nil {
+		state.recordOutcome(req.Context(), res, err)
+		if err != nil {
+			state.inFlight.Add(-1)
+		} else {
+			state.observe(ttfb)
+			res.Body = releaseOnClose(res.Body, func() { state.inFlight.Add(-1) })
+		}
+	}
+	if err == nil && threshold > 0 && ttfb > threshold {
+		slog.Warn("slow backend response",
+			"backend", backendKey(req.URL),
+			"path", req.URL.Path,
+			"ttfb_ms", ttfb.Milliseconds(),
+			"threshold_ms", threshold.Milliseconds(),
+		)
+	}
+	return res, err
+}
+
+// releaseOnClose wraps a response body to call release once it is closed,
+// such as to cancel the request context or free a backend's in-flight slot.
+// The body of a 101 Switching Protocols response is the upgraded connection,
+// which ReverseProxy writes to, so a writable body stays writable.
+func releaseOnClose(body io.ReadCloser, release func()) io.ReadCloser {
+	rb := releasingBody{ReadCloser: body, release: release, once: new(sync.Once)}
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		return releasingConn{releasingBody: rb, Writer: rwc}
+	}
+	return rb
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    *sync.Once
+}
+
+func (b releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// releasingConn is a releasingBody over an upgraded connection.
+type releasingConn struct {
+	releasingBody
+	io.Writer
+}
+
+// idleTimeoutBody aborts a response body read that waits longer than idle
+// for the backend to send more bytes, logging the stalled backend.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	idle    time.Duration
+	cancel  context.CancelCauseFunc
+	ctx     context.Context
+	timer   *time.Timer
+	backend string
+	path    string
+	logged  bool
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	if b.timer == nil {
+		b.timer = time.AfterFunc(b.idle, func() { b.cancel(errIdleTimeout) })
+	} else {
+		b.timer.Reset(b.idle)
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Stop()
+	if err != nil && errors.Is(context.Cause(b.ctx), errIdleTimeout) {
+		err = errIdleTimeout
+		if !b.logged {
+			b.logged = true
+			slog.Warn("backend response body stalled, aborting",
+				"backend", b.backend,
+				"path", b.path,
+				"failure", "body_idle_timeout",
+				"idle_ms", b.idle.Milliseconds(),
+			)
+		}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel(nil)
+	return err
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+// TunnelConfig enables forward-proxy CONNECT tunnels. Tunneling is off
+// unless AllowedHosts is set, so the proxy cannot be used as an open relay.
+type TunnelConfig struct {
+	// AllowedHosts lists the "host:port" targets clients may tunnel to. A
+	// port of "*" allows any port on the host.
+	AllowedHosts []string `json:"allowed_hosts"`
+}
+
+// Enabled reports whether CONNECT tunnels are accepted.
+func (c TunnelConfig) Enabled() bool {
+	return len(c.AllowedHosts) > 0
+}
+
+func (c TunnelConfig) validate() error {
+	for _, h := range c.AllowedHosts {
+		if host, port, err := net.SplitHostPort(h); err != nil || host == "" || port == "" {
+			return fmt.Errorf("tunnel: allowed host %q must be host:port", h)
+		}
+	}
+	return nil
+}
+
+// allows reports whether target, a CONNECT authority, is in AllowedHosts.
+func (c TunnelConfig) allows(target string) bool {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(c.AllowedHosts, target) ||
+		slices.Contains(c.AllowedHosts, net.JoinHostPort(host, "*")) && port != ""
+}
+
+// tunnelMiddleware serves CONNECT requests by opening a TCP tunnel to the
+// requested authority. Other requests pass through to next.
+func tunnelMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		serveTunnel(w, r)
+	})
+}
+
+// routeConnect sends CONNECT requests to proxy and everything else to mux.
+// ServeMux matches on the request path, which CONNECT requests lack.
+func routeConnect(mux, proxy http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serveTunnel dials the CONNECT target, hijacks the client connection and
+// copies bytes both ways until either side is done.
+func serveTunnel(w http.ResponseWriter, r *http.Request) {
+	target := r.Host
+	if !stateFrom(r.Context()).config.Tunnel.allows(target) {
+		http.Error(w, "tunnel target not allowed", http.StatusForbidden)
+		return
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.backend = target
+	}
+
+	upstream, err := dial(r.Context(), "tcp", target)
+	if err != nil {
+		slog.Warn("tunnel dial failed", "target", target, "error", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "tunneling not supported on this connection", http.StatusNotImplemented)
+		return
+	}
+	defer conn.Close()
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.status = http.StatusOK
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// Bytes the client sent after the CONNECT request may already be
+		// buffered.
+		io.Copy(upstream, io.MultiReader(io.LimitReader(brw, int64(brw.Reader.Buffered())), conn))
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, upstream)
+		closeWrite(conn)
+	}()
+	wg.Wait()
+}
+
+// closeWrite half-closes conn when it supports it, so the peer sees EOF
+// while replies can still flow the other way, and closes it otherwise.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// echoServer accepts TCP connections and echoes what it reads back.
+func echoServer(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln
+}
+
+// connect sends a CONNECT request for target through the proxy at addr.
+func connect(t *testing.T, addr, target string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, res
+}
+
+// newTunnelProxy serves the handler chain the way main does.
+func newTunnelProxy(t *testing.T) *httptest.Server {
+	t.Helper()
+	handler := newHandler()
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	var served sync.WaitGroup
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		defer served.Done()
+		routeConnect(mux, handler).ServeHTTP(w, r)
+	}))
+	// Hijacked connections outlive proxy.Close, so wait for their handlers
+	// before the test's config is restored.
+	t.Cleanup(func() {
+		proxy.Close()
+		served.Wait()
+	})
+	return proxy
+}
+
+func TestTunnel(t *testing.T) {
+	echo := echoServer(t)
+	withConfig(t, func(c *Config) {
+		c.Tunnel = TunnelConfig{AllowedHosts: []string{echo.Addr().String()}}
+	})
+	proxy := newTunnelProxy(t)
+
+	t.Run("allowed", func(t *testing.T) {
+		conn, br, res := connect(t, proxy.Listener.Addr().String(), echo.Addr().String())
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT status = %d, want 200", res.StatusCode)
+		}
+		io.WriteString(conn, "ping")
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("read %q, %v through tunnel, want ping", buf, err)
+		}
+	})
+
+	t.Run("not allowed", func(t *testing.T) {
+		_, _, res := connect(t, proxy.Listener.Addr().String(), "127.0.0.1:1")
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("CONNECT status = %d, want 403", res.StatusCode)
+		}
+	})
+}
+
+func TestTunnel_Disabled(t *testing.T) {
+	echo := echoServer(t)
+	proxy := newTunnelProxy(t)
+
+	_, _, res := connect(t, proxy.Listener.Addr().String(), echo.Addr().String())
+	if res.StatusCode != http.StatusNotImplemented {
+		t.Errorf("CONNECT status = %d, want 501", res.StatusCode)
+	}
+}
+
+func TestTunnelConfig_Allows(t *testing.T) {
+	c := TunnelConfig{AllowedHosts: []string{"db.internal:5432", "api.example.com:*"}}
+	tests := map[string]bool{
+		"db.internal:5432":    true,
+		"db.internal:5433":    false,
+		"api.example.com:443": true,
+		"evil.example.com:80": false,
+		"api.example.com":     false,
+	}
+	for target, want := range tests {
+		if got := c.allows(target); got != want {
+			t.Errorf("allows(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
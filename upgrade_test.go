@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// upgradeBackend switches to any requested protocol and then echoes each
+// line it reads, or answers 200 to requests without an Upgrade.
+func upgradeBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto := r.Header.Get("Upgrade")
+		if proto == "" {
+			io.WriteString(w, "not upgraded")
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: " + proto + "\r\n\r\n")
+		brw.Flush()
+		for {
+			line, err := brw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			brw.WriteString("echo " + line)
+			brw.Flush()
+		}
+	}))
+}
+
+func TestUpgrade(t *testing.T) {
+	backend := upgradeBackend()
+	defer backend.Close()
+
+	tests := []struct {
+		name       string
+		route      RouteConfig
+		wantStatus int
+	}{
+		{"any protocol", RouteConfig{Prefix: "/tunnel", Backend: backend.URL}, http.StatusSwitchingProtocols},
+		{"pooled with idle timeout", RouteConfig{
+			Prefix:   "/tunnel",
+			Backends: []string{backend.URL},
+			Timeouts: &TimeoutsConfig{Idle: Duration(time.Second)},
+		}, http.StatusSwitchingProtocols},
+		{"allowed protocol", RouteConfig{Prefix: "/tunnel", Backend: backend.URL, Upgrades: []string{"Custom-Proto"}}, http.StatusSwitchingProtocols},
+		{"protocol not allowed", RouteConfig{Prefix: "/tunnel", Backend: backend.URL, Upgrades: []string{"websocket"}}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRouteConfigs(t, tt.route)
+			captureLogs(t)
+			handler, served := newHandler(), make(chan struct{})
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer close(served)
+				handler.ServeHTTP(w, r)
+			}))
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Hijacked connections outlive proxy.Close, so wait for the
+			// handler before the route config is restored.
+			t.Cleanup(func() {
+				conn.Close()
+				select {
+				case <-served:
+				case <-time.After(5 * time.Second):
+					t.Error("proxy handler did not return after the client closed")
+				}
+			})
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			io.WriteString(conn, "GET /tunnel HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: custom-proto\r\n\r\n")
+			br := bufio.NewReader(conn)
+			res, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				return
+			}
+
+			for _, msg := range []string{"ping\n", "pong\n"} {
+				io.WriteString(conn, msg)
+				line, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatal(err)
+				}
+				if line != "echo "+msg {
+					t.Errorf("read %q, want %q", line, "echo "+msg)
+				}
+			}
+		})
+	}
+}
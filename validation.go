@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JSONLimitsConfig bounds the shape of JSON request bodies. Zero values
+// leave the corresponding dimension unbounded.
+type JSONLimitsConfig struct {
+	MaxDepth       int `json:"max_depth"`
+	MaxArrayLength int `json:"max_array_length"`
+}
+
+var (
+	errJSONTooDeep      = errors.New("JSON body nested too deeply")
+	errJSONArrayTooLong = errors.New("JSON array too long")
+	errJSONTrailingData = errors.New("JSON body has data after its first value")
+)
+
+// invalidJSONError fails the read of a JSON request body that broke the
+// route's JSONLimits, and is answered with 400.
+type invalidJSONError struct {
+	err error
+}
+
+func (e *invalidJSONError) Error() string {
+	return "invalid JSON body: " + e.err.Error()
+}
+
+func (e *invalidJSONError) Unwrap() error {
+	return e.err
+}
+
+// hostMiddleware handles requests without a Host header, which HTTP/1.0
+// clients may send, and with a malformed one. Config.DefaultHost is
+// substituted when set. Otherwise a missing Host is rejected with 400 if
+// Config.RequireHost is on, and a malformed Host always is. With
+// Config.RejectMisdirected, a TLS request for a host other than the one
+// its connection was opened for is answered 421.
+func hostMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := stateFrom(r.Context()).config
+		switch {
+		case config.RejectMisdirected && misdirected(r):
+			http.Error(w, "misdirected request", http.StatusMisdirectedRequest)
+			return
+		case r.Host != "" && validHost(r.Host):
+		case config.DefaultHost != "":
+			r.Host = config.DefaultHost
+		case r.Host != "":
+			http.Error(w, "malformed Host header", http.StatusBadRequest)
+			return
+		case config.RequireHost:
+			http.Error(w, "missing Host header", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// misdirected reports whether r arrived on a TLS connection whose SNI
+// server name is not the host r is for, as happens when an HTTP/2 client
+// reuses a connection across hosts sharing an IP address.
+func misdirected(r *http.Request) bool {
+	if r.TLS == nil || r.TLS.ServerName == "" || r.Host == "" {
+		return false
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return !strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(r.TLS.ServerName, "."))
+}
+
+// validHost reports whether host is a well-formed Host header value: a DNS
+// name, IPv4 address or bracketed IPv6 address, with an optional port.
+func validHost(host string) bool {
+	name := host
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		var port string
+		name, port = host[:i], host[i+1:]
+		if n, err := strconv.Atoi(port); port != "" && (err != nil || n < 1 || n > 65535 || port[0] == '+') {
+			return false
+		}
+	}
+	if ip, ok := strings.CutPrefix(name, "["); ok {
+		addr, err := netip.ParseAddr(strings.TrimSuffix(ip, "]"))
+		return err == nil && strings.HasSuffix(ip, "]") && addr.Is6()
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range []byte(label) {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// standardMethods are the request methods defined by RFC 9110 and RFC 5789.
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// methodMiddleware applies the method policy before routing. Methods are
+// case-sensitive, so "get" is not GET: with Config.NormalizeMethods a
+// standard method sent in the wrong case is upper-cased, and with
+// Config.RejectUnknownMethods any other method is rejected with 501 Not
+// Implemented. Methods outside Config.AllowedMethods or in
+// Config.BlockedMethods are rejected with 405. CONNECT is rejected with 501
+// unless Config.Tunnel is enabled.
+func methodMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := stateFrom(r.Context()).config
+		if config.NormalizeMethods {
+			if upper := strings.ToUpper(r.Method); slices.Contains(standardMethods, upper) {
+				r.Method = upper
+			}
+		}
+		if config.RejectUnknownMethods && !slices.Contains(standardMethods, r.Method) {
+			http.Error(w, "method not implemented", http.StatusNotImplemented)
+			return
+		}
+		if slices.Contains(config.BlockedMethods, r.Method) ||
+			(len(config.AllowedMethods) > 0 && !slices.Contains(config.AllowedMethods, r.Method)) {
+			if len(config.AllowedMethods) > 0 {
+				w.Header().Set("Allow", strings.Join(config.AllowedMethods, ", "))
+			}
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Method == http.MethodConnect && !config.Tunnel.Enabled() {
+			http.Error(w, "CONNECT tunneling not enabled", http.StatusNotImplemented)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedMethods returns the methods the method policy of config lets
+// through to a route, in standard order. CONNECT is never routed.
+func allowedMethods(config *Config) []string {
+	if len(config.AllowedMethods) > 0 {
+		return slices.DeleteFunc(slices.Clone(config.AllowedMethods), func(m string) bool { return m == http.MethodConnect })
+	}
+	return slices.DeleteFunc(slices.Clone(standardMethods), func(m string) bool {
+		return m == http.MethodConnect || slices.Contains(config.BlockedMethods, m)
+	})
+}
+
+// optionsMiddleware answers OPTIONS requests for routes with
+// RouteConfig.AnswerOptions, without contacting the backend.
+func optionsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s := stateFrom(r.Context())
+		if route, ok := routeMatchFrom(r.Context()); !ok || !route.Config.AnswerOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowedMethods(s.config), ", "))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// contentTypeMiddleware rejects requests carrying a body whose Content-Type
+// is not in the route's allow-list with 415 Unsupported Media Type.
+func contentTypeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := routeMatchFrom(r.Context())
+		rt := route.Config
+		if len(rt.AllowedContentTypes) > 0 && r.ContentLength != 0 &&
+			!contentTypeAllowed(r.Header.Get("Content-Type"), rt.AllowedContentTypes) {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequiredHeadersConfig lists headers a route's backend relies on, such as
+// X-Tenant-ID, and the response to requests without them.
+type RequiredHeadersConfig struct {
+	Names []string `json:"names"`
+	// Status defaults to 400.
+	Status int `json:"status"`
+	// Body defaults to naming the missing header.
+	Body        string `json:"body"`
+	ContentType string `json:"content_type"`
+}
+
+func (rc RequiredHeadersConfig) validate() error {
+	if len(rc.Names) == 0 {
+		return errors.New("required_headers: names must not be empty")
+	}
+	for _, name := range rc.Names {
+		if err := validateHeaderName(name); err != nil {
+			return fmt.Errorf("required_headers: %w", err)
+		}
+	}
+	if rc.Status != 0 && (rc.Status < 400 || rc.Status > 599) {
+		return fmt.Errorf("required_headers: status %d must be between 400 and 599", rc.Status)
+	}
+	return nil
+}
+
+// requiredHeadersMiddleware rejects requests missing a header their route
+// requires, with the route's configured response.
+func requiredHeadersMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := routeMatchFrom(r.Context())
+		rt := route.Config
+		if rt.RequiredHeaders == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, name := range rt.RequiredHeaders.Names {
+			if r.Header.Get(name) != "" {
+				continue
+			}
+			rc := rt.RequiredHeaders
+			body := rc.Body
+			if body == "" {
+				body = fmt.Sprintf("missing required header %s\n", name)
+			}
+			w.Header().Set("Content-Type", cmp.Or(rc.ContentType, "text/plain; charset=utf-8"))
+			w.Header().Set("X-Content-Type-Options", "nosniff")
+			w.WriteHeader(cmp.Or(rc.Status, http.StatusBadRequest))
+			io.WriteString(w, body)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// contentTypeAllowed reports whether the media type of contentType matches
+// an entry in allowed. Entries may use a subtype wildcard such as "image/*".
+func contentTypeAllowed(contentType string, allowed []string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if a == mediaType {
+			return true
+		}
+		if major, ok := strings.CutSuffix(a, "/*"); ok && strings.HasPrefix(mediaType, major+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// decompressMiddleware replaces gzip and deflate request bodies with their
+// decompressed content on routes with DecompressRequests, fixing up
+// Content-Length and removing Content-Encoding. Decompressed bodies larger
+// than maxBodySize are rejected with 413, so small compressed payloads
+// cannot expand without bound.
+func decompressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := routeMatchFrom(r.Context())
+		rt := route.Config
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if !rt.DecompressRequests || encoding == "" || encoding == "identity" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxBodySize)
+		var dec io.Reader
+		var err error
+		switch encoding {
+		case "gzip", "x-gzip":
+			dec, err = gzip.NewReader(body)
+		case "deflate":
+			dec, err = zlib.NewReader(body)
+		default:
+			w.Header().Set("Accept-Encoding", "gzip, deflate")
+			http.Error(w, "unsupported content encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		var plain []byte
+		if err == nil {
+			plain, err = io.ReadAll(io.LimitReader(dec, maxBodySize+1))
+		}
+		var maxBytesErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesErr) || len(plain) > maxBodySize:
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		case err != nil:
+			http.Error(w, fmt.Sprintf("invalid %s body: %v", encoding, err), http.StatusBadRequest)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(plain))
+		r.ContentLength = int64(len(plain))
+		r.Header.Set("Content-Length", strconv.Itoa(len(plain)))
+		r.Header.Del("Content-Encoding")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maxBufferedJSONBody is the largest JSON request body, by Content-Length,
+// that jsonLimitsMiddleware checks in full before forwarding.
+const maxBufferedJSONBody = 64 << 10
+
+// jsonLimitsMiddleware rejects JSON request bodies that exceed the route's
+// nesting depth or array length limits with 400. Bodies of a known length
+// up to maxBufferedJSONBody are checked before anything is forwarded.
+// Larger and chunked bodies are checked as they stream to the backend: each
+// chunk is only passed on once it has been parsed, and the first violation
+// fails the body's read, aborting the request. The backend may then have
+// received the start of an invalid body, which is the price of not
+// buffering it.
+func jsonLimitsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := routeMatchFrom(r.Context())
+		rt := route.Config
+		if rt.JSONLimits == nil || r.ContentLength == 0 || !isJSON(r.Header.Get("Content-Type")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.ContentLength > 0 && r.ContentLength <= maxBufferedJSONBody {
+			buf, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+				return
+			}
+			if err := validateJSON(json.NewDecoder(bytes.NewReader(buf)), *rt.JSONLimits); err != nil {
+				http.Error(w, (&invalidJSONError{err}).Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(buf))
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := newJSONLimitsBody(http.MaxBytesReader(w, r.Body, maxBodySize), *rt.JSONLimits)
+		// Handlers that answer without reading the body, such as an open
+		// breaker, would otherwise leave the validator waiting forever.
+		defer body.stop()
+		r.Body = body
+		next.ServeHTTP(w, r)
+	})
+}
+
+// jsonLimitsBody checks a JSON request body against limits as it is read.
+// validateJSON runs on its own goroutine and is fed each chunk in lockstep:
+// Read returns a chunk only once the validator has consumed it, and fails
+// with an *invalidJSONError as soon as the validator does.
+type jsonLimitsBody struct {
+	io.ReadCloser
+	chunks   chan []byte
+	consumed chan struct{}
+	// end is closed once the body is exhausted or closed, ending the
+	// validator's input.
+	end     chan struct{}
+	endOnce sync.Once
+	done    chan error
+	// err is returned by every Read once the body failed or ended.
+	err error
+}
+
+func newJSONLimitsBody(body io.ReadCloser, limits JSONLimitsConfig) *jsonLimitsBody {
+	b := &jsonLimitsBody{
+		ReadCloser: body,
+		chunks:     make(chan []byte),
+		consumed:   make(chan struct{}),
+		end:        make(chan struct{}),
+		done:       make(chan error, 1),
+	}
+	go func() { b.done <- validateJSON(json.NewDecoder(&chunkReader{b: b}), limits) }()
+	return b
+}
+
+func (b *jsonLimitsBody) Read(p []byte) (int, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if verr := b.feed(p[:n]); verr != nil {
+			b.err = &invalidJSONError{verr}
+			return 0, b.err
+		}
+	}
+	if err == io.EOF {
+		b.endOnce.Do(func() { close(b.end) })
+		if verr := <-b.done; verr != nil {
+			b.err = &invalidJSONError{verr}
+			return 0, b.err
+		}
+		b.err = io.EOF
+	}
+	return n, err
+}
+
+// feed hands chunk to the validator and waits until it has consumed it,
+// returning the validator's error if it stopped instead.
+func (b *jsonLimitsBody) feed(chunk []byte) error {
+	select {
+	case b.chunks <- chunk:
+	case err := <-b.done:
+		return err
+	}
+	select {
+	case <-b.consumed:
+		return nil
+	case err := <-b.done:
+		return err
+	}
+}
+
+// stop ends the validator's input, so it does not outlive a body that is
+// abandoned before its end.
+func (b *jsonLimitsBody) stop() {
+	b.endOnce.Do(func() { close(b.end) })
+}
+
+func (b *jsonLimitsBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
+
+// chunkReader is the validator's side of a jsonLimitsBody. It reports each
+// chunk consumed when it asks for the next one, by which time the decoder
+// has parsed every complete token it held.
+type chunkReader struct {
+	b       *jsonLimitsBody
+	pending []byte
+	fed     bool
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	if len(cr.pending) == 0 {
+		if cr.fed {
+			select {
+			case cr.b.consumed <- struct{}{}:
+			case <-cr.b.end:
+				return 0, io.EOF
+			}
+		}
+		select {
+		case cr.pending = <-cr.b.chunks:
+			cr.fed = true
+		case <-cr.b.end:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, cr.pending)
+	cr.pending = cr.pending[n:]
+	return n, nil
+}
+
+// isJSON reports whether contentType is application/json or a +json type.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validateJSON walks the token stream from dec and checks it against limits.
+// Only whitespace may follow the first value.
+func validateJSON(dec *json.Decoder, limits JSONLimitsConfig) error {
+	// arrayLens tracks each open container: the element count for arrays,
+	// -1 for objects.
+	var arrayLens []int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == ']' || delim == '}') {
+			arrayLens = arrayLens[:len(arrayLens)-1]
+			if len(arrayLens) == 0 {
+				return endOfJSON(dec)
+			}
+			continue
+		}
+		if n := len(arrayLens); n > 0 && arrayLens[n-1] >= 0 {
+			arrayLens[n-1]++
+			if limits.MaxArrayLength > 0 && arrayLens[n-1] > limits.MaxArrayLength {
+				return errJSONArrayTooLong
+			}
+		}
+		switch tok {
+		case json.Delim('['):
+			arrayLens = append(arrayLens, 0)
+		case json.Delim('{'):
+			arrayLens = append(arrayLens, -1)
+		}
+		if limits.MaxDepth > 0 && len(arrayLens) > limits.MaxDepth {
+			return errJSONTooDeep
+		}
+		if len(arrayLens) == 0 {
+			return endOfJSON(dec)
+		}
+	}
+}
+
+// endOfJSON checks that nothing but whitespace is left in dec.
+func endOfJSON(dec *json.Decoder) error {
+	_, err := dec.Token()
+	switch {
+	case err == io.EOF:
+		return nil
+	case err != nil:
+		return err
+	}
+	return errJSONTrailingData
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestContentTypeMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/upload", Backend: backend.URL, AllowedContentTypes: []string{"application/json", "image/*"}},
+		RouteConfig{Prefix: "/open", Backend: backend.URL},
+	)
+	handler := routeMiddleware(contentTypeMiddleware(newProxy()))
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"allowed type", "/upload", "application/json", "{}", http.StatusCreated},
+		{"allowed type with params", "/upload", "Application/JSON; charset=utf-8", "{}", http.StatusCreated},
+		{"wildcard subtype", "/upload", "image/png", "png", http.StatusCreated},
+		{"disallowed type", "/upload", "text/plain", "hi", http.StatusUnsupportedMediaType},
+		{"missing type with body", "/upload", "", "hi", http.StatusUnsupportedMediaType},
+		{"no body", "/upload", "", "", http.StatusCreated},
+		{"route without allow-list", "/open", "text/plain", "hi", http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %v, want %v", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequiredHeadersMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/tenant", Backend: backend.URL, RequiredHeaders: &RequiredHeadersConfig{Names: []string{"X-Tenant-ID", "X-Api-Version"}}},
+		RouteConfig{Prefix: "/custom", Backend: backend.URL, RequiredHeaders: &RequiredHeadersConfig{
+			Names:       []string{"X-Tenant-ID"},
+			Status:      http.StatusPreconditionFailed,
+			Body:        `{"error":"tenant required"}`,
+			ContentType: "application/json",
+		}},
+		RouteConfig{Prefix: "/open", Backend: backend.URL},
+	)
+	handler := routeMiddleware(requiredHeadersMiddleware(newProxy()))
+
+	tests := []struct {
+		name            string
+		path            string
+		headers         map[string]string
+		want            int
+		wantBody        string
+		wantContentType string
+	}{
+		{"all present", "/tenant", map[string]string{"X-Tenant-ID": "acme", "X-Api-Version": "2"}, http.StatusCreated, "", ""},
+		{"one missing", "/tenant", map[string]string{"X-Tenant-ID": "acme"}, http.StatusBadRequest, "missing required header X-Api-Version\n", "text/plain; charset=utf-8"},
+		{"empty value", "/tenant", map[string]string{"X-Tenant-ID": "", "X-Api-Version": "2"}, http.StatusBadRequest, "missing required header X-Tenant-ID\n", "text/plain; charset=utf-8"},
+		{"custom rejection", "/custom", nil, http.StatusPreconditionFailed, `{"error":"tenant required"}`, "application/json"},
+		{"custom present", "/custom", map[string]string{"X-Tenant-ID": "acme"}, http.StatusCreated, "", ""},
+		{"route without requirements", "/open", nil, http.StatusCreated, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %v, want %v", rr.Code, tt.want)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+			if got := rr.Header().Get("Content-Type"); tt.wantContentType != "" && got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestRequiredHeadersConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RequiredHeadersConfig
+		wantErr bool
+	}{
+		{"valid", RequiredHeadersConfig{Names: []string{"X-Tenant-ID"}, Status: 403}, false},
+		{"no names", RequiredHeadersConfig{}, true},
+		{"invalid name", RequiredHeadersConfig{Names: []string{"X Tenant"}}, true},
+		{"non-error status", RequiredHeadersConfig{Names: []string{"X-Tenant-ID"}, Status: 200}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateJSON(t *testing.T) {
+	limits := JSONLimitsConfig{MaxDepth: 3, MaxArrayLength: 3}
+	tests := []struct {
+		name    string
+		body    string
+		wantErr error
+	}{
+		{"flat object", `{"a": 1, "b": "two"}`, nil},
+		{"depth at limit", `{"a": {"b": [1]}}`, nil},
+		{"too deep", `{"a": {"b": {"c": [1]}}}`, errJSONTooDeep},
+		{"array at limit", `[1, 2, 3]`, nil},
+		{"array too long", `[1, 2, 3, 4]`, errJSONArrayTooLong},
+		{"object keys are not array elements", `{"a": 1, "b": 2, "c": 3, "d": 4}`, nil},
+		{"nested containers count once", `[[1, 2, 3], {"a": [1]}, []]`, nil},
+		{"trailing whitespace", "{\"a\": 1}\n\t ", nil},
+		{"second value", `{"a": 1} {"b": 2}`, errJSONTrailingData},
+		{"value after scalar", `1 2`, errJSONTrailingData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateJSON(json.NewDecoder(strings.NewReader(tt.body)), limits)
+			if err != tt.wantErr {
+				t.Errorf("validateJSON() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJSONLimitsMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{
+		Prefix:     "/api",
+		Backend:    backend.URL,
+		JSONLimits: &JSONLimitsConfig{MaxDepth: 4},
+	})
+	handler := routeMiddleware(jsonLimitsMiddleware(newProxy()))
+
+	deep := strings.Repeat("[", 20) + strings.Repeat("]", 20)
+	normal := `{"user": {"name": "ada", "tags": ["a", "b"]}}` + "\n"
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantBody    string
+	}{
+		{"deeply nested JSON", "application/json", deep, http.StatusBadRequest, ""},
+		{"second value", "application/json", normal + normal, http.StatusBadRequest, ""},
+		{"normal JSON forwarded intact", "application/json", normal, http.StatusOK, normal},
+		{"non-JSON body not inspected", "text/plain", deep, http.StatusOK, deep},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/api", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("backend received %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestJSONLimitsMiddleware_Streams(t *testing.T) {
+	gotPrefix := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := make([]byte, len(`[1, `))
+		if _, err := io.ReadFull(r.Body, prefix); err != nil {
+			t.Errorf("reading the start of the body: %v", err)
+			return
+		}
+		close(gotPrefix)
+		rest, _ := io.ReadAll(r.Body)
+		w.Write(append(prefix, rest...))
+	}))
+	defer backend.Close()
+	withRouteConfigs(t, RouteConfig{
+		Prefix:     "/api",
+		Backend:    backend.URL,
+		JSONLimits: &JSONLimitsConfig{MaxArrayLength: 2},
+	})
+
+	// The backend sees the start of the body before the client has sent
+	// the rest, so the body is not buffered until it has been validated.
+	pr, pw := io.Pipe()
+	streamed := make(chan bool, 1)
+	go func() {
+		io.WriteString(pw, `[1, `)
+		select {
+		case <-gotPrefix:
+			streamed <- true
+		case <-time.After(time.Second):
+			streamed <- false
+		}
+		io.WriteString(pw, `2]`)
+		pw.Close()
+	}()
+	req := httptest.NewRequest("POST", "/api", pr)
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	routeMiddleware(jsonLimitsMiddleware(newProxy())).ServeHTTP(rr, req)
+
+	if !<-streamed {
+		t.Fatal("backend received nothing before the body was complete")
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != `[1, 2]` {
+		t.Errorf("response = %d %q, want 200 %q", rr.Code, rr.Body, `[1, 2]`)
+	}
+}
+
+func TestJSONLimitsMiddleware_SmallBodyCheckedBeforeForwarding(t *testing.T) {
+	withRouteConfigs(t, RouteConfig{
+		Prefix:     "/api",
+		Backend:    "http://backend.invalid",
+		JSONLimits: &JSONLimitsConfig{MaxDepth: 4},
+	})
+	forwarded := false
+	handler := routeMiddleware(jsonLimitsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = true
+		io.Copy(io.Discard, r.Body)
+	})))
+
+	req := httptest.NewRequest("POST", "/api", strings.NewReader(strings.Repeat("[", 20)+strings.Repeat("]", 20)))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+	if forwarded {
+		t.Error("invalid body was forwarded before it was rejected")
+	}
+}
+
+func TestJSONLimitsMiddleware_UnreadBodyDoesNotLeak(t *testing.T) {
+	withRouteConfigs(t, RouteConfig{
+		Prefix:     "/api",
+		Backend:    "http://backend.invalid",
+		JSONLimits: &JSONLimitsConfig{MaxDepth: 4},
+	})
+	// Like an open breaker, the handler answers without reading the body.
+	handler := routeMiddleware(jsonLimitsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})))
+
+	before := runtime.NumGoroutine()
+	for range 100 {
+		// A body of unknown length is checked as it streams.
+		req := httptest.NewRequest("POST", "/api", io.NopCloser(strings.NewReader(`[1, 2]`)))
+		req.Header.Set("Content-Type", "application/json")
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// The validators exit on their own once stopped.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before+10 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := runtime.NumGoroutine(); got > before+10 {
+		t.Errorf("goroutines = %d after 100 requests, up from %d: validators leaked", got, before)
+	}
+}
+
+// rawRequest writes a raw HTTP request to addr and returns the parsed
+// response.
+func rawRequest(t *testing.T, addr, request string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := io.WriteString(conn, request); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestHostMiddleware_HTTP10WithoutHost(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+	proxy := httptest.NewServer(routeMiddleware(hostMiddleware(newProxy())))
+	defer proxy.Close()
+
+	tests := []struct {
+		name        string
+		defaultHost string
+		requireHost bool
+		wantStatus  int
+		wantHost    string
+	}{
+		{"passes through by default", "", false, http.StatusOK, ""},
+		{"default host applied", "legacy.example.com", false, http.StatusOK, "legacy.example.com"},
+		{"rejected when host required", "", true, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.DefaultHost = tt.defaultHost
+				c.RequireHost = tt.requireHost
+			})
+			res := rawRequest(t, proxy.Listener.Addr().String(), "GET /service1 HTTP/1.0\r\n\r\n")
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %v, want %v", res.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && string(body) != tt.wantHost {
+				t.Errorf("backend saw X-Forwarded-Host %q, want %q", body, tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestHostMiddleware_Validation(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	tests := []struct {
+		name        string
+		host        string
+		defaultHost string
+		wantStatus  int
+		wantHost    string
+	}{
+		{"valid name", "api.example.com", "", http.StatusOK, "api.example.com"},
+		{"valid name and port", "api.example.com:8443", "", http.StatusOK, "api.example.com:8443"},
+		{"valid IPv4", "192.0.2.1:80", "", http.StatusOK, "192.0.2.1:80"},
+		{"valid IPv6", "[2001:db8::1]:443", "", http.StatusOK, "[2001:db8::1]:443"},
+		{"missing passes through", "", "", http.StatusOK, ""},
+		{"missing gets default", "", "fallback.example.com", http.StatusOK, "fallback.example.com"},
+		{"bad port", "api.example.com:http", "", http.StatusBadRequest, ""},
+		{"port out of range", "api.example.com:70000", "", http.StatusBadRequest, ""},
+		{"empty label", "api..example.com", "", http.StatusBadRequest, ""},
+		{"bad character", "api.example.com/evil", "", http.StatusBadRequest, ""},
+		{"unbracketed IPv6", "2001:db8::1", "", http.StatusBadRequest, ""},
+		{"malformed gets default", "api..example.com", "fallback.example.com", http.StatusOK, "fallback.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.DefaultHost = tt.defaultHost })
+			req := httptest.NewRequest("GET", "/service1", nil)
+			req.Host = tt.host
+			rr := httptest.NewRecorder()
+			routeMiddleware(hostMiddleware(newProxy())).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rr.Body.String() != tt.wantHost {
+				t.Errorf("backend saw X-Forwarded-Host %q, want %q", rr.Body.String(), tt.wantHost)
+			}
+		})
+	}
+}
+
+func TestHostMiddleware_Misdirected(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	tests := []struct {
+		name       string
+		enabled    bool
+		serverName string
+		host       string
+		wantStatus int
+	}{
+		{"matching host", true, "api.example.com", "api.example.com", http.StatusOK},
+		{"matching host with port", true, "api.example.com", "API.example.com:8443", http.StatusOK},
+		{"mismatched host", true, "api.example.com", "admin.example.com", http.StatusMisdirectedRequest},
+		{"mismatch allowed when disabled", false, "api.example.com", "admin.example.com", http.StatusOK},
+		{"no SNI", true, "", "admin.example.com", http.StatusOK},
+		{"plain HTTP", true, "-", "admin.example.com", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) { c.RejectMisdirected = tt.enabled })
+			req := httptest.NewRequest("GET", "/service1", nil)
+			req.Host = tt.host
+			if tt.serverName != "-" {
+				req.TLS = &tls.ConnectionState{ServerName: tt.serverName}
+			}
+			rr := httptest.NewRecorder()
+			routeMiddleware(hostMiddleware(newProxy())).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMethodMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method)
+	}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	tests := []struct {
+		name       string
+		method     string
+		normalize  bool
+		reject     bool
+		wantStatus int
+		wantMethod string
+	}{
+		{"passed through by default", "get", false, false, http.StatusOK, "get"},
+		{"normalized", "get", true, false, http.StatusOK, "GET"},
+		{"normalized then allowed", "get", true, true, http.StatusOK, "GET"},
+		{"rejected without normalizing", "get", false, true, http.StatusNotImplemented, ""},
+		{"unknown method rejected", "BREW", true, true, http.StatusNotImplemented, ""},
+		{"unknown method passed through", "BREW", true, false, http.StatusOK, "BREW"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.NormalizeMethods = tt.normalize
+				c.RejectUnknownMethods = tt.reject
+			})
+			rr := httptest.NewRecorder()
+			routeMiddleware(methodMiddleware(newProxy())).ServeHTTP(rr, httptest.NewRequest(tt.method, "/service1", nil))
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rr.Body.String() != tt.wantMethod {
+				t.Errorf("backend saw method %q, want %q", rr.Body.String(), tt.wantMethod)
+			}
+		})
+	}
+}
+
+func TestMethodMiddleware_AllowAndBlockLists(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	withRoute(t, "/service1", backend.URL)
+
+	tests := []struct {
+		name       string
+		allowed    []string
+		blocked    []string
+		method     string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"TRACE blocked", nil, []string{"TRACE"}, "TRACE", "/service1", http.StatusMethodNotAllowed, ""},
+		{"TRACE blocked before routing", nil, []string{"TRACE"}, "TRACE", "/unknown", http.StatusMethodNotAllowed, ""},
+		{"unblocked method passes", nil, []string{"TRACE"}, "GET", "/service1", http.StatusOK, ""},
+		{"outside allow-list", []string{"GET", "HEAD"}, nil, "DELETE", "/service1", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{"in allow-list", []string{"GET", "HEAD"}, nil, "HEAD", "/service1", http.StatusOK, ""},
+		{"CONNECT rejected without tunneling", nil, nil, "CONNECT", "/service1", http.StatusNotImplemented, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AllowedMethods = tt.allowed
+				c.BlockedMethods = tt.blocked
+			})
+			rr := httptest.NewRecorder()
+			routeMiddleware(methodMiddleware(newProxy())).ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestOptionsMiddleware(t *testing.T) {
+	var reached atomic.Int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		w.Header().Set("Allow", "from-backend")
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/answered", Backend: backend.URL, AnswerOptions: true},
+		RouteConfig{Prefix: "/proxied", Backend: backend.URL},
+	)
+
+	tests := []struct {
+		name       string
+		allowed    []string
+		blocked    []string
+		path       string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"default policy", nil, nil, "/answered/items", http.StatusNoContent, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS, TRACE"},
+		{"blocked methods left out", nil, []string{"TRACE", "DELETE"}, "/answered", http.StatusNoContent, "GET, HEAD, POST, PUT, PATCH, OPTIONS"},
+		{"allow-list", []string{"GET", "OPTIONS"}, nil, "/answered", http.StatusNoContent, "GET, OPTIONS"},
+		{"route without the option", nil, nil, "/proxied", http.StatusOK, "from-backend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(c *Config) {
+				c.AllowedMethods = tt.allowed
+				c.BlockedMethods = tt.blocked
+			})
+			reached.Store(0)
+			rr := httptest.NewRecorder()
+			routeMiddleware(optionsMiddleware(newProxy())).ServeHTTP(rr, httptest.NewRequest("OPTIONS", tt.path, nil))
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if answered := tt.wantStatus == http.StatusNoContent; answered != (reached.Load() == 0) {
+				t.Errorf("backend reached %d times, want answered at the proxy %v", reached.Load(), answered)
+			}
+		})
+	}
+}
+
+func TestDecompressMiddleware(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s|%d|%s", r.Header.Get("Content-Encoding"), r.ContentLength, body)
+	}))
+	defer backend.Close()
+	withRouteConfigs(t,
+		RouteConfig{Prefix: "/decompress", Backend: backend.URL, DecompressRequests: true},
+		RouteConfig{Prefix: "/raw", Backend: backend.URL},
+	)
+
+	compress := func(encoding string, data []byte) []byte {
+		var buf bytes.Buffer
+		var zw io.WriteCloser = gzip.NewWriter(&buf)
+		if encoding == "deflate" {
+			zw = zlib.NewWriter(&buf)
+		}
+		zw.Write(data)
+		zw.Close()
+		return buf.Bytes()
+	}
+	payload := []byte(`{"hello":"world"}`)
+	gzipped := compress("gzip", payload)
+	bomb := compress("gzip", make([]byte, maxBodySize+1))
+
+	tests := []struct {
+		name       string
+		path       string
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantBody   string
+	}{
+		{"gzip", "/decompress", "gzip", gzipped, http.StatusOK, fmt.Sprintf("|%d|%s", len(payload), payload)},
+		{"deflate", "/decompress", "deflate", compress("deflate", payload), http.StatusOK, fmt.Sprintf("|%d|%s", len(payload), payload)},
+		{"uncompressed", "/decompress", "", payload, http.StatusOK, fmt.Sprintf("|%d|%s", len(payload), payload)},
+		{"bomb", "/decompress", "gzip", bomb, http.StatusRequestEntityTooLarge, ""},
+		{"corrupt", "/decompress", "gzip", payload, http.StatusBadRequest, ""},
+		{"unsupported encoding", "/decompress", "br", payload, http.StatusUnsupportedMediaType, ""},
+		{"route without the option", "/raw", "gzip", gzipped, http.StatusOK, fmt.Sprintf("gzip|%d|%s", len(gzipped), gzipped)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, bytes.NewReader(tt.body))
+			if tt.encoding != "" {
+				req.Header.Set("Content-Encoding", tt.encoding)
+			}
+			rr := httptest.NewRecorder()
+			routeMiddleware(decompressMiddleware(newProxy())).ServeHTTP(rr, req)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && rr.Body.String() != tt.wantBody {
+				t.Errorf("backend saw %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}